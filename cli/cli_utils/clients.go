@@ -4,10 +4,12 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 
 	"github.com/maddsua/syncctl/cli/config"
+	s4 "github.com/maddsua/syncctl/storage_service"
 	"github.com/maddsua/syncctl/storage_service/rest_client"
 	"github.com/maddsua/syncctl/utils"
 )
@@ -33,7 +35,9 @@ func NewS4RestClient(ctx context.Context, cfg config.RemoteConfig) (*rest_client
 			}
 		}
 
-		if remote.Auth != nil {
+		if remote.Token != "" {
+			client.Token = remote.Token
+		} else if remote.Auth != nil {
 			client.Auth = url.UserPassword(remote.Auth.Username, remote.Auth.Password)
 		}
 
@@ -46,3 +50,27 @@ func NewS4RestClient(ctx context.Context, cfg config.RemoteConfig) (*rest_client
 
 	return nil, fmt.Errorf("unsupported remote type")
 }
+
+// Connects to a remote of any type. Clients that hold onto some state have to be closed with CloseClient
+func NewStorageClient(ctx context.Context, cfg config.RemoteConfig) (s4.StorageClient, error) {
+
+	switch remote := cfg.(type) {
+	case *config.FileRemoteConfig:
+		return NewLocalClient(ctx, remote)
+	default:
+
+		client, err := NewS4RestClient(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		return client, nil
+	}
+}
+
+func CloseClient(client s4.StorageClient) error {
+	if closer, ok := client.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package cliutils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+
+	"github.com/maddsua/syncctl/utils"
+)
+
+func GetHashCacheLocation(localDir string) (string, error) {
+
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+
+	absDir, err := filepath.Abs(localDir)
+	if err != nil {
+		return "", err
+	}
+
+	dirHash := sha256.Sum256([]byte(absDir))
+
+	return path.Join(cacheDir, "syncctl/hashes", hex.EncodeToString(dirHash[:16])+".json"), nil
+}
+
+// Remembers file hashes for a local directory, so that we only have to re-hash
+// the files that have actually changed since the last time we've seen them
+type HashCache struct {
+	Location string
+	entries  map[string]hashCacheEntry
+	mtx      sync.Mutex
+	changed  bool
+}
+
+type hashCacheEntry struct {
+	Size     int64  `json:"size"`
+	Modified int64  `json:"mod"`
+	Inode    uint64 `json:"ino"`
+	SHA256   string `json:"sha256"`
+}
+
+func (entry *hashCacheEntry) matches(stat os.FileInfo) bool {
+	return entry.Size == stat.Size() &&
+		entry.Modified == stat.ModTime().UnixNano() &&
+		entry.Inode == fileInode(stat)
+}
+
+// Loads a hash cache for a local directory. Setting 'rehash' discards everything
+// that was stored previously, which effectively rebuilds the cache from scratch
+func OpenHashCache(localDir string, rehash bool) (*HashCache, error) {
+
+	loc, err := GetHashCacheLocation(localDir)
+	if err != nil {
+		return nil, err
+	}
+
+	cache := HashCache{
+		Location: loc,
+		entries:  map[string]hashCacheEntry{},
+	}
+
+	if rehash {
+		cache.changed = true
+		return &cache, nil
+	}
+
+	file, err := os.Open(loc)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &cache, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	//	a broken cache is no reason to fail, it just means we're rehashing everything
+	if err := json.NewDecoder(file).Decode(&cache.entries); err != nil {
+		cache.entries = map[string]hashCacheEntry{}
+		cache.changed = true
+	}
+
+	return &cache, nil
+}
+
+func (cache *HashCache) cacheKey(name string) string {
+	if abs, err := filepath.Abs(name); err == nil {
+		return abs
+	}
+	return path.Clean(name)
+}
+
+func (cache *HashCache) Lookup(name string, stat os.FileInfo) (string, bool) {
+
+	if cache == nil {
+		return "", false
+	}
+
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+
+	if entry, has := cache.entries[cache.cacheKey(name)]; has && entry.matches(stat) {
+		return entry.SHA256, true
+	}
+
+	return "", false
+}
+
+func (cache *HashCache) Store(name string, stat os.FileInfo, hash string) {
+
+	if cache == nil {
+		return
+	}
+
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+
+	cache.entries[cache.cacheKey(name)] = hashCacheEntry{
+		Size:     stat.Size(),
+		Modified: stat.ModTime().UnixNano(),
+		Inode:    fileInode(stat),
+		SHA256:   hash,
+	}
+
+	cache.changed = true
+}
+
+// Returns a hash of a named file, only reading it when the cached value is missing or stale
+func (cache *HashCache) FileHash(name string) (string, error) {
+
+	stat, err := os.Stat(name)
+	if err != nil {
+		return "", err
+	}
+
+	if hash, ok := cache.Lookup(name, stat); ok {
+		return hash, nil
+	}
+
+	hash, err := utils.NamedFileHashSha256(name)
+	if err != nil {
+		return "", err
+	}
+
+	cache.Store(name, stat, hash)
+
+	return hash, nil
+}
+
+// Writes the cache back to the disk, dropping the entries for files that no longer exist
+func (cache *HashCache) Save() error {
+
+	if cache == nil {
+		return nil
+	}
+
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+
+	for key, entry := range cache.entries {
+		if stat, err := os.Stat(key); err != nil || !entry.matches(stat) {
+			delete(cache.entries, key)
+			cache.changed = true
+		}
+	}
+
+	if !cache.changed {
+		return nil
+	}
+
+	if err := os.MkdirAll(path.Dir(cache.Location), os.ModePerm); err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(path.Dir(cache.Location), path.Base(cache.Location)+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	janitor := utils.FileJanitor{Name: file.Name()}
+	defer janitor.Cleanup()
+	defer file.Close()
+
+	if err := json.NewEncoder(file).Encode(cache.entries); err != nil {
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(file.Name(), cache.Location); err != nil {
+		return err
+	}
+
+	janitor.Release()
+	cache.changed = false
+
+	return nil
+}
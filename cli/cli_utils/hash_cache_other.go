@@ -0,0 +1,10 @@
+//go:build !unix
+
+package cliutils
+
+import "os"
+
+// inode numbers aren't a thing here, so size and mtime will have to do
+func fileInode(stat os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,122 @@
+package cliutils
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/maddsua/syncctl/cli/config"
+	s4 "github.com/maddsua/syncctl/storage_service"
+	"github.com/maddsua/syncctl/storage_service/blobstorage"
+	"github.com/maddsua/syncctl/utils"
+)
+
+// Uses a local directory as a remote, so that files could be synced to a usb drive or a mounted nas share
+type LocalClient struct {
+	s4.Storage
+	Dir    string
+	hashes *HashCache
+}
+
+func NewLocalClient(ctx context.Context, cfg *config.FileRemoteConfig) (*LocalClient, error) {
+
+	client := LocalClient{Dir: cfg.Dir}
+
+	switch cfg.Format {
+	case config.FileFormatPlain, "":
+
+		hashes, err := OpenHashCache(cfg.Dir, false)
+		if err != nil {
+			return nil, fmt.Errorf("open hash cache: %v", err)
+		}
+
+		client.hashes = hashes
+		client.Storage = &PlainStorage{RootDir: cfg.Dir, Hashes: hashes}
+
+	case config.FileFormatBlob:
+		client.Storage = &blobstorage.Storage{RootDir: cfg.Dir}
+
+	default:
+		return nil, fmt.Errorf("unsupported file format '%s'", cfg.Format)
+	}
+
+	if err := client.Ping(ctx); err != nil {
+		return nil, err
+	}
+
+	return &client, nil
+}
+
+// Checks that the directory is there, which it might not be if the drive that it's on isn't mounted
+func (client *LocalClient) Ping(ctx context.Context) error {
+
+	stat, err := os.Stat(client.Dir)
+	if err != nil {
+		return fmt.Errorf("directory '%s' is not accessible: %v", client.Dir, err)
+	} else if !stat.IsDir() {
+		return fmt.Errorf("'%s' is not a directory", client.Dir)
+	}
+
+	return nil
+}
+
+func (client *LocalClient) Download(ctx context.Context, name string, offset int64) (*s4.ReadableFile, error) {
+
+	file, err := client.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset > 0 {
+		if _, err := file.ReadSeekCloser.Seek(offset, io.SeekStart); err != nil {
+			_ = file.ReadSeekCloser.Close()
+			return nil, err
+		}
+	}
+
+	return &s4.ReadableFile{
+		FileMetadata: file.FileMetadata,
+		ReadCloser:   file.ReadSeekCloser,
+		Offset:       offset,
+	}, nil
+}
+
+// Blobs need to know their size before anything is written, so uploads that don't say it
+// are written to a temp file first. Plain files can take them as they are
+func (client *LocalClient) Put(ctx context.Context, entry *s4.FileUpload, overwrite bool) (*s4.FileMetadata, error) {
+
+	if _, isBlob := client.Storage.(*blobstorage.Storage); !isBlob || entry.Size >= 0 {
+		return client.Storage.Put(ctx, entry, overwrite)
+	}
+
+	temp, err := utils.WriteTempFile(client.Dir, ".syncctl-upload-", entry.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	defer temp.Cleanup()
+
+	file, err := os.Open(temp.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	upload := *entry
+	upload.Size = stat.Size()
+	upload.Reader = file
+
+	return client.Storage.Put(ctx, &upload, overwrite)
+}
+
+// Saves the hashes that have been computed while listing the directory
+func (client *LocalClient) Close() error {
+	return client.hashes.Save()
+}
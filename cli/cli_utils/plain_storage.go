@@ -0,0 +1,326 @@
+package cliutils
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	s4 "github.com/maddsua/syncctl/storage_service"
+	"github.com/maddsua/syncctl/storage_service/blobstorage"
+	"github.com/maddsua/syncctl/storage_service/metaindex"
+	"github.com/maddsua/syncctl/utils"
+)
+
+// Uploads are written next to where they're going to end up, and renamed once complete
+const plainTempPrefix = ".syncctl-"
+const plainTempExt = ".tmp"
+
+// Keeps files in a directory as they are, with no metadata of its own.
+// Hashes are computed on demand, which is why it's better off with a hash cache
+type PlainStorage struct {
+	RootDir string
+	Hashes  *HashCache
+}
+
+func (storage *PlainStorage) filePath(name string) string {
+	return path.Join(storage.RootDir, blobstorage.CleanRelativePath(name))
+}
+
+func isPlainTempFile(name string) bool {
+	return strings.HasPrefix(name, plainTempPrefix) && strings.HasSuffix(name, plainTempExt)
+}
+
+func (storage *PlainStorage) metadata(name string, stat os.FileInfo) (*s4.FileMetadata, error) {
+
+	hash, ok := storage.Hashes.Lookup(name, stat)
+	if !ok {
+
+		var err error
+		if hash, err = utils.NamedFileHashSha256(name); err != nil {
+			return nil, err
+		}
+
+		storage.Hashes.Store(name, stat, hash)
+	}
+
+	return &s4.FileMetadata{
+		Name:     "/" + strings.TrimPrefix(strings.TrimPrefix(name, path.Clean(storage.RootDir)), "/"),
+		Size:     stat.Size(),
+		Modified: stat.ModTime(),
+		SHA256:   hash,
+	}, nil
+}
+
+func (storage *PlainStorage) statFile(name string) (os.FileInfo, error) {
+
+	stat, err := os.Stat(storage.filePath(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, &s4.FileNotFoundError{Path: name}
+		}
+		return nil, err
+	} else if !stat.Mode().IsRegular() {
+		return nil, &s4.FileNotFoundError{Path: name}
+	}
+
+	return stat, nil
+}
+
+func (storage *PlainStorage) Put(ctx context.Context, entry *s4.FileUpload, overwrite bool) (*s4.FileMetadata, error) {
+
+	if entry.Name = blobstorage.CleanRelativePath(entry.Name); entry.Name == "/" || isPlainTempFile(path.Base(entry.Name)) {
+		return nil, &s4.NameError{Name: entry.Name}
+	}
+
+	filePath := storage.filePath(entry.Name)
+	if _, err := os.Stat(filePath); err == nil && !overwrite {
+		return nil, &s4.FileConflictError{Path: entry.Name}
+	}
+
+	if err := os.MkdirAll(path.Dir(filePath), fs.ModePerm); err != nil {
+		return nil, err
+	}
+
+	hasher := sha256.New()
+
+	temp, err := utils.WriteTempFile(path.Dir(filePath), plainTempPrefix+path.Base(filePath), io.TeeReader(entry.Reader, hasher))
+	if err != nil {
+		return nil, err
+	}
+
+	defer temp.Cleanup()
+
+	stat, err := os.Stat(temp.Name)
+	if err != nil {
+		return nil, err
+	} else if entry.Size >= 0 && stat.Size() != entry.Size {
+		return nil, fmt.Errorf("expected size: %d bytes but wrote %d instead", entry.Size, stat.Size())
+	}
+
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	if entry.SHA256 != "" && entry.SHA256 != hash {
+		return nil, fmt.Errorf("sha256 checksum mismatch: expected '%s'; have '%s'", entry.SHA256, hash)
+	}
+
+	if !entry.Modified.IsZero() {
+		if err := os.Chtimes(temp.Name, entry.Modified, entry.Modified); err != nil {
+			return nil, err
+		}
+	}
+
+	//	temp files are only readable by the owner, which isn't what anyone wants on a shared drive
+	if err := os.Chmod(temp.Name, 0644); err != nil {
+		return nil, err
+	}
+
+	//	a conflicting file could've shown up while this one was being written
+	if _, err := os.Stat(filePath); err == nil && !overwrite {
+		return nil, &s4.FileConflictError{Path: entry.Name}
+	}
+
+	if err := os.Rename(temp.Name, filePath); err != nil {
+		return nil, err
+	}
+
+	temp.Release()
+
+	if stat, err = os.Stat(filePath); err != nil {
+		return nil, err
+	}
+
+	storage.Hashes.Store(filePath, stat, hash)
+
+	return &s4.FileMetadata{
+		Name:     entry.Name,
+		Size:     stat.Size(),
+		Modified: stat.ModTime(),
+		SHA256:   hash,
+	}, nil
+}
+
+func (storage *PlainStorage) Get(ctx context.Context, name string) (*s4.ReadSeekableFile, error) {
+
+	stat, err := storage.statFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := storage.metadata(storage.filePath(name), stat)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(storage.filePath(name))
+	if err != nil {
+		return nil, err
+	}
+
+	return &s4.ReadSeekableFile{
+		FileMetadata:   *meta,
+		ReadSeekCloser: file,
+	}, nil
+}
+
+func (storage *PlainStorage) Stat(ctx context.Context, name string) (*s4.FileMetadata, error) {
+
+	stat, err := storage.statFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return storage.metadata(storage.filePath(name), stat)
+}
+
+func (storage *PlainStorage) Move(ctx context.Context, name, newName string, overwrite bool) (*s4.FileMetadata, error) {
+
+	if name = blobstorage.CleanRelativePath(name); name == "/" {
+		return nil, &s4.NameError{Name: name}
+	} else if newName = blobstorage.CleanRelativePath(newName); newName == "/" {
+		return nil, &s4.NameError{Name: newName}
+	}
+
+	if _, err := storage.statFile(name); err != nil {
+		return nil, err
+	}
+
+	newPath := storage.filePath(newName)
+	if _, err := os.Stat(newPath); err == nil && !overwrite {
+		return nil, &s4.FileConflictError{Path: newName}
+	}
+
+	if err := os.MkdirAll(path.Dir(newPath), fs.ModePerm); err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(storage.filePath(name), newPath); err != nil {
+		return nil, err
+	}
+
+	storage.removeEmptyDirs(path.Dir(storage.filePath(name)))
+
+	return storage.Stat(ctx, newName)
+}
+
+func (storage *PlainStorage) Delete(ctx context.Context, name string) (*s4.FileMetadata, error) {
+
+	meta, err := storage.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Remove(storage.filePath(name)); err != nil {
+		return nil, err
+	}
+
+	storage.removeEmptyDirs(path.Dir(storage.filePath(name)))
+
+	return meta, nil
+}
+
+// Cleans up the directories that were only there for the files that have been removed.
+// There's no such thing as an empty directory in the storage, so leaving them around would only be confusing
+func (storage *PlainStorage) removeEmptyDirs(dir string) {
+
+	root := path.Clean(storage.RootDir)
+
+	for dir = path.Clean(dir); dir != root && strings.HasPrefix(dir, root+"/"); dir = path.Dir(dir) {
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
+
+func (storage *PlainStorage) Find(ctx context.Context, prefix string, filter *regexp.Regexp, recursive bool, offset, limit int) ([]s4.FileMetadata, error) {
+
+	dir := storage.filePath(prefix)
+
+	//	a file isn't a directory with nothing in it, but it's what the other storages say about it
+	if stat, err := os.Stat(dir); err == nil && !stat.IsDir() {
+		return []s4.FileMetadata{}, nil
+	}
+
+	var matched []s4.FileMetadata
+
+	var walk func(dir, relDir string) error
+	walk = func(dir, relDir string) error {
+
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		for _, entry := range entries {
+
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			name := path.Join(dir, entry.Name())
+			relName := path.Join(relDir, entry.Name())
+
+			if entry.IsDir() {
+				if recursive {
+					if err := walk(name, relName); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+
+			if !entry.Type().IsRegular() || isPlainTempFile(entry.Name()) {
+				continue
+			}
+
+			if filter != nil && !filter.MatchString(relName) {
+				continue
+			}
+
+			stat, err := entry.Info()
+			if err != nil {
+				return err
+			}
+
+			meta, err := storage.metadata(name, stat)
+			if err != nil {
+				return err
+			}
+
+			matched = append(matched, *meta)
+		}
+
+		return nil
+	}
+
+	if err := walk(dir, "/"); err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(matched, func(a, b s4.FileMetadata) int {
+		return metaindex.ComparePaths(a.Name, b.Name)
+	})
+
+	if offset > 0 {
+		matched = matched[min(offset, len(matched)):]
+	}
+
+	if limit > 0 && len(matched) > limit {
+		matched = matched[:limit]
+	}
+
+	if matched == nil {
+		return []s4.FileMetadata{}, nil
+	}
+
+	return matched, nil
+}
@@ -4,6 +4,8 @@ import (
 	"errors"
 	"fmt"
 	"net/url"
+	"os"
+	"path/filepath"
 
 	"github.com/maddsua/syncctl/cli/config"
 	"github.com/maddsua/syncctl/utils"
@@ -26,7 +28,14 @@ func GetRemote(cfg *config.Config, name string) (config.RemoteConfig, error) {
 func ParseRemoteURL(inputURL string) (config.RemoteConfig, error) {
 
 	remoteURL, err := url.Parse(inputURL)
-	if err != nil || remoteURL.Scheme == "" || remoteURL.Host == "" {
+	if err != nil || remoteURL.Scheme == "" {
+		return nil, fmt.Errorf("Invalid url argument")
+	}
+
+	//	local directories don't have a host, so they're taken care of before anything else
+	if remoteURL.Scheme == "file" {
+		return parseFileRemoteURL(remoteURL)
+	} else if remoteURL.Host == "" {
 		return nil, fmt.Errorf("Invalid url argument")
 	}
 
@@ -86,3 +95,41 @@ func ParseRemoteURL(inputURL string) (config.RemoteConfig, error) {
 
 	return nil, fmt.Errorf("unsupported url")
 }
+
+func parseFileRemoteURL(remoteURL *url.URL) (config.RemoteConfig, error) {
+
+	if remoteURL.Host != "" && remoteURL.Host != "localhost" {
+		return nil, fmt.Errorf("File urls can't point to other hosts, did you mean 'file:///%s%s'?", remoteURL.Host, remoteURL.Path)
+	} else if remoteURL.Path == "" {
+		return nil, fmt.Errorf("File url must have a directory path")
+	}
+
+	dir, err := filepath.Abs(remoteURL.Path)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid directory path: %v", err)
+	}
+
+	format := config.FileFormat(remoteURL.Query().Get("format"))
+
+	switch format {
+	case "":
+		format = config.FileFormatPlain
+	case config.FileFormatPlain, config.FileFormatBlob:
+	default:
+		return nil, fmt.Errorf("Unsupported file format '%s', expected '%s' or '%s'", format, config.FileFormatPlain, config.FileFormatBlob)
+	}
+
+	if stat, err := os.Stat(dir); err != nil {
+		fmt.Println("Note: Directory doesn't exist (yet?):", dir)
+	} else if !stat.IsDir() {
+		return nil, fmt.Errorf("'%s' is not a directory", dir)
+	}
+
+	fmt.Println("Setting remote directory:", dir)
+	fmt.Println("Setting file format:", format)
+
+	return &config.FileRemoteConfig{
+		Dir:    dir,
+		Format: format,
+	}, nil
+}
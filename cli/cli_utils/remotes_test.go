@@ -0,0 +1,71 @@
+package cliutils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/maddsua/syncctl/cli/config"
+)
+
+func TestParseFileRemoteURL(t *testing.T) {
+
+	dir := t.TempDir()
+
+	notDir := filepath.Join(dir, "file")
+	if err := os.WriteFile(notDir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		url        string
+		wantDir    string
+		wantFormat config.FileFormat
+		wantErr    bool
+	}{
+		{name: "plain by default", url: "file://" + dir, wantDir: dir, wantFormat: config.FileFormatPlain},
+		{name: "localhost", url: "file://localhost" + dir, wantDir: dir, wantFormat: config.FileFormatPlain},
+		{name: "explicit plain", url: "file://" + dir + "?format=plain", wantDir: dir, wantFormat: config.FileFormatPlain},
+		{name: "blob", url: "file://" + dir + "?format=blob", wantDir: dir, wantFormat: config.FileFormatBlob},
+		{name: "path gets cleaned", url: "file://" + dir + "/sub/../", wantDir: dir, wantFormat: config.FileFormatPlain},
+		{name: "missing dir is fine", url: "file://" + dir + "/later", wantDir: dir + "/later", wantFormat: config.FileFormatPlain},
+		{name: "other host", url: "file://nas/share", wantErr: true},
+		{name: "no path", url: "file://", wantErr: true},
+		{name: "unknown format", url: "file://" + dir + "?format=zip", wantErr: true},
+		{name: "not a directory", url: "file://" + notDir, wantErr: true},
+		{name: "no scheme", url: dir, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			remote, err := ParseRemoteURL(tt.url)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseRemoteURL(%q) error = %v, wantErr %v", tt.url, err, tt.wantErr)
+			} else if err != nil {
+				return
+			}
+
+			fileRemote, ok := remote.(*config.FileRemoteConfig)
+			if !ok {
+				t.Fatalf("ParseRemoteURL(%q) = %T, want a file remote", tt.url, remote)
+			}
+
+			if fileRemote.Dir != tt.wantDir {
+				t.Errorf("dir = %q, want %q", fileRemote.Dir, tt.wantDir)
+			}
+
+			if fileRemote.Format != tt.wantFormat {
+				t.Errorf("format = %q, want %q", fileRemote.Format, tt.wantFormat)
+			}
+
+			//	and it has to make it back out the same way
+			if again, err := ParseRemoteURL(fileRemote.URL()); err != nil {
+				t.Errorf("parse URL() again: %v", err)
+			} else if *again.(*config.FileRemoteConfig) != *fileRemote {
+				t.Errorf("URL() = %q parses into %+v, want %+v", fileRemote.URL(), again, fileRemote)
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package cliutils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/maddsua/syncctl/utils"
+)
+
+func GetSyncStateLocation(localDir, remoteName, remoteDir string) (string, error) {
+
+	homedir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	absDir, err := filepath.Abs(localDir)
+	if err != nil {
+		return "", err
+	}
+
+	pairHash := sha256.Sum256([]byte(absDir + "\n" + remoteName + ":" + path.Clean("/"+remoteDir)))
+
+	return path.Join(homedir, ".config/syncctl/sync", hex.EncodeToString(pairHash[:16])+".json"), nil
+}
+
+// Remembers what a local directory and a remote directory looked like the last time they were in sync.
+// Comparing both sides against it is what tells an edit from a deletion, and a one-sided change from a conflict
+type SyncState struct {
+	Location  string
+	LocalDir  string
+	RemoteDir string
+	entries   map[string]SyncStateEntry
+	mtx       sync.Mutex
+	changed   bool
+}
+
+type SyncStateEntry struct {
+	SHA256         string    `json:"sha256"`
+	LocalModified  time.Time `json:"local_mod"`
+	RemoteModified time.Time `json:"remote_mod"`
+}
+
+type syncStateFile struct {
+	LocalDir  string                    `json:"local_dir"`
+	RemoteDir string                    `json:"remote_dir"`
+	Entries   map[string]SyncStateEntry `json:"entries"`
+}
+
+// Loads sync state for a directory pair. Not having one at all is fine,
+// it just means that every difference between the two sides is going to be treated as a conflict
+func OpenSyncState(localDir, remoteName, remoteDir string) (*SyncState, error) {
+
+	loc, err := GetSyncStateLocation(localDir, remoteName, remoteDir)
+	if err != nil {
+		return nil, err
+	}
+
+	absDir, err := filepath.Abs(localDir)
+	if err != nil {
+		return nil, err
+	}
+
+	state := SyncState{
+		Location:  loc,
+		LocalDir:  absDir,
+		RemoteDir: remoteName + ":" + path.Clean("/"+remoteDir),
+		entries:   map[string]SyncStateEntry{},
+	}
+
+	file, err := os.Open(loc)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &state, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	var content syncStateFile
+	if err := json.NewDecoder(file).Decode(&content); err != nil {
+		return nil, err
+	}
+
+	if content.Entries != nil {
+		state.entries = content.Entries
+	}
+
+	return &state, nil
+}
+
+// Returns all the recorded paths
+func (state *SyncState) Names() []string {
+
+	state.mtx.Lock()
+	defer state.mtx.Unlock()
+
+	names := make([]string, 0, len(state.entries))
+	for name := range state.entries {
+		names = append(names, name)
+	}
+
+	return names
+}
+
+func (state *SyncState) Get(name string) (SyncStateEntry, bool) {
+
+	state.mtx.Lock()
+	defer state.mtx.Unlock()
+
+	entry, has := state.entries[name]
+	return entry, has
+}
+
+func (state *SyncState) Set(name string, entry SyncStateEntry) {
+
+	state.mtx.Lock()
+	defer state.mtx.Unlock()
+
+	if prev, has := state.entries[name]; has && prev == entry {
+		return
+	}
+
+	state.entries[name] = entry
+	state.changed = true
+}
+
+func (state *SyncState) Delete(name string) {
+
+	state.mtx.Lock()
+	defer state.mtx.Unlock()
+
+	if _, has := state.entries[name]; has {
+		delete(state.entries, name)
+		state.changed = true
+	}
+}
+
+func (state *SyncState) Save() error {
+
+	state.mtx.Lock()
+	defer state.mtx.Unlock()
+
+	if !state.changed {
+		return nil
+	}
+
+	if err := os.MkdirAll(path.Dir(state.Location), os.ModePerm); err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(path.Dir(state.Location), path.Base(state.Location)+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	janitor := utils.FileJanitor{Name: file.Name()}
+	defer janitor.Cleanup()
+	defer file.Close()
+
+	if err := json.NewEncoder(file).Encode(syncStateFile{
+		LocalDir:  state.LocalDir,
+		RemoteDir: state.RemoteDir,
+		Entries:   state.entries,
+	}); err != nil {
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(file.Name(), state.Location); err != nil {
+		return err
+	}
+
+	janitor.Release()
+	state.changed = false
+
+	return nil
+}
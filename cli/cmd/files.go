@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	s4 "github.com/maddsua/syncctl/storage_service"
+	"github.com/maddsua/syncctl/storage_service/metaindex"
+	"github.com/maddsua/syncctl/utils"
+)
+
+func ls_cmd(ctx context.Context, client s4.StorageClient, remoteDir string, filter *regexp.Regexp, recursive, long bool) error {
+
+	remoteDir = path.Clean("/" + remoteDir)
+
+	var serverFilter *regexp.Regexp
+	if recursive {
+		serverFilter = filter
+	}
+
+	entries, err := client.Find(ctx, remoteDir, serverFilter, true, 0, 0)
+	if err != nil {
+		return fmt.Errorf("Unable to list '%s': %v", remoteDir, err)
+	}
+
+	//	could be a file and not a directory
+	if len(entries) == 0 {
+		if entry, err := client.Stat(ctx, remoteDir); err == nil {
+			printListEntry(listEntryEvent{Event: "entry", FileMetadata: *entry}, path.Base(entry.Name), long)
+			return nil
+		}
+	}
+
+	if !recursive {
+		entries = collapseDirs(entries, remoteDir)
+	}
+
+	var listed int
+
+	for _, entry := range entries {
+
+		relName := strings.TrimPrefix(strings.TrimPrefix(entry.Name, remoteDir), "/")
+
+		if !recursive && filter != nil && !filter.MatchString("/"+relName) {
+			continue
+		}
+
+		printListEntry(listEntryEvent{
+			Event:        "entry",
+			FileMetadata: entry,
+			Dir:          strings.HasSuffix(entry.Name, "/"),
+		}, relName, long)
+
+		listed++
+	}
+
+	if listed == 0 {
+		output.Status("[Nothing here]")
+	}
+
+	return nil
+}
+
+// Replaces the files in the subdirectories with the subdirectories themselves,
+// which get the combined size of everything inside of them, and the latest modification time
+func collapseDirs(entries []s4.FileMetadata, dir string) []s4.FileMetadata {
+
+	var result []s4.FileMetadata
+	dirs := map[string]int{}
+
+	for _, entry := range entries {
+
+		relName := strings.TrimPrefix(strings.TrimPrefix(entry.Name, dir), "/")
+
+		subdir, _, isNested := strings.Cut(relName, "/")
+		if !isNested {
+			result = append(result, entry)
+			continue
+		}
+
+		name := path.Join(dir, subdir) + "/"
+
+		idx, has := dirs[name]
+		if !has {
+			idx = len(result)
+			dirs[name] = idx
+			result = append(result, s4.FileMetadata{Name: name})
+		}
+
+		result[idx].Size += entry.Size
+		if entry.Modified.After(result[idx].Modified) {
+			result[idx].Modified = entry.Modified
+		}
+	}
+
+	slices.SortFunc(result, func(a, b s4.FileMetadata) int {
+		return metaindex.ComparePaths(a.Name, b.Name)
+	})
+
+	return result
+}
+
+func printListEntry(entry listEntryEvent, relName string, long bool) {
+	output.Object(entry, func() {
+
+		if !long {
+			fmt.Println(relName)
+			return
+		}
+
+		fmt.Printf("%s  %8s  %s\n",
+			entry.Modified.Local().Format(time.DateTime),
+			utils.DataSizeString(float64(entry.Size)),
+			relName)
+	})
+}
+
+func stat_cmd(ctx context.Context, client s4.StorageClient, name string) error {
+
+	entry, err := client.Stat(ctx, name)
+	if err != nil {
+		return fmt.Errorf("Unable to stat '%s': %v", name, err)
+	}
+
+	output.Object(listEntryEvent{Event: "stat", FileMetadata: *entry}, func() {
+		fmt.Println("Name:", entry.Name)
+		fmt.Println("Size:", utils.DataSizeString(float64(entry.Size)), fmt.Sprintf("(%d bytes)", entry.Size))
+		fmt.Println("Modified:", entry.Modified.Local().Format(time.DateTime))
+		fmt.Println("SHA256:", entry.SHA256)
+	})
+
+	return nil
+}
+
+func rm_cmd(ctx context.Context, client s4.StorageClient, name string, recursive, confirmed bool) error {
+
+	output.Begin("rm", false)
+
+	entries, err := client.Find(ctx, name, nil, true, 0, 0)
+	if err != nil {
+		return fmt.Errorf("Unable to list '%s': %v", name, err)
+	}
+
+	if len(entries) == 0 {
+
+		entry, err := client.Stat(ctx, name)
+		if err != nil {
+			return fmt.Errorf("Unable to delete '%s': %v", name, err)
+		}
+
+		return output.File(fileEvent{Action: fileDeleteRemote, Path: entry.Name, Size: entry.Size}, fmt.Sprintf("--> Deleting '%s'", entry.Name), func() error {
+			if _, err := client.Delete(ctx, entry.Name); err != nil {
+				return fmt.Errorf("Unable to delete '%s': %v", entry.Name, err)
+			}
+			return nil
+		})
+	}
+
+	if !recursive {
+		return fmt.Errorf("'%s' is a directory. Use --recursive to delete everything in it", name)
+	}
+
+	if !confirmed {
+
+		var size int64
+		for _, entry := range entries {
+			size += entry.Size
+		}
+
+		ok, err := confirm(fmt.Sprintf("Delete %d files (%s) from '%s'?", len(entries), utils.DataSizeString(float64(size)), name))
+		if err != nil {
+			return err
+		} else if !ok {
+			return fmt.Errorf("Not confirmed, nothing was deleted")
+		}
+	}
+
+	for _, entry := range entries {
+		if err := output.File(fileEvent{Action: fileDeleteRemote, Path: entry.Name, Size: entry.Size}, fmt.Sprintf("--> Deleting '%s'", entry.Name), func() error {
+			_, err := client.Delete(ctx, entry.Name)
+			return err
+		}); err != nil {
+			return fmt.Errorf("Unable to delete '%s': %v", entry.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Asks for a yes or no. The question goes to stderr, so that it doesn't get mixed up with the output
+func confirm(question string) (bool, error) {
+
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, fmt.Errorf("Unable to read the answer: %v", err)
+	}
+
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+func mv_cmd(ctx context.Context, client s4.StorageClient, name, newName string, overwrite bool) error {
+
+	output.Begin("mv", false)
+
+	entries, err := client.Find(ctx, name, nil, true, 0, 0)
+	if err != nil {
+		return fmt.Errorf("Unable to list '%s': %v", name, err)
+	}
+
+	if len(entries) == 0 {
+
+		entry, err := client.Stat(ctx, name)
+		if err != nil {
+			return fmt.Errorf("Unable to move '%s': %v", name, err)
+		}
+
+		//	moving a file into a directory keeps its name
+		if strings.HasSuffix(newName, "/") {
+			newName = path.Join(newName, path.Base(entry.Name))
+		}
+
+		return output.File(fileEvent{Action: fileMove, Path: newName, Source: entry.Name, Size: entry.Size}, fmt.Sprintf("--> Moving '%s' to '%s'", entry.Name, newName), func() error {
+			if _, err := client.Move(ctx, entry.Name, newName, overwrite); err != nil {
+				return fmt.Errorf("Unable to move '%s': %v", entry.Name, err)
+			}
+			return nil
+		})
+	}
+
+	dir := path.Clean("/" + name)
+
+	for _, entry := range entries {
+
+		target := path.Join(newName, strings.TrimPrefix(entry.Name, dir))
+
+		if err := output.File(fileEvent{Action: fileMove, Path: target, Source: entry.Name, Size: entry.Size}, fmt.Sprintf("--> Moving '%s' to '%s'", entry.Name, target), func() error {
+			_, err := client.Move(ctx, entry.Name, target, overwrite)
+			return err
+		}); err != nil {
+			return fmt.Errorf("Unable to move '%s': %v", entry.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Writes a remote file to stdout, checking its hash once it's all out
+func cat_cmd(ctx context.Context, client s4.StorageClient, name string) error {
+
+	blob, err := client.Download(ctx, name, 0)
+	if err != nil {
+		return fmt.Errorf("Unable to read '%s': %v", name, err)
+	}
+	defer blob.ReadCloser.Close()
+
+	hasher := sha256.New()
+
+	if _, err := io.Copy(os.Stdout, io.TeeReader(blob.ReadCloser, hasher)); err != nil {
+		return fmt.Errorf("Unable to read '%s': %v", name, err)
+	}
+
+	if hash := hex.EncodeToString(hasher.Sum(nil)); blob.SHA256 != "" && hash != blob.SHA256 {
+		return fmt.Errorf("Unable to read '%s': content hash mismatch: expected '%s', have '%s'", name, blob.SHA256, hash)
+	}
+
+	return nil
+}
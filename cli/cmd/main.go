@@ -5,15 +5,21 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"regexp"
 	"runtime"
 	"slices"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/maddsua/syncctl"
 	app "github.com/maddsua/syncctl/cli"
 	cliutils "github.com/maddsua/syncctl/cli/cli_utils"
 	"github.com/maddsua/syncctl/cli/config"
+	s4 "github.com/maddsua/syncctl/storage_service"
+	"github.com/maddsua/syncctl/storage_service/rest_client"
+	"github.com/maddsua/syncctl/utils"
 	"github.com/urfave/cli/v3"
 )
 
@@ -35,22 +41,59 @@ func main() {
 		Value: string(syncctl.ResolveOverwrite),
 	}
 
+	//	keeping both versions is the only option that never loses anything,
+	//	which is a much better default when changes can come from both sides
+	var syncConflictFlagValue = &cliutils.EnumValue{
+		Options: conflictFlagValue.Options,
+		Value:   string(syncctl.ResolveAsCopy),
+	}
+
+	var outputFlagValue = &cliutils.EnumValue{
+		Options: []string{
+			string(outputText),
+			string(outputJSON),
+		},
+		Value: string(outputText),
+	}
+
 	cmd := &cli.Command{
+		Flags: []cli.Flag{
+			&cli.GenericFlag{
+				Name:  "output",
+				Value: outputFlagValue,
+				Usage: fmt.Sprintf("What to print, prose or json lines? [%s]",
+					strings.Join(outputFlagValue.Options, "|")),
+			},
+		},
+		Before: func(ctx context.Context, cmd *cli.Command) (context.Context, error) {
+			output.format = outputFormat(cmd.String("output"))
+			return ctx, nil
+		},
 		Commands: []*cli.Command{
 			{
 				Name: "version",
 				Action: func(ctx context.Context, _ *cli.Command) error {
 
-					if app.Version == "" {
-						fmt.Println("Syncctl (dev version)")
-						return nil
-					}
+					output.Object(versionInfoEvent{
+						Event:   "version",
+						Version: app.Version,
+						Go:      runtime.Version(),
+						OS:      runtime.GOOS,
+						Arch:    runtime.GOARCH,
+					}, func() {
+
+						if app.Version == "" {
+							fmt.Println("Syncctl (dev version)")
+							return
+						}
+
+						fmt.Printf("Syncctl %s; %s (%s/%s)\n",
+							app.Version,
+							runtime.Version(),
+							runtime.GOOS,
+							runtime.GOARCH)
+					})
 
-					fmt.Printf("Syncctl %s; %s (%s/%s)\n",
-						app.Version,
-						runtime.Version(),
-						runtime.GOOS,
-						runtime.GOARCH)
 					return nil
 				},
 			},
@@ -80,6 +123,27 @@ func main() {
 						Name:  "dry",
 						Usage: "If you want to just watch without touching",
 					},
+					&cli.IntFlag{
+						Name:  "jobs",
+						Value: defaultTransferJobs,
+						Usage: "How many files to move at the same time",
+					},
+					&cli.BoolFlag{
+						Name:  "rehash",
+						Usage: "Forget all the cached local file hashes and compute them again",
+					},
+					&cli.StringSliceFlag{
+						Name:  "exclude",
+						Usage: "Skip the paths matching a .syncignore-style pattern. Can be repeated",
+					},
+					&cli.StringSliceFlag{
+						Name:  "include",
+						Usage: "Keep the paths matching a pattern even if they're ignored otherwise. Can be repeated",
+					},
+					&cli.StringFlag{
+						Name:  "plan",
+						Usage: "Save what's going to be done into a file instead of doing it, so that 'apply' could do it later",
+					},
 				},
 				Action: func(ctx context.Context, cmd *cli.Command) error {
 
@@ -88,6 +152,23 @@ func main() {
 						return fmt.Errorf("argument 'destination' not provided")
 					}
 
+					//	a single file going to stdout, same as with 'cat'
+					if isStdioArg(destinationDir) {
+
+						if cmd.String("plan") != "" || cmd.Bool("prune") {
+							return fmt.Errorf("Pulling to stdout can't be planned or pruned")
+						}
+
+						client, remotePath, err := connectRemote(ctx, &cfg, cmd.StringArg("remote"))
+						if err != nil {
+							return err
+						}
+
+						defer closeClient(client)
+
+						return cat_cmd(ctx, client, remotePath)
+					}
+
 					remoteArg := cmd.StringArg("remote")
 					if remoteArg == "" {
 						return fmt.Errorf("argument 'remote' not provided")
@@ -103,21 +184,33 @@ func main() {
 						return err
 					}
 
-					client, err := cliutils.NewS4RestClient(ctx, remote)
+					client, err := cliutils.NewStorageClient(ctx, remote)
 					if err != nil {
 						return err
 					}
 
+					defer closeClient(client)
+
 					dry := cmd.Bool("dry")
 
 					onConflict := syncctl.ResolvePolicy(cmd.String("conflict"))
+
+					ignore, err := ignoreRulesFromFlags(cmd)
+					if err != nil {
+						return err
+					}
 					prune := cmd.Bool("prune")
 
 					if err := canResolveFileConflicts(onConflict, prune); err != nil {
 						return err
 					}
 
-					return pull_cmd(ctx, client, remoteDir, destinationDir, onConflict, prune, dry)
+					plan, err := newTransferPlan(cmd, planPull, remoteName, remoteDir, destinationDir)
+					if err != nil {
+						return err
+					}
+
+					return transfer_cmd(ctx, client, plan, ignore, dry, cmd.String("plan"), cmd.Int("jobs"), cmd.Bool("rehash"))
 				},
 			},
 			{
@@ -146,6 +239,35 @@ func main() {
 						Name:  "dry",
 						Usage: "If you want to just watch without touching",
 					},
+					&cli.IntFlag{
+						Name:  "jobs",
+						Value: defaultTransferJobs,
+						Usage: "How many files to move at the same time",
+					},
+					&cli.BoolFlag{
+						Name:  "rehash",
+						Usage: "Forget all the cached local file hashes and compute them again",
+					},
+					&cli.StringSliceFlag{
+						Name:  "exclude",
+						Usage: "Skip the paths matching a .syncignore-style pattern. Can be repeated",
+					},
+					&cli.StringSliceFlag{
+						Name:  "include",
+						Usage: "Keep the paths matching a pattern even if they're ignored otherwise. Can be repeated",
+					},
+					&cli.StringFlag{
+						Name:  "plan",
+						Usage: "Save what's going to be done into a file instead of doing it, so that 'apply' could do it later",
+					},
+					&cli.BoolFlag{
+						Name:  "watch",
+						Usage: "Keep running and push local changes as they happen",
+					},
+					&cli.Int64Flag{
+						Name:  "size",
+						Usage: "Size in bytes of what's coming from stdin, if it's known. Otherwise it's uploaded in chunks",
+					},
 				},
 				Action: func(ctx context.Context, cmd *cli.Command) error {
 
@@ -164,26 +286,493 @@ func main() {
 						return err
 					}
 
-					client, err := cliutils.NewS4RestClient(ctx, remote)
+					client, err := cliutils.NewStorageClient(ctx, remote)
 					if err != nil {
 						return err
 					}
 
+					defer closeClient(client)
+
 					sourceDir := cmd.StringArg("source")
 					if sourceDir == "" {
 						return fmt.Errorf("argument 'source' not provided")
 					}
 
+					if !isStdioArg(sourceDir) {
+						if _, err := os.Stat(sourceDir); err != nil {
+							return fmt.Errorf("Unable to push '%s': %v", sourceDir, err)
+						}
+					}
+
 					dry := cmd.Bool("dry")
 
 					onConflict := syncctl.ResolvePolicy(cmd.String("conflict"))
+
+					ignore, err := ignoreRulesFromFlags(cmd)
+					if err != nil {
+						return err
+					}
 					prune := cmd.Bool("prune")
 
 					if err := canResolveFileConflicts(onConflict, prune); err != nil {
 						return err
 					}
 
-					return push_cmd(ctx, client, sourceDir, remoteDir, onConflict, prune, dry)
+					//	single files and stdin are pushed as they are, without anything to plan or to watch
+					if isStdioArg(sourceDir) || !isLocalDir(sourceDir) {
+
+						if cmd.Bool("watch") || cmd.String("plan") != "" || prune {
+							return fmt.Errorf("Single files can't be watched, planned or pruned")
+						}
+
+						if !isStdioArg(sourceDir) {
+							return push_file_cmd(ctx, client, sourceDir, remoteDir, onConflict, dry)
+						}
+
+						size := int64(-1)
+						if cmd.IsSet("size") {
+							size = cmd.Int64("size")
+						}
+
+						return push_stdin_cmd(ctx, client, remoteDir, size, onConflict, dry)
+					}
+
+					if cmd.Bool("watch") {
+
+						if dry {
+							return fmt.Errorf("Watching in dry mode makes no sense")
+						} else if cmd.String("plan") != "" {
+							return fmt.Errorf("Changes that haven't happened yet can't be planned")
+						}
+
+						return push_watch_cmd(ctx, client, sourceDir, remoteDir, ignore, onConflict, prune, cmd.Int("jobs"), cmd.Bool("rehash"))
+					}
+
+					plan, err := newTransferPlan(cmd, planPush, remoteName, remoteDir, sourceDir)
+					if err != nil {
+						return err
+					}
+
+					return transfer_cmd(ctx, client, plan, ignore, dry, cmd.String("plan"), cmd.Int("jobs"), cmd.Bool("rehash"))
+				},
+			},
+			{
+				Name:  "apply",
+				Usage: "Does what a plan saved by push or pull says, unless something has changed since",
+				Arguments: []cli.Argument{
+					&cli.StringArg{
+						Name: "plan",
+					},
+				},
+				Flags: []cli.Flag{
+					&cli.IntFlag{
+						Name:  "jobs",
+						Value: defaultTransferJobs,
+						Usage: "How many files to move at the same time",
+					},
+					&cli.BoolFlag{
+						Name:  "rehash",
+						Usage: "Forget all the cached local file hashes and compute them again",
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+
+					planFile := cmd.StringArg("plan")
+					if planFile == "" {
+						return fmt.Errorf("argument 'plan' not provided")
+					}
+
+					plan, err := loadTransferPlan(planFile)
+					if err != nil {
+						return fmt.Errorf("Unable to load plan: %v", err)
+					}
+
+					remote, err := cliutils.GetRemote(&cfg, plan.Remote)
+					if err != nil {
+						return err
+					}
+
+					client, err := cliutils.NewStorageClient(ctx, remote)
+					if err != nil {
+						return err
+					}
+
+					defer closeClient(client)
+
+					return apply_cmd(ctx, client, plan, cmd.Int("jobs"), cmd.Bool("rehash"))
+				},
+			},
+			{
+				Name:  "sync",
+				Usage: "Syncs your stupid files both ways, keeping track of what's changed where",
+				Arguments: []cli.Argument{
+					&cli.StringArg{
+						Name: "local",
+					},
+					&cli.StringArg{
+						Name: "remote",
+					},
+				},
+				Flags: []cli.Flag{
+					&cli.GenericFlag{
+						Name:  "conflict",
+						Value: syncConflictFlagValue,
+						Usage: fmt.Sprintf("How to handle files that were changed on both sides? [%s]",
+							strings.Join(syncConflictFlagValue.Options, "|")),
+					},
+					&cli.BoolFlag{
+						Name:  "dry",
+						Usage: "If you want to just watch without touching",
+					},
+					&cli.IntFlag{
+						Name:  "jobs",
+						Value: defaultTransferJobs,
+						Usage: "How many files to move at the same time",
+					},
+					&cli.BoolFlag{
+						Name:  "rehash",
+						Usage: "Forget all the cached local file hashes and compute them again",
+					},
+					&cli.StringSliceFlag{
+						Name:  "exclude",
+						Usage: "Skip the paths matching a .syncignore-style pattern. Can be repeated",
+					},
+					&cli.StringSliceFlag{
+						Name:  "include",
+						Usage: "Keep the paths matching a pattern even if they're ignored otherwise. Can be repeated",
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+
+					localDir := cmd.StringArg("local")
+					if localDir == "" {
+						return fmt.Errorf("argument 'local' not provided")
+					}
+
+					remoteArg := cmd.StringArg("remote")
+					if remoteArg == "" {
+						return fmt.Errorf("argument 'remote' not provided")
+					}
+
+					remoteName, remoteDir, ok := strings.Cut(remoteArg, ":")
+					if !ok {
+						return fmt.Errorf("argument 'remote' must have the following format: 'name:path'")
+					}
+
+					remote, err := cliutils.GetRemote(&cfg, remoteName)
+					if err != nil {
+						return err
+					}
+
+					client, err := cliutils.NewStorageClient(ctx, remote)
+					if err != nil {
+						return err
+					}
+
+					defer closeClient(client)
+
+					onConflict := syncctl.ResolvePolicy(cmd.String("conflict"))
+
+					ignore, err := ignoreRulesFromFlags(cmd)
+					if err != nil {
+						return err
+					}
+
+					return sync_cmd(ctx, client, remoteName, remoteDir, localDir, ignore, onConflict, cmd.Bool("dry"), cmd.Int("jobs"), cmd.Bool("rehash"))
+				},
+			},
+			{
+				Name:  "ls",
+				Usage: "List remote files",
+				Arguments: []cli.Argument{
+					&cli.StringArg{
+						Name: "remote",
+					},
+				},
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:    "recursive",
+						Aliases: []string{"r"},
+						Usage:   "List everything in the subdirectories too",
+					},
+					&cli.BoolFlag{
+						Name:    "long",
+						Aliases: []string{"l"},
+						Usage:   "Show sizes and modification dates",
+					},
+					&cli.StringFlag{
+						Name:  "filter",
+						Usage: "Only list the paths matching a regular expression. Paths are relative to the listed directory and start with a slash",
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+
+					client, remoteDir, err := connectRemote(ctx, &cfg, cmd.StringArg("remote"))
+					if err != nil {
+						return err
+					}
+
+					defer closeClient(client)
+
+					var filter *regexp.Regexp
+					if expr := cmd.String("filter"); expr != "" {
+						if filter, err = regexp.Compile(expr); err != nil {
+							return fmt.Errorf("flag 'filter': %v", err)
+						}
+					}
+
+					return ls_cmd(ctx, client, remoteDir, filter, cmd.Bool("recursive"), cmd.Bool("long"))
+				},
+			},
+			{
+				Name:  "stat",
+				Usage: "Show remote file details",
+				Arguments: []cli.Argument{
+					&cli.StringArg{
+						Name: "remote",
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+
+					client, name, err := connectRemote(ctx, &cfg, cmd.StringArg("remote"))
+					if err != nil {
+						return err
+					}
+
+					defer closeClient(client)
+
+					return stat_cmd(ctx, client, name)
+				},
+			},
+			{
+				Name:  "rm",
+				Usage: "Delete remote files",
+				Arguments: []cli.Argument{
+					&cli.StringArg{
+						Name: "remote",
+					},
+				},
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:    "recursive",
+						Aliases: []string{"r"},
+						Usage:   "Delete a whole directory",
+					},
+					&cli.BoolFlag{
+						Name:    "yes",
+						Aliases: []string{"y"},
+						Usage:   "Don't ask before deleting a whole directory",
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+
+					client, name, err := connectRemote(ctx, &cfg, cmd.StringArg("remote"))
+					if err != nil {
+						return err
+					}
+
+					defer closeClient(client)
+
+					return rm_cmd(ctx, client, name, cmd.Bool("recursive"), cmd.Bool("yes"))
+				},
+			},
+			{
+				Name:  "mv",
+				Usage: "Move or rename remote files",
+				Arguments: []cli.Argument{
+					&cli.StringArg{
+						Name: "remote",
+					},
+					&cli.StringArg{
+						Name: "destination",
+					},
+				},
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "overwrite",
+						Usage: "Replace the files that exist at the destination already",
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+
+					client, name, err := connectRemote(ctx, &cfg, cmd.StringArg("remote"))
+					if err != nil {
+						return err
+					}
+
+					defer closeClient(client)
+
+					destinationArg := cmd.StringArg("destination")
+					if destinationArg == "" {
+						return fmt.Errorf("argument 'destination' not provided")
+					}
+
+					//	the remote name can be left out of the destination, since it has to be the same one anyway
+					newName := destinationArg
+					if remoteName, dir, ok := strings.Cut(destinationArg, ":"); ok {
+						if sourceName, _, _ := strings.Cut(cmd.StringArg("remote"), ":"); remoteName != "" && remoteName != sourceName {
+							return fmt.Errorf("Files can only be moved within the same remote")
+						}
+						newName = dir
+					}
+
+					return mv_cmd(ctx, client, name, newName, cmd.Bool("overwrite"))
+				},
+			},
+			{
+				Name:  "cat",
+				Usage: "Write a remote file to stdout",
+				Arguments: []cli.Argument{
+					&cli.StringArg{
+						Name: "remote",
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+
+					client, name, err := connectRemote(ctx, &cfg, cmd.StringArg("remote"))
+					if err != nil {
+						return err
+					}
+
+					defer closeClient(client)
+
+					return cat_cmd(ctx, client, name)
+				},
+			},
+			{
+				Name:  "trash",
+				Usage: "Dig through the stuff you've deleted from the remote",
+				Commands: []*cli.Command{
+					{
+						Name:  "list",
+						Usage: "List deleted files",
+						Arguments: []cli.Argument{
+							&cli.StringArg{
+								Name: "remote",
+							},
+						},
+						Action: func(ctx context.Context, cmd *cli.Command) error {
+
+							client, remoteDir, err := connectRestRemote(ctx, &cfg, cmd.StringArg("remote"))
+							if err != nil {
+								return err
+							}
+
+							return trash_list_cmd(ctx, client, remoteDir)
+						},
+					},
+					{
+						Name:  "restore",
+						Usage: "Put a deleted file back where it was",
+						Arguments: []cli.Argument{
+							&cli.StringArg{
+								Name: "remote",
+							},
+							&cli.StringArg{
+								Name: "id",
+							},
+						},
+						Flags: []cli.Flag{
+							&cli.BoolFlag{
+								Name:  "overwrite",
+								Usage: "Replace the file if something else has taken its place already",
+							},
+						},
+						Action: func(ctx context.Context, cmd *cli.Command) error {
+
+							id := cmd.StringArg("id")
+							if id == "" {
+								return fmt.Errorf("argument 'id' not provided")
+							}
+
+							client, _, err := connectRestRemote(ctx, &cfg, cmd.StringArg("remote"))
+							if err != nil {
+								return err
+							}
+
+							return trash_restore_cmd(ctx, client, id, cmd.Bool("overwrite"))
+						},
+					},
+					{
+						Name:  "empty",
+						Usage: "Permanently delete trashed files",
+						Arguments: []cli.Argument{
+							&cli.StringArg{
+								Name: "remote",
+							},
+						},
+						Action: func(ctx context.Context, cmd *cli.Command) error {
+
+							client, remoteDir, err := connectRestRemote(ctx, &cfg, cmd.StringArg("remote"))
+							if err != nil {
+								return err
+							}
+
+							return trash_empty_cmd(ctx, client, remoteDir)
+						},
+					},
+				},
+			},
+			{
+				Name:  "versions",
+				Usage: "List or download previous versions of a remote file",
+				Arguments: []cli.Argument{
+					&cli.StringArg{
+						Name: "remote",
+					},
+				},
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "download",
+						Usage: "Download a version with this id instead of listing them",
+					},
+					&cli.StringFlag{
+						Name:  "to",
+						Usage: "Where to save the downloaded version. Defaults to the file name in the current directory",
+					},
+					&cli.BoolFlag{
+						Name:  "overwrite",
+						Usage: "Replace the local file if it exists already",
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+
+					client, remotePath, err := connectRestRemote(ctx, &cfg, cmd.StringArg("remote"))
+					if err != nil {
+						return err
+					}
+
+					if id := cmd.String("download"); id != "" {
+						return versions_download_cmd(ctx, client, remotePath, id, cmd.String("to"), cmd.Bool("overwrite"))
+					}
+
+					return versions_list_cmd(ctx, client, remotePath)
+				},
+			},
+			{
+				Name:  "restore",
+				Usage: "Make a previous version of a remote file current again",
+				Arguments: []cli.Argument{
+					&cli.StringArg{
+						Name: "remote",
+					},
+					&cli.StringArg{
+						Name: "id",
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+
+					id := cmd.StringArg("id")
+					if id == "" {
+						return fmt.Errorf("argument 'id' not provided")
+					}
+
+					client, remotePath, err := connectRestRemote(ctx, &cfg, cmd.StringArg("remote"))
+					if err != nil {
+						return err
+					}
+
+					return restore_cmd(ctx, client, remotePath, id)
 				},
 			},
 			{
@@ -201,6 +790,12 @@ func main() {
 								Name: "url",
 							},
 						},
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "token",
+								Usage: "Authorize using an api token instead of a username and password",
+							},
+						},
 						Action: func(ctx context.Context, cmd *cli.Command) error {
 
 							name := cmd.StringArg("name")
@@ -220,6 +815,19 @@ func main() {
 								return err
 							}
 
+							if token := cmd.String("token"); token != "" {
+
+								s4remote, ok := remote.(*config.S4RemoteConfig)
+								if !ok {
+									return fmt.Errorf("Tokens are only supported by S4 remotes")
+								}
+
+								//	no point in keeping the password around when there's a token
+								s4remote.Auth = nil
+								s4remote.Token = token
+								output.Status("Setting remote token")
+							}
+
 							if cfg.Remotes == nil {
 								cfg.Remotes = map[string]config.RemoteConfigWrapper{}
 							}
@@ -228,9 +836,9 @@ func main() {
 							cfg.Changed = true
 
 							if !existed {
-								fmt.Println("Remote added")
+								output.Status("Remote added")
 							} else {
-								fmt.Println("Remote updated")
+								output.Status("Remote updated")
 							}
 
 							return nil
@@ -257,7 +865,7 @@ func main() {
 
 							delete(cfg.Remotes, name)
 							cfg.Changed = true
-							fmt.Println("Remote deleted")
+							output.Status("Remote deleted")
 
 							return nil
 						},
@@ -282,21 +890,150 @@ func main() {
 								return err
 							}
 
-							fmt.Println("Type:", remote.Type())
-							fmt.Println("URL:", remote.URL())
+							status := remoteStatusEvent{
+								Event: "remote_status",
+								Name:  name,
+								Type:  string(remote.Type()),
+								URL:   remote.URL(),
+							}
 
-							if remote, ok := remote.(*config.S4RemoteConfig); ok && remote.Auth != nil {
-								fmt.Println("User:", remote.Auth.Username)
-							} else {
-								fmt.Println("[No user set]")
+							switch remote := remote.(type) {
+							case *config.S4RemoteConfig:
+								if remote.Token != "" {
+									status.Auth = "token"
+								} else if remote.Auth != nil {
+									status.Auth = "password"
+									status.User = remote.Auth.Username
+								}
+							case *config.FileRemoteConfig:
+								status.Format = string(remote.Format)
 							}
 
-							if _, err := cliutils.NewS4RestClient(ctx, remote); err != nil {
-								fmt.Println("Status: Unreachable", err)
+							if client, err := cliutils.NewStorageClient(ctx, remote); err != nil {
+								status.Error = err.Error()
 							} else {
+
+								defer closeClient(client)
+
+								status.Ready = true
+
+								//	local directories don't have quotas, and counting them up could take a good while
+								if client, ok := client.(*rest_client.RestClient); ok {
+									if status.Usage, err = client.Usage(ctx); err != nil {
+										status.UsageError = err.Error()
+									}
+								}
+							}
+
+							output.Object(status, func() {
+
+								fmt.Println("Type:", status.Type)
+								fmt.Println("URL:", status.URL)
+
+								switch {
+								case remote.Type() == config.RemoteTypeFile:
+									fmt.Println("Format:", status.Format)
+								case status.Auth == "token":
+									fmt.Println("Auth: Token")
+								case status.User != "":
+									fmt.Println("User:", status.User)
+								default:
+									fmt.Println("[No user set]")
+								}
+
+								if !status.Ready {
+									fmt.Println("Status: Unreachable", status.Error)
+									return
+								}
+
 								fmt.Println("Status: Ready")
+
+								if status.Usage != nil {
+									fmt.Println("Usage:", formatStorageUsage(status.Usage))
+								} else if status.UsageError != "" {
+									fmt.Println("Usage: Unavailable", status.UsageError)
+								}
+							})
+
+							return nil
+						},
+					},
+					{
+						Name:  "token",
+						Usage: "Issue an api token using the remote's password, and use it instead of the password from now on",
+						Arguments: []cli.Argument{
+							&cli.StringArg{
+								Name: "name",
+							},
+						},
+						Flags: []cli.Flag{
+							&cli.DurationFlag{
+								Name:  "expires",
+								Usage: "How long the token stays valid for. Never expires by default",
+							},
+							&cli.StringFlag{
+								Name:  "prefix",
+								Usage: "Only allow access to the paths under this prefix",
+							},
+							&cli.BoolFlag{
+								Name:  "read-only",
+								Usage: "Don't allow any changes to be made using the token",
+							},
+							&cli.StringFlag{
+								Name:  "label",
+								Usage: "Token name to tell it apart from the others",
+							},
+						},
+						Action: func(ctx context.Context, cmd *cli.Command) error {
+
+							name := cmd.StringArg("name")
+							if name == "" {
+								return fmt.Errorf("argument 'name' not provided")
 							}
 
+							remote, err := cliutils.GetRemote(&cfg, name)
+							if err != nil {
+								return err
+							}
+
+							s4remote, ok := remote.(*config.S4RemoteConfig)
+							if !ok {
+								return fmt.Errorf("Tokens are only supported by S4 remotes")
+							} else if s4remote.Auth == nil {
+								return fmt.Errorf("Remote '%s' has no password set to issue a token with", name)
+							}
+
+							client, err := cliutils.NewS4RestClient(ctx, remote)
+							if err != nil {
+								return err
+							}
+
+							//	the client might've picked up an existing token, and those can't issue new ones
+							client.Token = ""
+
+							issued, err := client.IssueToken(ctx, cmd.String("label"), cmd.Duration("expires"), cmd.String("prefix"), cmd.Bool("read-only"))
+							if err != nil {
+								return fmt.Errorf("Unable to issue token: %v", err)
+							}
+
+							s4remote.Auth = nil
+							s4remote.Token = issued.Value
+							cfg.Changed = true
+
+							output.Object(tokenEvent{
+								Event:   "token",
+								ID:      issued.ID,
+								Remote:  name,
+								Expires: issued.Expires,
+							}, func() {
+
+								fmt.Printf("Token '%s' issued, remote '%s' is going to use it from now on\n", issued.ID, name)
+
+								if !issued.Expires.IsZero() {
+									fmt.Println("Expires:", issued.Expires.Local().Format(time.DateTime))
+								}
+							})
+
 							return nil
 						},
 					},
@@ -305,10 +1042,10 @@ func main() {
 						Usage: "List remotes",
 						Action: func(ctx context.Context, cmd *cli.Command) error {
 
-							fmt.Println("> Config location:", cfg.Location)
+							output.Status("> Config location: %s", cfg.Location)
 
 							if len(cfg.Remotes) == 0 {
-								fmt.Println("[No remotes]")
+								output.Status("[No remotes]")
 								return nil
 							}
 
@@ -319,9 +1056,17 @@ func main() {
 							slices.Sort(names)
 
 							for _, name := range names {
+
 								remote := cfg.Remotes[name]
-								fmt.Printf("%s %s %s\n", name, remote.Type(), remote.URL())
-								return nil
+
+								output.Object(remoteEvent{
+									Event: "remote",
+									Name:  name,
+									Type:  string(remote.Type()),
+									URL:   remote.URL(),
+								}, func() {
+									fmt.Printf("%s %s %s\n", name, remote.Type(), remote.URL())
+								})
 							}
 
 							return nil
@@ -337,11 +1082,7 @@ func main() {
 	defer cancel()
 
 	go func() {
-		if err := cmd.Run(ctx, os.Args); ctx.Err() == nil {
-			errCh <- err
-		} else {
-			errCh <- nil
-		}
+		errCh <- cmd.Run(ctx, escapeStdioArgs(os.Args))
 	}()
 
 	exitCh := make(chan os.Signal, 2)
@@ -351,29 +1092,179 @@ func main() {
 
 	case err := <-errCh:
 
-		if err != nil {
-			fmt.Println(err.Error())
-			os.Exit(1)
+		if err == nil && cfg.Changed {
+			if err = cfg.Store(); err != nil {
+				err = fmt.Errorf("Store config: %v", err)
+			} else {
+				output.Status("Note: Config changed")
+			}
 		}
 
-		if cfg.Changed {
-			if err := cfg.Store(); err != nil {
-				fmt.Println("Store config:", err)
-				os.Exit(1)
-			}
-			fmt.Println("Note: Config changed")
+		output.Finish(err)
+
+		if err != nil {
+			os.Exit(1)
 		}
 
 	case <-exitCh:
-		fmt.Println("Cancelling...")
+		output.Status("Cancelling...")
 		cancel()
-		<-errCh
+
+		//	whatever the command has to say about being cancelled only goes into the summary
+		err := <-errCh
+		if output.JSON() {
+			output.Finish(err)
+		}
 	}
 }
 
+// Connects to the remote from a 'name:path' argument, returning the path along with the client
+func connectRemote(ctx context.Context, cfg *config.Config, remoteArg string) (s4.StorageClient, string, error) {
+
+	if remoteArg == "" {
+		return nil, "", fmt.Errorf("argument 'remote' not provided")
+	}
+
+	remoteName, remotePath, ok := strings.Cut(remoteArg, ":")
+	if !ok {
+		return nil, "", fmt.Errorf("argument 'remote' must have the following format: 'name:path'")
+	}
+
+	remote, err := cliutils.GetRemote(cfg, remoteName)
+	if err != nil {
+		return nil, "", err
+	}
+
+	client, err := cliutils.NewStorageClient(ctx, remote)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return client, remotePath, nil
+}
+
+// Connects to a remote that supports the rest api extras, like trash and versions
+func connectRestRemote(ctx context.Context, cfg *config.Config, remoteArg string) (*rest_client.RestClient, string, error) {
+
+	if remoteArg == "" {
+		return nil, "", fmt.Errorf("argument 'remote' not provided")
+	}
+
+	remoteName, remoteDir, _ := strings.Cut(remoteArg, ":")
+
+	remote, err := cliutils.GetRemote(cfg, remoteName)
+	if err != nil {
+		return nil, "", err
+	}
+
+	client, err := cliutils.NewS4RestClient(ctx, remote)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return client, remoteDir, nil
+}
+
+func closeClient(client s4.StorageClient) {
+	if err := cliutils.CloseClient(client); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to close remote client: %v\n", err)
+	}
+}
+
+func ignoreRulesFromFlags(cmd *cli.Command) (*utils.IgnoreRules, error) {
+	return ignoreRulesFromPatterns(cmd.StringSlice("exclude"), cmd.StringSlice("include"))
+}
+
+func ignoreRulesFromPatterns(exclude, include []string) (*utils.IgnoreRules, error) {
+
+	var rules utils.IgnoreRules
+
+	for _, pattern := range exclude {
+		if err := rules.Exclude(pattern); err != nil {
+			return nil, fmt.Errorf("flag 'exclude': %v", err)
+		}
+	}
+
+	for _, pattern := range include {
+		if err := rules.Include(pattern); err != nil {
+			return nil, fmt.Errorf("flag 'include': %v", err)
+		}
+	}
+
+	return &rules, nil
+}
+
+func newTransferPlan(cmd *cli.Command, direction planDirection, remoteName, remoteDir, localDir string) (*transferPlan, error) {
+
+	//	saved plans could be applied from anywhere
+	if cmd.String("plan") != "" {
+
+		var err error
+		if localDir, err = filepath.Abs(localDir); err != nil {
+			return nil, fmt.Errorf("Unable to resolve '%s': %v", localDir, err)
+		}
+
+		localDir = filepath.ToSlash(localDir)
+	}
+
+	return &transferPlan{
+		Direction: direction,
+		Remote:    remoteName,
+		RemoteDir: remoteDir,
+		LocalDir:  localDir,
+		Conflict:  syncctl.ResolvePolicy(cmd.String("conflict")),
+		Prune:     cmd.Bool("prune"),
+		Exclude:   cmd.StringSlice("exclude"),
+		Include:   cmd.StringSlice("include"),
+	}, nil
+}
+
+// The cli parser stops at a lone "-", which stands for stdin or stdout, and drops everything after it.
+// That's why it gets swapped for a placeholder that passes for a regular argument
+const stdioArg = "\x00-"
+
+func escapeStdioArgs(args []string) []string {
+
+	result := slices.Clone(args)
+
+	for idx, arg := range result {
+		if arg == "--" {
+			break
+		} else if arg == "-" {
+			result[idx] = stdioArg
+		}
+	}
+
+	return result
+}
+
+func isStdioArg(arg string) bool {
+	return arg == "-" || arg == stdioArg
+}
+
+func isLocalDir(name string) bool {
+	stat, err := os.Stat(name)
+	return err == nil && stat.IsDir()
+}
+
 func canResolveFileConflicts(onConflict syncctl.ResolvePolicy, prune bool) error {
 	if onConflict == syncctl.ResolveAsCopy && prune {
 		return fmt.Errorf("Dude did you just set both 'prune' flag and 'copy' conflict resolution strategy together?? Talk about sitting on two chairs with one ass huh?!")
 	}
 	return nil
 }
+
+func formatStorageUsage(usage *s4.StorageUsage) string {
+
+	text := utils.DataSizeString(float64(usage.Bytes))
+	if usage.QuotaBytes > 0 {
+		text += " of " + utils.DataSizeString(float64(usage.QuotaBytes))
+	}
+
+	text += fmt.Sprintf(", %d files", usage.Files)
+	if usage.MaxFiles > 0 {
+		text += fmt.Sprintf(" of %d", usage.MaxFiles)
+	}
+
+	return text
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	s4 "github.com/maddsua/syncctl/storage_service"
+)
+
+type outputFormat string
+
+const (
+	outputText = outputFormat("text")
+	outputJSON = outputFormat("json")
+)
+
+// File actions that only show up outside of plans. Plan actions are reported under their own names
+const (
+	fileDeleteLocal  = "delete-local"
+	fileDeleteRemote = "delete-remote"
+	fileRestore      = "restore"
+	filePurge        = "purge"
+	fileMove         = "move"
+)
+
+// Ways of resolving a sync conflict
+const (
+	conflictSkip       = "skip"
+	conflictKeepLocal  = "keep-local"
+	conflictKeepRemote = "keep-remote"
+	conflictKeepBoth   = "keep-both"
+)
+
+type fileEvent struct {
+	Event   string `json:"event"`
+	Action  string `json:"action"`
+	Path    string `json:"path"`
+	Source  string `json:"source,omitempty"`
+	Size    int64  `json:"size"`
+	Version int    `json:"version,omitempty"`
+	ID      string `json:"id,omitempty"`
+	Dry     bool   `json:"dry,omitempty"`
+}
+
+type conflictEvent struct {
+	Event      string `json:"event"`
+	Path       string `json:"path"`
+	Resolution string `json:"resolution"`
+}
+
+type errorEvent struct {
+	Event     string `json:"event"`
+	Operation string `json:"operation,omitempty"`
+	Path      string `json:"path,omitempty"`
+	Message   string `json:"message"`
+}
+
+// Directories only show up in non-recursive listings, with the combined size of what's inside of them
+type listEntryEvent struct {
+	Event string `json:"event"`
+	s4.FileMetadata
+	Dir bool `json:"dir,omitempty"`
+}
+
+type trashEvent struct {
+	Event string `json:"event"`
+	s4.TrashEntry
+}
+
+type versionEvent struct {
+	Event string `json:"event"`
+	s4.FileVersion
+}
+
+type remoteEvent struct {
+	Event string `json:"event"`
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	URL   string `json:"url"`
+}
+
+type remoteStatusEvent struct {
+	Event      string           `json:"event"`
+	Name       string           `json:"name"`
+	Type       string           `json:"type"`
+	URL        string           `json:"url"`
+	Auth       string           `json:"auth,omitempty"`
+	User       string           `json:"user,omitempty"`
+	Format     string           `json:"format,omitempty"`
+	Ready      bool             `json:"ready"`
+	Error      string           `json:"error,omitempty"`
+	Usage      *s4.StorageUsage `json:"usage,omitempty"`
+	UsageError string           `json:"usage_error,omitempty"`
+}
+
+type tokenEvent struct {
+	Event   string    `json:"event"`
+	ID      string    `json:"id"`
+	Remote  string    `json:"remote"`
+	Expires time.Time `json:"expires,omitzero"`
+}
+
+type versionInfoEvent struct {
+	Event   string `json:"event"`
+	Version string `json:"version"`
+	Go      string `json:"go"`
+	OS      string `json:"os"`
+	Arch    string `json:"arch"`
+}
+
+type summaryEvent struct {
+	Event      string         `json:"event"`
+	Command    string         `json:"command"`
+	OK         bool           `json:"ok"`
+	Dry        bool           `json:"dry"`
+	Files      int            `json:"files"`
+	Actions    map[string]int `json:"actions"`
+	Conflicts  int            `json:"conflicts"`
+	Errors     int            `json:"errors"`
+	Bytes      int64          `json:"bytes"`
+	DurationMs int64          `json:"duration_ms"`
+	Error      string         `json:"error,omitempty"`
+}
+
+// Everything the commands have to say goes through here. In text mode it's the usual prose,
+// in json mode every event is a separate line, and the progress chatter is left out altogether.
+// It's shared by the transfer workers, which is why it keeps their lines from being mixed together
+type outputWriter struct {
+	mtx     sync.Mutex
+	format  outputFormat
+	summary *summaryEvent
+	started time.Time
+}
+
+var output = outputWriter{format: outputText}
+
+func (out *outputWriter) JSON() bool {
+	return out.format == outputJSON
+}
+
+func (out *outputWriter) writeJSON(event any) {
+	data, _ := json.Marshal(event)
+	os.Stdout.Write(append(data, '\n'))
+}
+
+// Starts counting things up for the final summary. Only the first call counts,
+// so that commands running other commands end up with a single summary
+func (out *outputWriter) Begin(command string, dry bool) {
+
+	out.mtx.Lock()
+	defer out.mtx.Unlock()
+
+	if out.summary != nil {
+		return
+	}
+
+	out.started = time.Now()
+	out.summary = &summaryEvent{
+		Event:   "summary",
+		Command: command,
+		Dry:     dry,
+		Actions: map[string]int{},
+	}
+}
+
+// Progress messages that only make sense to a human
+func (out *outputWriter) Status(format string, args ...any) {
+
+	if out.JSON() {
+		return
+	}
+
+	out.mtx.Lock()
+	defer out.mtx.Unlock()
+
+	fmt.Printf(format+"\n", args...)
+}
+
+// Reports a file action. The action itself is run by fn, unless it's nil, which is the case with dry runs.
+// Text goes out before anything is done, so that it's clear what's taking so long,
+// while events only go out once the action has succeeded
+func (out *outputWriter) File(event fileEvent, text string, fn func() error) error {
+
+	out.fileStarted(text)
+
+	if fn != nil {
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+
+	out.fileDone(event, fn == nil)
+
+	return nil
+}
+
+// Same as File, but for streams, which only have a size once they've been read to the end
+func (out *outputWriter) Stream(event fileEvent, text string, fn func() (int64, error)) error {
+
+	out.fileStarted(text)
+
+	size, err := fn()
+	if err != nil {
+		return err
+	}
+
+	event.Size = size
+	out.fileDone(event, false)
+
+	return nil
+}
+
+func (out *outputWriter) fileStarted(text string) {
+
+	if out.JSON() {
+		return
+	}
+
+	out.mtx.Lock()
+	defer out.mtx.Unlock()
+
+	fmt.Println(text)
+}
+
+func (out *outputWriter) fileDone(event fileEvent, dry bool) {
+
+	out.mtx.Lock()
+	defer out.mtx.Unlock()
+
+	event.Event = "file"
+	event.Dry = dry
+
+	if out.summary != nil {
+
+		out.summary.Files++
+		out.summary.Actions[event.Action]++
+
+		switch event.Action {
+		case string(planUpload), string(planDownload), string(planUpdate), string(planVersionCopy):
+			if !event.Dry {
+				out.summary.Bytes += event.Size
+			}
+		}
+	}
+
+	if out.JSON() {
+		out.writeJSON(event)
+	}
+}
+
+// Reports a file action that has been done already
+func (out *outputWriter) Done(event fileEvent, text string) {
+	_ = out.File(event, text, func() error { return nil })
+}
+
+func (out *outputWriter) Conflict(name, resolution, text string) {
+
+	out.mtx.Lock()
+	defer out.mtx.Unlock()
+
+	if out.summary != nil {
+		out.summary.Conflicts++
+	}
+
+	if !out.JSON() {
+		fmt.Println(text)
+		return
+	}
+
+	out.writeJSON(conflictEvent{
+		Event:      "conflict",
+		Path:       name,
+		Resolution: resolution,
+	})
+}
+
+func (out *outputWriter) Error(operation string, name string, err error) {
+
+	out.mtx.Lock()
+	defer out.mtx.Unlock()
+
+	if out.summary != nil {
+		out.summary.Errors++
+	}
+
+	if !out.JSON() {
+		fmt.Fprintf(os.Stderr, "--X Error %s '%s':\n", operation, name)
+		fmt.Fprintf(os.Stderr, "    %v\n", err)
+		return
+	}
+
+	out.writeJSON(errorEvent{
+		Event:     "error",
+		Operation: operation,
+		Path:      name,
+		Message:   err.Error(),
+	})
+}
+
+// Anything that doesn't fit in with the rest, like listings and statuses
+func (out *outputWriter) Object(event any, text func()) {
+
+	out.mtx.Lock()
+	defer out.mtx.Unlock()
+
+	if out.JSON() {
+		out.writeJSON(event)
+	} else {
+		text()
+	}
+}
+
+// Wraps things up once the command is done, with err being whatever it has returned
+func (out *outputWriter) Finish(err error) {
+
+	out.mtx.Lock()
+	defer out.mtx.Unlock()
+
+	if !out.JSON() {
+		if err != nil {
+			fmt.Println(err.Error())
+		}
+		return
+	}
+
+	if err != nil {
+		out.writeJSON(errorEvent{
+			Event:   "error",
+			Message: err.Error(),
+		})
+	}
+
+	if out.summary == nil {
+		return
+	}
+
+	out.summary.OK = err == nil
+	out.summary.DurationMs = time.Since(out.started).Milliseconds()
+
+	if err != nil {
+		out.summary.Error = err.Error()
+	}
+
+	out.writeJSON(out.summary)
+}
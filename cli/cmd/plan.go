@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/maddsua/syncctl"
+	cliutils "github.com/maddsua/syncctl/cli/cli_utils"
+	s4 "github.com/maddsua/syncctl/storage_service"
+	"github.com/maddsua/syncctl/utils"
+)
+
+type planDirection string
+
+const (
+	planPush = planDirection("push")
+	planPull = planDirection("pull")
+)
+
+type planActionType string
+
+const (
+	planUpload      = planActionType("upload")
+	planDownload    = planActionType("download")
+	planUpdate      = planActionType("update")
+	planVersionCopy = planActionType("version-copy")
+	planSkip        = planActionType("skip")
+	planPrune       = planActionType("prune")
+)
+
+// A single thing to be done about a file. Source and target are local or remote paths,
+// depending on which way the plan goes. The hashes are what the files are expected to be
+// when the plan gets applied; an empty target hash means that there shouldn't be anything there yet
+type planAction struct {
+	Type         planActionType `json:"type"`
+	Source       string         `json:"source,omitempty"`
+	Target       string         `json:"target"`
+	Version      int            `json:"version,omitempty"`
+	Size         int64          `json:"size,omitempty"`
+	Modified     time.Time      `json:"modified,omitzero"`
+	SHA256       string         `json:"sha256,omitempty"`
+	TargetSHA256 string         `json:"target_sha256,omitempty"`
+}
+
+func (action *planAction) equal(other *planAction) bool {
+	return action.Type == other.Type &&
+		action.Source == other.Source &&
+		action.Target == other.Target &&
+		action.Version == other.Version &&
+		action.Size == other.Size &&
+		action.Modified.Equal(other.Modified) &&
+		action.SHA256 == other.SHA256 &&
+		action.TargetSHA256 == other.TargetSHA256
+}
+
+func (action *planAction) event() fileEvent {
+	return fileEvent{
+		Action:  string(action.Type),
+		Path:    action.Target,
+		Source:  action.Source,
+		Size:    action.Size,
+		Version: action.Version,
+	}
+}
+
+func (action *planAction) String() string {
+	switch action.Type {
+	case planUpload:
+		return fmt.Sprintf("--> Uploading '%s' (%s)", action.Target, utils.DataSizeString(float64(action.Size)))
+	case planDownload:
+		return fmt.Sprintf("--> Downloading '%s' (%s)", action.Target, utils.DataSizeString(float64(action.Size)))
+	case planUpdate:
+		return fmt.Sprintf("--> Updating '%s' (%s)", action.Target, utils.DataSizeString(float64(action.Size)))
+	case planVersionCopy:
+		return fmt.Sprintf("--> Adding version %d as '%s'", action.Version, action.Target)
+	case planSkip:
+		return fmt.Sprintf("--> Skip existing '%s' (diff)", action.Target)
+	case planPrune:
+		return fmt.Sprintf("--> Prune %s", action.Target)
+	default:
+		return fmt.Sprintf("--> Unknown action '%s' on '%s'", action.Type, action.Target)
+	}
+}
+
+// Everything push or pull is going to do, along with the options it's been made with,
+// so that it could be made again to check whether it still holds
+type transferPlan struct {
+	Direction planDirection         `json:"direction"`
+	Remote    string                `json:"remote"`
+	RemoteDir string                `json:"remote_dir"`
+	LocalDir  string                `json:"local_dir"`
+	Conflict  syncctl.ResolvePolicy `json:"conflict"`
+	Prune     bool                  `json:"prune"`
+	Exclude   []string              `json:"exclude,omitempty"`
+	Include   []string              `json:"include,omitempty"`
+	Created   time.Time             `json:"created"`
+	Actions   []planAction          `json:"actions"`
+}
+
+func (plan *transferPlan) name() string {
+	if plan.Direction == planPull {
+		return "Pull"
+	}
+	return "Push"
+}
+
+func (plan *transferPlan) Build(ctx context.Context, client s4.StorageClient, hashes *cliutils.HashCache, ignore *utils.IgnoreRules, jobs int) error {
+
+	var actions []planAction
+	var err error
+
+	//	remote names always start with a slash, and the paths relative to the directory only work out if it does too
+	plan.RemoteDir = path.Clean("/" + plan.RemoteDir)
+
+	switch plan.Direction {
+	case planPush:
+		actions, err = planPushActions(ctx, client, hashes, plan.LocalDir, plan.RemoteDir, ignore, plan.Conflict, plan.Prune, jobs)
+	case planPull:
+		actions, err = planPullActions(ctx, client, hashes, plan.RemoteDir, plan.LocalDir, ignore, plan.Conflict, plan.Prune, jobs)
+	default:
+		return fmt.Errorf("unknown plan direction '%s'", plan.Direction)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	//	prunes go last, so that nothing gets deleted if the transfers fail
+	slices.SortFunc(actions, func(a, b planAction) int {
+		if (a.Type == planPrune) != (b.Type == planPrune) {
+			if a.Type == planPrune {
+				return 1
+			}
+			return -1
+		}
+		return strings.Compare(a.Target, b.Target)
+	})
+
+	plan.Created = time.Now()
+	plan.Actions = actions
+
+	return nil
+}
+
+// Compares against a freshly made plan, returning the targets that would be handled differently now
+func (plan *transferPlan) Changed(current *transferPlan) []string {
+
+	saved := map[string]*planAction{}
+	for idx := range plan.Actions {
+		saved[plan.Actions[idx].Target] = &plan.Actions[idx]
+	}
+
+	var changed []string
+
+	for idx := range current.Actions {
+
+		action := &current.Actions[idx]
+
+		if prev, has := saved[action.Target]; !has || !prev.equal(action) {
+			changed = append(changed, action.Target)
+		}
+
+		delete(saved, action.Target)
+	}
+
+	for target := range saved {
+		changed = append(changed, target)
+	}
+
+	slices.Sort(changed)
+
+	return changed
+}
+
+// Executes the plan. Transfers run in parallel, prunes run one by one once all of them are done
+func (plan *transferPlan) Apply(ctx context.Context, client s4.StorageClient, hashes *cliutils.HashCache, jobs int) error {
+
+	var transfers, prunes []*planAction
+
+	for idx := range plan.Actions {
+		switch action := &plan.Actions[idx]; action.Type {
+		case planPrune:
+			prunes = append(prunes, action)
+		case planSkip:
+			output.Done(action.event(), action.String())
+		default:
+			transfers = append(transfers, action)
+		}
+	}
+
+	if err := transferEach(ctx, jobs, transfers, func(ctx context.Context, action *planAction) error {
+
+		err := output.File(action.event(), action.String(), func() error {
+			if plan.Direction == planPush {
+				return applyPushAction(ctx, client, action)
+			}
+			return applyPullAction(ctx, client, hashes, action)
+		})
+
+		if err != nil && ctx.Err() == nil {
+			output.Error(string(plan.Direction)+"ing", action.Source, err)
+		}
+
+		return err
+	}); err != nil {
+		return fmt.Errorf("%s aborted", plan.name())
+	}
+
+	for _, action := range prunes {
+		if err := output.File(action.event(), action.String(), func() error {
+			if plan.Direction == planPush {
+				_, err := client.Delete(ctx, action.Target)
+				return err
+			}
+			return os.Remove(action.Target)
+		}); err != nil {
+			return fmt.Errorf("Unable to prune '%s': %v", action.Target, err)
+		}
+	}
+
+	return nil
+}
+
+func (plan *transferPlan) Print() {
+	for idx := range plan.Actions {
+		_ = output.File(plan.Actions[idx].event(), plan.Actions[idx].String(), nil)
+	}
+}
+
+func (plan *transferPlan) Save(name string) error {
+
+	file, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+
+	if err := encoder.Encode(plan); err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+func loadTransferPlan(name string) (*transferPlan, error) {
+
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	var plan transferPlan
+	if err := json.NewDecoder(file).Decode(&plan); err != nil {
+		return nil, err
+	}
+
+	if plan.Direction != planPush && plan.Direction != planPull {
+		return nil, fmt.Errorf("unknown plan direction '%s'", plan.Direction)
+	} else if plan.Remote == "" || plan.LocalDir == "" {
+		return nil, fmt.Errorf("plan doesn't say where the files go")
+	}
+
+	return &plan, nil
+}
+
+// Plans a push or a pull, and then either executes it right away, prints it out or saves it for later
+func transfer_cmd(ctx context.Context, client s4.StorageClient, plan *transferPlan, ignore *utils.IgnoreRules, dry bool, planFile string, jobs int, rehash bool) error {
+
+	if plan.Conflict == syncctl.ResolveAsCopy {
+		plan.Prune = false
+	}
+
+	output.Begin(string(plan.Direction), dry || planFile != "")
+
+	hashes, err := cliutils.OpenHashCache(plan.LocalDir, rehash)
+	if err != nil {
+		return fmt.Errorf("Unable to open hash cache: %v", err)
+	}
+
+	defer func() {
+		if err := hashes.Save(); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to save hash cache: %v\n", err)
+		}
+	}()
+
+	if err := plan.Build(ctx, client, hashes, ignore, jobs); err != nil {
+		return err
+	}
+
+	if planFile != "" {
+
+		plan.Print()
+
+		if err := plan.Save(planFile); err != nil {
+			return fmt.Errorf("Unable to save plan: %v", err)
+		}
+
+		output.Status("Plan saved to '%s' (%d actions)", planFile, len(plan.Actions))
+		return nil
+	}
+
+	if dry {
+		plan.Print()
+		output.Status("Dry run (%s) complete", plan.Direction)
+		return nil
+	}
+
+	if err := plan.Apply(ctx, client, hashes, jobs); err != nil {
+		return err
+	}
+
+	output.Status("%s complete", plan.name())
+
+	return nil
+}
+
+// Executes a saved plan, but only when making it again gives the same result,
+// meaning that nothing has changed on either side since it was made
+func apply_cmd(ctx context.Context, client s4.StorageClient, plan *transferPlan, jobs int, rehash bool) error {
+
+	output.Begin("apply", false)
+
+	ignore, err := ignoreRulesFromPatterns(plan.Exclude, plan.Include)
+	if err != nil {
+		return fmt.Errorf("Invalid plan: %v", err)
+	}
+
+	hashes, err := cliutils.OpenHashCache(plan.LocalDir, rehash)
+	if err != nil {
+		return fmt.Errorf("Unable to open hash cache: %v", err)
+	}
+
+	defer func() {
+		if err := hashes.Save(); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to save hash cache: %v\n", err)
+		}
+	}()
+
+	current := *plan
+	if err := current.Build(ctx, client, hashes, ignore, jobs); err != nil {
+		return err
+	}
+
+	if changed := plan.Changed(&current); len(changed) > 0 {
+
+		for _, name := range changed {
+			output.Error("applying", name, fmt.Errorf("changed since the plan was made"))
+		}
+
+		return fmt.Errorf("Plan is out of date: there were changes to %d files since %s. Make a new one",
+			len(changed), plan.Created.Local().Format(time.DateTime))
+	}
+
+	if err := plan.Apply(ctx, client, hashes, jobs); err != nil {
+		return err
+	}
+
+	output.Status("%s complete", plan.name())
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPlanChanged(t *testing.T) {
+
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	upload := planAction{Type: planUpload, Source: "/local/a", Target: "/remote/a", Size: 10, Modified: modified, SHA256: "aa"}
+	update := planAction{Type: planUpdate, Source: "/local/b", Target: "/remote/b", Size: 20, Modified: modified, SHA256: "bb", TargetSHA256: "b0"}
+	prune := planAction{Type: planPrune, Target: "/remote/c", SHA256: "cc"}
+
+	var with = func(action planAction, change func(action *planAction)) planAction {
+		change(&action)
+		return action
+	}
+
+	tests := []struct {
+		name    string
+		saved   []planAction
+		current []planAction
+		want    []string
+	}{
+		{
+			name:    "same",
+			saved:   []planAction{upload, update, prune},
+			current: []planAction{prune, upload, update},
+		},
+		{
+			name:    "both empty",
+			saved:   nil,
+			current: nil,
+		},
+		{
+			name:    "new action",
+			saved:   []planAction{upload},
+			current: []planAction{upload, prune},
+			want:    []string{"/remote/c"},
+		},
+		{
+			name:    "action gone",
+			saved:   []planAction{upload, prune},
+			current: []planAction{upload},
+			want:    []string{"/remote/c"},
+		},
+		{
+			name:    "content changed",
+			saved:   []planAction{upload, update},
+			current: []planAction{with(upload, func(a *planAction) { a.SHA256 = "a2" }), update},
+			want:    []string{"/remote/a"},
+		},
+		{
+			name:    "target changed underneath",
+			saved:   []planAction{update},
+			current: []planAction{with(update, func(a *planAction) { a.TargetSHA256 = "b1" })},
+			want:    []string{"/remote/b"},
+		},
+		{
+			name:    "type changed",
+			saved:   []planAction{upload},
+			current: []planAction{with(upload, func(a *planAction) { a.Type = planSkip })},
+			want:    []string{"/remote/a"},
+		},
+		{
+			name:    "same time in another zone",
+			saved:   []planAction{upload},
+			current: []planAction{with(upload, func(a *planAction) { a.Modified = modified.In(time.FixedZone("x", 3600)) })},
+		},
+		{
+			name:    "everything sorted",
+			saved:   []planAction{prune},
+			current: []planAction{update, upload},
+			want:    []string{"/remote/a", "/remote/b", "/remote/c"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			saved := transferPlan{Actions: tt.saved}
+			current := transferPlan{Actions: tt.current}
+
+			if got := saved.Changed(&current); !slices.Equal(got, tt.want) {
+				t.Errorf("Changed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
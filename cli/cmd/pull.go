@@ -9,167 +9,294 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/maddsua/syncctl"
+	cliutils "github.com/maddsua/syncctl/cli/cli_utils"
 	s4 "github.com/maddsua/syncctl/storage_service"
 	"github.com/maddsua/syncctl/utils"
 )
 
-func pull_cmd(ctx context.Context, client s4.StorageClient, remoteDir, localDir string, onconflict syncctl.ResolvePolicy, prune, dry bool) error {
+func planPullActions(ctx context.Context, client s4.StorageClient, hashes *cliutils.HashCache, remoteDir, localDir string, ignore *utils.IgnoreRules, onconflict syncctl.ResolvePolicy, prune bool, jobs int) ([]planAction, error) {
 
-	if onconflict == syncctl.ResolveAsCopy {
-		prune = false
+	output.Status("Indexing local files...")
+
+	//	local files have to be listed even when not pruning, since that's where the ignore files are
+	localFiles, rules, err := utils.ListFilesIgnoring(localDir, ignore)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list local files: %v", err)
 	}
 
 	pruneMap := map[string]struct{}{}
 
 	if prune {
-
-		fmt.Println("Indexing local files...")
-
-		entries, err := utils.ListRegilarFiles(localDir)
-		if err != nil {
-			return fmt.Errorf("Unable to list local files: %v", err)
-		}
-
-		for _, entry := range entries {
+		for _, entry := range localFiles {
 			pruneMap[path.Clean(entry)] = struct{}{}
 		}
 	}
 
-	fmt.Println("Fetching remote index...")
+	output.Status("Fetching remote index...")
 
 	remoteFiles, err := client.Find(ctx, remoteDir, nil, true, 0, 0)
 	if err != nil {
-		return fmt.Errorf("Unable to fetch remote index: %v", err)
+		return nil, fmt.Errorf("Unable to fetch remote index: %v", err)
 	} else if len(remoteFiles) == 0 {
-		fmt.Println("No files on the remote. Exiting.")
-		return nil
+		output.Status("No files on the remote")
+		return nil, nil
 	}
 
+	type pullTask struct {
+		localPath string
+		entry     *s4.FileMetadata
+	}
+
+	var tasks []pullTask
+
 	for _, entry := range remoteFiles {
 
+		if rules.Ignored(strings.TrimPrefix(path.Clean(entry.Name), path.Clean(remoteDir)), false) {
+			continue
+		}
+
 		localPath := path.Join(localDir, strings.TrimPrefix(path.Clean(entry.Name), path.Clean(remoteDir)))
 
-		if err := pullEntry(ctx, client, localPath, onconflict, &entry, dry); err != nil {
-			fmt.Printf("--X Error pulling '%s':\n", entry.Name)
-			fmt.Printf("    %v\n", err)
-			return fmt.Errorf("Pull aborted")
-		}
+		tasks = append(tasks, pullTask{
+			localPath: localPath,
+			entry:     &entry,
+		})
 
 		delete(pruneMap, localPath)
 	}
 
-	if prune {
-		for name := range pruneMap {
-			if !dry {
-				if err := os.Remove(name); err != nil {
-					return fmt.Errorf("Unable to prune '%s': %v", name, err)
-				}
+	var actions []planAction
+	var mtx sync.Mutex
+
+	if err := transferEach(ctx, jobs, tasks, func(ctx context.Context, task pullTask) error {
+
+		action, err := planPullEntry(hashes, task.localPath, onconflict, task.entry)
+		if err != nil {
+			if ctx.Err() == nil {
+				output.Error("pulling", task.entry.Name, err)
 			}
-			fmt.Println("--> Prune", name)
+			return err
 		}
+
+		if action != nil {
+			mtx.Lock()
+			actions = append(actions, *action)
+			mtx.Unlock()
+		}
+
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("Pull aborted")
 	}
 
-	if !dry {
-		fmt.Println("Pull complete")
-	} else {
-		fmt.Println("Dry run (pull) complete")
+	for name := range pruneMap {
+
+		stat, err := os.Stat(name)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to stat '%s': %v", name, err)
+		}
+
+		hash, err := hashes.FileHash(name)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to hash '%s': %v", name, err)
+		}
+
+		actions = append(actions, planAction{
+			Type:         planPrune,
+			Target:       name,
+			Size:         stat.Size(),
+			TargetSHA256: hash,
+		})
 	}
 
-	return nil
+	return actions, nil
 }
 
-func pullEntry(ctx context.Context, client s4.StorageClient, localPath string, onconflict syncctl.ResolvePolicy, entry *s4.FileMetadata, dry bool) error {
+// Figures out what has to be done to get a remote file into the local directory. Returns nil when it's already there
+func planPullEntry(hashes *cliutils.HashCache, localPath string, onconflict syncctl.ResolvePolicy, entry *s4.FileMetadata) (*planAction, error) {
+
+	action := planAction{
+		Type:     planDownload,
+		Source:   entry.Name,
+		Target:   localPath,
+		Size:     entry.Size,
+		Modified: entry.Modified,
+		SHA256:   entry.SHA256,
+	}
 
-	if stat, _ := os.Stat(localPath); stat != nil {
+	if stat, _ := os.Stat(localPath); stat == nil {
+		return &action, nil
+	}
 
-		hash, err := utils.NamedFileHashSha256(localPath)
+	hash, err := hashes.FileHash(localPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if hash == entry.SHA256 {
+		return nil, nil
+	}
+
+	action.TargetSHA256 = hash
+
+	switch onconflict {
+
+	case syncctl.ResolveSkip:
+		action.Type = planSkip
+
+	case syncctl.ResolveAsCopy:
+
+		entries, err := os.ReadDir(path.Dir(localPath))
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		if hash == entry.SHA256 {
-			//	debug: log
-			//	fmt.Printf("--> Up to date '%s'\n", localPath)
-			return nil
+		indexer := utils.NewFileVersionIndexer(localPath)
+		for _, entry := range entries {
+			indexer.Index(entry.Name())
 		}
 
-		switch onconflict {
+		version := indexer.Sum()
+		latest := utils.WithFileVersion(localPath, version)
 
-		case syncctl.ResolveSkip:
-			fmt.Printf("--> Skip existing '%s' (diff)\n", localPath)
-			return nil
+		if hash, err := hashes.FileHash(latest); err != nil {
+			return nil, fmt.Errorf("hash '%s': %v", latest, err)
+		} else if hash == entry.SHA256 {
+			return nil, nil
+		}
 
-		case syncctl.ResolveAsCopy:
+		action.Type = planVersionCopy
+		action.Version = version + 1
+		action.Target = utils.WithFileVersion(localPath, version+1)
+		action.TargetSHA256 = ""
 
-			entries, err := os.ReadDir(path.Dir(localPath))
-			if err != nil {
-				return err
-			}
+	default:
+		action.Type = planUpdate
+	}
 
-			indexer := utils.NewFileVersionIndexer(localPath)
-			for _, entry := range entries {
-				indexer.Index(entry.Name())
-			}
+	return &action, nil
+}
 
-			version := indexer.Sum()
-			latest := utils.WithFileVersion(localPath, version)
-
-			if hash, err := utils.NamedFileHashSha256(latest); err != nil {
-				return fmt.Errorf("hash '%s': %v", latest, err)
-			} else if hash != entry.SHA256 {
-				fmt.Printf("--> Adding version %d to '%s'\n", version+1, localPath)
-				localPath = utils.WithFileVersion(localPath, version+1)
-			} else {
-				fmt.Printf("--> Up to date '%s', version %d\n", localPath, version)
-				return nil
-			}
+func applyPullAction(ctx context.Context, client s4.StorageClient, hashes *cliutils.HashCache, action *planAction) error {
+	_, err := downloadFile(ctx, client, hashes, action.Target, &s4.FileMetadata{
+		Name:     action.Source,
+		Size:     action.Size,
+		Modified: action.Modified,
+		SHA256:   action.SHA256,
+	})
+	return err
+}
 
-		default:
-			fmt.Printf("--> Updating '%s' (%s)\n", localPath, utils.DataSizeString(float64(entry.Size)))
-		}
+// Downloads a remote file, only replacing the local one once the whole thing has been received
+func downloadFile(ctx context.Context, client s4.StorageClient, hashes *cliutils.HashCache, localPath string, entry *s4.FileMetadata) (os.FileInfo, error) {
 
-	} else {
-		fmt.Printf("--> Downloading '%s' (%s)\n", localPath, utils.DataSizeString(float64(entry.Size)))
+	if err := os.MkdirAll(path.Dir(localPath), os.ModePerm); err != nil {
+		return nil, err
 	}
 
-	if !dry {
+	partName := utils.PartialDownloadName(localPath, entry.SHA256)
 
-		blob, err := client.Download(ctx, entry.Name)
-		if err != nil {
-			return nil
-		}
+	modified, err := downloadPartial(ctx, client, entry, partName)
+	if err != nil {
+		return nil, err
+	}
 
-		localDirName, tempBaseName := path.Split(localPath)
-		if err := os.MkdirAll(localDirName, os.ModePerm); err != nil {
+	if err := os.Chtimes(partName, modified, modified); err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(partName, localPath); err != nil {
+		return nil, err
+	}
+
+	stat, err := os.Stat(localPath)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes.Store(localPath, stat, entry.SHA256)
+
+	return stat, nil
+}
+
+// Downloads a remote file into a partial file, continuing from wherever the previous attempt has stopped.
+// The partial file is only removed when its content turns out to be garbage,
+// otherwise it's left for the next run to pick up
+func downloadPartial(ctx context.Context, client s4.StorageClient, entry *s4.FileMetadata, partName string) (time.Time, error) {
+
+	file, err := os.OpenFile(partName, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+
+	offset, err := io.Copy(hasher, file)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var restart = func() error {
+		hasher.Reset()
+		offset = 0
+		if err := file.Truncate(0); err != nil {
 			return err
 		}
+		_, err := file.Seek(0, io.SeekStart)
+		return err
+	}
 
-		hasher := sha256.New()
+	if offset > entry.Size {
+		if err := restart(); err != nil {
+			return time.Time{}, err
+		}
+	}
 
-		//	todo: add a progress bar
+	modified := entry.Modified
+
+	if offset < entry.Size || entry.Size == 0 {
 
-		tmpFile, err := utils.WriteTempFile(localDirName, tempBaseName, io.TeeReader(blob.ReadCloser, hasher))
+		blob, err := client.Download(ctx, entry.Name, offset)
 		if err != nil {
-			return err
+			return time.Time{}, err
 		}
-		defer tmpFile.Cleanup()
+		defer blob.ReadCloser.Close()
 
-		if hash := hex.EncodeToString(hasher.Sum(nil)); hash != entry.SHA256 {
-			return fmt.Errorf("content hash mismatch: expected '%s', have '%s'", entry.SHA256, hash)
+		if blob.SHA256 != "" && blob.SHA256 != entry.SHA256 {
+			return time.Time{}, fmt.Errorf("remote file changed during the pull")
 		}
 
-		if err := os.Chtimes(tmpFile.Name, blob.Modified, blob.Modified); err != nil {
-			return err
+		//	server decided not to honor our range request
+		if blob.Offset != offset {
+			if err := restart(); err != nil {
+				return time.Time{}, err
+			}
 		}
 
-		if err := os.Rename(tmpFile.Name, localPath); err != nil {
-			return err
+		//	todo: add a progress bar
+
+		if _, err := io.Copy(file, io.TeeReader(blob.ReadCloser, hasher)); err != nil {
+			return time.Time{}, err
 		}
 
-		_ = tmpFile.Release()
+		if !blob.Modified.IsZero() {
+			modified = blob.Modified
+		}
+	}
+
+	if err := file.Close(); err != nil {
+		return time.Time{}, err
+	}
+
+	if hash := hex.EncodeToString(hasher.Sum(nil)); hash != entry.SHA256 {
+		_ = os.Remove(partName)
+		return time.Time{}, fmt.Errorf("content hash mismatch: expected '%s', have '%s'", entry.SHA256, hash)
 	}
 
-	return nil
+	return modified, nil
 }
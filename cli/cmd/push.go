@@ -5,161 +5,376 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/maddsua/syncctl"
+	cliutils "github.com/maddsua/syncctl/cli/cli_utils"
 	s4 "github.com/maddsua/syncctl/storage_service"
 	"github.com/maddsua/syncctl/utils"
 )
 
-func push_cmd(ctx context.Context, client s4.StorageClient, localDir, remoteDir string, onconflict syncctl.ResolvePolicy, prune, dry bool) error {
+func planPushActions(ctx context.Context, client s4.StorageClient, hashes *cliutils.HashCache, localDir, remoteDir string, ignore *utils.IgnoreRules, onconflict syncctl.ResolvePolicy, prune bool, jobs int) ([]planAction, error) {
 
-	if onconflict == syncctl.ResolveAsCopy {
-		prune = false
-	}
-
-	fmt.Println("Fetching remote index...")
+	output.Status("Fetching remote index...")
 
 	remoteIndex := map[string]*s4.FileMetadata{}
 
 	if entries, err := client.Find(ctx, remoteDir, nil, true, 0, 0); err != nil {
-		return fmt.Errorf("Unable to fetch remote index: %v", err)
+		return nil, fmt.Errorf("Unable to fetch remote index: %v", err)
 	} else if len(entries) > 0 {
 		for _, entry := range entries {
 			remoteIndex[entry.Name] = &entry
 		}
 	}
 
-	fmt.Println("Indexing local files...")
+	output.Status("Indexing local files...")
 
-	entries, err := utils.ListRegilarFiles(localDir)
+	entries, rules, err := utils.ListFilesIgnoring(localDir, ignore)
 	if err != nil {
-		return fmt.Errorf("Unable to list local files: %v", err)
+		return nil, fmt.Errorf("Unable to list local files: %v", err)
+	}
+
+	//	ignored remote files are left alone, since they aren't supposed to be pushed or pruned
+	for key := range remoteIndex {
+		if rules.Ignored(strings.TrimPrefix(key, path.Clean(remoteDir)), false) {
+			delete(remoteIndex, key)
+		}
+	}
+
+	type pushTask struct {
+		name        string
+		remotePath  string
+		remoteEntry *s4.FileMetadata
 	}
 
+	var tasks []pushTask
+
 	for _, name := range entries {
 
 		remotePath := path.Join(remoteDir, strings.TrimPrefix(path.Clean(name), path.Clean(localDir)))
 
-		if err := pushEntry(ctx, client, name, remotePath, remoteIndex[remotePath], onconflict, dry); err != nil {
-			fmt.Fprintf(os.Stderr, "--X Error pushing '%s':\n", name)
-			fmt.Fprintf(os.Stderr, "    %v\n", err)
-			return fmt.Errorf("Push aborted")
-		}
+		tasks = append(tasks, pushTask{
+			name:        name,
+			remotePath:  remotePath,
+			remoteEntry: remoteIndex[remotePath],
+		})
 
 		delete(remoteIndex, remotePath)
 	}
 
-	if prune {
-		for key := range remoteIndex {
-			if !dry {
-				if _, err := client.Delete(ctx, key); err != nil {
-					return fmt.Errorf("Unable to prune '%s': %v", key, err)
-				}
+	var actions []planAction
+	var mtx sync.Mutex
+
+	if err := transferEach(ctx, jobs, tasks, func(ctx context.Context, task pushTask) error {
+
+		action, err := planPushEntry(ctx, client, hashes, task.name, task.remotePath, task.remoteEntry, onconflict)
+		if err != nil {
+			if ctx.Err() == nil {
+				output.Error("pushing", task.name, err)
 			}
-			fmt.Println("--> Prune", key)
+			return err
+		}
+
+		if action != nil {
+			mtx.Lock()
+			actions = append(actions, *action)
+			mtx.Unlock()
 		}
+
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("Push aborted")
 	}
 
-	if !dry {
-		fmt.Println("Push complete")
-	} else {
-		fmt.Println("Dry run (push) complete")
+	if prune {
+		for key, entry := range remoteIndex {
+			actions = append(actions, planAction{
+				Type:         planPrune,
+				Target:       key,
+				Size:         entry.Size,
+				TargetSHA256: entry.SHA256,
+			})
+		}
 	}
 
-	return nil
+	return actions, nil
 }
 
-func pushEntry(ctx context.Context, client s4.StorageClient, name, remotePath string, remoteEntry *s4.FileMetadata, onconflict syncctl.ResolvePolicy, dry bool) error {
+// Figures out what has to be done to get a local file onto the remote. Returns nil when it's already there
+func planPushEntry(ctx context.Context, client s4.StorageClient, hashes *cliutils.HashCache, name, remotePath string, remoteEntry *s4.FileMetadata, onconflict syncctl.ResolvePolicy) (*planAction, error) {
 
 	stat, err := os.Stat(name)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	file, err := os.Open(name)
+	hash, err := hashes.FileHash(name)
+	if err != nil {
+		return nil, err
+	}
+
+	action := planAction{
+		Type:     planUpload,
+		Source:   name,
+		Target:   remotePath,
+		Size:     stat.Size(),
+		Modified: stat.ModTime(),
+		SHA256:   hash,
+	}
+
+	if remoteEntry == nil {
+		return &action, nil
+	}
+
+	if remoteEntry.SHA256 == hash {
+		return nil, nil
+	}
+
+	action.TargetSHA256 = remoteEntry.SHA256
+
+	switch onconflict {
+
+	case syncctl.ResolveSkip:
+		action.Type = planSkip
+
+	case syncctl.ResolveAsCopy:
+
+		version, err := latestRemoteVersion(ctx, client, remotePath)
+		if err != nil {
+			return nil, err
+		}
+
+		latest := utils.WithFileVersion(remotePath, version)
+
+		stat, err := client.Stat(ctx, latest)
+		if err != nil {
+			return nil, fmt.Errorf("remote stat '%s': %v", latest, err)
+		} else if stat.SHA256 == hash {
+			return nil, nil
+		}
+
+		action.Type = planVersionCopy
+		action.Version = version + 1
+		action.Target = utils.WithFileVersion(remotePath, version+1)
+		action.TargetSHA256 = ""
+
+	default:
+		action.Type = planUpdate
+	}
+
+	return &action, nil
+}
+
+// Finds the number of the latest copy that has been made of a remote file, which is zero when there are none
+func latestRemoteVersion(ctx context.Context, client s4.StorageClient, remotePath string) (int, error) {
+
+	prefix, basename := path.Split(remotePath)
+	baseExt := path.Ext(basename)
+	basePrefix := strings.TrimSuffix(basename, baseExt)
+
+	filter := regexp.MustCompile(
+		fmt.Sprintf("%s-\\d+%s",
+			regexp.QuoteMeta(basePrefix),
+			regexp.QuoteMeta(baseExt)))
+
+	entries, err := client.Find(ctx, prefix, filter, false, 0, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	indexer := utils.NewFileVersionIndexer(remotePath)
+	for _, entry := range entries {
+		indexer.Index(entry.Name)
+	}
+
+	return indexer.Sum(), nil
+}
+
+func applyPushAction(ctx context.Context, client s4.StorageClient, action *planAction) error {
+
+	file, err := os.Open(action.Source)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	hash, err := utils.FileHashSha256(file)
-	if err != nil {
+	//	todo: add a progress bar
+
+	_, err = uploadFile(ctx, client, &s4.FileUpload{
+		FileMetadata: s4.FileMetadata{
+			Name:     action.Target,
+			Size:     action.Size,
+			Modified: action.Modified,
+			SHA256:   action.SHA256,
+		},
+		Reader: file,
+	}, action.Type == planUpdate)
+
+	return err
+}
+
+// Pushes a single file right away, without bothering with a plan
+func pushEntry(ctx context.Context, client s4.StorageClient, hashes *cliutils.HashCache, name, remotePath string, remoteEntry *s4.FileMetadata, onconflict syncctl.ResolvePolicy) error {
+
+	action, err := planPushEntry(ctx, client, hashes, name, remotePath, remoteEntry, onconflict)
+	if err != nil || action == nil {
 		return err
 	}
 
-	if remoteEntry != nil {
+	return output.File(action.event(), action.String(), func() error {
+		if action.Type == planSkip {
+			return nil
+		}
+		return applyPushAction(ctx, client, action)
+	})
+}
+
+// Looks up a single remote file, returning nil when there's no such thing.
+// Stat won't do for that, since not every client can tell a missing file from any other error
+func findRemoteFile(ctx context.Context, client s4.StorageClient, name string) (*s4.FileMetadata, error) {
+
+	dir, basename := path.Split(name)
+
+	entries, err := client.Find(ctx, dir, regexp.MustCompile("^/"+regexp.QuoteMeta(basename)+"$"), false, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if entry.Name == name {
+			return &entry, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// Pushes a single local file. When the remote path is a directory, the file keeps its name
+func push_file_cmd(ctx context.Context, client s4.StorageClient, name, remotePath string, onconflict syncctl.ResolvePolicy, dry bool) error {
+
+	output.Begin("push", dry)
+
+	if remotePath == "" || strings.HasSuffix(remotePath, "/") {
+		remotePath = path.Join(remotePath, filepath.Base(name))
+	}
+
+	remotePath = path.Clean("/" + remotePath)
+
+	remoteEntry, err := findRemoteFile(ctx, client, remotePath)
+	if err != nil {
+		return fmt.Errorf("Unable to fetch remote index: %v", err)
+	}
+
+	//	the hash cache is per directory, and it's not worth it for a single file
+	action, err := planPushEntry(ctx, client, nil, name, remotePath, remoteEntry, onconflict)
+	if err != nil {
+		return fmt.Errorf("Unable to push '%s': %v", name, err)
+	} else if action == nil {
+		output.Status("'%s' is up to date", remotePath)
+		return nil
+	}
+
+	if dry {
+		_ = output.File(action.event(), action.String(), nil)
+		output.Status("Dry run (push) complete")
+		return nil
+	}
 
-		if remoteEntry.SHA256 == hash {
-			//	debug: log
-			//	fmt.Printf("--> Up to date '%s'\n", remotePath)
+	if err := output.File(action.event(), action.String(), func() error {
+		if action.Type == planSkip {
 			return nil
 		}
+		return applyPushAction(ctx, client, action)
+	}); err != nil {
+		return fmt.Errorf("Unable to push '%s': %v", name, err)
+	}
+
+	output.Status("Push complete")
+
+	return nil
+}
+
+// Uploads whatever comes through stdin. There's no telling what it is until it's all been read,
+// so conflicts are resolved by the name alone. Streams of unknown size (-1) are uploaded in chunks
+func push_stdin_cmd(ctx context.Context, client s4.StorageClient, remotePath string, size int64, onconflict syncctl.ResolvePolicy, dry bool) error {
+
+	output.Begin("push", dry)
 
+	if remotePath = path.Clean("/" + remotePath); remotePath == "/" {
+		return fmt.Errorf("Pushing from stdin needs a remote file name, like 'remote:dumps/db.sql'")
+	}
+
+	remoteEntry, err := findRemoteFile(ctx, client, remotePath)
+	if err != nil {
+		return fmt.Errorf("Unable to fetch remote index: %v", err)
+	}
+
+	action := planAction{
+		Type:   planUpload,
+		Source: "-",
+		Target: remotePath,
+		Size:   max(size, 0),
+	}
+
+	var overwrite bool
+
+	if remoteEntry != nil {
 		switch onconflict {
 
 		case syncctl.ResolveSkip:
-			fmt.Printf("--> Skip existing '%s' (diff)\n", remotePath)
+			action.Type = planSkip
+			output.Done(action.event(), fmt.Sprintf("--> Skip existing '%s'", remotePath))
 			return nil
 
 		case syncctl.ResolveAsCopy:
 
-			prefix, basename := path.Split(remotePath)
-			baseExt := path.Ext(basename)
-			basePrefix := strings.TrimSuffix(basename, baseExt)
-
-			filter := regexp.MustCompile(
-				fmt.Sprintf("%s-\\d+%s",
-					regexp.QuoteMeta(basePrefix),
-					regexp.QuoteMeta(baseExt)))
-
-			entries, err := client.Find(ctx, prefix, filter, false, 0, 0)
+			version, err := latestRemoteVersion(ctx, client, remotePath)
 			if err != nil {
-				return err
-			}
-
-			indexer := utils.NewFileVersionIndexer(remotePath)
-			for _, entry := range entries {
-				indexer.Index(entry.Name)
+				return fmt.Errorf("Unable to fetch remote index: %v", err)
 			}
 
-			version := indexer.Sum()
-			latest := utils.WithFileVersion(remotePath, version)
-
-			if stat, err := client.Stat(ctx, latest); err != nil {
-				return fmt.Errorf("remote stat '%s': %v", latest, err)
-			} else if stat.SHA256 != hash {
-				fmt.Printf("--> Adding version %d to '%s'\n", version+1, remotePath)
-				remotePath = utils.WithFileVersion(remotePath, version+1)
-			} else {
-				fmt.Printf("--> Up to date '%s', version %d\n", remotePath, version)
-				return nil
-			}
+			action.Type = planVersionCopy
+			action.Version = version + 1
+			action.Target = utils.WithFileVersion(remotePath, version+1)
 
 		default:
-			fmt.Printf("--> Updating '%s' (%s)\n", remotePath, utils.DataSizeString(float64(stat.Size())))
+			action.Type = planUpdate
+			overwrite = true
 		}
-
-	} else {
-		fmt.Printf("--> Uploading '%s' (%s)\n", remotePath, utils.DataSizeString(float64(stat.Size())))
 	}
 
-	if !dry {
+	text := fmt.Sprintf("--> Uploading stdin to '%s'", action.Target)
+
+	if dry {
+		_ = output.File(action.event(), text, nil)
+		output.Status("Dry run (push) complete")
+		return nil
+	}
 
-		//	todo: add a progress bar
+	if err := output.Stream(action.event(), text, func() (int64, error) {
 
-		if _, err := client.Put(ctx, &s4.FileUpload{
+		entry, err := uploadFile(ctx, client, &s4.FileUpload{
 			FileMetadata: s4.FileMetadata{
-				Name:     remotePath,
-				Size:     stat.Size(),
-				Modified: stat.ModTime(),
+				Name:     action.Target,
+				Size:     size,
+				Modified: time.Now(),
 			},
-			Reader: file,
-		}, onconflict == syncctl.ResolveOverwrite); err != nil {
-			return err
+			Reader: os.Stdin,
+		}, overwrite)
+		if err != nil {
+			return 0, err
 		}
+
+		return entry.Size, nil
+	}); err != nil {
+		return fmt.Errorf("Unable to push stdin to '%s': %v", action.Target, err)
 	}
 
+	output.Status("Push complete")
+
 	return nil
 }
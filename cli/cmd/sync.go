@@ -0,0 +1,498 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/maddsua/syncctl"
+	cliutils "github.com/maddsua/syncctl/cli/cli_utils"
+	s4 "github.com/maddsua/syncctl/storage_service"
+	"github.com/maddsua/syncctl/utils"
+)
+
+type syncAction int
+
+const (
+	syncUnchanged = syncAction(iota)
+	syncForget
+	syncUpload
+	syncDownload
+	syncDeleteLocal
+	syncDeleteRemote
+	syncConflict
+)
+
+type localFileState struct {
+	SHA256   string
+	Size     int64
+	Modified time.Time
+}
+
+// Everything that's known about a single path, relative to the synced directories
+type syncItem struct {
+	name   string
+	local  *localFileState
+	remote *s4.FileMetadata
+	base   *cliutils.SyncStateEntry
+}
+
+// Compares both sides against the last synced state to find out which one has actually changed
+func (item *syncItem) action() syncAction {
+
+	switch {
+
+	case item.local == nil && item.remote == nil:
+		return syncForget
+
+	case item.local != nil && item.remote != nil:
+
+		if item.local.SHA256 == item.remote.SHA256 {
+			return syncUnchanged
+		} else if item.base == nil {
+			return syncConflict
+		}
+
+		localChanged := item.local.SHA256 != item.base.SHA256
+		remoteChanged := item.remote.SHA256 != item.base.SHA256
+
+		if !localChanged {
+			return syncDownload
+		} else if !remoteChanged {
+			return syncUpload
+		}
+
+		return syncConflict
+
+	case item.local != nil:
+
+		if item.base == nil {
+			return syncUpload
+		} else if item.local.SHA256 == item.base.SHA256 {
+			return syncDeleteLocal
+		}
+
+		return syncConflict
+
+	default:
+
+		if item.base == nil {
+			return syncDownload
+		} else if item.remote.SHA256 == item.base.SHA256 {
+			return syncDeleteRemote
+		}
+
+		return syncConflict
+	}
+}
+
+func sync_cmd(ctx context.Context, client s4.StorageClient, remoteName, remoteDir, localDir string, ignore *utils.IgnoreRules, onconflict syncctl.ResolvePolicy, dry bool, jobs int, rehash bool) error {
+
+	output.Begin("sync", dry)
+
+	//	remote names always start with a slash, and so should the directory for them to be relative to it
+	remoteDir = path.Clean("/" + remoteDir)
+
+	state, err := cliutils.OpenSyncState(localDir, remoteName, remoteDir)
+	if err != nil {
+		return fmt.Errorf("Unable to open sync state: %v", err)
+	}
+
+	defer func() {
+		if dry {
+			return
+		}
+		if err := state.Save(); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to save sync state: %v\n", err)
+		}
+	}()
+
+	hashes, err := cliutils.OpenHashCache(localDir, rehash)
+	if err != nil {
+		return fmt.Errorf("Unable to open hash cache: %v", err)
+	}
+
+	defer func() {
+		if err := hashes.Save(); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to save hash cache: %v\n", err)
+		}
+	}()
+
+	items := map[string]*syncItem{}
+
+	var itemFor = func(name string) *syncItem {
+		if item, has := items[name]; has {
+			return item
+		}
+		item := &syncItem{name: name}
+		items[name] = item
+		return item
+	}
+
+	output.Status("Fetching remote index...")
+
+	remoteEntries, err := client.Find(ctx, remoteDir, nil, true, 0, 0)
+	if err != nil {
+		return fmt.Errorf("Unable to fetch remote index: %v", err)
+	}
+
+	output.Status("Indexing local files...")
+
+	rules := ignore.Clone()
+
+	if stat, err := os.Stat(localDir); err == nil && !stat.IsDir() {
+		return fmt.Errorf("Unable to sync: '%s' is not a directory", localDir)
+	} else if err == nil {
+
+		var localEntries []string
+
+		if localEntries, rules, err = utils.ListFilesIgnoring(localDir, ignore); err != nil {
+			return fmt.Errorf("Unable to list local files: %v", err)
+		}
+
+		for _, name := range localEntries {
+
+			stat, err := os.Stat(name)
+			if err != nil {
+				return fmt.Errorf("Unable to stat '%s': %v", name, err)
+			}
+
+			hash, err := hashes.FileHash(name)
+			if err != nil {
+				return fmt.Errorf("Unable to hash '%s': %v", name, err)
+			}
+
+			itemFor(syncRelativePath(name, localDir)).local = &localFileState{
+				SHA256:   hash,
+				Size:     stat.Size(),
+				Modified: stat.ModTime(),
+			}
+		}
+
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("Unable to stat '%s': %v", localDir, err)
+	} else if len(state.Names()) > 0 {
+		//	it's much more likely to be an unmounted drive or a typo than everything getting deleted on purpose,
+		//	and treating it as an empty directory would delete everything on the remote too
+		return fmt.Errorf("Unable to sync: '%s' doesn't exist, even though it has been synced before", localDir)
+	}
+
+	remoteNames := make([]string, 0, len(remoteEntries))
+
+	for _, entry := range remoteEntries {
+
+		remoteNames = append(remoteNames, syncRelativePath(entry.Name, remoteDir))
+
+		if name := syncRelativePath(entry.Name, remoteDir); !rules.Ignored(name, false) {
+			itemFor(name).remote = &entry
+		}
+	}
+
+	//	ignored paths are left out completely, along with whatever state they had
+	for _, name := range state.Names() {
+		if base, has := state.Get(name); has && !rules.Ignored(name, false) {
+			itemFor(name).base = &base
+		}
+	}
+
+	tasks := make([]*syncItem, 0, len(items))
+	for _, item := range items {
+		tasks = append(tasks, item)
+	}
+
+	slices.SortFunc(tasks, func(a, b *syncItem) int {
+		return strings.Compare(a.name, b.name)
+	})
+
+	task := syncTask{
+		client:      client,
+		hashes:      hashes,
+		state:       state,
+		localDir:    localDir,
+		remoteDir:   remoteDir,
+		remoteNames: remoteNames,
+		dry:         dry,
+	}
+
+	var conflicts atomic.Int64
+
+	if err := transferEach(ctx, jobs, tasks, func(ctx context.Context, item *syncItem) error {
+
+		skipped, err := task.sync(ctx, item, onconflict)
+		if err != nil && ctx.Err() == nil {
+			output.Error("syncing", item.name, err)
+		} else if skipped {
+			conflicts.Add(1)
+		}
+
+		return err
+	}); err != nil {
+		return fmt.Errorf("Sync aborted")
+	}
+
+	if count := conflicts.Load(); count > 0 {
+		output.Status("Skipped %d conflicting files", count)
+	}
+
+	if !dry {
+		output.Status("Sync complete")
+	} else {
+		output.Status("Dry run (sync) complete")
+	}
+
+	return nil
+}
+
+func syncRelativePath(name, dir string) string {
+	return path.Clean("/" + strings.TrimPrefix(path.Clean(name), path.Clean(dir)))
+}
+
+type syncTask struct {
+	client    s4.StorageClient
+	hashes    *cliutils.HashCache
+	state     *cliutils.SyncState
+	localDir  string
+	remoteDir string
+	//	every remote file, including the ignored ones, so that conflict copies wouldn't run into any of them
+	remoteNames []string
+	dry         bool
+}
+
+// Dry runs only get to report what they would've done
+func (task *syncTask) unlessDry(fn func() error) func() error {
+	if task.dry {
+		return nil
+	}
+	return fn
+}
+
+func (task *syncTask) localPath(name string) string {
+	return path.Join(task.localDir, name)
+}
+
+func (task *syncTask) remotePath(name string) string {
+	return path.Join(task.remoteDir, name)
+}
+
+// Brings a single path in sync. Returns true when it's a conflict that was left alone
+func (task *syncTask) sync(ctx context.Context, item *syncItem, onconflict syncctl.ResolvePolicy) (bool, error) {
+
+	switch item.action() {
+
+	case syncUnchanged:
+		if !task.dry {
+			task.state.Set(item.name, cliutils.SyncStateEntry{
+				SHA256:         item.local.SHA256,
+				LocalModified:  item.local.Modified,
+				RemoteModified: item.remote.Modified,
+			})
+		}
+		return false, nil
+
+	case syncForget:
+		if !task.dry {
+			task.state.Delete(item.name)
+		}
+		return false, nil
+
+	case syncUpload:
+		return false, task.upload(ctx, item.name, item.local, item.remote != nil)
+
+	case syncDownload:
+		return false, task.download(ctx, item.name, item.remote)
+
+	case syncDeleteLocal:
+		return false, task.deleteLocal(item.name)
+
+	case syncDeleteRemote:
+		return false, task.deleteRemote(ctx, item.name)
+	}
+
+	return task.resolveConflict(ctx, item, onconflict)
+}
+
+// Applies the conflict policy to a path that has been changed on both sides.
+// When a file was deleted on one side and edited on the other, the edit always wins,
+// since bringing the file back is the only way not to lose anything
+func (task *syncTask) resolveConflict(ctx context.Context, item *syncItem, onconflict syncctl.ResolvePolicy) (bool, error) {
+
+	if onconflict == syncctl.ResolveSkip {
+		output.Conflict(item.name, conflictSkip, fmt.Sprintf("--> Conflict '%s' (skipped)", item.name))
+		return true, nil
+	}
+
+	switch {
+
+	case item.remote == nil:
+		output.Conflict(item.name, conflictKeepLocal, fmt.Sprintf("--> Conflict '%s' (deleted remotely, changed locally)", item.name))
+		return false, task.upload(ctx, item.name, item.local, false)
+
+	case item.local == nil:
+		output.Conflict(item.name, conflictKeepRemote, fmt.Sprintf("--> Conflict '%s' (deleted locally, changed remotely)", item.name))
+		return false, task.download(ctx, item.name, item.remote)
+
+	case onconflict == syncctl.ResolveAsCopy:
+
+		copyName, err := task.localCopyName(item.name)
+		if err != nil {
+			return false, err
+		}
+
+		output.Conflict(item.name, conflictKeepBoth, fmt.Sprintf("--> Conflict '%s' (keeping local version as '%s')", item.name, copyName))
+
+		if !task.dry {
+			if err := os.Rename(task.localPath(item.name), task.localPath(copyName)); err != nil {
+				return false, err
+			}
+		}
+
+		if err := task.download(ctx, item.name, item.remote); err != nil {
+			return false, err
+		}
+
+		return false, task.upload(ctx, copyName, item.local, false)
+
+	case item.local.Modified.After(item.remote.Modified):
+		output.Conflict(item.name, conflictKeepLocal, fmt.Sprintf("--> Conflict '%s' (local version is newer)", item.name))
+		return false, task.upload(ctx, item.name, item.local, true)
+
+	default:
+		output.Conflict(item.name, conflictKeepRemote, fmt.Sprintf("--> Conflict '%s' (remote version is newer)", item.name))
+		return false, task.download(ctx, item.name, item.remote)
+	}
+}
+
+// Picks a name for a conflict copy that isn't taken on either side
+func (task *syncTask) localCopyName(name string) (string, error) {
+
+	localPath := task.localPath(name)
+
+	entries, err := os.ReadDir(path.Dir(localPath))
+	if err != nil {
+		return "", err
+	}
+
+	indexer := utils.NewFileVersionIndexer(localPath)
+	for _, entry := range entries {
+		indexer.Index(entry.Name())
+	}
+
+	for _, remoteName := range task.remoteNames {
+		if path.Dir(remoteName) == path.Dir(name) {
+			indexer.Index(remoteName)
+		}
+	}
+
+	return utils.WithFileVersion(name, indexer.Sum()+1), nil
+}
+
+func (task *syncTask) upload(ctx context.Context, name string, local *localFileState, overwrite bool) error {
+
+	remotePath := task.remotePath(name)
+
+	event := fileEvent{
+		Action: string(planUpload),
+		Path:   remotePath,
+		Source: task.localPath(name),
+		Size:   local.Size,
+	}
+
+	if overwrite {
+		event.Action = string(planUpdate)
+	}
+
+	return output.File(event, fmt.Sprintf("--> Uploading '%s' (%s)", remotePath, utils.DataSizeString(float64(local.Size))), task.unlessDry(func() error {
+
+		file, err := os.Open(task.localPath(name))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		result, err := uploadFile(ctx, task.client, &s4.FileUpload{
+			FileMetadata: s4.FileMetadata{
+				Name:     remotePath,
+				Size:     local.Size,
+				Modified: local.Modified,
+				SHA256:   local.SHA256,
+			},
+			Reader: file,
+		}, overwrite)
+		if err != nil {
+			return err
+		}
+
+		task.state.Set(name, cliutils.SyncStateEntry{
+			SHA256:         local.SHA256,
+			LocalModified:  local.Modified,
+			RemoteModified: result.Modified,
+		})
+
+		return nil
+	}))
+}
+
+func (task *syncTask) download(ctx context.Context, name string, remote *s4.FileMetadata) error {
+
+	localPath := task.localPath(name)
+
+	event := fileEvent{
+		Action: string(planDownload),
+		Path:   localPath,
+		Source: remote.Name,
+		Size:   remote.Size,
+	}
+
+	return output.File(event, fmt.Sprintf("--> Downloading '%s' (%s)", localPath, utils.DataSizeString(float64(remote.Size))), task.unlessDry(func() error {
+
+		stat, err := downloadFile(ctx, task.client, task.hashes, localPath, remote)
+		if err != nil {
+			return err
+		}
+
+		task.state.Set(name, cliutils.SyncStateEntry{
+			SHA256:         remote.SHA256,
+			LocalModified:  stat.ModTime(),
+			RemoteModified: remote.Modified,
+		})
+
+		return nil
+	}))
+}
+
+func (task *syncTask) deleteLocal(name string) error {
+
+	localPath := task.localPath(name)
+
+	return output.File(fileEvent{Action: fileDeleteLocal, Path: localPath}, fmt.Sprintf("--> Deleting local '%s'", localPath), task.unlessDry(func() error {
+
+		if err := os.Remove(localPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		task.state.Delete(name)
+
+		return nil
+	}))
+}
+
+func (task *syncTask) deleteRemote(ctx context.Context, name string) error {
+
+	remotePath := task.remotePath(name)
+
+	return output.File(fileEvent{Action: fileDeleteRemote, Path: remotePath}, fmt.Sprintf("--> Deleting remote '%s'", remotePath), task.unlessDry(func() error {
+
+		if _, err := task.client.Delete(ctx, remotePath); err != nil {
+			return err
+		}
+
+		task.state.Delete(name)
+
+		return nil
+	}))
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maddsua/syncctl"
+	cliutils "github.com/maddsua/syncctl/cli/cli_utils"
+	"github.com/maddsua/syncctl/cli/config"
+	"github.com/maddsua/syncctl/utils"
+)
+
+// Sets up a file remote in a temp dir. Sync state and hash caches live in the home dir, so that gets swapped out as well
+func newTestRemote(t *testing.T, format config.FileFormat) *cliutils.LocalClient {
+
+	t.Setenv("HOME", t.TempDir())
+
+	client, err := cliutils.NewLocalClient(context.Background(), &config.FileRemoteConfig{
+		Dir:    t.TempDir(),
+		Format: format,
+	})
+	if err != nil {
+		t.Fatalf("open remote: %v", err)
+	}
+
+	t.Cleanup(func() { _ = client.Close() })
+
+	return client
+}
+
+// Writes out the files, giving each of them a distinct modification time so that the hash cache can't mix them up
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+
+	for name, content := range files {
+
+		fullName := filepath.Join(dir, name)
+
+		if err := os.MkdirAll(filepath.Dir(fullName), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(fullName, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		modified := time.Now().Add(-time.Duration(len(content)) * time.Second)
+		if err := os.Chtimes(fullName, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readTestFiles(t *testing.T, dir string) map[string]string {
+
+	result := map[string]string{}
+
+	if err := filepath.WalkDir(dir, func(name string, entry fs.DirEntry, err error) error {
+
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+
+		relName, _ := filepath.Rel(dir, name)
+		result[filepath.ToSlash(relName)] = string(data)
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	return result
+}
+
+func readTestRemote(t *testing.T, client *cliutils.LocalClient, dir string) map[string]string {
+
+	entries, err := client.Find(context.Background(), dir, nil, true, 0, 0)
+	if err != nil {
+		t.Fatalf("find remote files: %v", err)
+	}
+
+	result := map[string]string{}
+
+	for _, entry := range entries {
+
+		file, err := client.Get(context.Background(), entry.Name)
+		if err != nil {
+			t.Fatalf("read remote file '%s': %v", entry.Name, err)
+		}
+
+		data, err := io.ReadAll(file)
+		_ = file.Close()
+		if err != nil {
+			t.Fatalf("read remote file '%s': %v", entry.Name, err)
+		}
+
+		result[strings.TrimPrefix(entry.Name, dir+"/")] = string(data)
+	}
+
+	return result
+}
+
+func expectFiles(t *testing.T, what string, got, want map[string]string) {
+	t.Helper()
+	if !maps.Equal(got, want) {
+		t.Errorf("%s:\n got %v\nwant %v", what, got, want)
+	}
+}
+
+func TestTransferRoundTrip(t *testing.T) {
+
+	for _, format := range []config.FileFormat{config.FileFormatPlain, config.FileFormatBlob} {
+		t.Run(string(format), func(t *testing.T) {
+
+			ctx := context.Background()
+			client := newTestRemote(t, format)
+
+			source, target := t.TempDir(), t.TempDir()
+
+			writeTestFiles(t, source, map[string]string{
+				"a.txt":              "alpha",
+				"sub/b.txt":          "bravo",
+				"sub/deep/c.txt":     "charlie",
+				"scratch.tmp":        "ignored",
+				utils.IgnoreFileName: "*.tmp\n",
+			})
+
+			var push = func(prune bool) {
+				if err := transfer_cmd(ctx, client, &transferPlan{
+					Direction: planPush,
+					RemoteDir: "backup",
+					LocalDir:  source,
+					Conflict:  syncctl.ResolveOverwrite,
+					Prune:     prune,
+				}, nil, false, "", 2, false); err != nil {
+					t.Fatalf("push: %v", err)
+				}
+			}
+
+			var pull = func(prune bool) {
+				if err := transfer_cmd(ctx, client, &transferPlan{
+					Direction: planPull,
+					RemoteDir: "/backup",
+					LocalDir:  target,
+					Conflict:  syncctl.ResolveOverwrite,
+					Prune:     prune,
+				}, nil, false, "", 2, false); err != nil {
+					t.Fatalf("pull: %v", err)
+				}
+			}
+
+			push(false)
+
+			want := map[string]string{
+				"a.txt":              "alpha",
+				"sub/b.txt":          "bravo",
+				"sub/deep/c.txt":     "charlie",
+				utils.IgnoreFileName: "*.tmp\n",
+			}
+
+			expectFiles(t, "remote after push", readTestRemote(t, client, "/backup"), want)
+
+			pull(false)
+			expectFiles(t, "local after pull", readTestFiles(t, target), want)
+
+			//	changes and deletions only make it across when pruning
+			writeTestFiles(t, source, map[string]string{"a.txt": "alpha, but longer"})
+			if err := os.Remove(filepath.Join(source, "sub/b.txt")); err != nil {
+				t.Fatal(err)
+			}
+
+			push(false)
+			want["a.txt"] = "alpha, but longer"
+			expectFiles(t, "remote after push without pruning", readTestRemote(t, client, "/backup"), want)
+
+			push(true)
+			delete(want, "sub/b.txt")
+			expectFiles(t, "remote after push with pruning", readTestRemote(t, client, "/backup"), want)
+
+			writeTestFiles(t, target, map[string]string{"extra.txt": "local only"})
+
+			pull(true)
+			expectFiles(t, "local after pull with pruning", readTestFiles(t, target), want)
+
+			//	nothing left to do once both sides are the same
+			plan := transferPlan{Direction: planPush, RemoteDir: "/backup", LocalDir: source, Conflict: syncctl.ResolveOverwrite, Prune: true}
+			if err := plan.Build(ctx, client, nil, nil, 2); err != nil {
+				t.Fatalf("build plan: %v", err)
+			}
+
+			for _, action := range plan.Actions {
+				if action.Type != planSkip {
+					t.Errorf("unexpected action after a full round trip: %s", action.String())
+				}
+			}
+		})
+	}
+}
+
+func TestSyncRoundTrip(t *testing.T) {
+
+	for _, format := range []config.FileFormat{config.FileFormatPlain, config.FileFormatBlob} {
+		t.Run(string(format), func(t *testing.T) {
+
+			ctx := context.Background()
+			client := newTestRemote(t, format)
+
+			laptop, desktop := t.TempDir(), t.TempDir()
+
+			var sync = func(dir string, onconflict syncctl.ResolvePolicy) {
+				t.Helper()
+				if err := sync_cmd(ctx, client, "test", "shared", dir, nil, onconflict, false, 2, false); err != nil {
+					t.Fatalf("sync '%s': %v", dir, err)
+				}
+			}
+
+			writeTestFiles(t, laptop, map[string]string{
+				"notes.txt":     "first notes",
+				"docs/plan.txt": "the plan",
+			})
+
+			sync(laptop, syncctl.ResolveSkip)
+			sync(desktop, syncctl.ResolveSkip)
+
+			want := map[string]string{
+				"notes.txt":     "first notes",
+				"docs/plan.txt": "the plan",
+			}
+
+			expectFiles(t, "remote after the first sync", readTestRemote(t, client, "/shared"), want)
+			expectFiles(t, "desktop after the first sync", readTestFiles(t, desktop), want)
+
+			//	one-sided edits, additions and deletions go both ways
+			writeTestFiles(t, desktop, map[string]string{
+				"notes.txt":    "notes from the desktop",
+				"new/file.txt": "brand new",
+			})
+
+			if err := os.Remove(filepath.Join(desktop, "docs/plan.txt")); err != nil {
+				t.Fatal(err)
+			}
+
+			sync(desktop, syncctl.ResolveSkip)
+			sync(laptop, syncctl.ResolveSkip)
+
+			want = map[string]string{
+				"notes.txt":    "notes from the desktop",
+				"new/file.txt": "brand new",
+			}
+
+			expectFiles(t, "remote after desktop changes", readTestRemote(t, client, "/shared"), want)
+			expectFiles(t, "laptop after desktop changes", readTestFiles(t, laptop), want)
+
+			//	both sides changing the same file is a conflict, which gets skipped or resolved with a copy
+			writeTestFiles(t, laptop, map[string]string{"notes.txt": "laptop edit"})
+			writeTestFiles(t, desktop, map[string]string{"notes.txt": "desktop edit!"})
+
+			sync(laptop, syncctl.ResolveSkip)
+
+			sync(desktop, syncctl.ResolveSkip)
+			if got := readTestFiles(t, desktop)["notes.txt"]; got != "desktop edit!" {
+				t.Errorf("skipped conflict changed the local file to %q", got)
+			}
+
+			sync(desktop, syncctl.ResolveAsCopy)
+			sync(laptop, syncctl.ResolveSkip)
+
+			want = map[string]string{
+				"notes.txt":    "laptop edit",
+				"notes-2.txt":  "desktop edit!",
+				"new/file.txt": "brand new",
+			}
+
+			expectFiles(t, "remote after resolving the conflict", readTestRemote(t, client, "/shared"), want)
+			expectFiles(t, "desktop after resolving the conflict", readTestFiles(t, desktop), want)
+			expectFiles(t, "laptop after resolving the conflict", readTestFiles(t, laptop), want)
+
+			//	a directory that went missing must not wipe out the remote
+			if err := os.RemoveAll(laptop); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := sync_cmd(ctx, client, "test", "shared", laptop, nil, syncctl.ResolveSkip, false, 2, false); err == nil {
+				t.Errorf("syncing a missing directory didn't fail")
+			}
+
+			expectFiles(t, "remote after syncing a missing directory", readTestRemote(t, client, "/shared"), want)
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+const defaultTransferJobs = 4
+
+// Runs fn for every item using up to 'jobs' workers at the same time.
+// The first error returned by fn cancels everything else that's still in flight,
+// and becomes the return value of the whole thing
+func transferEach[T any](ctx context.Context, jobs int, items []T, fn func(ctx context.Context, item T) error) error {
+
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	queue := make(chan T)
+
+	var wg sync.WaitGroup
+
+	for range min(jobs, len(items)) {
+
+		wg.Add(1)
+
+		go func() {
+
+			defer wg.Done()
+
+			for item := range queue {
+				if err := fn(ctx, item); err != nil {
+					cancel(err)
+					return
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, item := range items {
+		select {
+		case queue <- item:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+
+	close(queue)
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	s4 "github.com/maddsua/syncctl/storage_service"
+	"github.com/maddsua/syncctl/utils"
+)
+
+func trash_list_cmd(ctx context.Context, client s4.TrashClient, prefix string) error {
+
+	entries, err := client.ListTrash(ctx, prefix)
+	if err != nil {
+		return fmt.Errorf("Unable to list trash: %v", err)
+	}
+
+	if len(entries) == 0 {
+		output.Status("[Trash is empty]")
+		return nil
+	}
+
+	for _, entry := range entries {
+		output.Object(trashEvent{Event: "trash", TrashEntry: entry}, func() {
+			fmt.Printf("%s  %s  %8s  %s\n",
+				entry.ID,
+				entry.Deleted.Local().Format(time.DateTime),
+				utils.DataSizeString(float64(entry.Size)),
+				entry.Name)
+		})
+	}
+
+	return nil
+}
+
+func trash_restore_cmd(ctx context.Context, client s4.TrashClient, id string, overwrite bool) error {
+
+	output.Begin("trash-restore", false)
+
+	entry, err := client.RestoreTrash(ctx, id, overwrite)
+	if err != nil {
+		return fmt.Errorf("Unable to restore '%s': %v", id, err)
+	}
+
+	output.Done(fileEvent{Action: fileRestore, Path: entry.Name, Size: entry.Size, ID: id}, fmt.Sprintf("--> Restored '%s'", entry.Name))
+
+	return nil
+}
+
+func trash_empty_cmd(ctx context.Context, client s4.TrashClient, prefix string) error {
+
+	output.Begin("trash-empty", false)
+
+	entries, err := client.EmptyTrash(ctx, prefix)
+	for _, entry := range entries {
+		output.Done(fileEvent{Action: filePurge, Path: entry.Name, Size: entry.Size, ID: entry.ID}, fmt.Sprintf("--> Purged '%s' (%s)", entry.Name, entry.ID))
+	}
+
+	if err != nil {
+		return fmt.Errorf("Unable to empty trash: %v", err)
+	}
+
+	if len(entries) == 0 {
+		output.Status("[Trash is empty]")
+	}
+
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"time"
+
+	s4 "github.com/maddsua/syncctl/storage_service"
+)
+
+// files smaller than that aren't worth the extra round trips
+const chunkedUploadThreshold = 32 * 1024 * 1024
+const uploadChunkSize = 8 * 1024 * 1024
+const uploadChunkRetries = 5
+
+func uploadFile(ctx context.Context, client s4.StorageClient, entry *s4.FileUpload, overwrite bool) (*s4.FileMetadata, error) {
+
+	if resumable, ok := client.(s4.ResumableUploadClient); ok && (entry.Size < 0 || entry.Size >= chunkedUploadThreshold) {
+		return uploadChunked(ctx, resumable, entry, overwrite)
+	}
+
+	return client.Put(ctx, entry, overwrite)
+}
+
+// Uploads a file in chunks, resending whatever didn't make it when the connection drops.
+// Each chunk is buffered in memory, so the source reader doesn't have to be seekable
+func uploadChunked(ctx context.Context, client s4.ResumableUploadClient, entry *s4.FileUpload, overwrite bool) (*s4.FileMetadata, error) {
+
+	session, err := client.CreateUpload(ctx, &entry.FileMetadata, overwrite)
+	if err != nil {
+		return nil, fmt.Errorf("create upload session: %v", err)
+	}
+
+	var done bool
+	defer func() {
+		if !done {
+			_ = client.CancelUpload(context.Background(), session.ID)
+		}
+	}()
+
+	hasher := sha256.New()
+	chunk := make([]byte, uploadChunkSize)
+
+	var offset int64
+
+	for {
+
+		n, err := io.ReadFull(entry.Reader, chunk)
+		if n > 0 {
+
+			hasher.Write(chunk[:n])
+
+			if err := writeUploadChunk(ctx, client, session.ID, offset, chunk[:n]); err != nil {
+				return nil, err
+			}
+
+			offset += int64(n)
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	if entry.SHA256 != "" && entry.SHA256 != hash {
+		return nil, fmt.Errorf("file changed during the upload")
+	}
+
+	result, err := client.FinalizeUpload(ctx, session.ID, hash)
+	if err != nil {
+		return nil, fmt.Errorf("finalize upload: %v", err)
+	}
+
+	done = true
+
+	return result, nil
+}
+
+func writeUploadChunk(ctx context.Context, client s4.ResumableUploadClient, id string, offset int64, chunk []byte) error {
+
+	var lastErr error
+
+	for attempt := range uploadChunkRetries {
+
+		if attempt > 0 {
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Duration(attempt) * time.Second):
+			}
+
+			//	check how much of the chunk has actually landed before sending it again
+			session, err := client.StatUpload(ctx, id)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+
+			committed := session.Offset - offset
+			if committed < 0 || committed > int64(len(chunk)) {
+				return fmt.Errorf("upload session offset mismatch: expected %d, have %d", offset, session.Offset)
+			}
+
+			chunk = chunk[committed:]
+			offset = session.Offset
+
+			if len(chunk) == 0 {
+				return nil
+			}
+		}
+
+		if _, err := client.WriteUpload(ctx, id, offset, chunk); err != nil {
+
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			lastErr = err
+			continue
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("write upload chunk: %v", lastErr)
+}
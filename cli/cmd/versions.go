@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	s4 "github.com/maddsua/syncctl/storage_service"
+	"github.com/maddsua/syncctl/utils"
+)
+
+func versions_list_cmd(ctx context.Context, client s4.VersionClient, name string) error {
+
+	versions, err := client.ListVersions(ctx, name)
+	if err != nil {
+		return fmt.Errorf("Unable to list versions: %v", err)
+	}
+
+	if len(versions) == 0 {
+		output.Status("[No previous versions]")
+		return nil
+	}
+
+	for _, version := range versions {
+		output.Object(versionEvent{Event: "file_version", FileVersion: version}, func() {
+			fmt.Printf("%s  %s  %8s  %s\n",
+				version.ID,
+				version.Archived.Local().Format(time.DateTime),
+				utils.DataSizeString(float64(version.Size)),
+				version.SHA256)
+		})
+	}
+
+	return nil
+}
+
+func versions_download_cmd(ctx context.Context, client s4.VersionClient, name, id, localPath string, overwrite bool) error {
+
+	output.Begin("versions-download", false)
+
+	if localPath == "" {
+		localPath = path.Base(name)
+	}
+
+	if _, err := os.Stat(localPath); err == nil && !overwrite {
+		return fmt.Errorf("Unable to download '%s': '%s' already exists", name, localPath)
+	}
+
+	blob, err := client.DownloadVersion(ctx, name, id, 0)
+	if err != nil {
+		return fmt.Errorf("Unable to download '%s': %v", name, err)
+	}
+	defer blob.ReadCloser.Close()
+
+	file, err := os.CreateTemp(path.Dir(localPath), "."+path.Base(localPath)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("Unable to create file: %v", err)
+	}
+
+	janitor := utils.FileJanitor{Name: file.Name()}
+	defer janitor.Cleanup()
+	defer file.Close()
+
+	hasher := sha256.New()
+
+	if _, err := io.Copy(file, io.TeeReader(blob.ReadCloser, hasher)); err != nil {
+		return fmt.Errorf("Unable to download '%s': %v", name, err)
+	}
+
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("Unable to write file: %v", err)
+	}
+
+	if hash := hex.EncodeToString(hasher.Sum(nil)); blob.SHA256 != "" && hash != blob.SHA256 {
+		return fmt.Errorf("Unable to download '%s': content hash mismatch: expected '%s', have '%s'", name, blob.SHA256, hash)
+	}
+
+	if !blob.Modified.IsZero() {
+		if err := os.Chtimes(file.Name(), blob.Modified, blob.Modified); err != nil {
+			return fmt.Errorf("Unable to set file times: %v", err)
+		}
+	}
+
+	if err := os.Rename(file.Name(), localPath); err != nil {
+		return fmt.Errorf("Unable to move file: %v", err)
+	}
+
+	janitor.Release()
+
+	output.Done(fileEvent{Action: string(planDownload), Path: localPath, Source: name, Size: blob.Size, ID: id},
+		fmt.Sprintf("--> Downloaded '%s' (%s) to '%s'", name, id, localPath))
+
+	return nil
+}
+
+func restore_cmd(ctx context.Context, client s4.VersionClient, name, id string) error {
+
+	output.Begin("restore", false)
+
+	entry, err := client.RestoreVersion(ctx, name, id)
+	if err != nil {
+		return fmt.Errorf("Unable to restore '%s': %v", name, err)
+	}
+
+	output.Done(fileEvent{Action: fileRestore, Path: entry.Name, Size: entry.Size, ID: id}, fmt.Sprintf("--> Restored '%s' to version %s", entry.Name, id))
+
+	return nil
+}
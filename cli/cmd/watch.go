@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maddsua/syncctl"
+	cliutils "github.com/maddsua/syncctl/cli/cli_utils"
+	s4 "github.com/maddsua/syncctl/storage_service"
+	"github.com/maddsua/syncctl/utils"
+)
+
+// How long things have to stay quiet before the changes get pushed
+const watchDebounce = 2 * time.Second
+
+// Files that never stop changing still get pushed every once in a while
+const watchMaxDelay = 30 * time.Second
+
+// Keeps pushing local changes as they happen. Everything gets pushed once at the start,
+// and after that it's only the files that have been touched. Losing the remote or missing
+// some of the events results in a full push once things are back to normal
+func push_watch_cmd(ctx context.Context, client s4.StorageClient, localDir, remoteDir string, ignore *utils.IgnoreRules, onconflict syncctl.ResolvePolicy, prune bool, jobs int, rehash bool) error {
+
+	output.Begin("watch", false)
+
+	remoteDir = path.Clean("/" + remoteDir)
+
+	if err := os.MkdirAll(localDir, os.ModePerm); err != nil {
+		return fmt.Errorf("Unable to create '%s': %v", localDir, err)
+	}
+
+	watcher, err := newFsWatcher(localDir)
+	if err != nil {
+		return fmt.Errorf("Unable to watch '%s': %v", localDir, err)
+	}
+	defer watcher.Close()
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var batch changeBatch
+
+	go func() {
+		if err := watcher.Run(ctx, batch.Add); err != nil {
+			cancel(err)
+		}
+	}()
+
+	resync := true
+
+	var rules *utils.IgnoreRules
+
+	for ctx.Err() == nil {
+
+		if resync {
+
+			if err := transfer_cmd(ctx, client, &transferPlan{
+				Direction: planPush,
+				RemoteDir: remoteDir,
+				LocalDir:  localDir,
+				Conflict:  onconflict,
+				Prune:     prune,
+			}, ignore, false, "", jobs, rehash); err != nil {
+				output.Error("pushing", localDir, err)
+				waitForRemote(ctx, client)
+				continue
+			}
+
+			//	picking up the rules from the ignore files, so that the changes could be checked against them
+			if _, rules, err = utils.ListFilesIgnoring(localDir, ignore); err != nil {
+				return fmt.Errorf("Unable to list local files: %v", err)
+			}
+
+			resync, rehash = false, false
+			output.Status("Watching '%s' for changes...", localDir)
+		}
+
+		names, rescan := batch.Wait(ctx)
+		if ctx.Err() != nil {
+			break
+		}
+
+		if rescan {
+			output.Status("Some changes might've been missed, pushing everything again")
+			resync = true
+			continue
+		}
+
+		if slices.ContainsFunc(names, func(name string) bool { return path.Base(name) == utils.IgnoreFileName }) {
+			output.Status("Ignore rules have changed, pushing everything again")
+			resync = true
+			continue
+		}
+
+		if err := pushChanges(ctx, client, localDir, remoteDir, rules, names, onconflict, prune, jobs); err != nil && ctx.Err() == nil {
+			output.Error("pushing", localDir, err)
+			waitForRemote(ctx, client)
+			resync = true
+		}
+	}
+
+	if err := context.Cause(ctx); err != nil && err != context.Canceled {
+		return fmt.Errorf("Watch stopped: %v", err)
+	}
+
+	return nil
+}
+
+// Pushes the changed files, and removes the deleted ones from the remote when pruning
+func pushChanges(ctx context.Context, client s4.StorageClient, localDir, remoteDir string, rules *utils.IgnoreRules, names []string, onconflict syncctl.ResolvePolicy, prune bool, jobs int) error {
+
+	hashes, err := cliutils.OpenHashCache(localDir, false)
+	if err != nil {
+		return fmt.Errorf("open hash cache: %v", err)
+	}
+
+	defer func() {
+		if err := hashes.Save(); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to save hash cache: %v\n", err)
+		}
+	}()
+
+	changed := map[string]string{}
+	var removed []string
+
+	var relativePathOf = func(name string) string {
+		return path.Clean("/" + strings.TrimPrefix(path.Clean(name), path.Clean(localDir)))
+	}
+
+	var remotePathOf = func(name string) string {
+		return path.Join(remoteDir, relativePathOf(name))
+	}
+
+	for _, name := range names {
+
+		stat, err := os.Stat(name)
+		if err != nil {
+			if os.IsNotExist(err) {
+				removed = append(removed, remotePathOf(name))
+				continue
+			}
+			return err
+		}
+
+		if rules.Ignored(relativePathOf(name), stat.IsDir()) {
+			continue
+		}
+
+		if stat.IsDir() {
+
+			entries, err := utils.ListRegilarFiles(name)
+			if err != nil {
+				return err
+			}
+
+			for _, entry := range entries {
+				if !rules.Ignored(relativePathOf(entry), false) {
+					changed[remotePathOf(entry)] = entry
+				}
+			}
+
+		} else if stat.Mode().IsRegular() && utils.NameListable(name) {
+			changed[remotePathOf(name)] = name
+		}
+	}
+
+	//	finding the remote entries by listing their directories, since that's
+	//	the only way to tell a missing file from an error without guessing
+	remoteDirs := map[string]map[string]*s4.FileMetadata{}
+
+	var remoteEntry = func(remotePath string) (*s4.FileMetadata, error) {
+
+		dir := path.Dir(remotePath)
+
+		entries, has := remoteDirs[dir]
+		if !has {
+
+			list, err := client.Find(ctx, dir, nil, false, 0, 0)
+			if err != nil {
+				return nil, err
+			}
+
+			entries = map[string]*s4.FileMetadata{}
+			for _, entry := range list {
+				entries[entry.Name] = &entry
+			}
+
+			remoteDirs[dir] = entries
+		}
+
+		return entries[remotePath], nil
+	}
+
+	type pushTask struct {
+		name        string
+		remotePath  string
+		remoteEntry *s4.FileMetadata
+	}
+
+	var tasks []pushTask
+
+	for remotePath, name := range changed {
+
+		entry, err := remoteEntry(remotePath)
+		if err != nil {
+			return err
+		}
+
+		tasks = append(tasks, pushTask{
+			name:        name,
+			remotePath:  remotePath,
+			remoteEntry: entry,
+		})
+	}
+
+	slices.SortFunc(tasks, func(a, b pushTask) int {
+		return strings.Compare(a.remotePath, b.remotePath)
+	})
+
+	if err := transferEach(ctx, jobs, tasks, func(ctx context.Context, task pushTask) error {
+
+		err := pushEntry(ctx, client, hashes, task.name, task.remotePath, task.remoteEntry, onconflict)
+		if err != nil && ctx.Err() == nil {
+			output.Error("pushing", task.name, err)
+		}
+
+		return err
+	}); err != nil {
+		return err
+	}
+
+	if !prune {
+		return nil
+	}
+
+	for _, remotePath := range removed {
+
+		if rules.Ignored(strings.TrimPrefix(remotePath, path.Clean(remoteDir)), false) {
+			continue
+		}
+
+		entry, err := remoteEntry(remotePath)
+		if err != nil {
+			return err
+		}
+
+		var pruned []string
+
+		if entry != nil {
+			pruned = append(pruned, entry.Name)
+		} else {
+
+			//	not a file, so it could be a whole directory that's gone
+			entries, err := client.Find(ctx, remotePath, nil, true, 0, 0)
+			if err != nil {
+				return err
+			}
+
+			for _, entry := range entries {
+				if !rules.Ignored(strings.TrimPrefix(entry.Name, path.Clean(remoteDir)), false) {
+					pruned = append(pruned, entry.Name)
+				}
+			}
+		}
+
+		for _, name := range pruned {
+			if err := output.File(fileEvent{Action: string(planPrune), Path: name}, "--> Prune "+name, func() error {
+				_, err := client.Delete(ctx, name)
+				return err
+			}); err != nil {
+				return fmt.Errorf("prune '%s': %v", name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func waitForRemote(ctx context.Context, client s4.StorageClient) {
+
+	output.Status("Waiting for the remote to come back...")
+
+	for delay := time.Second; ; delay = min(2*delay, time.Minute) {
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		if err := client.Ping(ctx); err == nil {
+			return
+		}
+	}
+}
+
+// Collects changed paths until they stop coming for a bit
+type changeBatch struct {
+	mtx    sync.Mutex
+	names  map[string]struct{}
+	rescan bool
+	notify chan struct{}
+	once   sync.Once
+}
+
+func (batch *changeBatch) init() {
+	batch.once.Do(func() {
+		batch.notify = make(chan struct{}, 1)
+	})
+}
+
+// Adds a changed path. An empty name means that the whole thing has to be looked through again
+func (batch *changeBatch) Add(name string) {
+
+	batch.init()
+
+	batch.mtx.Lock()
+
+	if name == "" {
+		batch.rescan = true
+	} else {
+		if batch.names == nil {
+			batch.names = map[string]struct{}{}
+		}
+		batch.names[name] = struct{}{}
+	}
+
+	batch.mtx.Unlock()
+
+	select {
+	case batch.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Waits for a batch of changes to settle down and returns it
+func (batch *changeBatch) Wait(ctx context.Context) ([]string, bool) {
+
+	batch.init()
+
+	select {
+	case <-batch.notify:
+	case <-ctx.Done():
+		return nil, false
+	}
+
+	deadline := time.NewTimer(watchMaxDelay)
+	defer deadline.Stop()
+
+	quiet := time.NewTimer(watchDebounce)
+	defer quiet.Stop()
+
+settle:
+	for {
+		select {
+		case <-batch.notify:
+			quiet.Reset(watchDebounce)
+		case <-quiet.C:
+			break settle
+		case <-deadline.C:
+			break settle
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+
+	batch.mtx.Lock()
+	defer batch.mtx.Unlock()
+
+	names := make([]string, 0, len(batch.names))
+	for name := range batch.names {
+		names = append(names, name)
+	}
+
+	rescan := batch.rescan
+	batch.names, batch.rescan = nil, false
+
+	return names, rescan
+}
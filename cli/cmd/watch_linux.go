@@ -0,0 +1,171 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	s4 "github.com/maddsua/syncctl/storage_service"
+)
+
+const watchMask = syscall.IN_CREATE |
+	syscall.IN_CLOSE_WRITE |
+	syscall.IN_MODIFY |
+	syscall.IN_MOVED_FROM |
+	syscall.IN_MOVED_TO |
+	syscall.IN_DELETE
+
+// Watches a directory tree using inotify. Every directory needs a watch of its own,
+// so new directories get picked up as they appear, and the ones that go away are forgotten
+type fsWatcher struct {
+	fd   int
+	file *os.File
+	dirs map[int]string
+}
+
+func newFsWatcher(root string) (*fsWatcher, error) {
+
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("inotify init: %v", err)
+	}
+
+	//	wrapping a non-blocking descriptor into a file puts it on the runtime poller,
+	//	which is what lets Close interrupt a pending read
+	watcher := fsWatcher{
+		fd:   fd,
+		file: os.NewFile(uintptr(fd), "inotify"),
+		dirs: map[int]string{},
+	}
+
+	if err := watcher.addTree(path.Clean(root), nil); err != nil {
+		_ = watcher.Close()
+		return nil, err
+	}
+
+	return &watcher, nil
+}
+
+func (watcher *fsWatcher) Close() error {
+	return watcher.file.Close()
+}
+
+// Adds watches for a directory and everything inside of it. The files that are already in there
+// are reported as well, since they could've been created before the watch was set up
+func (watcher *fsWatcher) addTree(dir string, found func(name string)) error {
+
+	wd, err := syscall.InotifyAddWatch(watcher.fd, dir, watchMask)
+	if err != nil {
+		if err == syscall.ENOENT {
+			return nil
+		}
+		return fmt.Errorf("watch '%s': %v", dir, err)
+	}
+
+	watcher.dirs[wd] = dir
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, entry := range entries {
+
+		name := path.Join(dir, entry.Name())
+
+		if entry.IsDir() {
+			if err := watcher.addTree(name, found); err != nil {
+				return err
+			}
+		} else if found != nil && entry.Type().IsRegular() {
+			found(name)
+		}
+	}
+
+	return nil
+}
+
+// Drops watches for a directory that was moved out, otherwise its events would be reported under the old path
+func (watcher *fsWatcher) removeTree(dir string) {
+	for wd, name := range watcher.dirs {
+		if s4.IsPathUnder(name, dir) {
+			_, _ = syscall.InotifyRmWatch(watcher.fd, uint32(wd))
+			delete(watcher.dirs, wd)
+		}
+	}
+}
+
+// Reads events until the context is done, reporting the paths that might have changed.
+// When the kernel event queue overflows some changes are lost for good, which is reported with an empty name
+func (watcher *fsWatcher) Run(ctx context.Context, onChange func(name string)) error {
+
+	go func() {
+		<-ctx.Done()
+		_ = watcher.Close()
+	}()
+
+	buff := make([]byte, 64*1024)
+
+	for {
+
+		n, err := watcher.file.Read(buff)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("read inotify events: %v", err)
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buff[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			offset = nameStart + int(event.Len)
+
+			name := strings.TrimRight(string(buff[nameStart:min(offset, n)]), "\x00")
+			watcher.handle(int(event.Wd), event.Mask, name, onChange)
+		}
+	}
+}
+
+func (watcher *fsWatcher) handle(wd int, mask uint32, name string, onChange func(name string)) {
+
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		onChange("")
+		return
+	}
+
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(watcher.dirs, wd)
+		return
+	}
+
+	dir, ok := watcher.dirs[wd]
+	if !ok || name == "" {
+		return
+	}
+
+	fullName := path.Join(dir, name)
+
+	if mask&syscall.IN_ISDIR != 0 {
+		if mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+			if err := watcher.addTree(fullName, onChange); err != nil {
+				//	can't really do anything about it other than looking through everything again
+				onChange("")
+			}
+		} else if mask&syscall.IN_MOVED_FROM != 0 {
+			watcher.removeTree(fullName)
+		}
+	}
+
+	onChange(fullName)
+}
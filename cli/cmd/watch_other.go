@@ -0,0 +1,23 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+type fsWatcher struct{}
+
+func newFsWatcher(root string) (*fsWatcher, error) {
+	return nil, fmt.Errorf("watch mode is only supported on linux")
+}
+
+func (watcher *fsWatcher) Close() error {
+	return nil
+}
+
+func (watcher *fsWatcher) Run(ctx context.Context, onChange func(name string)) error {
+	<-ctx.Done()
+	return nil
+}
@@ -0,0 +1,31 @@
+package config
+
+import "net/url"
+
+type FileFormat string
+
+const (
+	//	files are stored as they are, the same way they're laid out locally
+	FileFormatPlain = FileFormat("plain")
+	//	files are stored in the same blob format the server uses, which keeps the hashes and the timestamps
+	FileFormatBlob = FileFormat("blob")
+)
+
+type FileRemoteConfig struct {
+	Dir    string     `json:"dir"`
+	Format FileFormat `json:"format"`
+}
+
+func (cfg *FileRemoteConfig) URL() string {
+
+	remoteURL := url.URL{Scheme: "file", Path: cfg.Dir}
+	if cfg.Format != "" && cfg.Format != FileFormatPlain {
+		remoteURL.RawQuery = url.Values{"format": {string(cfg.Format)}}.Encode()
+	}
+
+	return remoteURL.String()
+}
+
+func (cfg *FileRemoteConfig) Type() RemoteType {
+	return RemoteTypeFile
+}
@@ -7,7 +7,8 @@ import (
 type RemoteType string
 
 const (
-	RemoteTypeS4 = RemoteType("s4")
+	RemoteTypeS4   = RemoteType("s4")
+	RemoteTypeFile = RemoteType("file")
 )
 
 type RemoteConfig interface {
@@ -56,6 +57,15 @@ func (wrapper *RemoteConfigWrapper) UnmarshalJSON(bytes []byte) error {
 			return err
 		}
 
+		wrapper.RemoteConfig = &config
+
+	case RemoteTypeFile:
+
+		var config FileRemoteConfig
+		if err := json.Unmarshal(state.Config, &config); err != nil {
+			return err
+		}
+
 		wrapper.RemoteConfig = &config
 	}
 
@@ -3,6 +3,8 @@ package config
 type S4RemoteConfig struct {
 	RemoteURL string       `json:"remote_url"`
 	Auth      *S4BasicAuth `json:"auth"`
+	//	api token, used instead of the basic auth when set
+	Token string `json:"token,omitempty"`
 }
 
 func (cfg *S4RemoteConfig) URL() string {
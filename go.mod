@@ -6,3 +6,9 @@ require (
 	github.com/urfave/cli/v3 v3.6.1
 	gopkg.in/yaml.v3 v3.0.1
 )
+
+require (
+	golang.org/x/crypto v0.45.0
+	golang.org/x/sys v0.38.0 // indirect
+	golang.org/x/term v0.37.0
+)
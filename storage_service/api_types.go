@@ -6,6 +6,9 @@ import (
 
 const UrlPrefixV1 = "/s4/v1/"
 
+// Where the WebDAV frontend lives, when it's enabled
+const UrlPrefixDAV = "/dav/"
+
 type SyncHandler interface {
 	http.Handler
 	Wait()
@@ -24,3 +27,11 @@ type APIError struct {
 func (err *APIError) Error() string {
 	return err.Message
 }
+
+// How much storage a user takes up. Limits are only set when the user has them configured
+type StorageUsage struct {
+	Bytes      int64 `json:"bytes"`
+	Files      int   `json:"files"`
+	QuotaBytes int64 `json:"quota_bytes,omitempty"`
+	MaxFiles   int   `json:"max_files,omitempty"`
+}
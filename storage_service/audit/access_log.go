@@ -0,0 +1,66 @@
+package audit
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/maddsua/syncctl/storage_service/metrics"
+)
+
+// Sets up the request actor, and logs every request once it's done unless the access log is disabled
+func Middleware(next http.Handler, accessLog bool) http.Handler {
+	return http.HandlerFunc(func(wrt http.ResponseWriter, req *http.Request) {
+
+		started := time.Now()
+
+		actor := Actor{
+			RequestID: requestID(req.Header.Get("X-Request-Id")),
+			Addr:      req.RemoteAddr,
+		}
+
+		wrt.Header().Set("X-Request-Id", actor.RequestID)
+
+		if !accessLog {
+			next.ServeHTTP(wrt, req.WithContext(WithActor(req.Context(), &actor)))
+			return
+		}
+
+		recorder := &metrics.StatusRecorder{ResponseWriter: wrt}
+		body := &countingReader{ReadCloser: req.Body}
+
+		req = req.WithContext(WithActor(req.Context(), &actor))
+		req.Body = body
+
+		next.ServeHTTP(recorder, req)
+
+		object := req.URL.Query().Get("name")
+		if object == "" {
+			object = req.URL.Query().Get("prefix")
+		}
+
+		slog.Info("Access",
+			slog.String("request_id", actor.RequestID),
+			slog.String("addr", actor.Addr),
+			slog.String("user", actor.User),
+			slog.String("method", req.Method),
+			slog.String("route", req.URL.Path),
+			slog.String("object", object),
+			slog.Int("status", recorder.Status()),
+			slog.Int64("bytes_in", body.read),
+			slog.Int64("bytes_out", recorder.Written),
+			slog.Duration("duration", time.Since(started)))
+	})
+}
+
+type countingReader struct {
+	io.ReadCloser
+	read int64
+}
+
+func (reader *countingReader) Read(buff []byte) (int, error) {
+	n, err := reader.ReadCloser.Read(buff)
+	reader.read += int64(n)
+	return n, err
+}
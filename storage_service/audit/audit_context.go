@@ -0,0 +1,44 @@
+package audit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"regexp"
+)
+
+// Whoever is making the request. The middleware puts an empty one into the request context,
+// and the user gets filled in once the request is authorized
+type Actor struct {
+	RequestID string
+	Addr      string
+	User      string
+	TokenID   string
+}
+
+type actorKey struct{}
+
+func WithActor(ctx context.Context, actor *Actor) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// Returns the actor of the request, or nil if there isn't one, as is the case for the server commands
+func ActorFrom(ctx context.Context) *Actor {
+	actor, _ := ctx.Value(actorKey{}).(*Actor)
+	return actor
+}
+
+var requestIdExpr = regexp.MustCompile(`^[0-9A-Za-z_-]{1,64}$`)
+
+// Uses the request id set by a proxy in front of the server, if it looks sane
+func requestID(header string) string {
+
+	if requestIdExpr.MatchString(header) {
+		return header
+	}
+
+	buff := make([]byte, 8)
+	_, _ = rand.Read(buff)
+
+	return hex.EncodeToString(buff)
+}
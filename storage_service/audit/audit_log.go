@@ -0,0 +1,88 @@
+package audit
+
+import (
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+type Operation string
+
+const (
+	OpPut    = Operation("put")
+	OpMove   = Operation("move")
+	OpDelete = Operation("delete")
+	//	files taken out of the trash or rolled back to an older version
+	OpRestore        = Operation("restore")
+	OpRestoreVersion = Operation("restore_version")
+	//	trashed files and old versions that are gone for good
+	OpPurge        = Operation("purge")
+	OpPurgeVersion = Operation("purge_version")
+)
+
+type Record struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id,omitempty"`
+	User      string    `json:"user,omitempty"`
+	TokenID   string    `json:"token_id,omitempty"`
+	Addr      string    `json:"addr,omitempty"`
+	Op        Operation `json:"op"`
+	Name      string    `json:"name"`
+	NewName   string    `json:"new_name,omitempty"`
+	//	trash entry or file version that the operation has been applied to
+	ID   string `json:"id,omitempty"`
+	Size int64  `json:"size"`
+	//	content that got replaced or removed by the operation
+	OldSHA256 string `json:"old_sha256,omitempty"`
+	SHA256    string `json:"sha256,omitempty"`
+}
+
+// An append-only JSON lines file. Records are never rewritten, so it's safe to rotate it with logrotate's copytruncate
+type Log struct {
+	Location string
+	mtx      sync.Mutex
+	file     *os.File
+}
+
+func (log *Log) Append(record *Record) error {
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	log.mtx.Lock()
+	defer log.mtx.Unlock()
+
+	if log.file == nil {
+
+		if err := os.MkdirAll(path.Dir(log.Location), fs.ModePerm); err != nil {
+			return err
+		}
+
+		if log.file, err = os.OpenFile(log.Location, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600); err != nil {
+			return err
+		}
+	}
+
+	_, err = log.file.Write(append(data, '\n'))
+	return err
+}
+
+func (log *Log) Close() error {
+
+	log.mtx.Lock()
+	defer log.mtx.Unlock()
+
+	if log.file == nil {
+		return nil
+	}
+
+	err := log.file.Close()
+	log.file = nil
+
+	return err
+}
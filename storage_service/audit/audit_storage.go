@@ -0,0 +1,268 @@
+package audit
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	s4 "github.com/maddsua/syncctl/storage_service"
+)
+
+// Records every change made to the storage into the audit log, along with who made it.
+// Meant to be the outermost wrapper, so that deletes are recorded as such even when they only move files to the trash
+type Storage struct {
+	s4.Storage
+	Log *Log
+}
+
+func (storage *Storage) Unwrap() s4.Storage {
+	return storage.Storage
+}
+
+func (storage *Storage) record(ctx context.Context, record Record) {
+
+	record.Time = time.Now()
+
+	if actor := ActorFrom(ctx); actor != nil {
+		record.RequestID = actor.RequestID
+		record.User = actor.User
+		record.TokenID = actor.TokenID
+		record.Addr = actor.Addr
+	}
+
+	//	the change has already been made at this point, so there's no point in failing the request
+	if err := storage.Log.Append(&record); err != nil {
+		slog.Error("Audit: Append record",
+			slog.String("op", string(record.Op)),
+			slog.String("name", record.Name),
+			slog.String("err", err.Error()))
+	}
+}
+
+// Returns the hash of a file that's about to be replaced
+func (storage *Storage) replacedHash(ctx context.Context, name string, overwrite bool) string {
+
+	if !overwrite {
+		return ""
+	}
+
+	if entry, err := storage.Storage.Stat(ctx, name); err == nil {
+		return entry.SHA256
+	}
+
+	return ""
+}
+
+func (storage *Storage) Put(ctx context.Context, entry *s4.FileUpload, overwrite bool) (*s4.FileMetadata, error) {
+
+	oldHash := storage.replacedHash(ctx, entry.Name, overwrite)
+
+	result, err := storage.Storage.Put(ctx, entry, overwrite)
+	if err != nil {
+		return nil, err
+	}
+
+	storage.record(ctx, Record{
+		Op:        OpPut,
+		Name:      result.Name,
+		Size:      result.Size,
+		OldSHA256: oldHash,
+		SHA256:    result.SHA256,
+	})
+
+	return result, nil
+}
+
+func (storage *Storage) Move(ctx context.Context, name string, newName string, overwrite bool) (*s4.FileMetadata, error) {
+
+	oldHash := storage.replacedHash(ctx, newName, overwrite)
+
+	result, err := storage.Storage.Move(ctx, name, newName, overwrite)
+	if err != nil {
+		return nil, err
+	}
+
+	storage.record(ctx, Record{
+		Op:        OpMove,
+		Name:      name,
+		NewName:   result.Name,
+		Size:      result.Size,
+		OldSHA256: oldHash,
+		SHA256:    result.SHA256,
+	})
+
+	return result, nil
+}
+
+func (storage *Storage) Delete(ctx context.Context, name string) (*s4.FileMetadata, error) {
+
+	result, err := storage.Storage.Delete(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	storage.record(ctx, Record{
+		Op:        OpDelete,
+		Name:      result.Name,
+		Size:      result.Size,
+		OldSHA256: result.SHA256,
+	})
+
+	return result, nil
+}
+
+// Trash and versions are looked up past this wrapper, which is why it has to pass those calls through itself instead of letting
+// them be unwrapped around it. When the feature isn't there at all, the calls fail with s4.NotSupportedError
+func (storage *Storage) trash() (s4.TrashController, error) {
+	if trash, ok := s4.StorageAs[s4.TrashController](storage.Storage); ok {
+		return trash, nil
+	}
+	return nil, &s4.NotSupportedError{Feature: "trash"}
+}
+
+func (storage *Storage) versions() (s4.VersionController, error) {
+	if versions, ok := s4.StorageAs[s4.VersionController](storage.Storage); ok {
+		return versions, nil
+	}
+	return nil, &s4.NotSupportedError{Feature: "versioning"}
+}
+
+func (storage *Storage) ListTrash(ctx context.Context, prefix string) ([]s4.TrashEntry, error) {
+
+	trash, err := storage.trash()
+	if err != nil {
+		return nil, err
+	}
+
+	return trash.ListTrash(ctx, prefix)
+}
+
+func (storage *Storage) RestoreTrash(ctx context.Context, scope string, id string, overwrite bool) (*s4.FileMetadata, error) {
+
+	trash, err := storage.trash()
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := trash.RestoreTrash(ctx, scope, id, overwrite)
+	if err != nil {
+		return nil, err
+	}
+
+	storage.record(ctx, Record{
+		Op:     OpRestore,
+		Name:   result.Name,
+		ID:     id,
+		Size:   result.Size,
+		SHA256: result.SHA256,
+	})
+
+	return result, nil
+}
+
+func (storage *Storage) EmptyTrash(ctx context.Context, prefix string) ([]s4.TrashEntry, error) {
+
+	trash, err := storage.trash()
+	if err != nil {
+		return nil, err
+	}
+
+	removed, err := trash.EmptyTrash(ctx, prefix)
+	storage.recordPurged(ctx, removed)
+
+	return removed, err
+}
+
+func (storage *Storage) PurgeTrash(ctx context.Context, before time.Time) ([]s4.TrashEntry, error) {
+
+	trash, err := storage.trash()
+	if err != nil {
+		return nil, err
+	}
+
+	removed, err := trash.PurgeTrash(ctx, before)
+	storage.recordPurged(ctx, removed)
+
+	return removed, err
+}
+
+// Records each of the entries separately, since some of them could've been removed before running into an error
+func (storage *Storage) recordPurged(ctx context.Context, entries []s4.TrashEntry) {
+	for _, entry := range entries {
+		storage.record(ctx, Record{
+			Op:        OpPurge,
+			Name:      entry.Name,
+			ID:        entry.ID,
+			Size:      entry.Size,
+			OldSHA256: entry.SHA256,
+		})
+	}
+}
+
+func (storage *Storage) ListVersions(ctx context.Context, name string) ([]s4.FileVersion, error) {
+
+	versions, err := storage.versions()
+	if err != nil {
+		return nil, err
+	}
+
+	return versions.ListVersions(ctx, name)
+}
+
+func (storage *Storage) GetVersion(ctx context.Context, name string, id string) (*s4.ReadSeekableFile, error) {
+
+	versions, err := storage.versions()
+	if err != nil {
+		return nil, err
+	}
+
+	return versions.GetVersion(ctx, name, id)
+}
+
+func (storage *Storage) RestoreVersion(ctx context.Context, name string, id string) (*s4.FileMetadata, error) {
+
+	versions, err := storage.versions()
+	if err != nil {
+		return nil, err
+	}
+
+	oldHash := storage.replacedHash(ctx, name, true)
+
+	result, err := versions.RestoreVersion(ctx, name, id)
+	if err != nil {
+		return nil, err
+	}
+
+	storage.record(ctx, Record{
+		Op:        OpRestoreVersion,
+		Name:      result.Name,
+		ID:        id,
+		Size:      result.Size,
+		OldSHA256: oldHash,
+		SHA256:    result.SHA256,
+	})
+
+	return result, nil
+}
+
+func (storage *Storage) PurgeVersions(ctx context.Context, before time.Time) ([]s4.FileVersion, error) {
+
+	versions, err := storage.versions()
+	if err != nil {
+		return nil, err
+	}
+
+	removed, err := versions.PurgeVersions(ctx, before)
+
+	for _, version := range removed {
+		storage.record(ctx, Record{
+			Op:        OpPurgeVersion,
+			Name:      version.Name,
+			ID:        version.ID,
+			Size:      version.Size,
+			OldSHA256: version.SHA256,
+		})
+	}
+
+	return removed, err
+}
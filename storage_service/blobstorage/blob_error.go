@@ -10,3 +10,7 @@ type BlobError struct {
 func (err *BlobError) Error() string {
 	return fmt.Sprintf("%s: %v", err.Operation, err.Err)
 }
+
+func (err *BlobError) Unwrap() error {
+	return err.Err
+}
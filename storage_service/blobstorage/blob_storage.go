@@ -3,15 +3,19 @@ package blobstorage
 import (
 	"archive/tar"
 	"context"
+	"errors"
 	"fmt"
 	"io/fs"
+	"log/slog"
 	"os"
 	"path"
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 
 	s4 "github.com/maddsua/syncctl/storage_service"
+	"github.com/maddsua/syncctl/storage_service/metaindex"
 )
 
 func CleanRelativePath(val string) string {
@@ -23,10 +27,122 @@ func StripPrefix(name, prefix string) string {
 	return strings.TrimPrefix(path.Clean(name), path.Clean(prefix))
 }
 
+const IndexFileName = ".index.jsonl"
+
 type Storage struct {
 	RootDir    string
 	listLock   sync.Mutex
 	uploadLock sync.Map
+	indexLock  sync.Mutex
+	index      *metaindex.Index
+}
+
+// Opens the metadata index, or builds it from the blobs if there's none on the disk yet.
+// Meant to be called when the storage starts, so that none of the requests has to sit through the build
+func (storage *Storage) LoadIndex(ctx context.Context) error {
+	_, err := storage.loadIndex(ctx)
+	return err
+}
+
+// Returns the metadata index, loading it on the first call
+func (storage *Storage) metaIndex() (*metaindex.Index, error) {
+	//	the index is shared by all requests, so it can't be tied to whichever one happened to come first
+	return storage.loadIndex(context.Background())
+}
+
+func (storage *Storage) loadIndex(ctx context.Context) (*metaindex.Index, error) {
+
+	storage.indexLock.Lock()
+	defer storage.indexLock.Unlock()
+
+	if storage.index != nil {
+		return storage.index, nil
+	}
+
+	location := path.Join(storage.RootDir, IndexFileName)
+
+	index, err := metaindex.Open(location)
+	if os.IsNotExist(err) {
+		slog.Info("Blob storage: Building metadata index",
+			slog.String("root", storage.RootDir))
+		index, err = storage.buildIndex(ctx, location)
+	}
+
+	//	failures aren't kept around, so the next call gets to try again
+	if err != nil {
+		return nil, &BlobError{"load metadata index", err}
+	}
+
+	storage.index = index
+
+	return index, nil
+}
+
+// Reads every blob and writes out a fresh index from them.
+// Nothing gets written if the walk is cut short, as a partial index would just hide the rest of the files for good
+func (storage *Storage) buildIndex(ctx context.Context, location string) (*metaindex.Index, error) {
+
+	var entries []s4.FileMetadata
+
+	var onFile = func(name string) (bool, error) {
+
+		file, err := os.Open(name)
+		if err != nil {
+			return false, err
+		}
+		defer file.Close()
+
+		info, err := ReadBlobInfo(ctx, tar.NewReader(file))
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return false, err
+		} else if err != nil {
+			slog.Warn("Blob storage: Skipping broken blob",
+				slog.String("name", name),
+				slog.String("err", err.Error()))
+			return true, nil
+		}
+
+		entries = append(entries, s4.FileMetadata{
+			Name:     OriginalPath(name, storage.RootDir),
+			Size:     info.Size,
+			Modified: info.Modified,
+			SHA256:   info.SHA256,
+		})
+
+		return true, nil
+	}
+
+	if _, err := os.Stat(storage.RootDir); err == nil {
+		if err := WalkBlobDir(storage.RootDir, true, onFile); err != nil {
+			return nil, err
+		}
+	}
+
+	return metaindex.Create(location, entries)
+}
+
+// Throws away the metadata index and builds a new one by reading every single blob.
+// Not meant to be called while the storage is serving requests
+func (storage *Storage) RebuildIndex(ctx context.Context) (int, error) {
+
+	storage.listLock.Lock()
+	defer storage.listLock.Unlock()
+
+	storage.indexLock.Lock()
+	defer storage.indexLock.Unlock()
+
+	index, err := storage.buildIndex(ctx, path.Join(storage.RootDir, IndexFileName))
+	if err != nil {
+		return 0, err
+	}
+
+	if storage.index != nil {
+		_ = storage.index.Close()
+	}
+
+	storage.index = index
+
+	return index.Len(), nil
 }
 
 func (storage *Storage) Put(ctx context.Context, entry *s4.FileUpload, overwrite bool) (*s4.FileMetadata, error) {
@@ -46,6 +162,14 @@ func (storage *Storage) Put(ctx context.Context, entry *s4.FileUpload, overwrite
 		return nil, &s4.FileConflictError{Path: entry.Name}
 	}
 
+	index, err := storage.metaIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	//	tar headers don't go any further than seconds anyway
+	entry.Modified = entry.Modified.Truncate(time.Second)
+
 	if err := os.MkdirAll(path.Dir(blobPath), fs.ModePerm); err != nil {
 		return nil, err
 	}
@@ -55,6 +179,9 @@ func (storage *Storage) Put(ctx context.Context, entry *s4.FileUpload, overwrite
 		return nil, err
 	}
 
+	storage.listLock.Lock()
+	defer storage.listLock.Unlock()
+
 	if err := os.Rename(tempBlob.Name, blobPath); err != nil {
 		_ = os.Remove(tempBlob.Name)
 		return nil, err
@@ -62,6 +189,10 @@ func (storage *Storage) Put(ctx context.Context, entry *s4.FileUpload, overwrite
 
 	entry.FileMetadata.SHA256 = tempBlob.SHA256
 
+	if err := index.Put(entry.FileMetadata); err != nil {
+		return nil, err
+	}
+
 	return &entry.FileMetadata, nil
 }
 
@@ -100,30 +231,39 @@ func (storage *Storage) Get(ctx context.Context, name string) (*s4.ReadSeekableF
 
 func (storage *Storage) Stat(ctx context.Context, name string) (*s4.FileMetadata, error) {
 
-	blobPath := BlobPath(storage.RootDir, name)
+	index, err := storage.metaIndex()
+	if err != nil {
+		return nil, err
+	}
 
-	if _, err := os.Stat(blobPath); err != nil {
+	entry, has := index.Get(CleanRelativePath(name))
+	if !has {
 		return nil, &s4.FileNotFoundError{Path: name}
 	}
 
-	file, err := os.Open(blobPath)
+	return entry, nil
+}
+
+func (storage *Storage) Stats(ctx context.Context) (*s4.StorageStats, error) {
+
+	index, err := storage.metaIndex()
 	if err != nil {
 		return nil, err
 	}
 
-	defer file.Close()
+	stats := s4.StorageStats{Blobs: index.Len()}
 
-	info, err := ReadBlobInfo(ctx, tar.NewReader(file))
-	if err != nil {
-		return nil, fmt.Errorf("read blob info: %v", err)
-	}
+	index.Range(func(entry s4.FileMetadata) bool {
+		stats.Bytes += entry.Size
+		return true
+	})
 
-	return &s4.FileMetadata{
-		Name:     CleanRelativePath(name),
-		Size:     info.Size,
-		Modified: info.Modified,
-		SHA256:   info.SHA256,
-	}, nil
+	storage.uploadLock.Range(func(_, _ any) bool {
+		stats.Uploads++
+		return true
+	})
+
+	return &stats, nil
 }
 
 func (storage *Storage) Move(ctx context.Context, name, newName string, overwrite bool) (*s4.FileMetadata, error) {
@@ -158,6 +298,10 @@ func (storage *Storage) Move(ctx context.Context, name, newName string, overwrit
 
 	stat.Name = CleanRelativePath(newName)
 
+	if err := storage.index.Move(CleanRelativePath(name), stat.Name); err != nil {
+		return nil, err
+	}
+
 	return stat, nil
 }
 
@@ -176,63 +320,21 @@ func (storage *Storage) Delete(ctx context.Context, name string) (*s4.FileMetada
 		return nil, err
 	}
 
+	if err := storage.index.Delete(stat.Name); err != nil {
+		return nil, err
+	}
+
 	return stat, nil
 }
 
 func (storage *Storage) Find(ctx context.Context, prefix string, filter *regexp.Regexp, recursive bool, offset, limit int) ([]s4.FileMetadata, error) {
 
-	storage.listLock.Lock()
-	defer storage.listLock.Unlock()
-
-	dirname := path.Join(storage.RootDir, prefix)
-	if stat, _ := os.Stat(dirname); stat == nil || !stat.IsDir() {
-		return []s4.FileMetadata{}, nil
-	}
-
-	results := make([]s4.FileMetadata, 0)
-	var pageIdx int
-
-	var onFile = func(name string) (bool, error) {
-
-		normalName := strings.TrimSuffix(name, FileExtBlob)
-		if filter != nil && !filter.MatchString(StripPrefix(normalName, dirname)) {
-			return true, nil
-		}
-
-		pageIdx++
-
-		if offset > 0 && pageIdx <= offset {
-			return true, nil
-		} else if limit > 0 && len(results) >= limit {
-			return false, nil
-		}
-
-		file, err := os.Open(name)
-		if err != nil {
-			return false, err
-		}
-		defer file.Close()
-
-		info, err := ReadBlobInfo(ctx, tar.NewReader(file))
-		if err != nil {
-			return false, err
-		}
-
-		results = append(results, s4.FileMetadata{
-			Name:     StripPrefix(normalName, storage.RootDir),
-			Size:     info.Size,
-			Modified: info.Modified,
-			SHA256:   info.SHA256,
-		})
-
-		return true, nil
-	}
-
-	if err := WalkBlobDir(dirname, recursive, onFile); err != nil {
+	index, err := storage.metaIndex()
+	if err != nil {
 		return nil, err
 	}
 
-	return results, nil
+	return index.Find(prefix, filter, recursive, offset, limit), nil
 }
 
 func WalkBlobDir(dir string, recursive bool, onFile func(name string) (wantMore bool, err error)) error {
@@ -0,0 +1,62 @@
+package blobstorage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	s4 "github.com/maddsua/syncctl/storage_service"
+)
+
+func TestLoadIndex(t *testing.T) {
+
+	ctx := context.Background()
+	rootDir := t.TempDir()
+
+	//	writing the blobs leaves an index behind, which has to go for the build to have anything to do
+	writer := Storage{RootDir: rootDir}
+	for _, name := range []string{"/a.txt", "/b/c.txt", "/b/d.txt"} {
+		if _, err := writer.Put(ctx, &s4.FileUpload{
+			FileMetadata: s4.FileMetadata{Name: name, Size: int64(len(name)), Modified: time.Now()},
+			Reader:       strings.NewReader(name),
+		}, false); err != nil {
+			t.Fatalf("put '%s': %v", name, err)
+		}
+	}
+
+	location := path.Join(rootDir, IndexFileName)
+	if err := os.Remove(location); err != nil {
+		t.Fatal(err)
+	}
+
+	storage := Storage{RootDir: rootDir}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	if err := storage.LoadIndex(cancelled); !errors.Is(err, context.Canceled) {
+		t.Fatalf("LoadIndex() with a cancelled context error = %v, want context.Canceled", err)
+	}
+
+	if _, err := os.Stat(location); !os.IsNotExist(err) {
+		t.Fatalf("an aborted build left an index behind: %v", err)
+	}
+
+	//	the failed attempt must not stick around
+	if err := storage.LoadIndex(ctx); err != nil {
+		t.Fatalf("LoadIndex(): %v", err)
+	}
+
+	entries, err := storage.Find(ctx, "/", nil, true, 0, 0)
+	if err != nil {
+		t.Fatalf("Find(): %v", err)
+	}
+
+	if len(entries) != 3 {
+		t.Errorf("Find() returned %d entries, want 3", len(entries))
+	}
+}
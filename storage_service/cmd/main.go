@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
 	"flag"
 	"fmt"
 	"log/slog"
@@ -8,13 +10,22 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path"
 	"strings"
 	"syscall"
+	"time"
 
 	s4 "github.com/maddsua/syncctl/storage_service"
+	"github.com/maddsua/syncctl/storage_service/audit"
 	"github.com/maddsua/syncctl/storage_service/blobstorage"
 	"github.com/maddsua/syncctl/storage_service/config"
+	"github.com/maddsua/syncctl/storage_service/dedupstorage"
+	"github.com/maddsua/syncctl/storage_service/metrics"
 	"github.com/maddsua/syncctl/storage_service/rest_handler"
+	"github.com/maddsua/syncctl/storage_service/tokens"
+	"github.com/maddsua/syncctl/storage_service/trashbin"
+	"github.com/maddsua/syncctl/storage_service/uploads"
+	"github.com/maddsua/syncctl/storage_service/versioning"
 	"github.com/maddsua/syncctl/utils"
 )
 
@@ -25,6 +36,18 @@ func main() {
 
 	flag.Parse()
 
+	//	doesn't need a config, which might not even exist yet
+	if flag.Arg(0) == "hash-password" {
+
+		if err := hashPasswordCommand(flag.Args()[1:]); err != nil {
+			slog.Error("Hash password",
+				slog.String("err", err.Error()))
+			os.Exit(1)
+		}
+
+		return
+	}
+
 	cfg, err := config.ReadConfig(*cfgfile)
 	if err != nil {
 		slog.Error("Read config",
@@ -32,28 +55,164 @@ func main() {
 		os.Exit(1)
 	}
 
-	storage := blobstorage.Storage{
-		RootDir: selectString(*dataDir, os.Getenv("S4_DATA_DIR"), cfg.DataDir, "/var/syncctl/data"),
+	dataRoot := selectString(*dataDir, os.Getenv("S4_DATA_DIR"), cfg.DataDir, "/var/syncctl/data")
+
+	var storage s4.Storage
+
+	switch cfg.Storage {
+	case config.StorageBlob, "":
+		storage = &blobstorage.Storage{
+			RootDir: dataRoot,
+		}
+	case config.StorageDedup:
+		storage = &dedupstorage.Storage{
+			RootDir: path.Join(dataRoot, "dedup"),
+		}
+	default:
+		slog.Error("Unsupported storage backend",
+			slog.String("name", string(cfg.Storage)))
+		os.Exit(1)
+	}
+
+	var versions *versioning.Storage
+	if cfg.Versions.Enabled() {
+		versions = &versioning.Storage{
+			Storage:  storage,
+			MaxCount: cfg.Versions.MaxCount,
+			MaxAge:   cfg.Versions.MaxAge,
+		}
+		storage = versions
+	}
+
+	var trash *trashbin.Storage
+	if cfg.Trash.Enabled {
+		trash = &trashbin.Storage{
+			Storage:   storage,
+			Retention: cfg.Trash.Retention,
+		}
+		storage = trash
+	}
+
+	var auditLog *audit.Log
+	if !cfg.Logging.DisableAudit {
+		auditLog = &audit.Log{
+			Location: selectString(cfg.Logging.AuditFile, path.Join(dataRoot, ".audit.jsonl")),
+		}
+		storage = &audit.Storage{
+			Storage: storage,
+			Log:     auditLog,
+		}
+	}
+
+	uploadSessions := uploads.SessionStore{
+		Dir: path.Join(dataRoot, ".uploads"),
 	}
 
-	fshandler := rest_handler.NewHandler(&storage, &cfg.AuthConfig)
+	tokenStore := tokens.Store{
+		Location: path.Join(dataRoot, ".tokens.json"),
+	}
+
+	switch flag.Arg(0) {
+
+	case "":
+
+	case "reindex":
+
+		indexed, ok := s4.StorageAs[interface {
+			RebuildIndex(ctx context.Context) (int, error)
+		}](storage)
+
+		if !ok {
+			slog.Error("Storage backend doesn't support index rebuilds",
+				slog.String("name", string(cfg.Storage)))
+			os.Exit(1)
+		}
+
+		slog.Info("Rebuilding metadata index",
+			slog.String("root", dataRoot))
+
+		count, err := indexed.RebuildIndex(context.Background())
+		if err != nil {
+			slog.Error("Rebuild index",
+				slog.String("err", err.Error()))
+			os.Exit(1)
+		}
+
+		slog.Info("Metadata index rebuilt",
+			slog.Int("entries", count))
+		return
+
+	case "token":
+
+		if err := tokenCommand(&tokenStore, cfg, flag.Args()[1:]); err != nil {
+			slog.Error("Token command",
+				slog.String("err", err.Error()))
+			os.Exit(1)
+		}
+
+		return
+
+	default:
+		slog.Error("Unknown command",
+			slog.String("name", flag.Arg(0)))
+		os.Exit(1)
+	}
+
+	if indexed, ok := s4.StorageAs[interface {
+		LoadIndex(ctx context.Context) error
+	}](storage); ok {
+		if err := indexed.LoadIndex(context.Background()); err != nil {
+			slog.Error("Load metadata index",
+				slog.String("err", err.Error()))
+			os.Exit(1)
+		}
+	}
+
+	serverMetrics := metrics.NewServerMetrics()
+	serverMetrics.WatchStorage(storage)
+
+	backend := rest_handler.NewBackend(storage, &tokenStore, serverMetrics, &cfg.AuthConfig)
+	fshandler := rest_handler.NewHandler(backend, &uploadSessions)
 
 	var mux http.ServeMux
 
 	//	s4 stands for Stipidly-Simple-Storage-Service, btw
 	mux.Handle(s4.UrlPrefixV1, http.StripPrefix(strings.TrimRight(s4.UrlPrefixV1, "/"), fshandler))
 
+	var davHandler s4.SyncHandler
+	if cfg.WebDAV.Enabled {
+		davHandler = rest_handler.NewDAVHandler(backend, s4.UrlPrefixDAV)
+		mux.Handle(s4.UrlPrefixDAV, http.StripPrefix(strings.TrimRight(s4.UrlPrefixDAV, "/"), davHandler))
+	}
+
+	if !cfg.Metrics.Disabled {
+		mux.Handle("GET /metrics", metricsHandler(serverMetrics, cfg.Metrics.Token))
+	}
+
+	//	s3 has to live at the root, as that's where the clients expect the buckets to be
+	var s3Handler s4.SyncHandler
+	if cfg.S3.Enabled {
+		s3Handler = rest_handler.NewS3Handler(backend, path.Join(dataRoot, ".s3uploads"))
+		mux.Handle("/", s3Handler)
+	}
+
+	rootHandler := audit.Middleware(&mux, !cfg.Logging.DisableAccess)
+
 	plainSrv := http.Server{
-		Handler: &mux,
+		Handler: rootHandler,
 		Addr:    fmt.Sprintf(":%d", selectPortNumber(utils.EnvInt("S4_PORT"), cfg.HttpPort, 44_080)),
 	}
 
 	tlsSrv := http.Server{
-		Handler:   &mux,
+		Handler:   rootHandler,
 		Addr:      fmt.Sprintf(":%d", selectPortNumber(utils.EnvInt("S4_TLS_PORT"), cfg.TlsPort, 44_443)),
 		TLSConfig: setupSelfSignedTlsOrDie(),
 	}
 
+	if trash != nil || versions != nil {
+		go purgeExpiredLoop(storage, trash, versions)
+	}
+
 	errCh := make(chan error, 2)
 
 	go func() {
@@ -85,6 +244,15 @@ func main() {
 		_ = plainSrv.Close()
 		_ = tlsSrv.Close()
 		fshandler.Wait()
+		if davHandler != nil {
+			davHandler.Wait()
+		}
+		if s3Handler != nil {
+			s3Handler.Wait()
+		}
+		if auditLog != nil {
+			_ = auditLog.Close()
+		}
 	case err := <-errCh:
 		slog.Error("Terminated",
 			slog.String("reason", err.Error()))
@@ -92,6 +260,47 @@ func main() {
 	}
 }
 
+// Purges go through the outermost storage, so that they'd end up in the audit log along with everything else
+func purgeExpiredLoop(storage s4.Storage, trash *trashbin.Storage, versions *versioning.Storage) {
+
+	trashController, _ := s4.StorageAs[s4.TrashController](storage)
+	versionController, _ := s4.StorageAs[s4.VersionController](storage)
+
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for ; ; <-ticker.C {
+
+		if trash != nil {
+
+			removed, err := trashController.PurgeTrash(context.Background(), trash.Expiry())
+			if err != nil {
+				slog.Error("Trash: Purge expired",
+					slog.String("err", err.Error()))
+			}
+
+			if len(removed) > 0 {
+				slog.Info("Trash: Purged expired entries",
+					slog.Int("count", len(removed)))
+			}
+		}
+
+		if versions != nil && versions.MaxAge > 0 {
+
+			removed, err := versionController.PurgeVersions(context.Background(), versions.Expiry())
+			if err != nil {
+				slog.Error("Versioning: Purge expired",
+					slog.String("err", err.Error()))
+			}
+
+			if len(removed) > 0 {
+				slog.Info("Versioning: Purged expired versions",
+					slog.Int("count", len(removed)))
+			}
+		}
+	}
+}
+
 func selectPortNumber(opts ...int) int {
 	return utils.SelectValue(func(val int) bool {
 		return val > 0 && val < math.MaxUint16
@@ -103,3 +312,22 @@ func selectString(opts ...string) string {
 		return val != ""
 	}, opts...)
 }
+
+// Serves the metrics, checking the scraper token if there's one set
+func metricsHandler(serverMetrics *metrics.ServerMetrics, token string) http.Handler {
+
+	if token == "" {
+		return serverMetrics
+	}
+
+	return http.HandlerFunc(func(wrt http.ResponseWriter, req *http.Request) {
+
+		value, _ := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(value), []byte(token)) != 1 {
+			wrt.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		serverMetrics.ServeHTTP(wrt, req)
+	})
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/maddsua/syncctl/storage_service/passwords"
+	"golang.org/x/term"
+)
+
+// Hashes a password for the config file. The password is read from stdin,
+// so that it doesn't end up in the shell history
+func hashPasswordCommand(args []string) error {
+
+	flags := flag.NewFlagSet("hash-password", flag.ExitOnError)
+	algo := flags.String("algo", string(passwords.Argon2id), "Hash algorithm: argon2id or bcrypt")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	password, err := readPassword()
+	if err != nil {
+		return fmt.Errorf("read password: %v", err)
+	}
+
+	if password == "" {
+		return fmt.Errorf("password is empty")
+	}
+
+	hash, err := passwords.Hash(passwords.Algorithm(*algo), password)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(hash)
+	return nil
+}
+
+// Prompts for the password without echoing it when run in a terminal,
+// otherwise takes the first line of whatever got piped in
+func readPassword() (string, error) {
+
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+
+		fmt.Fprint(os.Stderr, "Password: ")
+		data, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+
+		return string(data), err
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/maddsua/syncctl/storage_service/config"
+	"github.com/maddsua/syncctl/storage_service/tokens"
+)
+
+// Manages api tokens right on the server, which is handy for issuing them to users that don't have a password at all
+func tokenCommand(store *tokens.Store, cfg *config.ServerConfig, args []string) error {
+
+	if len(args) == 0 {
+		return fmt.Errorf("token command expects one of: create, list, revoke")
+	}
+
+	switch args[0] {
+
+	case "create":
+
+		flags := flag.NewFlagSet("token create", flag.ExitOnError)
+		username := flags.String("user", "", "Username to issue the token to")
+		name := flags.String("name", "", "Token name, for your own reference")
+		expires := flags.Duration("expires", 0, "How long the token stays valid for (forever by default)")
+		prefix := flags.String("prefix", "", "Restrict the token to a path prefix, relative to the user's root dir")
+		readOnly := flags.Bool("readonly", false, "Don't allow any changes to be made using the token")
+
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+
+		if *username == "" {
+			return fmt.Errorf("username is required")
+		} else if !slices.ContainsFunc(cfg.Users, func(user config.UserConfig) bool { return user.Username == *username }) {
+			return fmt.Errorf("user '%s' not found", *username)
+		}
+
+		opts := tokens.TokenOptions{
+			Name:       *name,
+			PathPrefix: *prefix,
+			ReadOnly:   *readOnly,
+		}
+
+		if *expires > 0 {
+			opts.Expires = time.Now().Add(*expires)
+		}
+
+		value, token, err := store.Issue(*username, opts)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Token '%s' issued to '%s'\n", token.ID, token.Username)
+		fmt.Println(value)
+		return nil
+
+	case "list":
+
+		flags := flag.NewFlagSet("token list", flag.ExitOnError)
+		username := flags.String("user", "", "Only list tokens of this user")
+
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+
+		entries, err := store.List(*username)
+		if err != nil {
+			return err
+		}
+
+		if len(entries) == 0 {
+			fmt.Println("No tokens issued")
+			return nil
+		}
+
+		for _, entry := range entries {
+			fmt.Println(formatTokenEntry(&entry))
+		}
+
+		return nil
+
+	case "revoke":
+
+		if len(args) < 2 {
+			return fmt.Errorf("token id is required")
+		}
+
+		token, err := store.Revoke("", args[1])
+		if err != nil {
+			return err
+		} else if token == nil {
+			return fmt.Errorf("token '%s' not found", args[1])
+		}
+
+		fmt.Printf("Token '%s' of '%s' revoked\n", token.ID, token.Username)
+		return nil
+
+	default:
+		return fmt.Errorf("unknown token command '%s'", args[0])
+	}
+}
+
+func formatTokenEntry(token *tokens.Token) string {
+
+	scope := "read-write"
+	if token.ReadOnly {
+		scope = "read-only"
+	}
+
+	result := fmt.Sprintf("%s  user: %s  %s", token.ID, token.Username, scope)
+
+	if token.PathPrefix != "" {
+		result += "  prefix: " + token.PathPrefix
+	}
+
+	if token.Expires.IsZero() {
+		result += "  expires: never"
+	} else if token.Expired(time.Now()) {
+		result += "  expired: " + token.Expires.Format(time.DateTime)
+	} else {
+		result += "  expires: " + token.Expires.Format(time.DateTime)
+	}
+
+	if token.Name != "" {
+		result += "  name: " + token.Name
+	}
+
+	return result
+}
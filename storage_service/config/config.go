@@ -3,25 +3,111 @@ package config
 import (
 	"fmt"
 	"os"
+	"path"
+	"time"
 
+	"github.com/maddsua/syncctl/storage_service/passwords"
 	"gopkg.in/yaml.v3"
 )
 
+type StorageBackend string
+
+const (
+	StorageBlob  = StorageBackend("blob")
+	StorageDedup = StorageBackend("dedup")
+)
+
 type ServerConfig struct {
-	DataDir    string `yaml:"data_dir"`
-	HttpPort   int    `yaml:"http_port"`
-	TlsPort    int    `yaml:"tls_port"`
+	DataDir    string         `yaml:"data_dir"`
+	Storage    StorageBackend `yaml:"storage"`
+	HttpPort   int            `yaml:"http_port"`
+	TlsPort    int            `yaml:"tls_port"`
+	Trash      TrashConfig    `yaml:"trash"`
+	Versions   VersionsConfig `yaml:"versions"`
+	Metrics    MetricsConfig  `yaml:"metrics"`
+	Logging    LoggingConfig  `yaml:"logging"`
+	WebDAV     WebDAVConfig   `yaml:"webdav"`
+	S3         S3Config       `yaml:"s3"`
 	AuthConfig `yaml:",inline"`
 }
 
+// Off by default, since it turns deletes into moves, and the files keep taking up space until they expire
+type TrashConfig struct {
+	Enabled   bool          `yaml:"enabled"`
+	Retention time.Duration `yaml:"retention"`
+}
+
+type MetricsConfig struct {
+	Disabled bool `yaml:"disabled"`
+	//	when set, scrapers have to send it as a bearer token
+	Token string `yaml:"token"`
+}
+
+type WebDAVConfig struct {
+	Enabled bool `yaml:"enabled"`
+}
+
+// The s3 api is served at the root of the server, so the buckets named 's4', 'dav' and 'metrics' are off limits
+type S3Config struct {
+	Enabled bool `yaml:"enabled"`
+}
+
+type LoggingConfig struct {
+	//	turns off logging of every request that's been handled
+	DisableAccess bool `yaml:"disable_access"`
+	//	turns off recording of the changes made to the storage
+	DisableAudit bool `yaml:"disable_audit"`
+	//	defaults to a file in the data dir
+	AuditFile string `yaml:"audit_file"`
+}
+
+// Versioning is only enabled when at least one of the limits is set
+type VersionsConfig struct {
+	MaxCount int           `yaml:"max_count"`
+	MaxAge   time.Duration `yaml:"max_age"`
+}
+
+func (cfg *VersionsConfig) Enabled() bool {
+	return cfg.MaxCount > 0 || cfg.MaxAge > 0
+}
+
 type AuthConfig struct {
 	Users []UserConfig `yaml:"users"`
 }
 
+type UserRole string
+
+const (
+	RoleFull     = UserRole("")
+	RoleReadOnly = UserRole("read-only")
+	RoleDropBox  = UserRole("drop-box")
+)
+
 type UserConfig struct {
-	Username string `yaml:"username"`
-	Password string `yaml:"password"`
-	RootDir  string `yaml:"root_dir"`
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	RootDir  string   `yaml:"root_dir"`
+	Role     UserRole `yaml:"role"`
+	NoDelete bool     `yaml:"no_delete"`
+	//	quotas cover everything under the mounts that the user can write to. Zero means no limit
+	QuotaBytes int64 `yaml:"quota_bytes"`
+	MaxFiles   int   `yaml:"max_files"`
+	//	makes storage directories show up at the set paths. When used along with root_dir,
+	//	the root dir gets mounted at '/', and otherwise only the mounts are accessible
+	Mounts []MountConfig `yaml:"mounts"`
+	//	sigv4 needs the secret itself rather than a hash of it, so s3 clients get their own key pair
+	S3 S3KeyConfig `yaml:"s3"`
+}
+
+type S3KeyConfig struct {
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+}
+
+type MountConfig struct {
+	Path     string `yaml:"path"`
+	Target   string `yaml:"target"`
+	ReadOnly bool   `yaml:"read_only"`
 }
 
 func ReadConfig(configPath string) (*ServerConfig, error) {
@@ -43,5 +129,47 @@ func ReadConfig(configPath string) (*ServerConfig, error) {
 		return nil, err
 	}
 
+	accessKeys := map[string]bool{}
+
+	for _, user := range cfg.Users {
+
+		if err := passwords.Check(user.Password); err != nil {
+			return nil, fmt.Errorf("user '%s' has a broken password hash: %v", user.Username, err)
+		}
+
+		if key := user.S3.AccessKey; key != "" {
+
+			if user.S3.SecretKey == "" {
+				return nil, fmt.Errorf("user '%s' has an s3 access key without a secret key", user.Username)
+			} else if accessKeys[key] {
+				return nil, fmt.Errorf("s3 access key '%s' is used more than once", key)
+			}
+
+			accessKeys[key] = true
+		}
+
+		switch user.Role {
+		case RoleFull, RoleReadOnly, RoleDropBox:
+		default:
+			return nil, fmt.Errorf("user '%s' has unknown role '%s'", user.Username, user.Role)
+		}
+
+		mountPaths := map[string]bool{}
+
+		for _, mount := range user.Mounts {
+
+			if mount.Path == "" || mount.Target == "" {
+				return nil, fmt.Errorf("user '%s' has a mount without a path or a target", user.Username)
+			}
+
+			mountPath := path.Clean("/" + mount.Path)
+			if mountPaths[mountPath] || (mountPath == "/" && user.RootDir != "") {
+				return nil, fmt.Errorf("user '%s' has more than one mount at '%s'", user.Username, mountPath)
+			}
+
+			mountPaths[mountPath] = true
+		}
+	}
+
 	return &cfg, nil
 }
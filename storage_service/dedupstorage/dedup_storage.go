@@ -0,0 +1,405 @@
+package dedupstorage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	s4 "github.com/maddsua/syncctl/storage_service"
+	"github.com/maddsua/syncctl/storage_service/metaindex"
+	"github.com/maddsua/syncctl/utils"
+)
+
+const IndexFileName = ".index.jsonl"
+
+const objectsDir = "objects"
+const tempDir = "tmp"
+
+var objectNameExpr = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+func CleanRelativePath(val string) string {
+	const separator = "/"
+	return path.Clean(separator + strings.TrimRight(val, separator))
+}
+
+// Stores every unique piece of content exactly once, named after its sha256 hash.
+// File names only exist in the metadata index, which makes moving stuff around basically free.
+// Objects are reference counted and get removed as soon as nothing points to them anymore
+type Storage struct {
+	RootDir    string
+	uploadLock sync.Map
+	mtx        sync.Mutex
+	initOnce   sync.Once
+	initErr    error
+	index      *metaindex.Index
+	refs       map[string]int
+}
+
+func (storage *Storage) objectPath(hash string) string {
+	return path.Join(storage.RootDir, objectsDir, hash[:2], hash)
+}
+
+func (storage *Storage) init() error {
+
+	storage.initOnce.Do(func() {
+
+		location := path.Join(storage.RootDir, IndexFileName)
+
+		index, err := metaindex.Open(location)
+		if os.IsNotExist(err) {
+			index, err = metaindex.Create(location, nil)
+		}
+
+		if err != nil {
+			storage.initErr = err
+			return
+		}
+
+		storage.index = index
+		storage.refs = map[string]int{}
+
+		index.Range(func(entry s4.FileMetadata) bool {
+			storage.refs[entry.SHA256]++
+			return true
+		})
+
+		if count, err := storage.collectGarbage(); err != nil {
+			slog.Warn("Dedup storage: Collect garbage",
+				slog.String("err", err.Error()))
+		} else if count > 0 {
+			slog.Info("Dedup storage: Removed orphaned objects",
+				slog.Int("count", count))
+		}
+	})
+
+	if storage.initErr != nil {
+		return fmt.Errorf("init dedup storage: %v", storage.initErr)
+	}
+
+	return nil
+}
+
+// Removes all the objects that aren't referenced by any file,
+// which can only really happen when the server goes down in the middle of something
+func (storage *Storage) collectGarbage() (int, error) {
+
+	var removed int
+
+	err := fs.WalkDir(os.DirFS(path.Join(storage.RootDir, objectsDir)), ".", func(name string, entry fs.DirEntry, err error) error {
+
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		hash := path.Base(name)
+		if !objectNameExpr.MatchString(hash) || storage.refs[hash] > 0 {
+			return nil
+		}
+
+		if err := os.Remove(storage.objectPath(hash)); err != nil {
+			return err
+		}
+
+		removed++
+		return nil
+	})
+
+	_ = os.RemoveAll(path.Join(storage.RootDir, tempDir))
+
+	return removed, err
+}
+
+func (storage *Storage) CollectGarbage(ctx context.Context) (int, error) {
+
+	if err := storage.init(); err != nil {
+		return 0, err
+	}
+
+	storage.mtx.Lock()
+	defer storage.mtx.Unlock()
+
+	return storage.collectGarbage()
+}
+
+// Decrements object reference count and removes it once there's nothing else pointing to it.
+// Must be called with the storage mutex held
+func (storage *Storage) unref(hash string) {
+
+	if storage.refs[hash]--; storage.refs[hash] > 0 {
+		return
+	}
+
+	delete(storage.refs, hash)
+
+	if err := os.Remove(storage.objectPath(hash)); err != nil && !os.IsNotExist(err) {
+		slog.Warn("Dedup storage: Remove object",
+			slog.String("sha256", hash),
+			slog.String("err", err.Error()))
+	}
+}
+
+// Writes upload data into a temporary file, returning its name and content hash
+func (storage *Storage) writeTemp(entry *s4.FileUpload) (*utils.FileJanitor, string, error) {
+
+	dir := path.Join(storage.RootDir, tempDir)
+	if err := os.MkdirAll(dir, fs.ModePerm); err != nil {
+		return nil, "", err
+	}
+
+	file, err := os.CreateTemp(dir, "*.part")
+	if err != nil {
+		return nil, "", err
+	}
+
+	janitor := utils.FileJanitor{Name: file.Name()}
+	defer file.Close()
+
+	hasher := sha256.New()
+
+	if n, err := io.Copy(file, io.TeeReader(entry.Reader, hasher)); err != nil {
+		_ = janitor.Cleanup()
+		return nil, "", err
+	} else if n != entry.Size {
+		_ = janitor.Cleanup()
+		return nil, "", fmt.Errorf("expected size: %d bytes but wrote %d instead", entry.Size, n)
+	}
+
+	if err := file.Close(); err != nil {
+		_ = janitor.Cleanup()
+		return nil, "", err
+	}
+
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	if entry.SHA256 != "" && entry.SHA256 != hash {
+		_ = janitor.Cleanup()
+		return nil, "", fmt.Errorf("sha256 checksum mismatch: expected: '%s'; have '%s'", entry.SHA256, hash)
+	}
+
+	return &janitor, hash, nil
+}
+
+func (storage *Storage) Put(ctx context.Context, entry *s4.FileUpload, overwrite bool) (*s4.FileMetadata, error) {
+
+	if err := storage.init(); err != nil {
+		return nil, err
+	}
+
+	if entry.Name = CleanRelativePath(entry.Name); entry.Name == "/" {
+		return nil, &s4.NameError{Name: entry.Name}
+	}
+
+	if _, locked := storage.uploadLock.LoadOrStore(entry.Name, ctx); locked {
+		return nil, &s4.FileConflictError{Path: entry.Name}
+	}
+
+	defer storage.uploadLock.Delete(entry.Name)
+
+	if _, has := storage.index.Get(entry.Name); has && !overwrite {
+		return nil, &s4.FileConflictError{Path: entry.Name}
+	}
+
+	temp, hash, err := storage.writeTemp(entry)
+	if err != nil {
+		return nil, err
+	}
+	defer temp.Cleanup()
+
+	storage.mtx.Lock()
+	defer storage.mtx.Unlock()
+
+	prev, hadPrev := storage.index.Get(entry.Name)
+	if hadPrev && !overwrite {
+		return nil, &s4.FileConflictError{Path: entry.Name}
+	}
+
+	if storage.refs[hash] == 0 {
+
+		objectPath := storage.objectPath(hash)
+
+		if err := os.MkdirAll(path.Dir(objectPath), fs.ModePerm); err != nil {
+			return nil, err
+		}
+
+		if err := os.Rename(temp.Name, objectPath); err != nil {
+			return nil, err
+		}
+
+		temp.Release()
+	}
+
+	meta := entry.FileMetadata
+	meta.SHA256 = hash
+
+	storage.refs[hash]++
+
+	if err := storage.index.Put(meta); err != nil {
+		storage.unref(hash)
+		return nil, err
+	}
+
+	if hadPrev {
+		storage.unref(prev.SHA256)
+	}
+
+	return &meta, nil
+}
+
+func (storage *Storage) Get(ctx context.Context, name string) (*s4.ReadSeekableFile, error) {
+
+	if err := storage.init(); err != nil {
+		return nil, err
+	}
+
+	//	holding the lock so that the object doesn't get collected before it's open
+	storage.mtx.Lock()
+	defer storage.mtx.Unlock()
+
+	entry, has := storage.index.Get(CleanRelativePath(name))
+	if !has {
+		return nil, &s4.FileNotFoundError{Path: name}
+	}
+
+	file, err := os.Open(storage.objectPath(entry.SHA256))
+	if err != nil {
+		return nil, fmt.Errorf("open object: %v", err)
+	}
+
+	return &s4.ReadSeekableFile{
+		FileMetadata:   *entry,
+		ReadSeekCloser: file,
+	}, nil
+}
+
+func (storage *Storage) Stat(ctx context.Context, name string) (*s4.FileMetadata, error) {
+
+	if err := storage.init(); err != nil {
+		return nil, err
+	}
+
+	entry, has := storage.index.Get(CleanRelativePath(name))
+	if !has {
+		return nil, &s4.FileNotFoundError{Path: name}
+	}
+
+	return entry, nil
+}
+
+// Objects are only counted once, no matter how many files point to them
+func (storage *Storage) Stats(ctx context.Context) (*s4.StorageStats, error) {
+
+	if err := storage.init(); err != nil {
+		return nil, err
+	}
+
+	objects := map[string]int64{}
+
+	storage.index.Range(func(entry s4.FileMetadata) bool {
+		objects[entry.SHA256] = entry.Size
+		return true
+	})
+
+	stats := s4.StorageStats{Blobs: len(objects)}
+
+	for _, size := range objects {
+		stats.Bytes += size
+	}
+
+	storage.uploadLock.Range(func(_, _ any) bool {
+		stats.Uploads++
+		return true
+	})
+
+	return &stats, nil
+}
+
+func (storage *Storage) Move(ctx context.Context, name string, newName string, overwrite bool) (*s4.FileMetadata, error) {
+
+	if err := storage.init(); err != nil {
+		return nil, err
+	}
+
+	if name == "" {
+		return nil, &s4.NameError{Name: name}
+	} else if newName == "" {
+		return nil, &s4.NameError{Name: newName}
+	}
+
+	name, newName = CleanRelativePath(name), CleanRelativePath(newName)
+
+	storage.mtx.Lock()
+	defer storage.mtx.Unlock()
+
+	entry, has := storage.index.Get(name)
+	if !has {
+		return nil, &s4.FileNotFoundError{Path: name}
+	}
+
+	if name == newName {
+		return entry, nil
+	}
+
+	prev, hadPrev := storage.index.Get(newName)
+	if hadPrev && !overwrite {
+		return nil, &s4.FileConflictError{Path: name}
+	}
+
+	if err := storage.index.Move(name, newName); err != nil {
+		return nil, err
+	}
+
+	if hadPrev {
+		storage.unref(prev.SHA256)
+	}
+
+	entry.Name = newName
+
+	return entry, nil
+}
+
+func (storage *Storage) Delete(ctx context.Context, name string) (*s4.FileMetadata, error) {
+
+	if err := storage.init(); err != nil {
+		return nil, err
+	}
+
+	storage.mtx.Lock()
+	defer storage.mtx.Unlock()
+
+	entry, has := storage.index.Get(CleanRelativePath(name))
+	if !has {
+		return nil, &s4.FileNotFoundError{Path: name}
+	}
+
+	if err := storage.index.Delete(entry.Name); err != nil {
+		return nil, err
+	}
+
+	storage.unref(entry.SHA256)
+
+	return entry, nil
+}
+
+func (storage *Storage) Find(ctx context.Context, prefix string, filter *regexp.Regexp, recursive bool, offset int, limit int) ([]s4.FileMetadata, error) {
+
+	if err := storage.init(); err != nil {
+		return nil, err
+	}
+
+	return storage.index.Find(prefix, filter, recursive, offset, limit), nil
+}
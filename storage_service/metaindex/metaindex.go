@@ -0,0 +1,320 @@
+package metaindex
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	s4 "github.com/maddsua/syncctl/storage_service"
+)
+
+const (
+	opPut    = "put"
+	opDelete = "delete"
+	opMove   = "move"
+)
+
+// Keeps file metadata in memory, backed by an append-only journal on the disk.
+// Every change is a single line appended to the journal, and once the journal grows
+// way bigger than the actual number of entries it gets compacted into a fresh snapshot
+type Index struct {
+	Location string
+	entries  map[string]s4.FileMetadata
+	mtx      sync.RWMutex
+	journal  *os.File
+	ops      int
+}
+
+type journalRecord struct {
+	Op    string           `json:"op"`
+	Name  string           `json:"name,omitempty"`
+	Entry *s4.FileMetadata `json:"entry,omitempty"`
+}
+
+// Opens an existing index. Returns an error satisfying os.IsNotExist when there isn't one yet
+func Open(location string) (*Index, error) {
+
+	file, err := os.Open(location)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	index := Index{
+		Location: location,
+		entries:  map[string]s4.FileMetadata{},
+	}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024*1024)
+
+	for scanner.Scan() {
+
+		var record journalRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			//	most likely a write that got cut off by a crash,
+			//	anything past it is going to be garbage anyway
+			break
+		}
+
+		index.apply(&record)
+		index.ops++
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	//	compacting right away gets rid of any cut off records at the end of the journal
+	if err := index.compact(); err != nil {
+		return nil, err
+	}
+
+	return &index, nil
+}
+
+// Creates a new index from a set of entries, replacing whatever was stored at the location before
+func Create(location string, entries []s4.FileMetadata) (*Index, error) {
+
+	index := Index{
+		Location: location,
+		entries:  map[string]s4.FileMetadata{},
+	}
+
+	for _, entry := range entries {
+		index.entries[entry.Name] = entry
+	}
+
+	if err := index.compact(); err != nil {
+		return nil, err
+	}
+
+	return &index, nil
+}
+
+func (index *Index) apply(record *journalRecord) {
+	switch record.Op {
+	case opPut:
+		if record.Entry != nil {
+			index.entries[record.Entry.Name] = *record.Entry
+		}
+	case opDelete:
+		delete(index.entries, record.Name)
+	case opMove:
+		if record.Entry != nil {
+			delete(index.entries, record.Name)
+			index.entries[record.Entry.Name] = *record.Entry
+		}
+	}
+}
+
+func (index *Index) commit(record *journalRecord) error {
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	if _, err := index.journal.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("write index journal: %v", err)
+	}
+
+	index.apply(record)
+	index.ops++
+
+	if index.ops > 2*len(index.entries)+1000 {
+		return index.compact()
+	}
+
+	return nil
+}
+
+// Rewrites the journal so that it only has a single record for every entry
+func (index *Index) compact() error {
+
+	if err := os.MkdirAll(path.Dir(index.Location), fs.ModePerm); err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(path.Dir(index.Location), path.Base(index.Location)+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	var cleanup = func() {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+	}
+
+	wrt := bufio.NewWriter(file)
+	enc := json.NewEncoder(wrt)
+
+	for _, entry := range index.entries {
+		if err := enc.Encode(journalRecord{Op: opPut, Entry: &entry}); err != nil {
+			cleanup()
+			return err
+		}
+	}
+
+	if err := wrt.Flush(); err != nil {
+		cleanup()
+		return err
+	}
+
+	if err := os.Rename(file.Name(), index.Location); err != nil {
+		cleanup()
+		return err
+	}
+
+	if index.journal != nil {
+		_ = index.journal.Close()
+	}
+
+	index.journal = file
+	index.ops = len(index.entries)
+
+	return nil
+}
+
+func (index *Index) Close() error {
+
+	index.mtx.Lock()
+	defer index.mtx.Unlock()
+
+	if index.journal == nil {
+		return nil
+	}
+
+	err := index.journal.Close()
+	index.journal = nil
+
+	return err
+}
+
+func (index *Index) Put(entry s4.FileMetadata) error {
+
+	index.mtx.Lock()
+	defer index.mtx.Unlock()
+
+	return index.commit(&journalRecord{Op: opPut, Entry: &entry})
+}
+
+func (index *Index) Delete(name string) error {
+
+	index.mtx.Lock()
+	defer index.mtx.Unlock()
+
+	if _, has := index.entries[name]; !has {
+		return nil
+	}
+
+	return index.commit(&journalRecord{Op: opDelete, Name: name})
+}
+
+func (index *Index) Move(name, newName string) error {
+
+	index.mtx.Lock()
+	defer index.mtx.Unlock()
+
+	entry, has := index.entries[name]
+	if !has {
+		return nil
+	}
+
+	entry.Name = newName
+
+	return index.commit(&journalRecord{Op: opMove, Name: name, Entry: &entry})
+}
+
+func (index *Index) Get(name string) (*s4.FileMetadata, bool) {
+
+	index.mtx.RLock()
+	defer index.mtx.RUnlock()
+
+	entry, has := index.entries[name]
+	if !has {
+		return nil, false
+	}
+
+	return &entry, true
+}
+
+func (index *Index) Len() int {
+
+	index.mtx.RLock()
+	defer index.mtx.RUnlock()
+
+	return len(index.entries)
+}
+
+// Iterates over all the entries. Returning false from the callback stops it.
+// Don't call any other index methods from the callback, it's going to deadlock
+func (index *Index) Range(fn func(entry s4.FileMetadata) bool) {
+
+	index.mtx.RLock()
+	defer index.mtx.RUnlock()
+
+	for _, entry := range index.entries {
+		if !fn(entry) {
+			return
+		}
+	}
+}
+
+// Lists entries inside a directory. The filter expression is matched against
+// entry names relative to the prefix, same as the blob storage used to do it
+func (index *Index) Find(prefix string, filter *regexp.Regexp, recursive bool, offset, limit int) []s4.FileMetadata {
+
+	dirname := path.Clean("/" + prefix)
+	dirPrefix := strings.TrimSuffix(dirname, "/") + "/"
+
+	index.mtx.RLock()
+
+	var matched []s4.FileMetadata
+
+	for name, entry := range index.entries {
+
+		relName, ok := strings.CutPrefix(name, dirPrefix)
+		if !ok || (!recursive && strings.Contains(relName, "/")) {
+			continue
+		}
+
+		if filter != nil && !filter.MatchString("/"+relName) {
+			continue
+		}
+
+		matched = append(matched, entry)
+	}
+
+	index.mtx.RUnlock()
+
+	slices.SortFunc(matched, func(a, b s4.FileMetadata) int {
+		return ComparePaths(a.Name, b.Name)
+	})
+
+	if offset > 0 {
+		matched = matched[min(offset, len(matched)):]
+	}
+
+	if limit > 0 && len(matched) > limit {
+		matched = matched[:limit]
+	}
+
+	if matched == nil {
+		return []s4.FileMetadata{}
+	}
+
+	return matched
+}
+
+// Compares paths segment by segment, which puts them in the same order a directory walk would
+func ComparePaths(a, b string) int {
+	return strings.Compare(strings.ReplaceAll(a, "/", "\x00"), strings.ReplaceAll(b, "/", "\x00"))
+}
@@ -0,0 +1,213 @@
+package metaindex
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"testing"
+
+	s4 "github.com/maddsua/syncctl/storage_service"
+)
+
+func testEntry(name string, size int64) s4.FileMetadata {
+	return s4.FileMetadata{Name: name, Size: size}
+}
+
+func entryNames(entries []s4.FileMetadata) []string {
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name)
+	}
+	return names
+}
+
+func TestJournalReplay(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		initial []s4.FileMetadata
+		apply   func(index *Index) error
+		//	appended to the journal after closing, as if the last write got cut off
+		garbage string
+		want    map[string]int64
+	}{
+		{
+			name:    "snapshot only",
+			initial: []s4.FileMetadata{testEntry("/a", 1), testEntry("/b/c", 2)},
+			apply:   func(index *Index) error { return nil },
+			want:    map[string]int64{"/a": 1, "/b/c": 2},
+		},
+		{
+			name:    "puts replace entries",
+			initial: []s4.FileMetadata{testEntry("/a", 1)},
+			apply: func(index *Index) error {
+				if err := index.Put(testEntry("/a", 10)); err != nil {
+					return err
+				}
+				return index.Put(testEntry("/new", 3))
+			},
+			want: map[string]int64{"/a": 10, "/new": 3},
+		},
+		{
+			name:    "deletes and moves",
+			initial: []s4.FileMetadata{testEntry("/a", 1), testEntry("/b", 2), testEntry("/c", 3)},
+			apply: func(index *Index) error {
+				if err := index.Delete("/a"); err != nil {
+					return err
+				}
+				if err := index.Move("/b", "/dir/b"); err != nil {
+					return err
+				}
+				//	neither of these is there, so nothing should happen
+				if err := index.Delete("/missing"); err != nil {
+					return err
+				}
+				return index.Move("/missing", "/elsewhere")
+			},
+			want: map[string]int64{"/dir/b": 2, "/c": 3},
+		},
+		{
+			name:    "move over an existing entry",
+			initial: []s4.FileMetadata{testEntry("/a", 1), testEntry("/b", 2)},
+			apply:   func(index *Index) error { return index.Move("/a", "/b") },
+			want:    map[string]int64{"/b": 1},
+		},
+		{
+			name:    "cut off record at the end",
+			initial: []s4.FileMetadata{testEntry("/a", 1)},
+			apply:   func(index *Index) error { return index.Put(testEntry("/b", 2)) },
+			garbage: `{"op":"put","entry":{"name":"/c","si`,
+			want:    map[string]int64{"/a": 1, "/b": 2},
+		},
+		{
+			name:    "unknown records are skipped",
+			initial: []s4.FileMetadata{testEntry("/a", 1)},
+			apply:   func(index *Index) error { return nil },
+			garbage: `{"op":"shrug","name":"/a"}` + "\n" + `{"op":"put"}` + "\n",
+			want:    map[string]int64{"/a": 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			location := filepath.Join(t.TempDir(), "index.jsonl")
+
+			index, err := Create(location, tt.initial)
+			if err != nil {
+				t.Fatalf("Create: %v", err)
+			}
+
+			if err := tt.apply(index); err != nil {
+				t.Fatalf("apply: %v", err)
+			}
+
+			if err := index.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+
+			if tt.garbage != "" {
+				file, err := os.OpenFile(location, os.O_WRONLY|os.O_APPEND, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = file.WriteString(tt.garbage)
+				_ = file.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			//	opening twice makes sure that whatever got compacted on the first open reads back the same
+			for pass := range 2 {
+
+				index, err := Open(location)
+				if err != nil {
+					t.Fatalf("Open (pass %d): %v", pass, err)
+				}
+
+				got := map[string]int64{}
+				index.Range(func(entry s4.FileMetadata) bool {
+					got[entry.Name] = entry.Size
+					return true
+				})
+
+				if err := index.Close(); err != nil {
+					t.Fatalf("Close (pass %d): %v", pass, err)
+				}
+
+				if len(got) != len(tt.want) {
+					t.Fatalf("pass %d: got %v, want %v", pass, got, tt.want)
+				}
+
+				for name, size := range tt.want {
+					if gotSize, has := got[name]; !has || gotSize != size {
+						t.Errorf("pass %d: entry '%s' = %d (present: %v), want %d", pass, name, gotSize, has, size)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestOpenMissing(t *testing.T) {
+	if _, err := Open(filepath.Join(t.TempDir(), "nope.jsonl")); !os.IsNotExist(err) {
+		t.Errorf("Open() error = %v, want a not exist error", err)
+	}
+}
+
+func TestFind(t *testing.T) {
+
+	index, err := Create(filepath.Join(t.TempDir(), "index.jsonl"), []s4.FileMetadata{
+		testEntry("/a.txt", 1),
+		testEntry("/b/c.txt", 1),
+		testEntry("/b/d.log", 1),
+		testEntry("/b/e/f.txt", 1),
+		testEntry("/b-sibling/g.txt", 1),
+		testEntry("/bb/h.txt", 1),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	tests := []struct {
+		name      string
+		prefix    string
+		filter    string
+		recursive bool
+		offset    int
+		limit     int
+		want      []string
+	}{
+		{name: "root", prefix: "/", want: []string{"/a.txt"}},
+		{name: "root recursive", prefix: "", recursive: true, want: []string{"/a.txt", "/b/c.txt", "/b/d.log", "/b/e/f.txt", "/b-sibling/g.txt", "/bb/h.txt"}},
+		{name: "dir", prefix: "/b", want: []string{"/b/c.txt", "/b/d.log"}},
+		{name: "dir with trailing slash", prefix: "b/", recursive: true, want: []string{"/b/c.txt", "/b/d.log", "/b/e/f.txt"}},
+		{name: "filter", prefix: "/b", filter: `\.txt$`, recursive: true, want: []string{"/b/c.txt", "/b/e/f.txt"}},
+		{name: "filter is relative", prefix: "/b", filter: `^/e/`, recursive: true, want: []string{"/b/e/f.txt"}},
+		{name: "offset and limit", prefix: "/", recursive: true, offset: 1, limit: 2, want: []string{"/b/c.txt", "/b/d.log"}},
+		{name: "offset past the end", prefix: "/", offset: 10, want: []string{}},
+		{name: "missing dir", prefix: "/nope", want: []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			var filter *regexp.Regexp
+			if tt.filter != "" {
+				filter = regexp.MustCompile(tt.filter)
+			}
+
+			got := index.Find(tt.prefix, filter, tt.recursive, tt.offset, tt.limit)
+			if got == nil {
+				t.Fatalf("Find() returned nil instead of an empty slice")
+			}
+
+			if names := entryNames(got); !slices.Equal(names, tt.want) {
+				t.Errorf("Find() = %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,267 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Just enough of the Prometheus text format to get the server graphed,
+// without pulling the whole client library in
+type Registry struct {
+	mtx     sync.Mutex
+	entries []metric
+}
+
+type metric interface {
+	writeText(wrt io.Writer)
+}
+
+func (reg *Registry) register(entry metric) {
+	reg.mtx.Lock()
+	defer reg.mtx.Unlock()
+	reg.entries = append(reg.entries, entry)
+}
+
+func (reg *Registry) WriteText(wrt io.Writer) {
+
+	reg.mtx.Lock()
+	entries := slices.Clone(reg.entries)
+	reg.mtx.Unlock()
+
+	for _, entry := range entries {
+		entry.writeText(wrt)
+	}
+}
+
+func (reg *Registry) ServeHTTP(wrt http.ResponseWriter, _ *http.Request) {
+	wrt.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	reg.WriteText(wrt)
+}
+
+func (reg *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	counter := &Counter{desc: desc{name: name, help: help, labels: labels}}
+	reg.register(counter)
+	return counter
+}
+
+func (reg *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	histogram := &Histogram{desc: desc{name: name, help: help, labels: labels}, buckets: buckets}
+	reg.register(histogram)
+	return histogram
+}
+
+// Gauges are collected on every scrape, which suits the values that are already tracked somewhere else
+func (reg *Registry) NewGaugeFunc(name, help string, value func() float64) {
+	reg.register(&gaugeFunc{desc: desc{name: name, help: help}, value: value})
+}
+
+// Default latency buckets, in seconds
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+type desc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (desc *desc) writeHeader(wrt io.Writer, kind string) {
+	fmt.Fprintf(wrt, "# HELP %s %s\n", desc.name, desc.help)
+	fmt.Fprintf(wrt, "# TYPE %s %s\n", desc.name, kind)
+}
+
+// Joins label values into a key that's used to store the series
+func seriesKey(values []string) string {
+	return strings.Join(values, "\x00")
+}
+
+func formatLabels(names []string, values []string, extra ...string) string {
+
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+
+	var pairs []string
+
+	for idx, name := range names {
+		pairs = append(pairs, name+"="+strconv.Quote(values[idx]))
+	}
+
+	for idx := 0; idx+1 < len(extra); idx += 2 {
+		pairs = append(pairs, extra[idx]+"="+strconv.Quote(extra[idx+1]))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(val float64) string {
+	switch {
+	case math.IsInf(val, 1):
+		return "+Inf"
+	case math.IsInf(val, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(val, 'g', -1, 64)
+	}
+}
+
+// Label values of a series, along with the series itself
+type series[T any] struct {
+	labels []string
+	value  T
+}
+
+type seriesMap[T any] struct {
+	mtx     sync.Mutex
+	entries map[string]*series[T]
+}
+
+// Returns the series for the label values, creating it if needed. Has to be called with the lock held
+func (sm *seriesMap[T]) get(desc *desc, labels []string, init func() T) *series[T] {
+
+	if len(labels) != len(desc.labels) {
+		panic(fmt.Sprintf("metric '%s' expects %d labels, got %d", desc.name, len(desc.labels), len(labels)))
+	}
+
+	if sm.entries == nil {
+		sm.entries = map[string]*series[T]{}
+	}
+
+	key := seriesKey(labels)
+
+	entry := sm.entries[key]
+	if entry == nil {
+		entry = &series[T]{labels: slices.Clone(labels), value: init()}
+		sm.entries[key] = entry
+	}
+
+	return entry
+}
+
+// Lists the series in a stable order, so that the scrapes don't jump around
+func (sm *seriesMap[T]) sorted() []*series[T] {
+
+	var result []*series[T]
+	for _, entry := range sm.entries {
+		result = append(result, entry)
+	}
+
+	slices.SortFunc(result, func(a, b *series[T]) int {
+		return strings.Compare(seriesKey(a.labels), seriesKey(b.labels))
+	})
+
+	return result
+}
+
+type Counter struct {
+	desc
+	values seriesMap[float64]
+}
+
+func (counter *Counter) Add(val float64, labels ...string) {
+
+	if counter == nil {
+		return
+	}
+
+	counter.values.mtx.Lock()
+	defer counter.values.mtx.Unlock()
+
+	counter.values.get(&counter.desc, labels, func() float64 { return 0 }).value += val
+}
+
+func (counter *Counter) Inc(labels ...string) {
+	counter.Add(1, labels...)
+}
+
+func (counter *Counter) writeText(wrt io.Writer) {
+
+	counter.desc.writeHeader(wrt, "counter")
+
+	counter.values.mtx.Lock()
+	defer counter.values.mtx.Unlock()
+
+	for _, entry := range counter.values.sorted() {
+		fmt.Fprintf(wrt, "%s%s %s\n", counter.name, formatLabels(counter.desc.labels, entry.labels), formatValue(entry.value))
+	}
+}
+
+type Histogram struct {
+	desc
+	buckets []float64
+	values  seriesMap[*histogramState]
+}
+
+type histogramState struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (histogram *Histogram) Observe(val float64, labels ...string) {
+
+	if histogram == nil {
+		return
+	}
+
+	histogram.values.mtx.Lock()
+	defer histogram.values.mtx.Unlock()
+
+	state := histogram.values.get(&histogram.desc, labels, func() *histogramState {
+		return &histogramState{counts: make([]uint64, len(histogram.buckets))}
+	}).value
+
+	for idx, bound := range histogram.buckets {
+		if val <= bound {
+			state.counts[idx]++
+		}
+	}
+
+	state.count++
+	state.sum += val
+}
+
+func (histogram *Histogram) writeText(wrt io.Writer) {
+
+	histogram.desc.writeHeader(wrt, "histogram")
+
+	histogram.values.mtx.Lock()
+	defer histogram.values.mtx.Unlock()
+
+	for _, entry := range histogram.values.sorted() {
+
+		for idx, bound := range histogram.buckets {
+			fmt.Fprintf(wrt, "%s_bucket%s %d\n", histogram.name,
+				formatLabels(histogram.desc.labels, entry.labels, "le", formatValue(bound)), entry.value.counts[idx])
+		}
+
+		fmt.Fprintf(wrt, "%s_bucket%s %d\n", histogram.name,
+			formatLabels(histogram.desc.labels, entry.labels, "le", "+Inf"), entry.value.count)
+
+		labels := formatLabels(histogram.desc.labels, entry.labels)
+		fmt.Fprintf(wrt, "%s_sum%s %s\n", histogram.name, labels, formatValue(entry.value.sum))
+		fmt.Fprintf(wrt, "%s_count%s %d\n", histogram.name, labels, entry.value.count)
+	}
+}
+
+type gaugeFunc struct {
+	desc
+	value func() float64
+}
+
+func (gauge *gaugeFunc) writeText(wrt io.Writer) {
+
+	val := gauge.value()
+	if math.IsNaN(val) {
+		//	the value couldn't be collected, so it's better to leave it out entirely
+		return
+	}
+
+	gauge.desc.writeHeader(wrt, "gauge")
+	fmt.Fprintf(wrt, "%s %s\n", gauge.name, formatValue(val))
+}
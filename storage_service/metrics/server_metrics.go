@@ -0,0 +1,152 @@
+package metrics
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	s4 "github.com/maddsua/syncctl/storage_service"
+)
+
+// Everything that the storage server reports. It's always collected, even with the endpoint disabled
+type ServerMetrics struct {
+	Registry
+	Requests        *Counter
+	RequestDuration *Histogram
+	BytesUploaded   *Counter
+	BytesDownloaded *Counter
+	AuthFailures    *Counter
+	FindDuration    *Histogram
+}
+
+func NewServerMetrics() *ServerMetrics {
+
+	var sm ServerMetrics
+
+	sm.Requests = sm.NewCounter("s4_http_requests_total",
+		"Number of handled requests", "route", "method", "status")
+	sm.RequestDuration = sm.NewHistogram("s4_http_request_duration_seconds",
+		"Time it took to handle a request", DefaultBuckets, "route", "method", "status")
+	sm.BytesUploaded = sm.NewCounter("s4_uploaded_bytes_total",
+		"Amount of file data received from a user", "user")
+	sm.BytesDownloaded = sm.NewCounter("s4_downloaded_bytes_total",
+		"Amount of file data sent to a user", "user")
+	sm.AuthFailures = sm.NewCounter("s4_auth_failures_total",
+		"Number of rejected requests due to missing or invalid credentials", "reason")
+	sm.FindDuration = sm.NewHistogram("s4_find_duration_seconds",
+		"Time it took to list files", DefaultBuckets)
+
+	return &sm
+}
+
+// Collection of stats is a bit too heavy to repeat for each of the gauges, so it's done once per this long
+const storageStatsTTL = 5 * time.Second
+
+// Adds gauges for what the storage backend holds, if it can tell that
+func (sm *ServerMetrics) WatchStorage(storage s4.Storage) {
+
+	controller, ok := s4.StorageAs[s4.StatsController](storage)
+	if !ok {
+		return
+	}
+
+	var mtx sync.Mutex
+	var stats *s4.StorageStats
+	var collected time.Time
+
+	var collect = func(value func(stats *s4.StorageStats) float64) func() float64 {
+		return func() float64 {
+
+			mtx.Lock()
+			defer mtx.Unlock()
+
+			if stats == nil || time.Since(collected) > storageStatsTTL {
+
+				var err error
+				if stats, err = controller.Stats(context.Background()); err != nil {
+					slog.Error("Metrics: Collect storage stats",
+						slog.String("err", err.Error()))
+					return math.NaN()
+				}
+
+				collected = time.Now()
+			}
+
+			return value(stats)
+		}
+	}
+
+	sm.NewGaugeFunc("s4_storage_blobs", "Number of stored blobs",
+		collect(func(stats *s4.StorageStats) float64 { return float64(stats.Blobs) }))
+	sm.NewGaugeFunc("s4_storage_bytes", "Total size of the stored files",
+		collect(func(stats *s4.StorageStats) float64 { return float64(stats.Bytes) }))
+	sm.NewGaugeFunc("s4_uploads_in_flight", "Number of uploads that are being written to the storage",
+		collect(func(stats *s4.StorageStats) float64 { return float64(stats.Uploads) }))
+}
+
+// Counts requests handled by a ServeMux. Has to be put right in front of the mux itself,
+// as that's where the route pattern gets set
+func (sm *ServerMetrics) Middleware(next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(wrt http.ResponseWriter, req *http.Request) {
+
+		started := time.Now()
+		recorder := &StatusRecorder{ResponseWriter: wrt}
+
+		next.ServeHTTP(recorder, req)
+
+		route := "unmatched"
+		if _, pattern, _ := strings.Cut(req.Pattern, " "); pattern != "" {
+			route = pattern
+		} else if req.Pattern != "" {
+			route = req.Pattern
+		}
+
+		status := strconv.Itoa(recorder.Status())
+
+		sm.Requests.Inc(route, req.Method, status)
+		sm.RequestDuration.Observe(time.Since(started).Seconds(), route, req.Method, status)
+	})
+}
+
+// Keeps track of what's been written to a response
+type StatusRecorder struct {
+	http.ResponseWriter
+	status  int
+	Written int64
+}
+
+func (rec *StatusRecorder) Status() int {
+	if rec.status == 0 {
+		return http.StatusOK
+	}
+	return rec.status
+}
+
+func (rec *StatusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *StatusRecorder) Write(data []byte) (int, error) {
+	n, err := rec.ResponseWriter.Write(data)
+	rec.Written += int64(n)
+	return n, err
+}
+
+func (rec *StatusRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (rec *StatusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
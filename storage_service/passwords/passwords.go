@@ -0,0 +1,196 @@
+package passwords
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type Algorithm string
+
+const (
+	Argon2id = Algorithm("argon2id")
+	Bcrypt   = Algorithm("bcrypt")
+)
+
+// Hashes are told apart from plaintext passwords by their standard prefixes:
+// '$argon2id$' for the PHC-formatted argon2id, and '$2a$', '$2b$' or '$2y$' for bcrypt
+const argon2idPrefix = "$argon2id$"
+
+var bcryptPrefixes = []string{"$2a$", "$2b$", "$2y$"}
+
+// Recommended argon2id parameters for when there's enough memory to go around
+const (
+	argon2idTime    = 1
+	argon2idMemory  = 64 * 1024
+	argon2idThreads = 4
+	argon2idKeyLen  = 32
+	argon2idSaltLen = 16
+)
+
+// Limits for the argon2id parameters read from the config. Zero time or threads would panic,
+// and since the hash is computed on every login, a huge memory cost is a good way to run out of memory
+const (
+	argon2idMaxMemory  = 256 * 1024
+	argon2idMaxTime    = 64
+	argon2idMaxThreads = 255
+	argon2idMaxKeyLen  = 1024
+)
+
+var ErrInvalidHash = errors.New("invalid password hash")
+
+func IsArgon2id(stored string) bool {
+	return strings.HasPrefix(stored, argon2idPrefix)
+}
+
+func IsBcrypt(stored string) bool {
+	for _, prefix := range bcryptPrefixes {
+		if strings.HasPrefix(stored, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks whether the stored value is a password hash rather than a plaintext password
+func IsHash(stored string) bool {
+	return IsArgon2id(stored) || IsBcrypt(stored)
+}
+
+func Hash(algo Algorithm, password string) (string, error) {
+	switch algo {
+	case Argon2id, "":
+		return hashArgon2id(password)
+	case Bcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		return string(hash), err
+	default:
+		return "", fmt.Errorf("unsupported hash algorithm '%s'", algo)
+	}
+}
+
+// Compares a password against whatever is stored in the config, be it a hash or a plaintext password.
+// An error is only returned when the stored hash itself is broken
+func Verify(stored string, password string) (bool, error) {
+
+	switch {
+
+	case IsArgon2id(stored):
+		return verifyArgon2id(stored, password)
+
+	case IsBcrypt(stored):
+
+		err := bcrypt.CompareHashAndPassword([]byte(stored), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+
+		return true, nil
+
+	default:
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1, nil
+	}
+}
+
+// Checks that the stored value is either a plaintext password or a hash that could actually be verified
+func Check(stored string) error {
+
+	switch {
+
+	case IsArgon2id(stored):
+		_, err := parseArgon2id(stored)
+		return err
+
+	case IsBcrypt(stored):
+		if _, err := bcrypt.Cost([]byte(stored)); err != nil {
+			return ErrInvalidHash
+		}
+		return nil
+
+	default:
+		return nil
+	}
+}
+
+type argon2idParams struct {
+	memory  uint32
+	time    uint32
+	threads uint32
+	salt    []byte
+	key     []byte
+}
+
+func hashArgon2id(password string) (string, error) {
+
+	salt := make([]byte, argon2idSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, argon2idTime, argon2idMemory, argon2idThreads, argon2idKeyLen)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		argon2idMemory, argon2idTime, argon2idThreads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Parses a PHC string, as in '$argon2id$v=19$m=65536,t=1,p=4$<salt>$<key>'
+func parseArgon2id(stored string) (*argon2idParams, error) {
+
+	parts := strings.Split(stored, "$")
+	if len(parts) != 6 {
+		return nil, ErrInvalidHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return nil, ErrInvalidHash
+	} else if version != argon2.Version {
+		return nil, fmt.Errorf("unsupported argon2 version %d", version)
+	}
+
+	var params argon2idParams
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads); err != nil {
+		return nil, ErrInvalidHash
+	}
+
+	if params.time < 1 || params.time > argon2idMaxTime ||
+		params.threads < 1 || params.threads > argon2idMaxThreads ||
+		params.memory < 8*params.threads || params.memory > argon2idMaxMemory {
+		return nil, ErrInvalidHash
+	}
+
+	var err error
+
+	if params.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, ErrInvalidHash
+	}
+
+	if params.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(params.key) == 0 || len(params.key) > argon2idMaxKeyLen {
+		return nil, ErrInvalidHash
+	}
+
+	return &params, nil
+}
+
+func verifyArgon2id(stored string, password string) (bool, error) {
+
+	params, err := parseArgon2id(stored)
+	if err != nil {
+		return false, err
+	}
+
+	otherKey := argon2.IDKey([]byte(password), params.salt, params.time, params.memory, uint8(params.threads), uint32(len(params.key)))
+
+	return subtle.ConstantTimeCompare(params.key, otherKey) == 1, nil
+}
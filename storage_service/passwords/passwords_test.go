@@ -0,0 +1,141 @@
+package passwords
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Builds a PHC string with cheap parameters, so that the tests don't have to burn through 64MB per hash
+func testArgon2id(password string, memory, time uint32, threads uint8) string {
+
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte(password), salt, time, memory, threads, 32)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, memory, time, threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key))
+}
+
+func TestVerify(t *testing.T) {
+
+	argonHash, err := Hash(Argon2id, "hunter2")
+	if err != nil {
+		t.Fatalf("hash argon2id: %v", err)
+	}
+
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("hash bcrypt: %v", err)
+	}
+
+	cheapHash := testArgon2id("hunter2", 64, 1, 1)
+
+	tests := []struct {
+		name     string
+		stored   string
+		password string
+		want     bool
+		wantErr  bool
+	}{
+		{name: "argon2id match", stored: argonHash, password: "hunter2", want: true},
+		{name: "argon2id mismatch", stored: argonHash, password: "hunter3"},
+		{name: "argon2id custom params", stored: cheapHash, password: "hunter2", want: true},
+		{name: "bcrypt match", stored: string(bcryptHash), password: "hunter2", want: true},
+		{name: "bcrypt mismatch", stored: string(bcryptHash), password: "hunter3"},
+		{name: "plaintext match", stored: "hunter2", password: "hunter2", want: true},
+		{name: "plaintext mismatch", stored: "hunter2", password: "hunter"},
+		{name: "argon2id broken", stored: "$argon2id$v=19$m=64,t=1,p=1$c2FsdA", password: "hunter2", wantErr: true},
+		{name: "bcrypt broken", stored: "$2a$10$tooshort", password: "hunter2", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			got, err := Verify(tt.stored, tt.password)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if got != tt.want {
+				t.Errorf("Verify() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+
+	valid := testArgon2id("x", 64, 1, 1)
+
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("x"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("hash bcrypt: %v", err)
+	}
+
+	salt := base64.RawStdEncoding.EncodeToString([]byte("0123456789abcdef"))
+	key := base64.RawStdEncoding.EncodeToString(make([]byte, 32))
+
+	var withParams = func(params string) string {
+		return fmt.Sprintf("$argon2id$v=19$%s$%s$%s", params, salt, key)
+	}
+
+	tests := []struct {
+		name    string
+		stored  string
+		wantErr bool
+	}{
+		{name: "plaintext", stored: "12345"},
+		{name: "argon2id", stored: valid},
+		{name: "argon2id max params", stored: withParams("m=262144,t=64,p=255")},
+		{name: "zero time", stored: withParams("m=64,t=0,p=1"), wantErr: true},
+		{name: "zero threads", stored: withParams("m=64,t=1,p=0"), wantErr: true},
+		{name: "too many threads", stored: withParams("m=4096,t=1,p=256"), wantErr: true},
+		{name: "too little memory for threads", stored: withParams("m=31,t=1,p=4"), wantErr: true},
+		{name: "too much memory", stored: withParams("m=262145,t=1,p=1"), wantErr: true},
+		{name: "too much time", stored: withParams("m=64,t=65,p=1"), wantErr: true},
+		{name: "wrong version", stored: "$argon2id$v=16$m=64,t=1,p=1$" + salt + "$" + key, wantErr: true},
+		{name: "missing key", stored: withParams("m=64,t=1,p=1") + "$", wantErr: true},
+		{name: "empty key", stored: fmt.Sprintf("$argon2id$v=19$m=64,t=1,p=1$%s$", salt), wantErr: true},
+		{name: "bad salt", stored: fmt.Sprintf("$argon2id$v=19$m=64,t=1,p=1$!!$%s", key), wantErr: true},
+		{name: "bcrypt", stored: string(bcryptHash)},
+		{name: "bcrypt broken", stored: "$2b$04$short", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Check(tt.stored); (err != nil) != tt.wantErr {
+				t.Errorf("Check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestIsHash(t *testing.T) {
+
+	tests := []struct {
+		stored string
+		want   bool
+	}{
+		{stored: "$argon2id$v=19$m=64,t=1,p=1$a$b", want: true},
+		{stored: "$2a$10$abc", want: true},
+		{stored: "$2b$10$abc", want: true},
+		{stored: "$2y$10$abc", want: true},
+		{stored: "$2x$10$abc"},
+		{stored: "$argon2i$v=19$m=64,t=1,p=1$a$b"},
+		{stored: "password"},
+		{stored: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.stored, func(t *testing.T) {
+			if got := IsHash(tt.stored); got != tt.want {
+				t.Errorf("IsHash(%q) = %v, want %v", tt.stored, got, tt.want)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package rest_client
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -14,11 +15,13 @@ import (
 	"time"
 
 	s4 "github.com/maddsua/syncctl/storage_service"
+	"github.com/maddsua/syncctl/storage_service/tokens"
 )
 
 type RestClient struct {
 	RemoteURL  string
 	Auth       *url.Userinfo
+	Token      string
 	HttpClient http.Client
 }
 
@@ -40,7 +43,9 @@ func (client *RestClient) prepare(ctx context.Context, operationMethod, operatio
 		return nil, err
 	}
 
-	if client.Auth != nil && client.Auth.Username() != "" {
+	if client.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+client.Token)
+	} else if client.Auth != nil && client.Auth.Username() != "" {
 		password, _ := client.Auth.Password()
 		req.SetBasicAuth(client.Auth.Username(), password)
 	}
@@ -118,22 +123,117 @@ func (client *RestClient) Put(ctx context.Context, entry *s4.FileUpload, overwri
 	return unwrapJSON[*s4.FileMetadata](client.exec(req))
 }
 
-func (client *RestClient) Download(ctx context.Context, name string) (*s4.ReadableFile, error) {
+func (client *RestClient) CreateUpload(ctx context.Context, entry *s4.FileMetadata, overwrite bool) (*s4.UploadSession, error) {
+
+	params := url.Values{}
+	params.Set("name", entry.Name)
+
+	if overwrite {
+		params.Set("overwrite", "true")
+	}
+
+	req, err := client.prepare(ctx, http.MethodPost, "/upload/session", params, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry.Size >= 0 {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", entry.Size))
+	}
+
+	req.Header.Set("Last-Modified", entry.Modified.Format(time.RFC1123))
+
+	return unwrapJSON[*s4.UploadSession](client.exec(req))
+}
+
+func (client *RestClient) StatUpload(ctx context.Context, id string) (*s4.UploadSession, error) {
+
+	params := url.Values{}
+	params.Set("id", id)
+
+	req, err := client.prepare(ctx, http.MethodGet, "/upload/session", params, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return unwrapJSON[*s4.UploadSession](client.exec(req))
+}
+
+func (client *RestClient) WriteUpload(ctx context.Context, id string, offset int64, chunk []byte) (*s4.UploadSession, error) {
+
+	if len(chunk) == 0 {
+		return client.StatUpload(ctx, id)
+	}
+
+	params := url.Values{}
+	params.Set("id", id)
+
+	req, err := client.prepare(ctx, http.MethodPut, "/upload/session", params, bytes.NewReader(chunk))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/*", offset, offset+int64(len(chunk))-1))
+
+	return unwrapJSON[*s4.UploadSession](client.exec(req))
+}
+
+func (client *RestClient) FinalizeUpload(ctx context.Context, id string, sha256 string) (*s4.FileMetadata, error) {
+
+	params := url.Values{}
+	params.Set("id", id)
+
+	req, err := client.prepare(ctx, http.MethodPost, "/upload/session/finalize", params, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if sha256 != "" {
+		req.Header.Set("If-None-Match", "sha256="+sha256)
+	}
+
+	return unwrapJSON[*s4.FileMetadata](client.exec(req))
+}
+
+func (client *RestClient) CancelUpload(ctx context.Context, id string) error {
+
+	params := url.Values{}
+	params.Set("id", id)
+
+	req, err := client.prepare(ctx, http.MethodDelete, "/upload/session", params, nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = unwrapJSON[any](client.exec(req))
+	return err
+}
+
+func (client *RestClient) Download(ctx context.Context, name string, offset int64) (*s4.ReadableFile, error) {
 
 	params := url.Values{}
 	params.Set("name", name)
 
-	req, err := client.prepare(ctx, http.MethodGet, "/download", params, nil)
+	return client.download(ctx, "/download", params, name, offset)
+}
+
+func (client *RestClient) download(ctx context.Context, operationPath string, params url.Values, name string, offset int64) (*s4.ReadableFile, error) {
+
+	req, err := client.prepare(ctx, http.MethodGet, operationPath, params, nil)
 	if err != nil {
 		return nil, err
 	}
 
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
 	response, err := client.exec(req)
 	if err != nil {
 		return nil, err
 	}
 
-	if response.StatusCode != http.StatusOK {
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusPartialContent {
 
 		if _, err := unwrapJSON[any](response, nil); err != nil {
 			return nil, err
@@ -157,6 +257,23 @@ func (client *RestClient) Download(ctx context.Context, name string) (*s4.Readab
 		meta.Size = val
 	}
 
+	var rangeStart int64
+
+	if response.StatusCode == http.StatusPartialContent {
+
+		start, totalSize, err := parseContentRange(response.Header.Get("Content-Range"))
+		if err != nil {
+			_ = response.Body.Close()
+			return nil, &NetworkError{
+				Message:       "api error",
+				OriginalError: err,
+			}
+		}
+
+		rangeStart = start
+		meta.Size = totalSize
+	}
+
 	if val, ok := strings.CutPrefix(response.Header.Get("Content-Disposition"), "attachment;"); ok {
 		if val, ok = strings.CutPrefix(strings.TrimSpace(val), "filename="); ok {
 			if val, _ = url.QueryUnescape(strings.TrimSpace(val)); val != "" {
@@ -172,6 +289,7 @@ func (client *RestClient) Download(ctx context.Context, name string) (*s4.Readab
 	return &s4.ReadableFile{
 		FileMetadata: meta,
 		ReadCloser:   response.Body,
+		Offset:       rangeStart,
 	}, nil
 }
 
@@ -239,3 +357,122 @@ func (client *RestClient) Find(ctx context.Context, prefix string, filter *regex
 
 	return unwrapJSON[[]s4.FileMetadata](client.exec(req))
 }
+
+func (client *RestClient) ListTrash(ctx context.Context, prefix string) ([]s4.TrashEntry, error) {
+
+	params := url.Values{}
+	params.Set("prefix", prefix)
+
+	req, err := client.prepare(ctx, http.MethodGet, "/trash", params, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return unwrapJSON[[]s4.TrashEntry](client.exec(req))
+}
+
+func (client *RestClient) RestoreTrash(ctx context.Context, id string, overwrite bool) (*s4.FileMetadata, error) {
+
+	params := url.Values{}
+	params.Set("id", id)
+
+	if overwrite {
+		params.Set("overwrite", "true")
+	}
+
+	req, err := client.prepare(ctx, http.MethodPost, "/trash/restore", params, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return unwrapJSON[*s4.FileMetadata](client.exec(req))
+}
+
+func (client *RestClient) EmptyTrash(ctx context.Context, prefix string) ([]s4.TrashEntry, error) {
+
+	params := url.Values{}
+	params.Set("prefix", prefix)
+
+	req, err := client.prepare(ctx, http.MethodDelete, "/trash", params, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return unwrapJSON[[]s4.TrashEntry](client.exec(req))
+}
+
+func (client *RestClient) ListVersions(ctx context.Context, name string) ([]s4.FileVersion, error) {
+
+	params := url.Values{}
+	params.Set("name", name)
+
+	req, err := client.prepare(ctx, http.MethodGet, "/versions", params, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return unwrapJSON[[]s4.FileVersion](client.exec(req))
+}
+
+func (client *RestClient) DownloadVersion(ctx context.Context, name string, id string, offset int64) (*s4.ReadableFile, error) {
+
+	params := url.Values{}
+	params.Set("name", name)
+	params.Set("id", id)
+
+	return client.download(ctx, "/versions/download", params, name, offset)
+}
+
+func (client *RestClient) RestoreVersion(ctx context.Context, name string, id string) (*s4.FileMetadata, error) {
+
+	params := url.Values{}
+	params.Set("name", name)
+	params.Set("id", id)
+
+	req, err := client.prepare(ctx, http.MethodPost, "/versions/restore", params, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return unwrapJSON[*s4.FileMetadata](client.exec(req))
+}
+
+// Returns how much storage the current user takes up, along with the quota limits if there are any
+func (client *RestClient) Usage(ctx context.Context) (*s4.StorageUsage, error) {
+
+	req, err := client.prepare(ctx, http.MethodGet, "/usage", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return unwrapJSON[*s4.StorageUsage](client.exec(req))
+}
+
+// Issues an api token to the current user. Only works when authorized with a password
+func (client *RestClient) IssueToken(ctx context.Context, name string, ttl time.Duration, prefix string, readOnly bool) (*tokens.IssuedToken, error) {
+
+	params := url.Values{}
+
+	if name != "" {
+		params.Set("name", name)
+	}
+
+	if ttl > 0 {
+		params.Set("expires", ttl.String())
+	}
+
+	if prefix != "" {
+		params.Set("prefix", prefix)
+	}
+
+	if readOnly {
+		params.Set("read_only", "true")
+	}
+
+	req, err := client.prepare(ctx, http.MethodPost, "/tokens", params, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return unwrapJSON[*tokens.IssuedToken](client.exec(req))
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 
 	s4 "github.com/maddsua/syncctl/storage_service"
@@ -51,3 +52,31 @@ func unwrapJSON[R any](response *http.Response, err error) (R, error) {
 
 	return result.Data, nil
 }
+
+func parseContentRange(val string) (start int64, totalSize int64, err error) {
+
+	val, ok := strings.CutPrefix(val, "bytes ")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid content range type")
+	}
+
+	span, total, ok := strings.Cut(val, "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid content range value")
+	}
+
+	before, _, ok := strings.Cut(span, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid content range span")
+	}
+
+	if start, err = strconv.ParseInt(before, 10, 64); err != nil || start < 0 {
+		return 0, 0, fmt.Errorf("invalid content range start")
+	}
+
+	if totalSize, err = strconv.ParseInt(total, 10, 64); err != nil || totalSize < start {
+		return 0, 0, fmt.Errorf("invalid content range size")
+	}
+
+	return start, totalSize, nil
+}
@@ -0,0 +1,703 @@
+package rest_handler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	s4 "github.com/maddsua/syncctl/storage_service"
+	"github.com/maddsua/syncctl/utils"
+)
+
+// Serves the storage over WebDAV, so that it could be mounted by file managers on devices that don't have the cli.
+// The storage doesn't have directories as such, they're made up from the file paths. The empty ones created with MKCOL
+// are only kept in memory until a file gets put into them, or until the server restarts
+func NewDAVHandler(backend *Backend, urlPrefix string) s4.SyncHandler {
+
+	storage, stats := backend.Storage, backend.Metrics
+	auth, quotas := backend.auth, backend.quotas
+
+	urlPrefix = strings.TrimRight(urlPrefix, "/")
+
+	var wg sync.WaitGroup
+	var mux http.ServeMux
+	var emptyDirs davDirs
+
+	var authorize = func(wrt http.ResponseWriter, req *http.Request) *UserState {
+		user, err := auth.Authorize(req)
+		if err != nil {
+			writeDAVError(wrt, err)
+			return nil
+		}
+		return user
+	}
+
+	//	directories that exist without having any files in them: the mount points and the ones made with MKCOL
+	var knownDirs = func(user *UserState) []string {
+
+		dirs := emptyDirs.List(user.Username)
+		for _, mount := range user.mounts {
+			dirs = append(dirs, mount.Path)
+		}
+
+		return dirs
+	}
+
+	mux.HandleFunc("OPTIONS /", func(wrt http.ResponseWriter, _ *http.Request) {
+		wrt.Header().Set("DAV", "1, 2")
+		wrt.Header().Set("MS-Author-Via", "DAV")
+		wrt.Header().Set("Allow", "OPTIONS, PROPFIND, PROPPATCH, GET, HEAD, PUT, DELETE, MOVE, MKCOL, LOCK, UNLOCK")
+		wrt.WriteHeader(http.StatusOK)
+	})
+
+	mux.HandleFunc("PROPFIND /", func(wrt http.ResponseWriter, req *http.Request) {
+
+		user := authorize(wrt, req)
+		if user == nil {
+			return
+		}
+
+		name := path.Clean("/" + req.URL.Path)
+
+		target, err := user.Resolve(accessList, name)
+		if err != nil && name != "/" {
+			writeDAVError(wrt, err)
+			return
+		}
+
+		if target != nil && name != "/" {
+
+			entry, err := storage.Stat(req.Context(), target.Name)
+			if err == nil {
+				entry.Name = name
+				writeXML(wrt, http.StatusMultiStatus, davMultistatus{
+					Xmlns:     "DAV:",
+					Responses: []davResponse{davFileResponse(urlPrefix, entry)},
+				})
+				return
+			} else if _, ok := err.(*s4.FileNotFoundError); !ok {
+				slog.Error("WebDAV: Stat file",
+					slog.String("name", target.Name),
+					slog.String("err", err.Error()))
+				writeDAVError(wrt, err)
+				return
+			}
+		}
+
+		wg.Add(1)
+		defer wg.Done()
+
+		files, err := backend.listFiles(req.Context(), user, name)
+		if err != nil {
+			slog.Error("WebDAV: List entries",
+				slog.String("prefix", name),
+				slog.String("err", err.Error()))
+			writeDAVError(wrt, err)
+			return
+		}
+
+		//	child directories along with the last time something in them has changed
+		dirs := map[string]time.Time{}
+		var modified time.Time
+		var children []davResponse
+
+		for _, entry := range files {
+
+			if entry.Modified.After(modified) {
+				modified = entry.Modified
+			}
+
+			child, nested := davChild(name, entry.Name)
+			if !nested {
+				children = append(children, davFileResponse(urlPrefix, &entry))
+			} else if entry.Modified.After(dirs[child]) {
+				dirs[child] = entry.Modified
+			}
+		}
+
+		exists := name == "/" || len(files) > 0
+
+		for _, dir := range knownDirs(user) {
+
+			if dir == name {
+				exists = true
+			} else if child, _ := davChild(name, dir); child != "" && s4.IsPathUnder(dir, name) {
+				exists = true
+				if _, has := dirs[child]; !has {
+					dirs[child] = time.Time{}
+				}
+			}
+		}
+
+		if !exists {
+			writeDAVError(wrt, &s4.FileNotFoundError{Path: name})
+			return
+		}
+
+		result := davMultistatus{
+			Xmlns:     "DAV:",
+			Responses: []davResponse{davDirResponse(urlPrefix, name, modified)},
+		}
+
+		if req.Header.Get("Depth") != "0" {
+
+			for child, modified := range dirs {
+				children = append(children, davDirResponse(urlPrefix, path.Join(name, child), modified))
+			}
+
+			slices.SortFunc(children, func(a, b davResponse) int { return strings.Compare(a.Href, b.Href) })
+			result.Responses = append(result.Responses, children...)
+		}
+
+		writeXML(wrt, http.StatusMultiStatus, result)
+	})
+
+	//	file properties are made up from the metadata, so there's nothing to change. Clients still want to hear that it went fine
+	mux.HandleFunc("PROPPATCH /", func(wrt http.ResponseWriter, req *http.Request) {
+
+		user := authorize(wrt, req)
+		if user == nil {
+			return
+		}
+
+		name := path.Clean("/" + req.URL.Path)
+
+		if err := user.Allow(accessWrite, name); err != nil {
+			writeDAVError(wrt, err)
+			return
+		}
+
+		writeXML(wrt, http.StatusMultiStatus, davMultistatus{
+			Xmlns: "DAV:",
+			Responses: []davResponse{{
+				Href:     davHref(urlPrefix, name, strings.HasSuffix(req.URL.Path, "/")),
+				Propstat: davPropstat{Status: davStatusLine(http.StatusOK)},
+			}},
+		})
+	})
+
+	mux.HandleFunc("HEAD /", func(wrt http.ResponseWriter, req *http.Request) {
+
+		user := authorize(wrt, req)
+		if user == nil {
+			return
+		}
+
+		target, err := user.Resolve(accessRead, req.URL.Path)
+		if err != nil {
+			writeDAVError(wrt, err)
+			return
+		}
+
+		entry, err := storage.Stat(req.Context(), target.Name)
+		if err != nil {
+			writeDAVError(wrt, err)
+			return
+		}
+
+		wrt.Header().Set("Content-Type", "application/octet-stream")
+		wrt.Header().Set("Content-Length", strconv.FormatInt(entry.Size, 10))
+		wrt.Header().Set("Last-Modified", entry.Modified.UTC().Format(http.TimeFormat))
+		wrt.Header().Set("Etag", `"`+entry.SHA256+`"`)
+		wrt.WriteHeader(http.StatusOK)
+	})
+
+	mux.HandleFunc("GET /", func(wrt http.ResponseWriter, req *http.Request) {
+
+		user := authorize(wrt, req)
+		if user == nil {
+			return
+		}
+
+		target, err := user.Resolve(accessRead, req.URL.Path)
+		if err != nil {
+			writeDAVError(wrt, err)
+			return
+		}
+
+		wg.Add(1)
+		defer wg.Done()
+
+		file, err := storage.Get(req.Context(), target.Name)
+		if err != nil {
+			if _, ok := err.(*s4.FileNotFoundError); !ok {
+				slog.Error("WebDAV: Read file",
+					slog.String("name", target.Name),
+					slog.String("err", err.Error()))
+			}
+			writeDAVError(wrt, err)
+			return
+		}
+
+		written := serveFile(wrt, req, path.Base(req.URL.Path), file)
+		stats.BytesDownloaded.Add(float64(written), user.Username)
+	})
+
+	mux.HandleFunc("PUT /", func(wrt http.ResponseWriter, req *http.Request) {
+
+		user := authorize(wrt, req)
+		if user == nil {
+			return
+		}
+
+		name := path.Clean("/" + req.URL.Path)
+		if strings.HasSuffix(req.URL.Path, "/") {
+			http.Error(wrt, "can't put a directory", http.StatusMethodNotAllowed)
+			return
+		}
+
+		target, err := user.Resolve(accessWrite, name)
+		if err != nil {
+			writeDAVError(wrt, err)
+			return
+		}
+
+		//	webdav puts always replace files, but not every user is allowed to do that
+		_, err = storage.Stat(req.Context(), target.Name)
+		overwrite := err == nil
+
+		if overwrite {
+			if err := user.Allow(writeAccess(true), name); err != nil {
+				writeDAVError(wrt, err)
+				return
+			}
+		}
+
+		wg.Add(1)
+		defer wg.Done()
+
+		//	some clients don't say how much data there's going to be, in which case it has to be buffered first
+		size := req.ContentLength
+		if val, err := strconv.ParseInt(req.Header.Get("X-Expected-Entity-Length"), 10, 64); size < 0 && err == nil {
+			size = val
+		}
+
+		quota, err := quotas.Reserve(req.Context(), user, target.Name, size, overwrite)
+		if err != nil {
+			writeDAVError(wrt, err)
+			return
+		}
+
+		meta := s4.FileMetadata{
+			Name:     target.Name,
+			Size:     size,
+			Modified: time.Now(),
+		}
+
+		var reader io.Reader = quota.Reader(io.LimitReader(req.Body, size))
+
+		if size < 0 {
+
+			temp, err := utils.WriteTempFile(os.TempDir(), "s4-dav-", quota.Reader(req.Body))
+			if err != nil {
+				quota.Release(nil)
+				writeDAVError(wrt, selectError(quota.Err(), err))
+				return
+			}
+
+			defer temp.Cleanup()
+
+			file, err := os.Open(temp.Name)
+			if err != nil {
+				quota.Release(nil)
+				writeDAVError(wrt, err)
+				return
+			}
+
+			defer file.Close()
+
+			if stat, err := file.Stat(); err == nil {
+				meta.Size = stat.Size()
+			}
+
+			reader = file
+		}
+
+		result, err := storage.Put(req.Context(), &s4.FileUpload{
+			FileMetadata: meta,
+			Reader:       reader,
+		}, overwrite)
+
+		quota.Release(result)
+
+		if err = selectError(quota.Err(), err); err != nil {
+			slog.Error("WebDAV: Store file",
+				slog.String("name", meta.Name),
+				slog.String("err", err.Error()))
+			writeDAVError(wrt, err)
+			return
+		}
+
+		stats.BytesUploaded.Add(float64(result.Size), user.Username)
+
+		if overwrite {
+			wrt.WriteHeader(http.StatusNoContent)
+		} else {
+			wrt.WriteHeader(http.StatusCreated)
+		}
+	})
+
+	mux.HandleFunc("MKCOL /", func(wrt http.ResponseWriter, req *http.Request) {
+
+		user := authorize(wrt, req)
+		if user == nil {
+			return
+		}
+
+		name := path.Clean("/" + req.URL.Path)
+
+		target, err := user.Resolve(accessWrite, name)
+		if err != nil {
+			writeDAVError(wrt, err)
+			return
+		}
+
+		if _, err := storage.Stat(req.Context(), target.Name); err == nil || name == "/" {
+			http.Error(wrt, "already exists", http.StatusMethodNotAllowed)
+			return
+		}
+
+		emptyDirs.Add(user.Username, name)
+		wrt.WriteHeader(http.StatusCreated)
+	})
+
+	mux.HandleFunc("DELETE /", func(wrt http.ResponseWriter, req *http.Request) {
+
+		user := authorize(wrt, req)
+		if user == nil {
+			return
+		}
+
+		name := path.Clean("/" + req.URL.Path)
+
+		//	a single request shouldn't be able to wipe out everything that the user can see
+		if user.isMountRoot(name) {
+			writeDAVError(wrt, &AuthError{Path: name, Denied: "mount roots can't be deleted"})
+			return
+		}
+
+		target, err := user.Resolve(accessDelete, name)
+		if err != nil {
+			writeDAVError(wrt, err)
+			return
+		}
+
+		wg.Add(1)
+		defer wg.Done()
+
+		if _, err := storage.Delete(req.Context(), target.Name); err == nil {
+			wrt.WriteHeader(http.StatusNoContent)
+			return
+		} else if _, ok := err.(*s4.FileNotFoundError); !ok {
+			slog.Error("WebDAV: Delete file",
+				slog.String("name", target.Name),
+				slog.String("err", err.Error()))
+			writeDAVError(wrt, err)
+			return
+		}
+
+		//	must be a directory then
+		files, err := backend.listFiles(req.Context(), user, name)
+		if err != nil {
+			writeDAVError(wrt, err)
+			return
+		}
+
+		if len(files) == 0 && !emptyDirs.Has(user.Username, name) {
+			writeDAVError(wrt, &s4.FileNotFoundError{Path: name})
+			return
+		}
+
+		//	directories get deleted with everything in them, so clients have to ask for that explicitly
+		if !strings.EqualFold(req.Header.Get("Depth"), "infinity") {
+			http.Error(wrt, "deleting a collection requires 'Depth: infinity'", http.StatusBadRequest)
+			return
+		}
+
+		for _, entry := range files {
+
+			target, err := user.Resolve(accessDelete, entry.Name)
+			if err == nil {
+				_, err = storage.Delete(req.Context(), target.Name)
+			}
+
+			if err != nil {
+				slog.Error("WebDAV: Delete file",
+					slog.String("name", entry.Name),
+					slog.String("err", err.Error()))
+				writeDAVError(wrt, err)
+				return
+			}
+		}
+
+		emptyDirs.Remove(user.Username, name)
+		wrt.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("MOVE /", func(wrt http.ResponseWriter, req *http.Request) {
+
+		user := authorize(wrt, req)
+		if user == nil {
+			return
+		}
+
+		name := path.Clean("/" + req.URL.Path)
+
+		newName, err := davDestination(req.Header.Get("Destination"), urlPrefix)
+		if err != nil {
+			http.Error(wrt, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		overwrite := req.Header.Get("Overwrite") != "F"
+
+		var moveFile = func(name, newName string) (bool, error) {
+
+			source, err := user.Resolve(accessRead|accessWrite, name)
+			if err != nil {
+				return false, err
+			}
+
+			dest, err := user.Resolve(accessWrite, newName)
+			if err != nil {
+				return false, err
+			}
+
+			//	clients ask for overwrites by default, but only actually replacing something needs the permission
+			_, err = storage.Stat(req.Context(), dest.Name)
+			replaced := err == nil
+
+			if replaced && overwrite {
+				if err := user.Allow(writeAccess(true), newName); err != nil {
+					return false, err
+				}
+			}
+
+			_, err = storage.Move(req.Context(), source.Name, dest.Name, overwrite)
+			return replaced, err
+		}
+
+		wg.Add(1)
+		defer wg.Done()
+
+		replaced, err := moveFile(name, newName)
+		if _, ok := err.(*s4.FileNotFoundError); ok {
+
+			//	not a file, so it's a whole directory that's being moved
+			files, err := backend.listFiles(req.Context(), user, name)
+			if err != nil {
+				writeDAVError(wrt, err)
+				return
+			}
+
+			if len(files) == 0 && !emptyDirs.Has(user.Username, name) {
+				writeDAVError(wrt, &s4.FileNotFoundError{Path: name})
+				return
+			}
+
+			for _, entry := range files {
+
+				if _, err := moveFile(entry.Name, path.Join(newName, strings.TrimPrefix(entry.Name, name))); err != nil {
+					slog.Error("WebDAV: Move file",
+						slog.String("name", entry.Name),
+						slog.String("err", err.Error()))
+					writeDAVError(wrt, err)
+					return
+				}
+			}
+
+			emptyDirs.Move(user.Username, name, newName)
+			wrt.WriteHeader(http.StatusCreated)
+			return
+
+		} else if _, ok := err.(*s4.FileConflictError); ok && !overwrite {
+			http.Error(wrt, err.Error(), http.StatusPreconditionFailed)
+			return
+		} else if err != nil {
+			slog.Error("WebDAV: Move file",
+				slog.String("name", name),
+				slog.String("err", err.Error()))
+			writeDAVError(wrt, err)
+			return
+		}
+
+		if replaced {
+			wrt.WriteHeader(http.StatusNoContent)
+		} else {
+			wrt.WriteHeader(http.StatusCreated)
+		}
+	})
+
+	//	locks aren't enforced in any way. They're only here because some clients (looking at you, Finder)
+	//	refuse to write anything to a server that doesn't support them
+	mux.HandleFunc("LOCK /", func(wrt http.ResponseWriter, req *http.Request) {
+
+		user := authorize(wrt, req)
+		if user == nil {
+			return
+		}
+
+		name := path.Clean("/" + req.URL.Path)
+
+		if err := user.Allow(accessWrite, name); err != nil {
+			writeDAVError(wrt, err)
+			return
+		}
+
+		buff := make([]byte, 16)
+		_, _ = rand.Read(buff)
+		token := "opaquelocktoken:" + hex.EncodeToString(buff)
+
+		var resp davLockResponse
+		resp.Xmlns = "DAV:"
+		resp.Lock.Active.Depth = "infinity"
+		resp.Lock.Active.Timeout = "Second-3600"
+		resp.Lock.Active.Token.Href = token
+		resp.Lock.Active.Root.Href = davHref(urlPrefix, name, false)
+
+		wrt.Header().Set("Lock-Token", "<"+token+">")
+		writeXML(wrt, http.StatusOK, resp)
+	})
+
+	mux.HandleFunc("UNLOCK /", func(wrt http.ResponseWriter, req *http.Request) {
+
+		if user := authorize(wrt, req); user == nil {
+			return
+		}
+
+		wrt.WriteHeader(http.StatusNoContent)
+	})
+
+	return &fsHandler{
+		Handler:   stats.Middleware(&mux),
+		WaitGroup: &wg,
+	}
+}
+
+// Unlike with the api, clients have to be told to ask the user for a password
+func writeDAVError(wrt http.ResponseWriter, err error) {
+
+	code := errorStatus(err)
+
+	if authErr, ok := err.(*AuthError); ok && authErr.Denied == "" {
+		wrt.Header().Set("WWW-Authenticate", `Basic realm="syncctl"`)
+		code = http.StatusUnauthorized
+	}
+
+	http.Error(wrt, err.Error(), code)
+}
+
+// Picks the quota error over whatever the storage has wrapped it into
+func selectError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the first path element under the directory, and whether there's more after it
+func davChild(dir, name string) (string, bool) {
+
+	rel := strings.TrimPrefix(name, strings.TrimSuffix(dir, "/")+"/")
+	if rel == name && dir != "/" {
+		return "", false
+	}
+
+	child, _, nested := strings.Cut(strings.TrimPrefix(rel, "/"), "/")
+	return child, nested
+}
+
+// Extracts the user path from the destination url, which has to point to the same handler
+func davDestination(val string, urlPrefix string) (string, error) {
+
+	if val == "" {
+		return "", fmt.Errorf("destination is required")
+	}
+
+	dest, err := url.Parse(val)
+	if err != nil {
+		return "", fmt.Errorf("invalid destination url")
+	}
+
+	name, ok := strings.CutPrefix(dest.Path, urlPrefix)
+	if !ok || (name != "" && !strings.HasPrefix(name, "/")) {
+		return "", fmt.Errorf("destination is outside of the webdav root")
+	}
+
+	return path.Clean("/" + name), nil
+}
+
+// Directories that have been created but that don't have anything in them
+type davDirs struct {
+	mtx     sync.Mutex
+	entries map[string][]string
+}
+
+func (dirs *davDirs) Add(username, name string) {
+
+	dirs.mtx.Lock()
+	defer dirs.mtx.Unlock()
+
+	if dirs.entries == nil {
+		dirs.entries = map[string][]string{}
+	}
+
+	if !slices.Contains(dirs.entries[username], name) {
+		dirs.entries[username] = append(dirs.entries[username], name)
+	}
+}
+
+func (dirs *davDirs) List(username string) []string {
+
+	dirs.mtx.Lock()
+	defer dirs.mtx.Unlock()
+
+	return slices.Clone(dirs.entries[username])
+}
+
+// Checks if the directory itself or anything inside of it is there
+func (dirs *davDirs) Has(username, name string) bool {
+	return slices.ContainsFunc(dirs.List(username), func(entry string) bool {
+		return s4.IsPathUnder(entry, name)
+	})
+}
+
+// Removes the directory along with everything inside of it
+func (dirs *davDirs) Remove(username, name string) {
+
+	dirs.mtx.Lock()
+	defer dirs.mtx.Unlock()
+
+	if dirs.entries == nil {
+		return
+	}
+
+	dirs.entries[username] = slices.DeleteFunc(dirs.entries[username], func(entry string) bool {
+		return s4.IsPathUnder(entry, name)
+	})
+}
+
+func (dirs *davDirs) Move(username, name, newName string) {
+
+	dirs.mtx.Lock()
+	defer dirs.mtx.Unlock()
+
+	for idx, entry := range dirs.entries[username] {
+		if s4.IsPathUnder(entry, name) {
+			dirs.entries[username][idx] = path.Join(newName, strings.TrimPrefix(entry, name))
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package rest_handler
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	s4 "github.com/maddsua/syncctl/storage_service"
+)
+
+// The 'D:' prefixes are baked into the element names, since encoding/xml
+// has its own ideas about namespaces that not every client is happy with
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"D:multistatus"`
+	Xmlns     string        `xml:"xmlns:D,attr"`
+	Responses []davResponse `xml:"D:response"`
+}
+
+type davResponse struct {
+	Href     string      `xml:"D:href"`
+	Propstat davPropstat `xml:"D:propstat"`
+}
+
+type davPropstat struct {
+	Prop   davProp `xml:"D:prop"`
+	Status string  `xml:"D:status"`
+}
+
+type davProp struct {
+	DisplayName   string           `xml:"D:displayname,omitempty"`
+	ResourceType  *davResourceType `xml:"D:resourcetype,omitempty"`
+	ContentLength *int64           `xml:"D:getcontentlength,omitempty"`
+	ContentType   string           `xml:"D:getcontenttype,omitempty"`
+	LastModified  string           `xml:"D:getlastmodified,omitempty"`
+	ETag          string           `xml:"D:getetag,omitempty"`
+}
+
+type davResourceType struct {
+	Collection *struct{} `xml:"D:collection"`
+}
+
+type davLockResponse struct {
+	XMLName xml.Name `xml:"D:prop"`
+	Xmlns   string   `xml:"xmlns:D,attr"`
+	Lock    struct {
+		Active struct {
+			Type struct {
+				Write struct{} `xml:"D:write"`
+			} `xml:"D:locktype"`
+			Scope struct {
+				Exclusive struct{} `xml:"D:exclusive"`
+			} `xml:"D:lockscope"`
+			Depth   string `xml:"D:depth"`
+			Timeout string `xml:"D:timeout"`
+			Token   struct {
+				Href string `xml:"D:href"`
+			} `xml:"D:locktoken"`
+			Root struct {
+				Href string `xml:"D:href"`
+			} `xml:"D:lockroot"`
+		} `xml:"D:activelock"`
+	} `xml:"D:lockdiscovery"`
+}
+
+func davHref(prefix, name string, isDir bool) string {
+
+	href := (&url.URL{Path: path.Join(prefix, name)}).EscapedPath()
+	if isDir && !strings.HasSuffix(href, "/") {
+		href += "/"
+	}
+
+	return href
+}
+
+func davStatusLine(code int) string {
+	return fmt.Sprintf("HTTP/1.1 %d %s", code, http.StatusText(code))
+}
+
+func davFileResponse(prefix string, entry *s4.FileMetadata) davResponse {
+
+	size := entry.Size
+
+	return davResponse{
+		Href: davHref(prefix, entry.Name, false),
+		Propstat: davPropstat{
+			Prop: davProp{
+				DisplayName:   path.Base(entry.Name),
+				ResourceType:  &davResourceType{},
+				ContentLength: &size,
+				ContentType:   "application/octet-stream",
+				LastModified:  entry.Modified.UTC().Format(http.TimeFormat),
+				ETag:          `"` + entry.SHA256 + `"`,
+			},
+			Status: davStatusLine(http.StatusOK),
+		},
+	}
+}
+
+func davDirResponse(prefix string, name string, modified time.Time) davResponse {
+
+	prop := davProp{
+		DisplayName:  path.Base(name),
+		ResourceType: &davResourceType{Collection: &struct{}{}},
+	}
+
+	if !modified.IsZero() {
+		prop.LastModified = modified.UTC().Format(http.TimeFormat)
+	}
+
+	return davResponse{
+		Href: davHref(prefix, name, true),
+		Propstat: davPropstat{
+			Prop:   prop,
+			Status: davStatusLine(http.StatusOK),
+		},
+	}
+}
+
+func writeXML(wrt http.ResponseWriter, code int, val any) {
+
+	wrt.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	wrt.WriteHeader(code)
+
+	_, _ = io.WriteString(wrt, xml.Header)
+	_ = xml.NewEncoder(wrt).Encode(val)
+}
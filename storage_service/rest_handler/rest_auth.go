@@ -1,6 +1,7 @@
 package rest_handler
 
 import (
+	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/base64"
 	"fmt"
@@ -11,24 +12,106 @@ import (
 	"strings"
 	"sync"
 
+	s4 "github.com/maddsua/syncctl/storage_service"
+	"github.com/maddsua/syncctl/storage_service/audit"
 	"github.com/maddsua/syncctl/storage_service/config"
+	"github.com/maddsua/syncctl/storage_service/metrics"
+	"github.com/maddsua/syncctl/storage_service/passwords"
+	"github.com/maddsua/syncctl/storage_service/tokens"
 )
 
 type AuthThingy struct {
-	users sync.Map
+	users    sync.Map
+	verified sync.Map
+	//	s3 access keys mapped to the users
+	accessKeys sync.Map
+	Tokens     *tokens.Store
+	Metrics    *metrics.ServerMetrics
 }
 
 func (auth *AuthThingy) LoadUsers(users []config.UserConfig) {
 	for _, entry := range users {
-		auth.users.Store(entry.Username, &UserState{UserConfig: entry})
+
+		if !passwords.IsHash(entry.Password) {
+			slog.Warn("User auth: Plaintext password in config, consider hashing it",
+				slog.String("username", entry.Username))
+		}
+
+		state := &UserState{
+			UserConfig: entry,
+			mounts:     newUserMounts(&entry),
+		}
+
+		auth.users.Store(entry.Username, state)
+
+		if entry.S3.AccessKey != "" {
+			auth.accessKeys.Store(entry.S3.AccessKey, state)
+		}
 	}
 }
 
+// Password hashes are slow to check on purpose, and since clients send the password with every single request,
+// the last one that matched is kept around as a plain sha256 digest which is a lot cheaper to compare against
+func (auth *AuthThingy) checkPassword(user *UserState, password string) bool {
+
+	if !passwords.IsHash(user.Password) {
+		return subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) == 1
+	}
+
+	digest := sha256.Sum256([]byte(password))
+
+	if val, ok := auth.verified.Load(user.Username); ok {
+		if known := val.([sha256.Size]byte); subtle.ConstantTimeCompare(known[:], digest[:]) == 1 {
+			return true
+		}
+	}
+
+	ok, err := passwords.Verify(user.Password, password)
+	if err != nil {
+		slog.Error("User auth: Verify password hash",
+			slog.String("username", user.Username),
+			slog.String("err", err.Error()))
+		return false
+	}
+
+	if ok {
+		auth.verified.Store(user.Username, digest)
+	}
+
+	return ok
+}
+
 func (auth *AuthThingy) Authorize(req *http.Request) (*UserState, error) {
 
+	user, err := auth.authorize(req)
+	if err != nil {
+		return nil, err
+	}
+
+	setActor(req, user)
+	return user, nil
+}
+
+// Lets the access and audit logs know who's there
+func setActor(req *http.Request, user *UserState) {
+	if actor := audit.ActorFrom(req.Context()); actor != nil {
+		actor.User = user.Username
+		if user.Token != nil {
+			actor.TokenID = user.Token.ID
+		}
+	}
+}
+
+func (auth *AuthThingy) authorize(req *http.Request) (*UserState, error) {
+
+	if value, ok := extractBearerToken(req); ok {
+		return auth.authorizeToken(value)
+	}
+
 	creds := extractBasicAuth(req)
 	if creds == nil {
 		slog.Debug("User auth: Unauthorized")
+		auth.Metrics.AuthFailures.Inc("missing")
 		return nil, &AuthError{}
 	}
 
@@ -37,9 +120,10 @@ func (auth *AuthThingy) Authorize(req *http.Request) (*UserState, error) {
 
 		pass, _ := creds.Password()
 
-		if subtle.ConstantTimeCompare([]byte(state.Password), []byte(pass)) != 1 {
+		if !auth.checkPassword(state, pass) {
 			slog.Warn("User auth: Password mismatch",
 				slog.String("username", state.Username))
+			auth.Metrics.AuthFailures.Inc("password")
 			return nil, &AuthError{IsInvalid: true}
 		}
 
@@ -49,9 +133,61 @@ func (auth *AuthThingy) Authorize(req *http.Request) (*UserState, error) {
 	slog.Warn("User auth: Username not found",
 		slog.String("username", creds.Username()))
 
+	auth.Metrics.AuthFailures.Inc("username")
+
+	return nil, &AuthError{IsInvalid: true}
+}
+
+func (auth *AuthThingy) authorizeToken(value string) (*UserState, error) {
+
+	if auth.Tokens == nil {
+		return nil, &AuthError{IsInvalid: true}
+	}
+
+	token, err := auth.Tokens.Verify(value)
+	if err != nil {
+
+		if err != tokens.ErrInvalidToken && err != tokens.ErrTokenExpired {
+			slog.Error("User auth: Verify token",
+				slog.String("err", err.Error()))
+			return nil, err
+		}
+
+		slog.Warn("User auth: Token rejected",
+			slog.String("reason", err.Error()))
+
+		auth.Metrics.AuthFailures.Inc("token")
+
+		return nil, &AuthError{IsInvalid: true}
+	}
+
+	entry, _ := auth.users.Load(token.Username)
+	if state, ok := entry.(*UserState); ok {
+		scoped := *state
+		scoped.Token = token
+		return &scoped, nil
+	}
+
+	//	tokens outlive users that were removed from the config, but they shouldn't work anymore
+	slog.Warn("User auth: Token owner not found",
+		slog.String("username", token.Username),
+		slog.String("token_id", token.ID))
+
+	auth.Metrics.AuthFailures.Inc("token")
+
 	return nil, &AuthError{IsInvalid: true}
 }
 
+func extractBearerToken(req *http.Request) (string, bool) {
+
+	schema, value, _ := strings.Cut(strings.TrimSpace(req.Header.Get("Authorization")), " ")
+	if !strings.EqualFold(schema, "Bearer") {
+		return "", false
+	}
+
+	return strings.TrimSpace(value), true
+}
+
 func extractBasicAuth(req *http.Request) *url.Userinfo {
 
 	schema, value, _ := strings.Cut(strings.TrimSpace(req.Header.Get("Authorization")), " ")
@@ -75,29 +211,140 @@ func extractBasicAuth(req *http.Request) *url.Userinfo {
 
 type UserState struct {
 	config.UserConfig
+	//	set when the request was authorized with an api token, which can limit what the user can do
+	Token  *tokens.Token
+	mounts []userMount
 }
 
-func (user *UserState) ScopePath(name string) string {
-	if user.RootDir == "" {
-		return name
+type accessMode int
+
+const (
+	accessList = accessMode(1 << iota)
+	accessRead
+	accessWrite
+	//	replacing files that already exist
+	accessOverwrite
+	accessDelete
+)
+
+const accessAll = accessList | accessRead | accessWrite | accessOverwrite | accessDelete
+
+func (mode accessMode) String() string {
+
+	var names []string
+
+	for _, entry := range []struct {
+		mode accessMode
+		name string
+	}{
+		{accessList, "list"},
+		{accessRead, "read"},
+		{accessWrite, "write"},
+		{accessOverwrite, "overwrite"},
+		{accessDelete, "delete"},
+	} {
+		if mode&entry.mode != 0 {
+			names = append(names, entry.name)
+		}
+	}
+
+	return strings.Join(names, ", ")
+}
+
+// Write access, plus the permission to replace existing files when that's what's being asked for
+func writeAccess(overwrite bool) accessMode {
+	if overwrite {
+		return accessWrite | accessOverwrite
 	}
-	return path.Join(user.RootDir, name)
+	return accessWrite
+}
+
+// What the user's role allows for, before any token restrictions are applied
+func (user *UserState) permissions() accessMode {
+
+	var perms accessMode
+
+	switch user.Role {
+	case config.RoleReadOnly:
+		perms = accessList | accessRead
+	case config.RoleDropBox:
+		//	drop box users can only add new files, they can't even see what's already there
+		perms = accessWrite
+	default:
+		perms = accessAll
+	}
+
+	//	replacing a file destroys it just as well as deleting it does
+	if user.NoDelete {
+		perms &^= accessDelete | accessOverwrite
+	}
+
+	return perms
+}
+
+// Checks if the user is allowed to access a path. The path is relative to the user's root,
+// same as the token path prefix is
+func (user *UserState) Allow(mode accessMode, name string) error {
+
+	name = path.Clean("/" + name)
+
+	if err := user.allowRole(mode, name); err != nil {
+		return err
+	}
+
+	mount := user.mountOf(name)
+	if mount == nil {
+		return &AuthError{Path: name, Denied: "path is outside of the user's mounts"}
+	}
+
+	return mount.allow(mode, name)
+}
+
+// Checks the access against the user role and the token, if there's one
+func (user *UserState) allowRole(mode accessMode, name string) error {
+
+	if denied := mode &^ user.permissions(); denied != 0 {
+		return &AuthError{Path: name, Denied: fmt.Sprintf("user is not allowed to %s", denied)}
+	}
+
+	if user.Token == nil {
+		return nil
+	}
+
+	if mode&^(accessList|accessRead) != 0 && user.Token.ReadOnly {
+		return &AuthError{Path: name, Denied: "token is read-only"}
+	}
+
+	if prefix := user.Token.PathPrefix; prefix != "" && !s4.IsPathUnder(name, prefix) {
+		return &AuthError{Path: name, Denied: "path is outside of the token scope"}
+	}
+
+	return nil
 }
 
-func (user *UserState) UnscopePath(name string) string {
-	if user.RootDir == "" {
-		return name
+func (mount *userMount) allow(mode accessMode, name string) error {
+	if mode&^(accessList|accessRead) != 0 && mount.ReadOnly {
+		return &AuthError{Path: name, Denied: fmt.Sprintf("'%s' is mounted read-only", mount.Path)}
 	}
-	return path.Join("/" + strings.TrimPrefix(path.Clean(name), path.Clean(user.RootDir)))
+	return nil
 }
 
 type AuthError struct {
 	IsInvalid bool
+	//	set when the credentials are fine, but the user isn't allowed to do something
+	Denied string
+	Path   string
 }
 
 func (err *AuthError) Error() string {
-	if err.IsInvalid {
+	switch {
+	case err.Denied != "" && err.Path != "":
+		return fmt.Sprintf("access to '%s' denied: %s", err.Path, err.Denied)
+	case err.Denied != "":
+		return "access denied: " + err.Denied
+	case err.IsInvalid:
 		return "invalid credentials"
+	default:
+		return "unauthorized"
 	}
-	return "unauthorized"
 }
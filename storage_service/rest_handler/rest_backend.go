@@ -0,0 +1,56 @@
+package rest_handler
+
+import (
+	"context"
+	"time"
+
+	s4 "github.com/maddsua/syncctl/storage_service"
+	"github.com/maddsua/syncctl/storage_service/config"
+	"github.com/maddsua/syncctl/storage_service/metrics"
+	"github.com/maddsua/syncctl/storage_service/tokens"
+)
+
+// What the api frontends share, so that the auth and the quotas work the same no matter which one the user goes through
+type Backend struct {
+	Storage s4.Storage
+	Tokens  *tokens.Store
+	Metrics *metrics.ServerMetrics
+	auth    *AuthThingy
+	quotas  *quotaKeeper
+}
+
+func NewBackend(storage s4.Storage, tokenStore *tokens.Store, stats *metrics.ServerMetrics, cfg *config.AuthConfig) *Backend {
+
+	auth := AuthThingy{Tokens: tokenStore, Metrics: stats}
+	auth.LoadUsers(cfg.Users)
+
+	return &Backend{
+		Storage: storage,
+		Tokens:  tokenStore,
+		Metrics: stats,
+		auth:    &auth,
+		quotas:  newQuotaKeeper(storage, &auth),
+	}
+}
+
+// Lists every file under a directory, across all the mounts that it covers. Names are the user paths
+func (backend *Backend) listFiles(ctx context.Context, user *UserState, name string) ([]s4.FileMetadata, error) {
+
+	scopes, err := user.ListScopes(accessList, name)
+	if err != nil {
+		return nil, err
+	}
+
+	started := time.Now()
+	defer func() { backend.Metrics.FindDuration.Observe(time.Since(started).Seconds()) }()
+
+	return listAcross(user, scopes, func(entry *s4.FileMetadata) *string { return &entry.Name }, func(scope *listScope) ([]s4.FileMetadata, error) {
+
+		entries, err := backend.Storage.Find(ctx, scope.Prefix, nil, true, 0, 0)
+		if _, ok := err.(*s4.FileNotFoundError); ok {
+			return nil, nil
+		}
+
+		return entries, err
+	})
+}
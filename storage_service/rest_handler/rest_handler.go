@@ -7,23 +7,41 @@ import (
 	"net/http"
 	"net/url"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	s4 "github.com/maddsua/syncctl/storage_service"
-	"github.com/maddsua/syncctl/storage_service/config"
+	"github.com/maddsua/syncctl/storage_service/metaindex"
+	"github.com/maddsua/syncctl/storage_service/tokens"
+	"github.com/maddsua/syncctl/storage_service/uploads"
 )
 
-func NewHandler(storage s4.Storage, cfg *config.AuthConfig) s4.SyncHandler {
+func NewHandler(backend *Backend, sessions *uploads.SessionStore) s4.SyncHandler {
 
-	var auth AuthThingy
-	auth.LoadUsers(cfg.Users)
+	storage, tokenStore, stats := backend.Storage, backend.Tokens, backend.Metrics
+	auth, quotas := backend.auth, backend.quotas
 
 	var wg sync.WaitGroup
 	var mux http.ServeMux
 
+	//	upload sessions belong to the user, but that doesn't mean the user (or the token) is allowed to touch the file that a session is for
+	var allowSession = func(user *UserState, mode accessMode, id string) (*s4.UploadSession, error) {
+
+		session, err := sessions.Stat(user.Username, id)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := user.Allow(mode, user.UnscopePath(session.Name)); err != nil {
+			return nil, err
+		}
+
+		return session, nil
+	}
+
 	mux.HandleFunc("GET /gen_204", func(wrt http.ResponseWriter, _ *http.Request) {
 		wrt.WriteHeader(http.StatusNoContent)
 	})
@@ -36,8 +54,14 @@ func NewHandler(storage s4.Storage, cfg *config.AuthConfig) s4.SyncHandler {
 			return
 		}
 
+		target, err := user.Resolve(writeAccess(strings.EqualFold(req.URL.Query().Get("overwrite"), "true")), req.URL.Query().Get("name"))
+		if err != nil {
+			writeError(wrt, err)
+			return
+		}
+
 		meta := s4.FileMetadata{
-			Name:     user.ScopePath(req.URL.Query().Get("name")),
+			Name:     target.Name,
 			Modified: time.Now(),
 		}
 
@@ -64,11 +88,25 @@ func NewHandler(storage s4.Storage, cfg *config.AuthConfig) s4.SyncHandler {
 		wg.Add(1)
 		defer wg.Done()
 
+		quota, err := quotas.Reserve(req.Context(), user, meta.Name, meta.Size, strings.EqualFold(req.URL.Query().Get("overwrite"), "true"))
+		if err != nil {
+			writeError(wrt, err)
+			return
+		}
+
 		result, err := storage.Put(req.Context(), &s4.FileUpload{
 			FileMetadata: meta,
-			Reader:       io.LimitReader(req.Body, meta.Size),
+			Reader:       quota.Reader(io.LimitReader(req.Body, meta.Size)),
 		}, strings.EqualFold(req.URL.Query().Get("overwrite"), "true"))
 
+		quota.Release(result)
+
+		if qerr := quota.Err(); qerr != nil {
+			err = qerr
+		} else if result != nil {
+			stats.BytesUploaded.Add(float64(result.Size), user.Username)
+		}
+
 		if err != nil {
 			slog.Error("Storage: Store file",
 				slog.String("name", meta.Name),
@@ -76,13 +114,13 @@ func NewHandler(storage s4.Storage, cfg *config.AuthConfig) s4.SyncHandler {
 		}
 
 		if result != nil {
-			result.Name = user.UnscopePath(result.Name)
+			result.Name = target.unscope(result.Name)
 		}
 
 		writeGeneirc(wrt, result, err)
 	})
 
-	mux.HandleFunc("GET /download", func(wrt http.ResponseWriter, req *http.Request) {
+	mux.HandleFunc("POST /upload/session", func(wrt http.ResponseWriter, req *http.Request) {
 
 		user, err := auth.Authorize(req)
 		if err != nil {
@@ -90,69 +128,248 @@ func NewHandler(storage s4.Storage, cfg *config.AuthConfig) s4.SyncHandler {
 			return
 		}
 
-		wg.Add(1)
-		defer wg.Done()
+		if req.URL.Query().Get("name") == "" {
+			writeError(wrt, &s4.NameError{})
+			return
+		}
 
-		file, err := storage.Get(req.Context(), user.ScopePath(req.URL.Query().Get("name")))
+		target, err := user.Resolve(writeAccess(strings.EqualFold(req.URL.Query().Get("overwrite"), "true")), req.URL.Query().Get("name"))
 		if err != nil {
-			slog.Error("Storage: Read file",
-				slog.String("name", file.Name),
+			writeError(wrt, err)
+			return
+		}
+
+		meta := s4.FileMetadata{
+			Name:     target.Name,
+			Modified: time.Now(),
+			Size:     -1,
+		}
+
+		if val, _ := time.Parse(time.RFC1123, req.Header.Get("Last-Modified")); !val.IsZero() {
+			meta.Modified = val
+		}
+
+		if val := req.Header.Get("Content-Range"); val != "" {
+			if _, _, total, err := parseUploadRange(val); err != nil {
+				writeErrorWithCode(wrt, err, http.StatusBadRequest)
+				return
+			} else {
+				meta.Size = total
+			}
+		}
+
+		//	there's no point in starting an upload that won't fit anyway
+		if meta.Size > 0 {
+			if err := quotas.Check(req.Context(), user, meta.Name, meta.Size, strings.EqualFold(req.URL.Query().Get("overwrite"), "true")); err != nil {
+				writeError(wrt, err)
+				return
+			}
+		}
+
+		session, err := sessions.Create(user.Username, &meta, strings.EqualFold(req.URL.Query().Get("overwrite"), "true"))
+		if err != nil {
+			slog.Error("Uploads: Create session",
+				slog.String("name", meta.Name),
 				slog.String("err", err.Error()))
+		}
+
+		if session != nil {
+			session.Name = target.unscope(session.Name)
+		}
+
+		writeGeneirc(wrt, session, err)
+	})
+
+	mux.HandleFunc("GET /upload/session", func(wrt http.ResponseWriter, req *http.Request) {
+
+		user, err := auth.Authorize(req)
+		if err != nil {
 			writeError(wrt, err)
 			return
 		}
 
-		defer file.ReadSeekCloser.Close()
+		session, err := allowSession(user, accessWrite, req.URL.Query().Get("id"))
+		if session != nil {
+			session.Name = user.UnscopePath(session.Name)
+		}
+
+		writeGeneirc(wrt, session, err)
+	})
+
+	mux.HandleFunc("PUT /upload/session", func(wrt http.ResponseWriter, req *http.Request) {
 
-		cringe := contentRange{}
-		if err := cringe.ParseWith(req.Header.Get("Range"), file.Size); err != nil {
-			writeErrorWithCode(wrt, err, http.StatusRequestedRangeNotSatisfiable)
+		user, err := auth.Authorize(req)
+		if err != nil {
+			writeError(wrt, err)
 			return
 		}
 
-		//	static headers that aren't really needed but still are set for informational purposes
-		wrt.Header().Set("Content-Type", "application/octet-stream")
-		wrt.Header().Set("Accept-Ranges", "bytes")
+		start, end, _, err := parseUploadRange(req.Header.Get("Content-Range"))
+		if err != nil {
+			writeErrorWithCode(wrt, err, http.StatusBadRequest)
+			return
+		} else if start < 0 {
+			writeErrorWithCode(wrt, fmt.Errorf("content range must specify a span"), http.StatusBadRequest)
+			return
+		}
 
-		//	these are dynamic and slightly repurposed headers
-		wrt.Header().Set("Last-Modified", file.FileMetadata.Modified.Format(time.RFC1123))
-		wrt.Header().Set("Content-Disposition", "attachment; filename="+url.QueryEscape(user.UnscopePath(file.Name)))
-		wrt.Header().Set("Etag", "sha256="+file.FileMetadata.SHA256)
+		wg.Add(1)
+		defer wg.Done()
+
+		id := req.URL.Query().Get("id")
+		chunkSize := end - start + 1
 
-		if cringe.Valid {
-			wrt.Header().Set("Content-Length", strconv.FormatInt(cringe.Size(), 10))
-			wrt.Header().Set("Content-Range", cringe.String())
-			wrt.WriteHeader(http.StatusPartialContent)
-		} else {
-			wrt.Header().Set("Content-Length", strconv.FormatInt(file.FileMetadata.Size, 10))
-			wrt.WriteHeader(http.StatusOK)
+		session, err := allowSession(user, accessWrite, id)
+		if err != nil {
+			writeError(wrt, err)
+			return
 		}
 
-		if cringe.Valid && cringe.Start > 0 {
-			if _, err := file.ReadSeekCloser.Seek(cringe.Start, io.SeekStart); err != nil {
-				slog.Error("Storage: Serve file",
-					slog.String("name", file.Name),
-					slog.String("err", err.Error()))
+		//	chunks of uploads with an unknown size get checked as they come
+		if hasQuota(user) {
+
+			size := end + 1
+			if session.SizeKnown() {
+				size = session.Size
+			}
+
+			if err := quotas.Check(req.Context(), user, session.Name, size, session.Overwrite); err != nil {
 				writeError(wrt, err)
 				return
 			}
 		}
 
-		bodyReader := io.LimitReader(file.ReadSeekCloser, file.Size)
-		if cringe.Valid && cringe.End > 0 {
-			bodyReader = io.LimitReader(file.ReadSeekCloser, cringe.Size())
+		session, err = sessions.Write(req.Context(), user.Username, id, start, io.LimitReader(req.Body, chunkSize))
+		if session != nil && session.Offset > start {
+			stats.BytesUploaded.Add(float64(session.Offset-start), user.Username)
 		}
 
-		if _, err := io.Copy(wrt, bodyReader); err != nil {
-			slog.Error("Storage: Serve file",
-				slog.String("name", file.Name),
+		if err == nil && session.Offset != end+1 {
+			err = &s4.UploadConflictError{ID: id, Offset: session.Offset}
+		}
+
+		if err != nil {
+			slog.Error("Uploads: Write chunk",
+				slog.String("id", id),
+				slog.String("err", err.Error()))
+		}
+
+		if session != nil {
+			session.Name = user.UnscopePath(session.Name)
+		}
+
+		writeGeneirc(wrt, session, err)
+	})
+
+	mux.HandleFunc("DELETE /upload/session", func(wrt http.ResponseWriter, req *http.Request) {
+
+		user, err := auth.Authorize(req)
+		if err != nil {
+			writeError(wrt, err)
+			return
+		}
+
+		if _, err := allowSession(user, accessWrite, req.URL.Query().Get("id")); err != nil {
+			writeError(wrt, err)
+			return
+		}
+
+		err = sessions.Remove(user.Username, req.URL.Query().Get("id"))
+		writeGeneirc[any](wrt, nil, err)
+	})
+
+	mux.HandleFunc("POST /upload/session/finalize", func(wrt http.ResponseWriter, req *http.Request) {
+
+		user, err := auth.Authorize(req)
+		if err != nil {
+			writeError(wrt, err)
+			return
+		}
+
+		wg.Add(1)
+		defer wg.Done()
+
+		id := req.URL.Query().Get("id")
+
+		if _, err := allowSession(user, accessWrite, id); err != nil {
+			writeError(wrt, err)
+			return
+		}
+
+		var result *s4.FileMetadata
+
+		err = sessions.Commit(user.Username, id, func(session *s4.UploadSession, reader io.Reader) error {
+
+			meta := s4.FileMetadata{
+				Name:     session.Name,
+				Size:     session.Offset,
+				Modified: session.Modified,
+			}
+
+			if val, ok := strings.CutPrefix(req.Header.Get("If-None-Match"), "sha256="); ok {
+				meta.SHA256 = val
+			}
+
+			quota, err := quotas.Reserve(req.Context(), user, meta.Name, meta.Size, session.Overwrite)
+			if err != nil {
+				return err
+			}
+
+			result, err = storage.Put(req.Context(), &s4.FileUpload{
+				FileMetadata: meta,
+				Reader:       quota.Reader(reader),
+			}, session.Overwrite)
+
+			quota.Release(result)
+
+			if qerr := quota.Err(); qerr != nil {
+				return qerr
+			}
+
+			return err
+		})
+
+		if err != nil {
+			slog.Error("Uploads: Finalize",
+				slog.String("id", id),
 				slog.String("err", err.Error()))
+		}
+
+		if result != nil {
+			result.Name = user.UnscopePath(result.Name)
+		}
+
+		writeGeneirc(wrt, result, err)
+	})
+
+	mux.HandleFunc("GET /download", func(wrt http.ResponseWriter, req *http.Request) {
+
+		user, err := auth.Authorize(req)
+		if err != nil {
+			writeError(wrt, err)
 			return
 		}
 
-		if flusher, ok := wrt.(http.Flusher); ok {
-			flusher.Flush()
+		target, err := user.Resolve(accessRead, req.URL.Query().Get("name"))
+		if err != nil {
+			writeError(wrt, err)
+			return
 		}
+
+		wg.Add(1)
+		defer wg.Done()
+
+		file, err := storage.Get(req.Context(), target.Name)
+		if err != nil {
+			slog.Error("Storage: Read file",
+				slog.String("name", target.Name),
+				slog.String("err", err.Error()))
+			writeError(wrt, err)
+			return
+		}
+
+		written := serveFile(wrt, req, target.unscope(file.Name), file)
+		stats.BytesDownloaded.Add(float64(written), user.Username)
 	})
 
 	mux.HandleFunc("GET /stat", func(wrt http.ResponseWriter, req *http.Request) {
@@ -163,17 +380,21 @@ func NewHandler(storage s4.Storage, cfg *config.AuthConfig) s4.SyncHandler {
 			return
 		}
 
-		name := user.ScopePath(req.URL.Query().Get("name"))
+		target, err := user.Resolve(accessRead, req.URL.Query().Get("name"))
+		if err != nil {
+			writeError(wrt, err)
+			return
+		}
 
-		result, err := storage.Stat(req.Context(), name)
+		result, err := storage.Stat(req.Context(), target.Name)
 		if err != nil {
 			slog.Error("Storage: State",
-				slog.String("name", name),
+				slog.String("name", target.Name),
 				slog.String("err", err.Error()))
 		}
 
 		if result != nil {
-			result.Name = user.UnscopePath(result.Name)
+			result.Name = target.unscope(result.Name)
 		}
 
 		writeGeneirc(wrt, result, err)
@@ -188,7 +409,13 @@ func NewHandler(storage s4.Storage, cfg *config.AuthConfig) s4.SyncHandler {
 		}
 
 		prefix := req.URL.Query().Get("prefix")
-		scopedPrefix := user.ScopePath(prefix)
+
+		scopes, err := user.ListScopes(accessList, prefix)
+		if err != nil {
+			writeError(wrt, err)
+			return
+		}
+
 		limit, _ := strconv.Atoi(req.URL.Query().Get("limit"))
 		offset, _ := strconv.Atoi(req.URL.Query().Get("offset"))
 
@@ -203,24 +430,37 @@ func NewHandler(storage s4.Storage, cfg *config.AuthConfig) s4.SyncHandler {
 		wg.Add(1)
 		defer wg.Done()
 
-		result, err := storage.Find(
-			req.Context(),
-			scopedPrefix,
-			filter,
-			strings.EqualFold(req.URL.Query().Get("recursive"), "true"),
-			offset,
-			limit,
-		)
+		recursive := strings.EqualFold(req.URL.Query().Get("recursive"), "true")
+
+		//	mounts that are located under the prefix can't have any files directly in it
+		if !recursive {
+			scopes = slices.DeleteFunc(scopes, func(scope listScope) bool {
+				return !s4.IsPathUnder(prefix, scope.Path)
+			})
+		}
+
+		//	a listing that covers more than one mount has to be merged before it can be paged
+		merged := len(scopes) > 1
+		started := time.Now()
+
+		result, err := listAcross(user, scopes, func(entry *s4.FileMetadata) *string { return &entry.Name }, func(scope *listScope) ([]s4.FileMetadata, error) {
+
+			if merged {
+				return storage.Find(req.Context(), scope.Prefix, filter, recursive, 0, 0)
+			}
+
+			return storage.Find(req.Context(), scope.Prefix, filter, recursive, offset, limit)
+		})
+
+		stats.FindDuration.Observe(time.Since(started).Seconds())
 
 		if err != nil {
 			slog.Error("Storage: List entries",
 				slog.String("prefix", prefix),
-				slog.String("scope_prefix", scopedPrefix),
 				slog.String("err", err.Error()))
-		}
-
-		for idx, entry := range result {
-			result[idx].Name = user.UnscopePath(entry.Name)
+		} else if merged {
+			slices.SortFunc(result, func(a, b s4.FileMetadata) int { return metaindex.ComparePaths(a.Name, b.Name) })
+			result = pageEntries(result, offset, limit)
 		}
 
 		writeGeneirc(wrt, result, err)
@@ -234,25 +474,34 @@ func NewHandler(storage s4.Storage, cfg *config.AuthConfig) s4.SyncHandler {
 			return
 		}
 
-		name := user.ScopePath(req.URL.Query().Get("name"))
-		newName := req.URL.Query().Get("new_name")
+		source, err := user.Resolve(accessRead|accessWrite, req.URL.Query().Get("name"))
+		if err != nil {
+			writeError(wrt, err)
+			return
+		}
+
+		target, err := user.Resolve(writeAccess(strings.EqualFold(req.URL.Query().Get("overwrite"), "true")), req.URL.Query().Get("new_name"))
+		if err != nil {
+			writeError(wrt, err)
+			return
+		}
 
 		result, err := storage.Move(
 			req.Context(),
-			name,
-			newName,
+			source.Name,
+			target.Name,
 			strings.EqualFold(req.URL.Query().Get("overwrite"), "true"),
 		)
 
 		if err != nil {
 			slog.Error("Storage: Move file",
-				slog.String("name", name),
-				slog.String("new_name", newName),
+				slog.String("name", source.Name),
+				slog.String("new_name", target.Name),
 				slog.String("err", err.Error()))
 		}
 
 		if result != nil {
-			result.Name = user.UnscopePath(result.Name)
+			result.Name = target.unscope(result.Name)
 		}
 
 		writeGeneirc(wrt, result, err)
@@ -266,16 +515,109 @@ func NewHandler(storage s4.Storage, cfg *config.AuthConfig) s4.SyncHandler {
 			return
 		}
 
-		name := user.ScopePath(req.URL.Query().Get("name"))
+		target, err := user.Resolve(accessDelete, req.URL.Query().Get("name"))
+		if err != nil {
+			writeError(wrt, err)
+			return
+		}
 
 		result, err := storage.Delete(
 			req.Context(),
-			name,
+			target.Name,
 		)
 
 		if err != nil {
 			slog.Error("Storage: Delete file",
-				slog.String("name", name),
+				slog.String("name", target.Name),
+				slog.String("err", err.Error()))
+		}
+
+		if result != nil {
+			result.Name = target.unscope(result.Name)
+		}
+
+		writeGeneirc(wrt, result, err)
+	})
+
+	mux.HandleFunc("GET /trash", func(wrt http.ResponseWriter, req *http.Request) {
+
+		user, err := auth.Authorize(req)
+		if err != nil {
+			writeError(wrt, err)
+			return
+		}
+
+		trash, ok := s4.StorageAs[s4.TrashController](storage)
+		if !ok {
+			writeErrorWithCode(wrt, fmt.Errorf("trash is disabled"), http.StatusNotImplemented)
+			return
+		}
+
+		prefix := req.URL.Query().Get("prefix")
+
+		scopes, err := user.ListScopes(accessList, prefix)
+		if err != nil {
+			writeError(wrt, err)
+			return
+		}
+
+		result, err := listAcross(user, scopes, func(entry *s4.TrashEntry) *string { return &entry.Name }, func(scope *listScope) ([]s4.TrashEntry, error) {
+			return trash.ListTrash(req.Context(), scope.Prefix)
+		})
+
+		if err != nil && !isDisabledError(err) {
+			slog.Error("Storage: List trash",
+				slog.String("prefix", prefix),
+				slog.String("err", err.Error()))
+		}
+
+		writeGeneirc(wrt, result, err)
+	})
+
+	mux.HandleFunc("POST /trash/restore", func(wrt http.ResponseWriter, req *http.Request) {
+
+		user, err := auth.Authorize(req)
+		if err != nil {
+			writeError(wrt, err)
+			return
+		}
+
+		trash, ok := s4.StorageAs[s4.TrashController](storage)
+		if !ok {
+			writeErrorWithCode(wrt, fmt.Errorf("trash is disabled"), http.StatusNotImplemented)
+			return
+		}
+
+		overwrite := strings.EqualFold(req.URL.Query().Get("overwrite"), "true")
+
+		//	entries can only be restored to where the user is allowed to write to, which also covers the token scope
+		restoreRoot := "/"
+		if user.Token != nil && user.Token.PathPrefix != "" {
+			restoreRoot = user.Token.PathPrefix
+		}
+
+		scopes, err := user.ListScopes(accessList|writeAccess(overwrite), restoreRoot)
+		if err != nil {
+			writeError(wrt, err)
+			return
+		}
+
+		id := req.URL.Query().Get("id")
+
+		var result *s4.FileMetadata
+		err = &s4.FileNotFoundError{Path: id}
+
+		for _, scope := range scopes {
+			if result, err = trash.RestoreTrash(req.Context(), scope.Prefix, id, overwrite); err == nil {
+				break
+			} else if _, ok := err.(*s4.FileNotFoundError); !ok {
+				break
+			}
+		}
+
+		if err != nil && !isDisabledError(err) {
+			slog.Error("Storage: Restore from trash",
+				slog.String("id", id),
 				slog.String("err", err.Error()))
 		}
 
@@ -286,13 +628,355 @@ func NewHandler(storage s4.Storage, cfg *config.AuthConfig) s4.SyncHandler {
 		writeGeneirc(wrt, result, err)
 	})
 
+	mux.HandleFunc("DELETE /trash", func(wrt http.ResponseWriter, req *http.Request) {
+
+		user, err := auth.Authorize(req)
+		if err != nil {
+			writeError(wrt, err)
+			return
+		}
+
+		trash, ok := s4.StorageAs[s4.TrashController](storage)
+		if !ok {
+			writeErrorWithCode(wrt, fmt.Errorf("trash is disabled"), http.StatusNotImplemented)
+			return
+		}
+
+		prefix := req.URL.Query().Get("prefix")
+
+		scopes, err := user.ListScopes(accessDelete, prefix)
+		if err != nil {
+			writeError(wrt, err)
+			return
+		}
+
+		result, err := listAcross(user, scopes, func(entry *s4.TrashEntry) *string { return &entry.Name }, func(scope *listScope) ([]s4.TrashEntry, error) {
+			return trash.EmptyTrash(req.Context(), scope.Prefix)
+		})
+
+		if err != nil && !isDisabledError(err) {
+			slog.Error("Storage: Empty trash",
+				slog.String("prefix", prefix),
+				slog.String("err", err.Error()))
+		}
+
+		writeGeneirc(wrt, result, err)
+	})
+
+	mux.HandleFunc("GET /versions", func(wrt http.ResponseWriter, req *http.Request) {
+
+		user, err := auth.Authorize(req)
+		if err != nil {
+			writeError(wrt, err)
+			return
+		}
+
+		versions, ok := s4.StorageAs[s4.VersionController](storage)
+		if !ok {
+			writeErrorWithCode(wrt, fmt.Errorf("versioning is disabled"), http.StatusNotImplemented)
+			return
+		}
+
+		target, err := user.Resolve(accessList, req.URL.Query().Get("name"))
+		if err != nil {
+			writeError(wrt, err)
+			return
+		}
+
+		result, err := versions.ListVersions(req.Context(), target.Name)
+		if err != nil && !isDisabledError(err) {
+			slog.Error("Storage: List versions",
+				slog.String("name", target.Name),
+				slog.String("err", err.Error()))
+		}
+
+		for idx, entry := range result {
+			result[idx].Name = target.unscope(entry.Name)
+		}
+
+		writeGeneirc(wrt, result, err)
+	})
+
+	mux.HandleFunc("GET /versions/download", func(wrt http.ResponseWriter, req *http.Request) {
+
+		user, err := auth.Authorize(req)
+		if err != nil {
+			writeError(wrt, err)
+			return
+		}
+
+		versions, ok := s4.StorageAs[s4.VersionController](storage)
+		if !ok {
+			writeErrorWithCode(wrt, fmt.Errorf("versioning is disabled"), http.StatusNotImplemented)
+			return
+		}
+
+		target, err := user.Resolve(accessRead, req.URL.Query().Get("name"))
+		if err != nil {
+			writeError(wrt, err)
+			return
+		}
+
+		wg.Add(1)
+		defer wg.Done()
+
+		id := req.URL.Query().Get("id")
+
+		file, err := versions.GetVersion(req.Context(), target.Name, id)
+		if err != nil {
+			if !isDisabledError(err) {
+				slog.Error("Storage: Read file version",
+					slog.String("name", target.Name),
+					slog.String("id", id),
+					slog.String("err", err.Error()))
+			}
+			writeError(wrt, err)
+			return
+		}
+
+		written := serveFile(wrt, req, target.unscope(file.Name), file)
+		stats.BytesDownloaded.Add(float64(written), user.Username)
+	})
+
+	mux.HandleFunc("POST /versions/restore", func(wrt http.ResponseWriter, req *http.Request) {
+
+		user, err := auth.Authorize(req)
+		if err != nil {
+			writeError(wrt, err)
+			return
+		}
+
+		versions, ok := s4.StorageAs[s4.VersionController](storage)
+		if !ok {
+			writeErrorWithCode(wrt, fmt.Errorf("versioning is disabled"), http.StatusNotImplemented)
+			return
+		}
+
+		target, err := user.Resolve(accessRead|accessWrite|accessOverwrite, req.URL.Query().Get("name"))
+		if err != nil {
+			writeError(wrt, err)
+			return
+		}
+
+		id := req.URL.Query().Get("id")
+
+		result, err := versions.RestoreVersion(req.Context(), target.Name, id)
+		if err != nil && !isDisabledError(err) {
+			slog.Error("Storage: Restore version",
+				slog.String("name", target.Name),
+				slog.String("id", id),
+				slog.String("err", err.Error()))
+		}
+
+		if result != nil {
+			result.Name = target.unscope(result.Name)
+		}
+
+		writeGeneirc(wrt, result, err)
+	})
+
+	//	tokens can only be managed with a password, otherwise a leaked token could be used to issue more of them
+	var authorizeTokenAdmin = func(req *http.Request) (*UserState, error) {
+
+		user, err := auth.Authorize(req)
+		if err != nil {
+			return nil, err
+		} else if user.Token != nil {
+			return nil, &AuthError{Denied: "tokens can only be managed using a password"}
+		} else if tokenStore == nil {
+			return nil, fmt.Errorf("tokens are disabled")
+		}
+
+		return user, nil
+	}
+
+	mux.HandleFunc("GET /usage", func(wrt http.ResponseWriter, req *http.Request) {
+
+		user, err := auth.Authorize(req)
+		if err != nil {
+			writeError(wrt, err)
+			return
+		}
+
+		usage, err := quotas.Usage(req.Context(), user)
+		if err != nil {
+			slog.Error("Storage: Count usage",
+				slog.String("username", user.Username),
+				slog.String("err", err.Error()))
+		}
+
+		writeGeneirc(wrt, usage, err)
+	})
+
+	mux.HandleFunc("GET /tokens", func(wrt http.ResponseWriter, req *http.Request) {
+
+		user, err := authorizeTokenAdmin(req)
+		if err != nil {
+			writeError(wrt, err)
+			return
+		}
+
+		result, err := tokenStore.List(user.Username)
+		if err != nil {
+			slog.Error("Tokens: List",
+				slog.String("username", user.Username),
+				slog.String("err", err.Error()))
+		}
+
+		writeGeneirc(wrt, result, err)
+	})
+
+	mux.HandleFunc("POST /tokens", func(wrt http.ResponseWriter, req *http.Request) {
+
+		user, err := authorizeTokenAdmin(req)
+		if err != nil {
+			writeError(wrt, err)
+			return
+		}
+
+		opts := tokens.TokenOptions{
+			Name:       req.URL.Query().Get("name"),
+			PathPrefix: req.URL.Query().Get("prefix"),
+			ReadOnly:   strings.EqualFold(req.URL.Query().Get("read_only"), "true"),
+		}
+
+		if val := req.URL.Query().Get("expires"); val != "" {
+
+			ttl, err := time.ParseDuration(val)
+			if err != nil || ttl <= 0 {
+				writeErrorWithCode(wrt, fmt.Errorf("invalid token expiry duration"), http.StatusBadRequest)
+				return
+			}
+
+			opts.Expires = time.Now().Add(ttl)
+		}
+
+		value, token, err := tokenStore.Issue(user.Username, opts)
+		if err != nil {
+			slog.Error("Tokens: Issue",
+				slog.String("username", user.Username),
+				slog.String("err", err.Error()))
+			writeError(wrt, err)
+			return
+		}
+
+		slog.Info("Tokens: Issued",
+			slog.String("username", user.Username),
+			slog.String("id", token.ID))
+
+		writeData(wrt, tokens.IssuedToken{Value: value, Token: *token})
+	})
+
+	mux.HandleFunc("DELETE /tokens", func(wrt http.ResponseWriter, req *http.Request) {
+
+		user, err := authorizeTokenAdmin(req)
+		if err != nil {
+			writeError(wrt, err)
+			return
+		}
+
+		id := req.URL.Query().Get("id")
+
+		result, err := tokenStore.Revoke(user.Username, id)
+		if err != nil {
+			slog.Error("Tokens: Revoke",
+				slog.String("id", id),
+				slog.String("err", err.Error()))
+		} else if result == nil {
+			writeErrorWithCode(wrt, fmt.Errorf("token '%s' not found", id), http.StatusNotFound)
+			return
+		}
+
+		writeGeneirc(wrt, result, err)
+	})
+
 	return &fsHandler{
-		ServeMux:  &mux,
+		Handler:   stats.Middleware(&mux),
 		WaitGroup: &wg,
 	}
 }
 
 type fsHandler struct {
-	*http.ServeMux
+	http.Handler
 	*sync.WaitGroup
 }
+
+// Writes file contents as a response, taking care of the range requests. Returns how much of the file data was sent
+func serveFile(wrt http.ResponseWriter, req *http.Request, displayName string, file *s4.ReadSeekableFile) int64 {
+
+	defer file.ReadSeekCloser.Close()
+
+	cringe := contentRange{}
+	if err := cringe.ParseWith(req.Header.Get("Range"), file.Size); err != nil {
+		wrt.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", file.Size))
+		writeErrorWithCode(wrt, err, http.StatusRequestedRangeNotSatisfiable)
+		return 0
+	}
+
+	if cringe.Valid && cringe.Start > 0 {
+		if _, err := file.ReadSeekCloser.Seek(cringe.Start, io.SeekStart); err != nil {
+			slog.Error("Storage: Serve file",
+				slog.String("name", file.Name),
+				slog.String("err", err.Error()))
+			writeError(wrt, err)
+			return 0
+		}
+	}
+
+	//	static headers that aren't really needed but still are set for informational purposes
+	setHeaderDefault(wrt, "Content-Type", "application/octet-stream")
+	wrt.Header().Set("Accept-Ranges", "bytes")
+
+	//	these are dynamic and slightly repurposed headers. Other frontends may have their own takes on them
+	setHeaderDefault(wrt, "Last-Modified", file.FileMetadata.Modified.Format(time.RFC1123))
+	setHeaderDefault(wrt, "Content-Disposition", "attachment; filename="+url.QueryEscape(displayName))
+	setHeaderDefault(wrt, "Etag", "sha256="+file.FileMetadata.SHA256)
+
+	if cringe.Valid {
+		wrt.Header().Set("Content-Length", strconv.FormatInt(cringe.Size(), 10))
+		wrt.Header().Set("Content-Range", cringe.String())
+		wrt.WriteHeader(http.StatusPartialContent)
+	} else {
+		wrt.Header().Set("Content-Length", strconv.FormatInt(file.FileMetadata.Size, 10))
+		wrt.WriteHeader(http.StatusOK)
+	}
+
+	bodyReader := io.LimitReader(file.ReadSeekCloser, file.Size)
+	if cringe.Valid && cringe.End > 0 {
+		bodyReader = io.LimitReader(file.ReadSeekCloser, cringe.Size())
+	}
+
+	written, err := io.Copy(wrt, bodyReader)
+	if err != nil {
+		slog.Error("Storage: Serve file",
+			slog.String("name", file.Name),
+			slog.String("err", err.Error()))
+		return written
+	}
+
+	if flusher, ok := wrt.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	return written
+}
+
+func setHeaderDefault(wrt http.ResponseWriter, key, val string) {
+	if wrt.Header().Get(key) == "" {
+		wrt.Header().Set(key, val)
+	}
+}
+
+// Applies offset and limit to a listing that had to be fetched in full
+func pageEntries[T any](entries []T, offset int, limit int) []T {
+
+	if offset > 0 {
+		entries = entries[min(offset, len(entries)):]
+	}
+
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+
+	return entries
+}
@@ -20,7 +20,8 @@ func (cr *contentRange) Size() int64 {
 }
 
 func (cr *contentRange) String() string {
-	return fmt.Sprintf("bytes %d-%d/%d", cr.Start, cr.End, cr.TotalSize)
+	//	range end is inclusive on the wire, while here we keep it exclusive
+	return fmt.Sprintf("bytes %d-%d/%d", cr.Start, cr.End-1, cr.TotalSize)
 }
 
 func (cr *contentRange) ParseWith(val string, totalSize int64) error {
@@ -41,34 +42,46 @@ func (cr *contentRange) ParseWith(val string, totalSize int64) error {
 	val = strings.TrimSpace(val[len(prefix):])
 
 	before, after, ok := strings.Cut(val, "-")
-	if !ok {
+	if !ok || (before == "" && after == "") {
 		return fmt.Errorf("invalid range value")
 	}
 
 	cr.TotalSize = totalSize
 
-	if before != "" {
-		cr.Start, _ = strconv.ParseInt(before, 10, 64)
-		if cr.Start < 0 {
-			return fmt.Errorf("invalid range start")
-		} else if cr.Start >= cr.TotalSize {
-			return fmt.Errorf("range start exceeds file size")
+	//	suffix range, as in 'give me the last N bytes'
+	if before == "" {
+
+		suffixSize, err := strconv.ParseInt(after, 10, 64)
+		if err != nil || suffixSize <= 0 {
+			return fmt.Errorf("invalid range suffix")
 		}
+
+		cr.Start = max(cr.TotalSize-suffixSize, 0)
+		cr.End = cr.TotalSize
+		cr.Valid = true
+
+		return nil
 	}
 
+	var err error
+	if cr.Start, err = strconv.ParseInt(before, 10, 64); err != nil || cr.Start < 0 {
+		return fmt.Errorf("invalid range start")
+	} else if cr.Start >= cr.TotalSize {
+		return fmt.Errorf("range start exceeds file size")
+	}
+
+	cr.End = cr.TotalSize
+
 	if after != "" {
-		cr.End, _ = strconv.ParseInt(after, 10, 64)
-		if cr.End < 0 {
+
+		end, err := strconv.ParseInt(after, 10, 64)
+		if err != nil || end < 0 {
 			return fmt.Errorf("invalid range end")
-		} else if cr.TotalSize > 0 && cr.End > cr.TotalSize {
-			return fmt.Errorf("range end exceeds file size")
-		} else if cr.Start >= cr.End {
+		} else if end < cr.Start {
 			return fmt.Errorf("range start and end are overlapping")
 		}
-	}
 
-	if cr.End == 0 {
-		cr.End = cr.TotalSize
+		cr.End = min(end+1, cr.TotalSize)
 	}
 
 	cr.Valid = true
@@ -76,6 +89,51 @@ func (cr *contentRange) ParseWith(val string, totalSize int64) error {
 	return nil
 }
 
+// Parses upload content range in the format of 'bytes start-end/total'.
+// Both span and total can be replaced with a '*' when unknown, in which case -1 is returned
+func parseUploadRange(val string) (start int64, end int64, total int64, err error) {
+
+	val, ok := strings.CutPrefix(val, "bytes ")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("invalid content range type")
+	}
+
+	span, totalVal, ok := strings.Cut(strings.TrimSpace(val), "/")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("invalid content range value")
+	}
+
+	start, end, total = -1, -1, -1
+
+	if totalVal != "*" {
+		if total, err = strconv.ParseInt(totalVal, 10, 64); err != nil || total < 0 {
+			return 0, 0, 0, fmt.Errorf("invalid content range size")
+		}
+	}
+
+	if span != "*" {
+
+		before, after, ok := strings.Cut(span, "-")
+		if !ok {
+			return 0, 0, 0, fmt.Errorf("invalid content range span")
+		}
+
+		if start, err = strconv.ParseInt(before, 10, 64); err != nil || start < 0 {
+			return 0, 0, 0, fmt.Errorf("invalid content range start")
+		}
+
+		if end, err = strconv.ParseInt(after, 10, 64); err != nil || end < start {
+			return 0, 0, 0, fmt.Errorf("invalid content range end")
+		}
+
+		if total >= 0 && end >= total {
+			return 0, 0, 0, fmt.Errorf("content range end exceeds total size")
+		}
+	}
+
+	return start, end, total, nil
+}
+
 func writeGeneirc[T any](wrt http.ResponseWriter, val T, err error) error {
 	if err != nil {
 		return writeError(wrt, err)
@@ -88,23 +146,52 @@ func writeData[T any](wrt http.ResponseWriter, val T) error {
 }
 
 func writeError(wrt http.ResponseWriter, err error) error {
+
+	code := errorStatus(err)
+	if code == http.StatusUnauthorized {
+		wrt.Header().Set("WWW-Authenticate", "Basic")
+	}
+
+	return writeErrorWithCode(wrt, err, code)
+}
+
+// Features that are turned off in the config aren't worth logging about every time somebody asks for them
+func isDisabledError(err error) bool {
+	_, ok := err.(*s4.NotSupportedError)
+	return ok
+}
+
+// Picks the status code that an error should be reported with
+func errorStatus(err error) int {
 	switch err := err.(type) {
 	case *s4.FileNotFoundError:
-		return writeErrorWithCode(wrt, err, http.StatusNotFound)
+		return http.StatusNotFound
 	case *s4.FileConflictError:
-		return writeErrorWithCode(wrt, err, http.StatusConflict)
+		return http.StatusConflict
 	case *s4.NameError:
-		return writeErrorWithCode(wrt, err, http.StatusBadRequest)
+		return http.StatusBadRequest
+	case *s4.UploadNotFoundError:
+		return http.StatusNotFound
+	case *s4.UploadConflictError:
+		return http.StatusConflict
+	case *s4.QuotaError:
+
+		if err.TooLarge() {
+			return http.StatusRequestEntityTooLarge
+		}
+
+		return http.StatusInsufficientStorage
+	case *s4.NotSupportedError:
+		return http.StatusNotImplemented
 	case *AuthError:
 
-		if !err.IsInvalid {
-			wrt.Header().Set("WWW-Authenticate", "Basic")
-			return writeErrorWithCode(wrt, err, http.StatusUnauthorized)
+		if !err.IsInvalid && err.Denied == "" {
+			return http.StatusUnauthorized
 		}
 
-		return writeErrorWithCode(wrt, err, http.StatusForbidden)
+		return http.StatusForbidden
 	default:
-		return writeErrorWithCode(wrt, err, http.StatusInternalServerError)
+		return http.StatusInternalServerError
 	}
 }
 
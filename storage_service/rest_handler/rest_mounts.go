@@ -0,0 +1,192 @@
+package rest_handler
+
+import (
+	"path"
+	"slices"
+	"strings"
+
+	s4 "github.com/maddsua/syncctl/storage_service"
+	"github.com/maddsua/syncctl/storage_service/config"
+)
+
+// Maps a path that the user sees to a directory in the storage
+type userMount struct {
+	Path     string
+	Target   string
+	ReadOnly bool
+}
+
+// Returns the storage path for a name that's under the mount path
+func (mount *userMount) scope(name string) string {
+	return path.Join(mount.Target, strings.TrimPrefix(path.Clean("/"+name), mount.Path))
+}
+
+// Returns the user path for a name that's under the mount target
+func (mount *userMount) unscope(name string) string {
+	return path.Join(mount.Path, "/"+strings.TrimPrefix(path.Clean(name), mount.Target))
+}
+
+// Builds the list of mounts, ordered so that the deepest ones come first.
+// Users without any mounts get their root dir (or the whole storage) mounted at '/'
+func newUserMounts(user *config.UserConfig) []userMount {
+
+	var mounts []userMount
+
+	if user.RootDir != "" || len(user.Mounts) == 0 {
+		mounts = append(mounts, userMount{
+			Path:   "/",
+			Target: path.Clean("/" + user.RootDir),
+		})
+	}
+
+	for _, entry := range user.Mounts {
+		mounts = append(mounts, userMount{
+			Path:     path.Clean("/" + entry.Path),
+			Target:   path.Clean("/" + entry.Target),
+			ReadOnly: entry.ReadOnly,
+		})
+	}
+
+	slices.SortStableFunc(mounts, func(a, b userMount) int {
+		return len(b.Path) - len(a.Path)
+	})
+
+	return mounts
+}
+
+// Finds the mount that a user path belongs to. Nested mounts shadow the ones they're in
+func (user *UserState) mountOf(name string) *userMount {
+
+	name = path.Clean("/" + name)
+
+	for idx := range user.mounts {
+		if mount := &user.mounts[idx]; s4.IsPathUnder(name, mount.Path) {
+			return mount
+		}
+	}
+
+	return nil
+}
+
+// Tells whether a user path is '/' or the point where one of the mounts is attached
+func (user *UserState) isMountRoot(name string) bool {
+
+	name = path.Clean("/" + name)
+
+	return name == "/" || slices.ContainsFunc(user.mounts, func(mount userMount) bool {
+		return mount.Path == name
+	})
+}
+
+// A user path that has been checked and mapped to its location in the storage
+type resolvedPath struct {
+	*userMount
+	Name string
+}
+
+// Checks the access to a user path and returns where it's located in the storage
+func (user *UserState) Resolve(mode accessMode, name string) (*resolvedPath, error) {
+
+	name = path.Clean("/" + name)
+
+	if err := user.Allow(mode, name); err != nil {
+		return nil, err
+	}
+
+	mount := user.mountOf(name)
+
+	return &resolvedPath{userMount: mount, Name: mount.scope(name)}, nil
+}
+
+// Maps a storage path back to the user's view of it, for the cases when it's not known which mount it came from
+func (user *UserState) UnscopePath(name string) string {
+
+	var match *userMount
+
+	for idx := range user.mounts {
+		if mount := &user.mounts[idx]; s4.IsPathUnder(name, mount.Target) && (match == nil || len(mount.Target) > len(match.Target)) {
+			match = mount
+		}
+	}
+
+	if match == nil {
+		return path.Clean("/" + name)
+	}
+
+	return match.unscope(name)
+}
+
+// A part of the storage that a listing has to look through
+type listScope struct {
+	*userMount
+	Prefix string
+}
+
+// Figures out which parts of the storage a listing under the prefix covers: the mount the prefix is in,
+// as well as all the mounts located under it. Mounts under the prefix that don't allow for the access are skipped,
+// while the mount that the prefix itself is in has to allow it
+func (user *UserState) ListScopes(mode accessMode, prefix string) ([]listScope, error) {
+
+	prefix = path.Clean("/" + prefix)
+
+	if err := user.allowRole(mode, prefix); err != nil {
+		return nil, err
+	}
+
+	var scopes []listScope
+
+	if mount := user.mountOf(prefix); mount != nil {
+
+		if err := mount.allow(mode, prefix); err != nil {
+			return nil, err
+		}
+
+		scopes = append(scopes, listScope{userMount: mount, Prefix: mount.scope(prefix)})
+	}
+
+	for idx := range user.mounts {
+
+		mount := &user.mounts[idx]
+
+		if mount.Path == prefix || !s4.IsPathUnder(mount.Path, prefix) || mount.allow(mode, mount.Path) != nil {
+			continue
+		}
+
+		scopes = append(scopes, listScope{userMount: mount, Prefix: mount.Target})
+	}
+
+	return scopes, nil
+}
+
+// Lists entries across multiple scopes, leaving out the ones that are hidden by other mounts
+// and mapping the rest to the user paths
+func listAcross[T any](user *UserState, scopes []listScope, nameOf func(entry *T) *string, list func(scope *listScope) ([]T, error)) ([]T, error) {
+
+	result := []T{}
+
+	for _, scope := range scopes {
+
+		entries, err := list(&scope)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+
+			name := nameOf(&entry)
+			if !s4.IsPathUnder(*name, scope.Target) {
+				continue
+			}
+
+			userPath := scope.unscope(*name)
+			if user.mountOf(userPath) != scope.userMount {
+				continue
+			}
+
+			*name = userPath
+			result = append(result, entry)
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,391 @@
+package rest_handler
+
+import (
+	"context"
+	"io"
+	"path"
+	"slices"
+	"sync"
+	"time"
+
+	s4 "github.com/maddsua/syncctl/storage_service"
+	"github.com/maddsua/syncctl/storage_service/audit"
+)
+
+// Counting up the usage means listing everything the user has, which is way too slow to do on every upload.
+// Uploads that go through the server are added to the counted usage right away, so the cached value
+// only lags behind on deletes, and that errs on the safe side
+const usageCacheTTL = 30 * time.Second
+
+// Keeps track of how much storage the users take up, including the uploads that are still in progress
+type quotaKeeper struct {
+	storage s4.Storage
+	auth    *AuthThingy
+	mtx     sync.Mutex
+	users   map[string]*quotaState
+}
+
+type quotaState struct {
+	counted time.Time
+	bytes   int64
+	files   int
+	//	space taken by the uploads that haven't finished yet
+	pendingBytes int64
+	pendingFiles int
+}
+
+func newQuotaKeeper(storage s4.Storage, auth *AuthThingy) *quotaKeeper {
+	return &quotaKeeper{
+		storage: storage,
+		auth:    auth,
+		users:   map[string]*quotaState{},
+	}
+}
+
+// Implemented by the versioning storage. Old versions take up space too, and they're charged to whoever holds the files
+type versionLister interface {
+	ListVersionsUnder(ctx context.Context, prefix string) ([]s4.FileVersion, error)
+}
+
+func hasQuota(user *UserState) bool {
+	return user.QuotaBytes > 0 || user.MaxFiles > 0
+}
+
+// Storage directories that count towards the user's quota: the user's root and the mounts that the user can write to.
+// Mounts that are inside of someone else's root are charged to that user instead, since it's their space that's being used.
+// Nested targets are left out so that nothing gets counted twice
+func quotaTargets(user *UserState, otherRoots []string) []string {
+
+	var targets []string
+
+	for _, mount := range user.mounts {
+
+		if mount.ReadOnly {
+			continue
+		}
+
+		if mount.Path != "/" && slices.ContainsFunc(otherRoots, func(root string) bool { return s4.IsPathUnder(mount.Target, root) }) {
+			continue
+		}
+
+		targets = append(targets, mount.Target)
+	}
+
+	slices.SortFunc(targets, func(a, b string) int {
+		return len(a) - len(b)
+	})
+
+	var result []string
+
+	for _, target := range targets {
+		if !slices.ContainsFunc(result, func(parent string) bool { return s4.IsPathUnder(target, parent) }) {
+			result = append(result, target)
+		}
+	}
+
+	return result
+}
+
+// Roots of all the other users, which are the ones that have a root directory of their own
+func (keeper *quotaKeeper) otherRoots(user *UserState) []string {
+
+	var roots []string
+
+	keeper.auth.users.Range(func(key, value any) bool {
+		if other := value.(*UserState); other.Username != user.Username && other.RootDir != "" {
+			roots = append(roots, path.Clean("/"+other.RootDir))
+		}
+		return true
+	})
+
+	return roots
+}
+
+// Counts up everything that's charged to the user: the files, the old versions of them, and whatever the user has put in the trash
+func (keeper *quotaKeeper) count(ctx context.Context, user *UserState) (int64, int, error) {
+
+	var bytes int64
+	var files int
+
+	versions, hasVersions := s4.StorageAs[versionLister](keeper.storage)
+
+	for _, target := range quotaTargets(user, keeper.otherRoots(user)) {
+
+		entries, err := keeper.storage.Find(ctx, target, nil, true, 0, 0)
+		if _, ok := err.(*s4.FileNotFoundError); ok {
+			continue
+		} else if err != nil {
+			return 0, 0, err
+		}
+
+		for _, entry := range entries {
+			bytes += entry.Size
+		}
+
+		files += len(entries)
+
+		if !hasVersions {
+			continue
+		}
+
+		archived, err := versions.ListVersionsUnder(ctx, target)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		for _, version := range archived {
+			bytes += version.Size
+		}
+
+		files += len(archived)
+	}
+
+	if trash, ok := s4.StorageAs[s4.TrashController](keeper.storage); ok {
+
+		//	the trash only lists what's been deleted by whoever is asking
+		trashed, err := trash.ListTrash(audit.WithActor(ctx, &audit.Actor{User: user.Username}), "/")
+		if err != nil && !isDisabledError(err) {
+			return 0, 0, err
+		}
+
+		for _, entry := range trashed {
+			bytes += entry.Size
+		}
+
+		files += len(trashed)
+	}
+
+	return bytes, files, nil
+}
+
+// Returns the state of the user's usage, counting it up again if it's gone stale. The keeper is locked when it returns
+func (keeper *quotaKeeper) lockState(ctx context.Context, user *UserState) (*quotaState, error) {
+
+	keeper.mtx.Lock()
+
+	state := keeper.users[user.Username]
+	if state != nil && time.Since(state.counted) < usageCacheTTL {
+		return state, nil
+	}
+
+	//	not holding the lock while listing the storage, as that could take a while
+	keeper.mtx.Unlock()
+
+	bytes, files, err := keeper.count(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	keeper.mtx.Lock()
+
+	if state = keeper.users[user.Username]; state == nil {
+		state = &quotaState{}
+		keeper.users[user.Username] = state
+	}
+
+	state.counted = time.Now()
+	state.bytes = bytes
+	state.files = files
+
+	return state, nil
+}
+
+func (keeper *quotaKeeper) Usage(ctx context.Context, user *UserState) (*s4.StorageUsage, error) {
+
+	state, err := keeper.lockState(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	defer keeper.mtx.Unlock()
+
+	return &s4.StorageUsage{
+		Bytes:      state.bytes,
+		Files:      state.files,
+		QuotaBytes: user.QuotaBytes,
+		MaxFiles:   user.MaxFiles,
+	}, nil
+}
+
+// Sets aside the space for a file upload, failing with a QuotaError when it doesn't fit.
+// The size is whatever the client has declared, the actual amount of data is checked by the reservation reader.
+// Users without a quota get a nil reservation, which is fine to use all the same
+func (keeper *quotaKeeper) Reserve(ctx context.Context, user *UserState, name string, size int64, overwrite bool) (*quotaReservation, error) {
+
+	if !hasQuota(user) {
+		return nil, nil
+	}
+
+	res := quotaReservation{
+		keeper:   keeper,
+		user:     user,
+		declared: max(size, 0),
+		newFile:  true,
+	}
+
+	//	overwriting a file frees up the space that it's been taking, unless it's kept around as a previous version
+	_, keepsVersions := s4.StorageAs[versionLister](keeper.storage)
+
+	if entry, err := keeper.storage.Stat(ctx, path.Clean("/"+name)); err == nil {
+		res.newFile = false
+		if overwrite && !keepsVersions {
+			res.replaced = entry.Size
+		}
+	} else if _, ok := err.(*s4.FileNotFoundError); !ok {
+		return nil, err
+	}
+
+	state, err := keeper.lockState(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	defer keeper.mtx.Unlock()
+
+	if err := res.fit(state, res.declared); err != nil {
+		return nil, err
+	}
+
+	res.bytes = max(res.declared-res.replaced, 0)
+	if res.newFile {
+		res.files = 1
+	}
+
+	state.pendingBytes += res.bytes
+	state.pendingFiles += res.files
+
+	return &res, nil
+}
+
+// Checks that a file would fit without holding up any space for it
+func (keeper *quotaKeeper) Check(ctx context.Context, user *UserState, name string, size int64, overwrite bool) error {
+
+	res, err := keeper.Reserve(ctx, user, name, size, overwrite)
+	if err != nil {
+		return err
+	}
+
+	res.Release(nil)
+	return nil
+}
+
+type quotaReservation struct {
+	keeper   *quotaKeeper
+	user     *UserState
+	declared int64
+	replaced int64
+	newFile  bool
+	//	what's held up in the pending usage
+	bytes int64
+	files int
+	//	set when the streamed data went over the quota
+	err error
+}
+
+// Checks whether a file of this size fits in, not counting what this reservation is already holding
+func (res *quotaReservation) fit(state *quotaState, size int64) error {
+
+	if limit := res.user.QuotaBytes; limit > 0 {
+
+		used := state.bytes + state.pendingBytes - res.bytes
+
+		if size > limit || used+size-res.replaced > limit {
+			return &s4.QuotaError{Limit: limit, Used: used, Size: size}
+		}
+	}
+
+	if limit := res.user.MaxFiles; limit > 0 && res.newFile {
+		if used := state.files + state.pendingFiles - res.files; used+1 > limit {
+			return &s4.QuotaError{IsFiles: true, Limit: int64(limit), Used: int64(used), Size: 1}
+		}
+	}
+
+	return nil
+}
+
+// Grows the reservation when more data is streamed in than has been declared
+func (res *quotaReservation) grow(size int64) error {
+
+	res.keeper.mtx.Lock()
+	defer res.keeper.mtx.Unlock()
+
+	state := res.keeper.users[res.user.Username]
+
+	if err := res.fit(state, size); err != nil {
+		return err
+	}
+
+	bytes := max(size-res.replaced, 0)
+	state.pendingBytes += bytes - res.bytes
+	res.bytes = bytes
+	res.declared = size
+
+	return nil
+}
+
+// Wraps the upload data so that the reading fails once there's more of it than the quota allows for
+func (res *quotaReservation) Reader(reader io.Reader) io.Reader {
+	if res == nil {
+		return reader
+	}
+	return &quotaReader{res: res, Reader: reader}
+}
+
+// The error that the upload has failed with due to the quota. Storage backends tend to wrap
+// reader errors, so the handlers have to check this to tell that it's the quota that failed it
+func (res *quotaReservation) Err() error {
+	if res == nil {
+		return nil
+	}
+	return res.err
+}
+
+// Frees up the reserved space. When the upload has gone through, the stored file gets added to the counted usage
+func (res *quotaReservation) Release(stored *s4.FileMetadata) {
+
+	if res == nil {
+		return
+	}
+
+	res.keeper.mtx.Lock()
+	defer res.keeper.mtx.Unlock()
+
+	state := res.keeper.users[res.user.Username]
+	state.pendingBytes -= res.bytes
+	state.pendingFiles -= res.files
+
+	if stored != nil {
+		state.bytes += stored.Size - res.replaced
+		if res.newFile {
+			state.files++
+		}
+	}
+
+	res.bytes = 0
+	res.files = 0
+}
+
+type quotaReader struct {
+	io.Reader
+	res  *quotaReservation
+	read int64
+}
+
+func (reader *quotaReader) Read(buff []byte) (int, error) {
+
+	if reader.res.err != nil {
+		return 0, reader.res.err
+	}
+
+	n, err := reader.Reader.Read(buff)
+	reader.read += int64(n)
+
+	if reader.read > reader.res.declared {
+		if err := reader.res.grow(reader.read); err != nil {
+			reader.res.err = err
+			return 0, err
+		}
+	}
+
+	return n, err
+}
@@ -0,0 +1,1125 @@
+package rest_handler
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	s4 "github.com/maddsua/syncctl/storage_service"
+)
+
+// Bucket names that are taken by the other routes of the server
+var s3ReservedBuckets = []string{"s4", "dav", "metrics"}
+
+// The default page size, which is also the max one
+const s3MaxKeys = 1000
+
+// Request bodies that are parsed as a whole, such as the list of parts to complete an upload with
+const s3MaxXMLBodySize = 4 << 20
+
+var s3PayloadHashExpr = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// Serves a subset of the s3 api, so that the storage could be used with the s3 tooling. Buckets are the top level
+// directories of a user's view of the storage, and the objects are the files in them. Files that are right at the root
+// aren't reachable, and since there are no directories as such, a bucket only shows up once there's something in it.
+// Only the path-style addressing is supported
+func NewS3Handler(backend *Backend, uploadsDir string) s4.SyncHandler {
+
+	storage, stats := backend.Storage, backend.Metrics
+	auth, quotas := backend.auth, backend.quotas
+
+	var wg sync.WaitGroup
+	var mux http.ServeMux
+
+	uploads := s3Uploads{Dir: uploadsDir}
+
+	type s3Request struct {
+		*sigV4Request
+		Bucket string
+		Key    string
+	}
+
+	var handle = func(method string, bucketOp func(wrt http.ResponseWriter, req *http.Request, s3req *s3Request), objectOp func(wrt http.ResponseWriter, req *http.Request, s3req *s3Request)) {
+
+		serve := func(wrt http.ResponseWriter, req *http.Request) {
+
+			sig, err := auth.AuthorizeSigV4(req)
+			if err != nil {
+				writeS3Error(wrt, req, err)
+				return
+			}
+
+			s3req := s3Request{
+				sigV4Request: sig,
+				Bucket:       req.PathValue("bucket"),
+				Key:          req.PathValue("key"),
+			}
+
+			if slices.Contains(s3ReservedBuckets, s3req.Bucket) {
+				writeS3Error(wrt, req, &s3Error{Status: http.StatusBadRequest, Code: "InvalidBucketName", Message: fmt.Sprintf("bucket name '%s' is reserved", s3req.Bucket)})
+				return
+			}
+
+			if s3req.Key == "" {
+				bucketOp(wrt, req, &s3req)
+			} else {
+				objectOp(wrt, req, &s3req)
+			}
+		}
+
+		mux.HandleFunc(method+" /{bucket}", serve)
+		mux.HandleFunc(method+" /{bucket}/{key...}", serve)
+	}
+
+	var notImplemented = func(wrt http.ResponseWriter, req *http.Request) {
+		writeS3Error(wrt, req, &s3Error{Status: http.StatusNotImplemented, Code: "NotImplemented", Message: "this operation is not supported"})
+	}
+
+	//	user path of the bucket itself
+	var bucketPath = func(s3req *s3Request) string {
+		return "/" + s3req.Bucket
+	}
+
+	//	user path of the object. Keys that don't map to a clean path one to one are rejected,
+	//	as they wouldn't be listed back under the same key
+	var objectPath = func(s3req *s3Request) (string, error) {
+
+		name := "/" + s3req.Bucket + "/" + s3req.Key
+		if path.Clean(name) != name {
+			return "", &s3Error{Status: http.StatusBadRequest, Code: "InvalidArgument", Message: fmt.Sprintf("object key '%s' is not a valid file path", s3req.Key)}
+		}
+
+		return name, nil
+	}
+
+	//	folder markers that some clients create. There aren't any directories to make, so these are simply ignored
+	var isFolderMarker = func(s3req *s3Request) bool {
+		return strings.HasSuffix(s3req.Key, "/")
+	}
+
+	mux.HandleFunc("GET /{$}", func(wrt http.ResponseWriter, req *http.Request) {
+
+		sig, err := auth.AuthorizeSigV4(req)
+		if err != nil {
+			writeS3Error(wrt, req, err)
+			return
+		}
+
+		user := sig.User
+
+		wg.Add(1)
+		defer wg.Done()
+
+		files, err := backend.listFiles(req.Context(), user, "/")
+		if err != nil {
+			slog.Error("S3: List buckets",
+				slog.String("err", err.Error()))
+			writeS3Error(wrt, req, err)
+			return
+		}
+
+		//	bucket creation date is as close as it gets: the oldest file in it
+		created := map[string]time.Time{}
+
+		for _, entry := range files {
+
+			bucket, _, nested := strings.Cut(strings.TrimPrefix(entry.Name, "/"), "/")
+			if !nested {
+				continue
+			}
+
+			if val, has := created[bucket]; !has || entry.Modified.Before(val) {
+				created[bucket] = entry.Modified
+			}
+		}
+
+		for _, mount := range user.mounts {
+			if bucket, _, _ := strings.Cut(strings.TrimPrefix(mount.Path, "/"), "/"); bucket != "" {
+				if _, has := created[bucket]; !has {
+					created[bucket] = time.Now()
+				}
+			}
+		}
+
+		result := s3ListBucketsResult{
+			Xmlns: s3Xmlns,
+			Owner: s3Owner{ID: user.Username, DisplayName: user.Username},
+		}
+
+		for bucket, date := range created {
+			if !slices.Contains(s3ReservedBuckets, bucket) {
+				result.Buckets = append(result.Buckets, s3Bucket{Name: bucket, CreationDate: s3Time(date)})
+			}
+		}
+
+		slices.SortFunc(result.Buckets, func(a, b s3Bucket) int {
+			return strings.Compare(a.Name, b.Name)
+		})
+
+		writeXML(wrt, http.StatusOK, result)
+	})
+
+	var listObjects = func(wrt http.ResponseWriter, req *http.Request, s3req *s3Request) {
+
+		query := req.URL.Query()
+
+		isV2 := query.Get("list-type") == "2"
+		prefix := query.Get("prefix")
+		delimiter := query.Get("delimiter")
+		urlEncoded := query.Get("encoding-type") == "url"
+
+		maxKeys := s3MaxKeys
+		if val := query.Get("max-keys"); val != "" {
+			var err error
+			if maxKeys, err = strconv.Atoi(val); err != nil || maxKeys < 0 {
+				writeS3Error(wrt, req, &s3Error{Status: http.StatusBadRequest, Code: "InvalidArgument", Message: "invalid max-keys value"})
+				return
+			}
+			maxKeys = min(maxKeys, s3MaxKeys)
+		}
+
+		//	everything up to this key, inclusive, has already been listed
+		var after string
+
+		if isV2 {
+
+			after = query.Get("start-after")
+
+			if token := query.Get("continuation-token"); token != "" {
+
+				val, err := base64.RawURLEncoding.DecodeString(token)
+				if err != nil {
+					writeS3Error(wrt, req, &s3Error{Status: http.StatusBadRequest, Code: "InvalidArgument", Message: "invalid continuation token"})
+					return
+				}
+
+				after = max(after, string(val))
+			}
+
+		} else {
+			after = query.Get("marker")
+		}
+
+		//	only the directory that the prefix points into has to be looked through
+		dir := bucketPath(s3req)
+		if idx := strings.LastIndex(prefix, "/"); idx >= 0 {
+			dir = path.Join(dir, prefix[:idx])
+		}
+
+		wg.Add(1)
+		defer wg.Done()
+
+		files, err := backend.listFiles(req.Context(), s3req.User, dir)
+		if err != nil {
+			slog.Error("S3: List objects",
+				slog.String("prefix", dir),
+				slog.String("err", err.Error()))
+			writeS3Error(wrt, req, err)
+			return
+		}
+
+		var entries []s4.FileMetadata
+
+		for _, entry := range files {
+			if key := strings.TrimPrefix(entry.Name, bucketPath(s3req)+"/"); key != entry.Name && strings.HasPrefix(key, prefix) {
+				entry.Name = key
+				entries = append(entries, entry)
+			}
+		}
+
+		slices.SortFunc(entries, func(a, b s4.FileMetadata) int {
+			return strings.Compare(a.Name, b.Name)
+		})
+
+		var encode = func(val string) string {
+			if urlEncoded {
+				return url.QueryEscape(val)
+			}
+			return val
+		}
+
+		result := s3ListBucketResult{
+			Xmlns:     s3Xmlns,
+			Name:      s3req.Bucket,
+			Prefix:    encode(prefix),
+			Delimiter: encode(delimiter),
+			MaxKeys:   maxKeys,
+		}
+
+		if urlEncoded {
+			result.EncodingType = "url"
+		}
+
+		var count int
+		var lastKey string
+
+		for _, entry := range entries {
+
+			if entry.Name <= after {
+				continue
+			}
+
+			if delimiter != "" {
+
+				if idx := strings.Index(entry.Name[len(prefix):], delimiter); idx >= 0 {
+
+					commonPrefix := entry.Name[:len(prefix)+idx+len(delimiter)]
+					if commonPrefix <= after || commonPrefix == lastKey {
+						continue
+					}
+
+					if count >= maxKeys {
+						result.IsTruncated = true
+						break
+					}
+
+					result.CommonPrefixes = append(result.CommonPrefixes, s3CommonPrefix{Prefix: encode(commonPrefix)})
+					lastKey = commonPrefix
+					count++
+					continue
+				}
+			}
+
+			if count >= maxKeys {
+				result.IsTruncated = true
+				break
+			}
+
+			result.Contents = append(result.Contents, s3Object{
+				Key:          encode(entry.Name),
+				LastModified: s3Time(entry.Modified),
+				ETag:         s3ETag(&entry),
+				Size:         entry.Size,
+				StorageClass: "STANDARD",
+			})
+
+			lastKey = entry.Name
+			count++
+		}
+
+		if isV2 {
+
+			result.KeyCount = &count
+			result.StartAfter = encode(query.Get("start-after"))
+			result.ContinuationToken = query.Get("continuation-token")
+
+			if result.IsTruncated {
+				result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(lastKey))
+			}
+
+		} else {
+
+			marker := encode(after)
+			result.Marker = &marker
+
+			if result.IsTruncated {
+				result.NextMarker = encode(lastKey)
+			}
+		}
+
+		writeXML(wrt, http.StatusOK, result)
+	}
+
+	var listUploads = func(wrt http.ResponseWriter, req *http.Request, s3req *s3Request) {
+
+		entries, err := uploads.List(s3req.User.Username, s3req.Bucket)
+		if err != nil {
+			slog.Error("S3: List uploads",
+				slog.String("err", err.Error()))
+			writeS3Error(wrt, req, err)
+			return
+		}
+
+		writeXML(wrt, http.StatusOK, s3ListMultipartUploadsResult{
+			Xmlns:   s3Xmlns,
+			Bucket:  s3req.Bucket,
+			Uploads: entries,
+		})
+	}
+
+	//	query parameters that the listings understand, anything else is a sub-resource that isn't supported
+	listParams := []string{"list-type", "prefix", "delimiter", "max-keys", "marker", "start-after", "continuation-token", "encoding-type", "fetch-owner"}
+
+	handle("GET", func(wrt http.ResponseWriter, req *http.Request, s3req *s3Request) {
+
+		query := req.URL.Query()
+
+		switch {
+		case query.Has("location"):
+			writeXML(wrt, http.StatusOK, s3LocationConstraint{Xmlns: s3Xmlns})
+		case query.Has("uploads"):
+			listUploads(wrt, req, s3req)
+		default:
+
+			for key := range query {
+				if !slices.Contains(listParams, key) && !strings.HasPrefix(key, "X-Amz-") {
+					notImplemented(wrt, req)
+					return
+				}
+			}
+
+			listObjects(wrt, req, s3req)
+		}
+
+	}, func(wrt http.ResponseWriter, req *http.Request, s3req *s3Request) {
+
+		if uploadID := req.URL.Query().Get("uploadId"); uploadID != "" {
+
+			if _, err := uploads.State(s3req.User.Username, uploadID, s3req.Bucket, s3req.Key); err != nil {
+				writeS3Error(wrt, req, err)
+				return
+			}
+
+			parts, err := uploads.Parts(uploadID)
+			if err != nil {
+				writeS3Error(wrt, req, err)
+				return
+			}
+
+			result := s3ListPartsResult{
+				Xmlns:    s3Xmlns,
+				Bucket:   s3req.Bucket,
+				Key:      s3req.Key,
+				UploadID: uploadID,
+			}
+
+			for _, part := range parts {
+				result.Parts = append(result.Parts, s3Part{
+					PartNumber:   part.Number,
+					LastModified: s3Time(part.Modified),
+					ETag:         `"` + part.ETag + `"`,
+					Size:         part.Size,
+				})
+			}
+
+			writeXML(wrt, http.StatusOK, result)
+			return
+		}
+
+		name, err := objectPath(s3req)
+		if err != nil {
+			writeS3Error(wrt, req, err)
+			return
+		}
+
+		target, err := s3req.User.Resolve(accessRead, name)
+		if err != nil {
+			writeS3Error(wrt, req, err)
+			return
+		}
+
+		wg.Add(1)
+		defer wg.Done()
+
+		file, err := storage.Get(req.Context(), target.Name)
+		if err != nil {
+			if _, ok := err.(*s4.FileNotFoundError); !ok {
+				slog.Error("S3: Read object",
+					slog.String("name", target.Name),
+					slog.String("err", err.Error()))
+			}
+			writeS3Error(wrt, req, err)
+			return
+		}
+
+		//	serving the file would report a bad range in its own way
+		var cringe contentRange
+		if err := cringe.ParseWith(req.Header.Get("Range"), file.Size); err != nil {
+			_ = file.ReadSeekCloser.Close()
+			writeS3Error(wrt, req, &s3Error{Status: http.StatusRequestedRangeNotSatisfiable, Code: "InvalidRange", Message: err.Error()})
+			return
+		}
+
+		setS3ObjectHeaders(wrt, &file.FileMetadata)
+
+		written := serveFile(wrt, req, path.Base(name), file)
+		stats.BytesDownloaded.Add(float64(written), s3req.User.Username)
+	})
+
+	handle("HEAD", func(wrt http.ResponseWriter, req *http.Request, s3req *s3Request) {
+
+		if err := s3req.User.Allow(accessList, bucketPath(s3req)); err != nil {
+			//	drop box users can't list anything but can still put files into the bucket
+			if err := s3req.User.Allow(accessWrite, bucketPath(s3req)); err != nil {
+				writeS3Error(wrt, req, err)
+				return
+			}
+		}
+
+		wrt.WriteHeader(http.StatusOK)
+
+	}, func(wrt http.ResponseWriter, req *http.Request, s3req *s3Request) {
+
+		name, err := objectPath(s3req)
+		if err != nil {
+			writeS3Error(wrt, req, err)
+			return
+		}
+
+		target, err := s3req.User.Resolve(accessRead, name)
+		if err != nil {
+			writeS3Error(wrt, req, err)
+			return
+		}
+
+		entry, err := storage.Stat(req.Context(), target.Name)
+		if err != nil {
+			writeS3Error(wrt, req, err)
+			return
+		}
+
+		setS3ObjectHeaders(wrt, entry)
+		wrt.Header().Set("Content-Type", "application/octet-stream")
+		wrt.Header().Set("Content-Length", strconv.FormatInt(entry.Size, 10))
+		wrt.Header().Set("Accept-Ranges", "bytes")
+		wrt.WriteHeader(http.StatusOK)
+	})
+
+	//	writes an object, making sure that the user is allowed to replace it if it's already there
+	var putObject = func(req *http.Request, s3req *s3Request, name string, meta s4.FileMetadata, reader io.Reader, readErr func() error) (*s4.FileMetadata, error) {
+
+		target, err := s3req.User.Resolve(accessWrite, name)
+		if err != nil {
+			return nil, err
+		}
+
+		//	s3 puts always replace objects, but not every user is allowed to do that
+		_, err = storage.Stat(req.Context(), target.Name)
+		overwrite := err == nil
+
+		if overwrite {
+			if err := s3req.User.Allow(writeAccess(true), name); err != nil {
+				return nil, err
+			}
+		}
+
+		quota, err := quotas.Reserve(req.Context(), s3req.User, target.Name, meta.Size, overwrite)
+		if err != nil {
+			return nil, err
+		}
+
+		meta.Name = target.Name
+
+		result, err := storage.Put(req.Context(), &s4.FileUpload{
+			FileMetadata: meta,
+			Reader:       quota.Reader(reader),
+		}, overwrite)
+
+		quota.Release(result)
+
+		if err = selectError(quota.Err(), readErr(), err); err != nil {
+			if _, ok := err.(*s3Error); !ok {
+				slog.Error("S3: Store object",
+					slog.String("name", meta.Name),
+					slog.String("err", err.Error()))
+			}
+			return nil, err
+		}
+
+		return result, nil
+	}
+
+	var copyObject = func(wrt http.ResponseWriter, req *http.Request, s3req *s3Request, name string) {
+
+		source, err := url.PathUnescape(req.Header.Get("X-Amz-Copy-Source"))
+		if err != nil {
+			writeS3Error(wrt, req, &s3Error{Status: http.StatusBadRequest, Code: "InvalidArgument", Message: "invalid copy source"})
+			return
+		}
+
+		//	versions aren't a thing here, so whatever comes after the path is ignored
+		source, _, _ = strings.Cut(source, "?")
+		sourceName := path.Clean("/" + source)
+
+		sourceTarget, err := s3req.User.Resolve(accessRead, sourceName)
+		if err != nil {
+			writeS3Error(wrt, req, err)
+			return
+		}
+
+		wg.Add(1)
+		defer wg.Done()
+
+		file, err := storage.Get(req.Context(), sourceTarget.Name)
+		if err != nil {
+			if _, ok := err.(*s4.FileNotFoundError); ok {
+				err = &s3Error{Status: http.StatusNotFound, Code: "NoSuchKey", Message: fmt.Sprintf("copy source '%s' not found", source)}
+			}
+			writeS3Error(wrt, req, err)
+			return
+		}
+
+		defer file.ReadSeekCloser.Close()
+
+		meta := s4.FileMetadata{
+			Size:     file.Size,
+			Modified: file.Modified,
+			SHA256:   file.SHA256,
+		}
+
+		if req.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+			meta.Modified = s3Modified(req)
+		}
+
+		result, err := putObject(req, s3req, name, meta, file.ReadSeekCloser, func() error { return nil })
+		if err != nil {
+			writeS3Error(wrt, req, err)
+			return
+		}
+
+		writeXML(wrt, http.StatusOK, s3CopyObjectResult{
+			Xmlns:        s3Xmlns,
+			LastModified: s3Time(result.Modified),
+			ETag:         s3ETag(result),
+		})
+	}
+
+	var uploadPart = func(wrt http.ResponseWriter, req *http.Request, s3req *s3Request, uploadID string) {
+
+		if req.Header.Get("X-Amz-Copy-Source") != "" {
+			notImplemented(wrt, req)
+			return
+		}
+
+		number, err := strconv.Atoi(req.URL.Query().Get("partNumber"))
+		if err != nil || number < 1 || number > s3MaxPartNumber {
+			writeS3Error(wrt, req, &s3Error{Status: http.StatusBadRequest, Code: "InvalidArgument", Message: "invalid part number"})
+			return
+		}
+
+		if _, err := uploads.State(s3req.User.Username, uploadID, s3req.Bucket, s3req.Key); err != nil {
+			writeS3Error(wrt, req, err)
+			return
+		}
+
+		payload, err := newS3Payload(req, s3req.sigV4Request)
+		if err != nil {
+			writeS3Error(wrt, req, err)
+			return
+		}
+
+		parts, err := uploads.Parts(uploadID)
+		if err != nil {
+			writeS3Error(wrt, req, err)
+			return
+		}
+
+		//	the parts are checked against the quota as they come in, so that the upload doesn't fail only at the very end.
+		//	parts of the other uploads count too, since they're taking up space all the same
+		totalSize := payload.Size
+		for _, part := range parts {
+			if part.Number != number {
+				totalSize += part.Size
+			}
+		}
+
+		if hasQuota(s3req.User) {
+
+			staged, err := uploads.Staged(s3req.User.Username, uploadID)
+			if err != nil {
+				writeS3Error(wrt, req, err)
+				return
+			}
+
+			totalSize += staged
+		}
+
+		target, err := s3req.User.Resolve(accessWrite, "/"+s3req.Bucket+"/"+s3req.Key)
+		if err != nil {
+			writeS3Error(wrt, req, err)
+			return
+		}
+
+		if err := quotas.Check(req.Context(), s3req.User, target.Name, totalSize, true); err != nil {
+			writeS3Error(wrt, req, err)
+			return
+		}
+
+		wg.Add(1)
+		defer wg.Done()
+
+		part, err := uploads.WritePart(uploadID, number, payload)
+		if err = selectError(payload.Err(), err); err != nil {
+			if _, ok := err.(*s3Error); !ok {
+				slog.Error("S3: Write part",
+					slog.String("upload_id", uploadID),
+					slog.String("err", err.Error()))
+			}
+			writeS3Error(wrt, req, err)
+			return
+		}
+
+		stats.BytesUploaded.Add(float64(part.Size), s3req.User.Username)
+
+		wrt.Header().Set("ETag", `"`+part.ETag+`"`)
+		wrt.WriteHeader(http.StatusOK)
+	}
+
+	handle("PUT", func(wrt http.ResponseWriter, req *http.Request, s3req *s3Request) {
+
+		if len(req.URL.Query()) > 0 {
+			notImplemented(wrt, req)
+			return
+		}
+
+		if err := s3req.User.Allow(accessWrite, bucketPath(s3req)); err != nil {
+			writeS3Error(wrt, req, err)
+			return
+		}
+
+		wrt.Header().Set("Location", bucketPath(s3req))
+		wrt.WriteHeader(http.StatusOK)
+
+	}, func(wrt http.ResponseWriter, req *http.Request, s3req *s3Request) {
+
+		if uploadID := req.URL.Query().Get("uploadId"); uploadID != "" {
+			uploadPart(wrt, req, s3req, uploadID)
+			return
+		}
+
+		if isFolderMarker(s3req) {
+			wrt.Header().Set("ETag", `"`+sha256Hex(nil)+`"`)
+			wrt.WriteHeader(http.StatusOK)
+			return
+		}
+
+		name, err := objectPath(s3req)
+		if err != nil {
+			writeS3Error(wrt, req, err)
+			return
+		}
+
+		if req.Header.Get("X-Amz-Copy-Source") != "" {
+			copyObject(wrt, req, s3req, name)
+			return
+		}
+
+		payload, err := newS3Payload(req, s3req.sigV4Request)
+		if err != nil {
+			writeS3Error(wrt, req, err)
+			return
+		}
+
+		wg.Add(1)
+		defer wg.Done()
+
+		result, err := putObject(req, s3req, name, s4.FileMetadata{
+			Size:     payload.Size,
+			Modified: s3Modified(req),
+		}, payload, payload.Err)
+		if err != nil {
+			writeS3Error(wrt, req, err)
+			return
+		}
+
+		stats.BytesUploaded.Add(float64(result.Size), s3req.User.Username)
+
+		wrt.Header().Set("ETag", s3ETag(result))
+		wrt.WriteHeader(http.StatusOK)
+	})
+
+	var deleteObjects = func(wrt http.ResponseWriter, req *http.Request, s3req *s3Request) {
+
+		var body s3DeleteRequest
+		if err := xml.NewDecoder(io.LimitReader(req.Body, s3MaxXMLBodySize)).Decode(&body); err != nil {
+			writeS3Error(wrt, req, &s3Error{Status: http.StatusBadRequest, Code: "MalformedXML", Message: err.Error()})
+			return
+		}
+
+		wg.Add(1)
+		defer wg.Done()
+
+		result := s3DeleteResult{Xmlns: s3Xmlns}
+
+		for _, object := range body.Objects {
+
+			err := func() error {
+
+				name, err := objectPath(&s3Request{Bucket: s3req.Bucket, Key: object.Key})
+				if err != nil {
+					return err
+				}
+
+				target, err := s3req.User.Resolve(accessDelete, name)
+				if err != nil {
+					return err
+				}
+
+				if _, err := storage.Delete(req.Context(), target.Name); err != nil {
+					if _, ok := err.(*s4.FileNotFoundError); !ok {
+						return err
+					}
+				}
+
+				return nil
+			}()
+
+			if err != nil {
+				s3err := s3ErrorOf(err)
+				result.Errors = append(result.Errors, s3DeleteError{Key: object.Key, Code: s3err.Code, Message: s3err.Message})
+			} else if !body.Quiet {
+				result.Deleted = append(result.Deleted, s3DeletedObject{Key: object.Key})
+			}
+		}
+
+		writeXML(wrt, http.StatusOK, result)
+	}
+
+	var completeUpload = func(wrt http.ResponseWriter, req *http.Request, s3req *s3Request, uploadID string) {
+
+		if _, err := uploads.State(s3req.User.Username, uploadID, s3req.Bucket, s3req.Key); err != nil {
+			writeS3Error(wrt, req, err)
+			return
+		}
+
+		name, err := objectPath(s3req)
+		if err != nil {
+			writeS3Error(wrt, req, err)
+			return
+		}
+
+		var body s3CompleteMultipartUpload
+		if err := xml.NewDecoder(io.LimitReader(req.Body, s3MaxXMLBodySize)).Decode(&body); err != nil || len(body.Parts) == 0 {
+			writeS3Error(wrt, req, &s3Error{Status: http.StatusBadRequest, Code: "MalformedXML", Message: "invalid list of parts"})
+			return
+		}
+
+		stored, err := uploads.Parts(uploadID)
+		if err != nil {
+			writeS3Error(wrt, req, err)
+			return
+		}
+
+		var parts []s3UploadPart
+		var size int64
+
+		for idx, entry := range body.Parts {
+
+			if idx > 0 && entry.PartNumber <= body.Parts[idx-1].PartNumber {
+				writeS3Error(wrt, req, &s3Error{Status: http.StatusBadRequest, Code: "InvalidPartOrder", Message: "parts must be listed in ascending order"})
+				return
+			}
+
+			partIdx := slices.IndexFunc(stored, func(part s3UploadPart) bool {
+				return part.Number == entry.PartNumber && part.ETag == strings.Trim(entry.ETag, `"`)
+			})
+
+			if partIdx < 0 {
+				writeS3Error(wrt, req, &s3Error{Status: http.StatusBadRequest, Code: "InvalidPart", Message: fmt.Sprintf("part %d not found", entry.PartNumber)})
+				return
+			}
+
+			parts = append(parts, stored[partIdx])
+			size += stored[partIdx].Size
+		}
+
+		wg.Add(1)
+		defer wg.Done()
+
+		reader, closeParts, err := uploads.Open(parts)
+		if err != nil {
+			writeS3Error(wrt, req, err)
+			return
+		}
+
+		result, err := putObject(req, s3req, name, s4.FileMetadata{
+			Size:     size,
+			Modified: time.Now(),
+		}, reader, func() error { return nil })
+
+		closeParts()
+
+		if err != nil {
+			writeS3Error(wrt, req, err)
+			return
+		}
+
+		if err := uploads.Remove(uploadID); err != nil {
+			slog.Warn("S3: Remove completed upload",
+				slog.String("upload_id", uploadID),
+				slog.String("err", err.Error()))
+		}
+
+		writeXML(wrt, http.StatusOK, s3CompleteMultipartUploadResult{
+			Xmlns:    s3Xmlns,
+			Location: name,
+			Bucket:   s3req.Bucket,
+			Key:      s3req.Key,
+			ETag:     s3ETag(result),
+		})
+	}
+
+	handle("POST", func(wrt http.ResponseWriter, req *http.Request, s3req *s3Request) {
+
+		if !req.URL.Query().Has("delete") {
+			notImplemented(wrt, req)
+			return
+		}
+
+		deleteObjects(wrt, req, s3req)
+
+	}, func(wrt http.ResponseWriter, req *http.Request, s3req *s3Request) {
+
+		query := req.URL.Query()
+
+		switch {
+
+		case query.Has("uploads"):
+
+			name, err := objectPath(s3req)
+			if err != nil {
+				writeS3Error(wrt, req, err)
+				return
+			}
+
+			if _, err := s3req.User.Resolve(accessWrite, name); err != nil {
+				writeS3Error(wrt, req, err)
+				return
+			}
+
+			uploadID, err := uploads.Create(s3req.User.Username, s3req.Bucket, s3req.Key)
+			if err != nil {
+				slog.Error("S3: Create upload",
+					slog.String("name", name),
+					slog.String("err", err.Error()))
+				writeS3Error(wrt, req, err)
+				return
+			}
+
+			writeXML(wrt, http.StatusOK, s3InitiateMultipartUploadResult{
+				Xmlns:    s3Xmlns,
+				Bucket:   s3req.Bucket,
+				Key:      s3req.Key,
+				UploadID: uploadID,
+			})
+
+		case query.Get("uploadId") != "":
+			completeUpload(wrt, req, s3req, query.Get("uploadId"))
+
+		default:
+			notImplemented(wrt, req)
+		}
+	})
+
+	handle("DELETE", func(wrt http.ResponseWriter, req *http.Request, s3req *s3Request) {
+
+		if err := s3req.User.Allow(accessDelete, bucketPath(s3req)); err != nil {
+			writeS3Error(wrt, req, err)
+			return
+		}
+
+		files, err := backend.listFiles(req.Context(), s3req.User, bucketPath(s3req))
+		if err != nil {
+			writeS3Error(wrt, req, err)
+			return
+		}
+
+		if len(files) > 0 {
+			writeS3Error(wrt, req, &s3Error{Status: http.StatusConflict, Code: "BucketNotEmpty", Message: "the bucket has objects in it"})
+			return
+		}
+
+		wrt.WriteHeader(http.StatusNoContent)
+
+	}, func(wrt http.ResponseWriter, req *http.Request, s3req *s3Request) {
+
+		if uploadID := req.URL.Query().Get("uploadId"); uploadID != "" {
+
+			if _, err := uploads.State(s3req.User.Username, uploadID, s3req.Bucket, s3req.Key); err != nil {
+				writeS3Error(wrt, req, err)
+				return
+			}
+
+			if err := uploads.Remove(uploadID); err != nil {
+				writeS3Error(wrt, req, err)
+				return
+			}
+
+			wrt.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if isFolderMarker(s3req) {
+			wrt.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		name, err := objectPath(s3req)
+		if err != nil {
+			writeS3Error(wrt, req, err)
+			return
+		}
+
+		target, err := s3req.User.Resolve(accessDelete, name)
+		if err != nil {
+			writeS3Error(wrt, req, err)
+			return
+		}
+
+		wg.Add(1)
+		defer wg.Done()
+
+		//	deleting something that isn't there is not an error in s3
+		if _, err := storage.Delete(req.Context(), target.Name); err != nil {
+			if _, ok := err.(*s4.FileNotFoundError); !ok {
+				slog.Error("S3: Delete object",
+					slog.String("name", target.Name),
+					slog.String("err", err.Error()))
+				writeS3Error(wrt, req, err)
+				return
+			}
+		}
+
+		wrt.WriteHeader(http.StatusNoContent)
+	})
+
+	return &fsHandler{
+		Handler:   stats.Middleware(&mux),
+		WaitGroup: &wg,
+	}
+}
+
+// Object metadata headers. The etag is the sha256 rather than md5, which most clients are fine with,
+// as they only compare the md5 when they see one
+func setS3ObjectHeaders(wrt http.ResponseWriter, entry *s4.FileMetadata) {
+	wrt.Header().Set("ETag", s3ETag(entry))
+	wrt.Header().Set("Last-Modified", entry.Modified.UTC().Format(http.TimeFormat))
+	wrt.Header().Set("X-Amz-Meta-Mtime", strconv.FormatFloat(float64(entry.Modified.UnixNano())/1e9, 'f', -1, 64))
+}
+
+// Modification time that the client wants the object to have, in the form rclone sends it in
+func s3Modified(req *http.Request) time.Time {
+
+	if val, err := strconv.ParseFloat(req.Header.Get("X-Amz-Meta-Mtime"), 64); err == nil && val > 0 {
+		sec, frac := math.Modf(val)
+		return time.Unix(int64(sec), int64(frac*1e9))
+	}
+
+	return time.Now()
+}
+
+// Object data that's being uploaded, decoded from however the client has sent it
+// and checked against the digests that came along with it
+type s3Payload struct {
+	Size       int64
+	reader     io.Reader
+	read       int64
+	sha256     hash.Hash
+	wantSHA256 string
+	md5        hash.Hash
+	wantMD5    []byte
+	//	storage backends wrap reader errors, so the handlers have to pick it up from here
+	err error
+}
+
+func newS3Payload(req *http.Request, sig *sigV4Request) (*s3Payload, error) {
+
+	payload := s3Payload{Size: req.ContentLength}
+
+	var reader io.Reader = req.Body
+
+	switch {
+
+	case sig.PayloadHash == payloadStreaming || sig.PayloadHash == payloadStreamingUnsign:
+
+		size, err := strconv.ParseInt(req.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64)
+		if err != nil || size < 0 {
+			return nil, &s3Error{Status: http.StatusLengthRequired, Code: "MissingContentLength", Message: "decoded content length is required"}
+		}
+
+		payload.Size = size
+		reader = newAWSChunkedReader(req.Body, sig)
+
+	case sig.PayloadHash == payloadUnsigned:
+
+	case s3PayloadHashExpr.MatchString(sig.PayloadHash):
+		payload.sha256 = sha256.New()
+		payload.wantSHA256 = sig.PayloadHash
+
+	default:
+		return nil, &s3Error{Status: http.StatusNotImplemented, Code: "NotImplemented", Message: "unsupported payload signing mode"}
+	}
+
+	if payload.Size < 0 {
+		return nil, &s3Error{Status: http.StatusLengthRequired, Code: "MissingContentLength", Message: "content length is required"}
+	}
+
+	if val := req.Header.Get("Content-MD5"); val != "" {
+
+		sum, err := base64.StdEncoding.DecodeString(val)
+		if err != nil || len(sum) != md5.Size {
+			return nil, &s3Error{Status: http.StatusBadRequest, Code: "InvalidDigest", Message: "invalid content md5"}
+		}
+
+		payload.md5 = md5.New()
+		payload.wantMD5 = sum
+	}
+
+	payload.reader = io.LimitReader(reader, payload.Size)
+
+	return &payload, nil
+}
+
+func (payload *s3Payload) Read(buff []byte) (int, error) {
+
+	n, err := payload.reader.Read(buff)
+
+	payload.read += int64(n)
+
+	if payload.sha256 != nil {
+		payload.sha256.Write(buff[:n])
+	}
+
+	if payload.md5 != nil {
+		payload.md5.Write(buff[:n])
+	}
+
+	if err == io.EOF {
+		err = payload.verify()
+	}
+
+	if s3err, ok := err.(*s3Error); ok {
+		payload.err = s3err
+	}
+
+	return n, err
+}
+
+// Checks the data once it's all been read
+func (payload *s3Payload) verify() error {
+
+	if payload.read != payload.Size {
+		return &s3Error{Status: http.StatusBadRequest, Code: "IncompleteBody", Message: fmt.Sprintf("expected %d bytes, got %d", payload.Size, payload.read)}
+	}
+
+	if payload.sha256 != nil && hex.EncodeToString(payload.sha256.Sum(nil)) != payload.wantSHA256 {
+		return &s3Error{Status: http.StatusBadRequest, Code: "XAmzContentSHA256Mismatch", Message: "content sha256 does not match"}
+	}
+
+	if payload.md5 != nil && !bytes.Equal(payload.md5.Sum(nil), payload.wantMD5) {
+		return &s3Error{Status: http.StatusBadRequest, Code: "BadDigest", Message: "content md5 does not match"}
+	}
+
+	return io.EOF
+}
+
+func (payload *s3Payload) Err() error {
+	return payload.err
+}
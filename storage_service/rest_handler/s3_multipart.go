@@ -0,0 +1,345 @@
+package rest_handler
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maddsua/syncctl/utils"
+)
+
+// Multipart uploads that are left unfinished get removed after this long
+const s3UploadLifetime = 7 * 24 * time.Hour
+
+const s3MaxPartNumber = 10_000
+
+const s3UploadStateFile = "upload.json"
+const s3PartExt = ".part"
+
+var s3UploadIdExpr = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// Keeps the parts of s3 multipart uploads until they're completed. Each upload gets a directory,
+// with the parts stored as plain files named after their number and md5, which also is their etag
+type s3Uploads struct {
+	Dir string
+}
+
+type s3UploadState struct {
+	Owner   string    `json:"owner"`
+	Bucket  string    `json:"bucket"`
+	Key     string    `json:"key"`
+	Created time.Time `json:"created"`
+}
+
+type s3UploadPart struct {
+	Number   int
+	ETag     string
+	Size     int64
+	Modified time.Time
+	path     string
+}
+
+func (uploads *s3Uploads) uploadDir(id string) string {
+	return path.Join(uploads.Dir, id)
+}
+
+func (uploads *s3Uploads) Create(owner, bucket, key string) (string, error) {
+
+	//	a bit of housekeeping
+	uploads.Cleanup()
+
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", err
+	}
+
+	id := hex.EncodeToString(idBytes)
+
+	if err := os.MkdirAll(uploads.uploadDir(id), fs.ModePerm); err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(s3UploadState{
+		Owner:   owner,
+		Bucket:  bucket,
+		Key:     key,
+		Created: time.Now(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.WriteFile(path.Join(uploads.uploadDir(id), s3UploadStateFile), data, 0600); err != nil {
+		_ = os.RemoveAll(uploads.uploadDir(id))
+		return "", err
+	}
+
+	return id, nil
+}
+
+func (uploads *s3Uploads) readState(id string) (*s3UploadState, error) {
+
+	data, err := os.ReadFile(path.Join(uploads.uploadDir(id), s3UploadStateFile))
+	if err != nil {
+		return nil, err
+	}
+
+	var state s3UploadState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+
+	return &state, nil
+}
+
+// Loads an upload, making sure that it's the same object that it's been created for
+func (uploads *s3Uploads) State(owner, id, bucket, key string) (*s3UploadState, error) {
+
+	errNotFound := &s3Error{Status: http.StatusNotFound, Code: "NoSuchUpload", Message: fmt.Sprintf("upload '%s' not found", id)}
+
+	if !s3UploadIdExpr.MatchString(id) {
+		return nil, errNotFound
+	}
+
+	state, err := uploads.readState(id)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errNotFound
+		}
+		return nil, err
+	}
+
+	if state.Owner != owner || state.Bucket != bucket || state.Key != key {
+		return nil, errNotFound
+	}
+
+	return state, nil
+}
+
+// Stores a part, replacing the one with the same number if it's been uploaded before
+func (uploads *s3Uploads) WritePart(id string, number int, reader io.Reader) (*s3UploadPart, error) {
+
+	dir := uploads.uploadDir(id)
+	hasher := md5.New()
+
+	temp, err := utils.WriteTempFile(dir, fmt.Sprintf("%05d-", number), io.TeeReader(reader, hasher))
+	if err != nil {
+		return nil, err
+	}
+
+	defer temp.Cleanup()
+
+	etag := hex.EncodeToString(hasher.Sum(nil))
+	name := path.Join(dir, fmt.Sprintf("%05d-%s%s", number, etag, s3PartExt))
+
+	parts, err := uploads.Parts(id)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, part := range parts {
+		if part.Number == number && part.path != name {
+			_ = os.Remove(part.path)
+		}
+	}
+
+	if err := os.Rename(temp.Name, name); err != nil {
+		return nil, err
+	}
+
+	stat, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3UploadPart{
+		Number:   number,
+		ETag:     etag,
+		Size:     stat.Size(),
+		Modified: stat.ModTime(),
+		path:     name,
+	}, nil
+}
+
+// Lists the stored parts, ordered by their number
+func (uploads *s3Uploads) Parts(id string) ([]s3UploadPart, error) {
+
+	entries, err := os.ReadDir(uploads.uploadDir(id))
+	if err != nil {
+		return nil, err
+	}
+
+	var parts []s3UploadPart
+
+	for _, entry := range entries {
+
+		baseName, ok := strings.CutSuffix(entry.Name(), s3PartExt)
+		if !ok || entry.IsDir() {
+			continue
+		}
+
+		numberVal, etag, _ := strings.Cut(baseName, "-")
+
+		number, err := strconv.Atoi(numberVal)
+		if err != nil {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		parts = append(parts, s3UploadPart{
+			Number:   number,
+			ETag:     etag,
+			Size:     info.Size(),
+			Modified: info.ModTime(),
+			path:     path.Join(uploads.uploadDir(id), entry.Name()),
+		})
+	}
+
+	slices.SortFunc(parts, func(a, b s3UploadPart) int {
+		return a.Number - b.Number
+	})
+
+	return parts, nil
+}
+
+// Opens the parts as a single stream
+func (uploads *s3Uploads) Open(parts []s3UploadPart) (io.Reader, func(), error) {
+
+	var files []*os.File
+
+	closeAll := func() {
+		for _, file := range files {
+			_ = file.Close()
+		}
+	}
+
+	var readers []io.Reader
+
+	for _, part := range parts {
+
+		file, err := os.Open(part.path)
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+
+		files = append(files, file)
+		readers = append(readers, file)
+	}
+
+	return io.MultiReader(readers...), closeAll, nil
+}
+
+func (uploads *s3Uploads) List(owner, bucket string) ([]s3MultipartUpload, error) {
+
+	entries, err := os.ReadDir(uploads.Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var result []s3MultipartUpload
+
+	for _, entry := range entries {
+
+		if !entry.IsDir() || !s3UploadIdExpr.MatchString(entry.Name()) {
+			continue
+		}
+
+		state, err := uploads.readState(entry.Name())
+		if err != nil || state.Owner != owner || state.Bucket != bucket {
+			continue
+		}
+
+		result = append(result, s3MultipartUpload{
+			Key:       state.Key,
+			UploadID:  entry.Name(),
+			Initiated: s3Time(state.Created),
+		})
+	}
+
+	slices.SortFunc(result, func(a, b s3MultipartUpload) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+
+	return result, nil
+}
+
+// Adds up the parts that the user has uploaded so far, leaving out the ones of a single upload
+func (uploads *s3Uploads) Staged(owner, exceptID string) (int64, error) {
+
+	entries, err := os.ReadDir(uploads.Dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	var size int64
+
+	for _, entry := range entries {
+
+		if !entry.IsDir() || entry.Name() == exceptID || !s3UploadIdExpr.MatchString(entry.Name()) {
+			continue
+		}
+
+		if state, err := uploads.readState(entry.Name()); err != nil || state.Owner != owner {
+			continue
+		}
+
+		parts, err := uploads.Parts(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		for _, part := range parts {
+			size += part.Size
+		}
+	}
+
+	return size, nil
+}
+
+func (uploads *s3Uploads) Remove(id string) error {
+	return os.RemoveAll(uploads.uploadDir(id))
+}
+
+// Removes the uploads that have been abandoned
+func (uploads *s3Uploads) Cleanup() {
+
+	entries, err := os.ReadDir(uploads.Dir)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+
+		if !entry.IsDir() || !s3UploadIdExpr.MatchString(entry.Name()) {
+			continue
+		}
+
+		state, err := uploads.readState(entry.Name())
+		if err == nil && time.Since(state.Created) < s3UploadLifetime {
+			continue
+		}
+
+		_ = uploads.Remove(entry.Name())
+	}
+}
@@ -0,0 +1,361 @@
+package rest_handler
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const sigV4Algorithm = "AWS4-HMAC-SHA256"
+const sigV4TimeFormat = "20060102T150405Z"
+
+// How far off the client clock can be
+const sigV4MaxSkew = 15 * time.Minute
+
+// The longest a presigned url can stay valid for, same as what aws allows
+const sigV4MaxExpires = 7 * 24 * 60 * 60
+
+// What can be put in place of the payload hash
+const (
+	payloadUnsigned        = "UNSIGNED-PAYLOAD"
+	payloadStreaming       = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	payloadStreamingUnsign = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+)
+
+// Streamed chunks are buffered to check their signatures before anything gets written.
+// Clients tend to send 64KiB chunks, so this is way more than enough
+const maxStreamingChunkSize = 16 << 20
+
+// A request that has passed the signature check
+type sigV4Request struct {
+	User        *UserState
+	PayloadHash string
+	signingKey  []byte
+	date        string
+	scope       string
+	signature   string
+}
+
+func (auth *AuthThingy) AuthorizeSigV4(req *http.Request) (*sigV4Request, error) {
+
+	result, err := auth.authorizeSigV4(req)
+	if err != nil {
+
+		slog.Warn("User auth: SigV4 rejected",
+			slog.String("reason", err.Error()))
+
+		auth.Metrics.AuthFailures.Inc("sigv4")
+		return nil, err
+	}
+
+	setActor(req, result.User)
+	return result, nil
+}
+
+func (auth *AuthThingy) authorizeSigV4(req *http.Request) (*sigV4Request, error) {
+
+	var credential, signedHeaders, signature, date string
+	var presigned bool
+
+	query := req.URL.Query()
+
+	if header := req.Header.Get("Authorization"); header != "" {
+
+		algo, params, _ := strings.Cut(header, " ")
+		if algo != sigV4Algorithm {
+			return nil, &s3Error{Status: http.StatusBadRequest, Code: "InvalidRequest", Message: "only " + sigV4Algorithm + " auth is supported"}
+		}
+
+		for _, param := range strings.Split(params, ",") {
+			key, val, _ := strings.Cut(strings.TrimSpace(param), "=")
+			switch key {
+			case "Credential":
+				credential = val
+			case "SignedHeaders":
+				signedHeaders = val
+			case "Signature":
+				signature = val
+			}
+		}
+
+		date = req.Header.Get("X-Amz-Date")
+
+	} else if query.Get("X-Amz-Algorithm") == sigV4Algorithm {
+
+		presigned = true
+		credential = query.Get("X-Amz-Credential")
+		signedHeaders = query.Get("X-Amz-SignedHeaders")
+		signature = query.Get("X-Amz-Signature")
+		date = query.Get("X-Amz-Date")
+
+	} else {
+		return nil, &s3Error{Status: http.StatusForbidden, Code: "AccessDenied", Message: "anonymous access is not allowed"}
+	}
+
+	if credential == "" || signedHeaders == "" || signature == "" {
+		return nil, &s3Error{Status: http.StatusBadRequest, Code: "AuthorizationHeaderMalformed", Message: "incomplete sigv4 parameters"}
+	}
+
+	//	without the host in the signature the request could be replayed against any other server sharing the keys
+	if !slices.Contains(strings.Split(signedHeaders, ";"), "host") {
+		return nil, &s3Error{Status: http.StatusBadRequest, Code: "AuthorizationHeaderMalformed", Message: "host header must be signed"}
+	}
+
+	//	credential is '<access key>/<date>/<region>/<service>/aws4_request'
+	accessKey, scope, _ := strings.Cut(credential, "/")
+	scopeParts := strings.Split(scope, "/")
+	if len(scopeParts) != 4 || scopeParts[3] != "aws4_request" || scopeParts[2] != "s3" {
+		return nil, &s3Error{Status: http.StatusBadRequest, Code: "AuthorizationHeaderMalformed", Message: "invalid credential scope"}
+	}
+
+	signedAt, err := time.Parse(sigV4TimeFormat, date)
+	if err != nil || !strings.HasPrefix(date, scopeParts[0]) {
+		return nil, &s3Error{Status: http.StatusBadRequest, Code: "AuthorizationHeaderMalformed", Message: "invalid request date"}
+	}
+
+	if presigned {
+
+		expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || expires < 0 || expires > sigV4MaxExpires {
+			return nil, &s3Error{Status: http.StatusBadRequest, Code: "AuthorizationQueryParametersError", Message: "invalid expiration"}
+		}
+
+		if time.Now().After(signedAt.Add(time.Duration(expires) * time.Second)) {
+			return nil, &s3Error{Status: http.StatusForbidden, Code: "AccessDenied", Message: "request has expired"}
+		}
+
+	} else if skew := time.Since(signedAt); skew > sigV4MaxSkew || skew < -sigV4MaxSkew {
+		return nil, &s3Error{Status: http.StatusForbidden, Code: "RequestTimeTooSkewed", Message: "request time is too far off the server time"}
+	}
+
+	entry, _ := auth.accessKeys.Load(accessKey)
+	user, ok := entry.(*UserState)
+	if !ok {
+		return nil, &s3Error{Status: http.StatusForbidden, Code: "InvalidAccessKeyId", Message: "access key does not exist"}
+	}
+
+	payloadHash := req.Header.Get("X-Amz-Content-Sha256")
+	if presigned || payloadHash == "" {
+		payloadHash = payloadUnsigned
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		sigV4CanonicalURI(req.URL.Path),
+		sigV4CanonicalQuery(query, presigned),
+		sigV4CanonicalHeaders(req, signedHeaders),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	result := sigV4Request{
+		User:        user,
+		PayloadHash: payloadHash,
+		signingKey:  sigV4SigningKey(user.S3.SecretKey, scopeParts[0], scopeParts[1]),
+		date:        date,
+		scope:       scope,
+		signature:   signature,
+	}
+
+	stringToSign := strings.Join([]string{sigV4Algorithm, date, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	if !hmac.Equal([]byte(hex.EncodeToString(hmacSHA256(result.signingKey, stringToSign))), []byte(signature)) {
+		return nil, &s3Error{Status: http.StatusForbidden, Code: "SignatureDoesNotMatch", Message: "request signature does not match"}
+	}
+
+	return &result, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func sigV4SigningKey(secret, date, region string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	return hmacSHA256(key, "aws4_request")
+}
+
+// Percent-encodes everything except for the unreserved characters, the way aws wants it
+func sigV4Escape(val string, keepSlash bool) string {
+
+	var buff strings.Builder
+
+	for _, char := range []byte(val) {
+		switch {
+		case 'A' <= char && char <= 'Z', 'a' <= char && char <= 'z', '0' <= char && char <= '9',
+			char == '-', char == '_', char == '.', char == '~', char == '/' && keepSlash:
+			buff.WriteByte(char)
+		default:
+			fmt.Fprintf(&buff, "%%%02X", char)
+		}
+	}
+
+	return buff.String()
+}
+
+func sigV4CanonicalURI(name string) string {
+	if name == "" {
+		return "/"
+	}
+	return sigV4Escape(name, true)
+}
+
+func sigV4CanonicalQuery(query url.Values, presigned bool) string {
+
+	var pairs []string
+
+	for key, values := range query {
+
+		if presigned && key == "X-Amz-Signature" {
+			continue
+		}
+
+		for _, val := range values {
+			pairs = append(pairs, sigV4Escape(key, false)+"="+sigV4Escape(val, false))
+		}
+	}
+
+	slices.Sort(pairs)
+
+	return strings.Join(pairs, "&")
+}
+
+func sigV4CanonicalHeaders(req *http.Request, signedHeaders string) string {
+
+	var buff strings.Builder
+
+	for _, name := range strings.Split(signedHeaders, ";") {
+
+		var val string
+
+		switch name {
+		case "host":
+			val = req.Host
+		case "content-length":
+			val = strconv.FormatInt(req.ContentLength, 10)
+		default:
+			val = strings.Join(req.Header.Values(name), ",")
+		}
+
+		buff.WriteString(name + ":" + strings.Join(strings.Fields(val), " ") + "\n")
+	}
+
+	return buff.String()
+}
+
+// Decodes 'aws-chunked' request bodies, checking the signature of every chunk when the payload is signed
+type awsChunkedReader struct {
+	reader  *bufio.Reader
+	request *sigV4Request
+	prevSig string
+	chunk   bytes.Reader
+	done    bool
+	//	storage backends wrap reader errors, so the handler has to pick it up from here
+	err error
+}
+
+func newAWSChunkedReader(reader io.Reader, request *sigV4Request) *awsChunkedReader {
+
+	result := awsChunkedReader{reader: bufio.NewReader(reader)}
+
+	if request.PayloadHash == payloadStreaming {
+		result.request = request
+		result.prevSig = request.signature
+	}
+
+	return &result
+}
+
+func (reader *awsChunkedReader) Read(buff []byte) (int, error) {
+
+	for reader.chunk.Len() == 0 {
+
+		if reader.done {
+			return 0, io.EOF
+		}
+
+		if err := reader.nextChunk(); err != nil {
+			reader.err = err
+			return 0, err
+		}
+	}
+
+	return reader.chunk.Read(buff)
+}
+
+func (reader *awsChunkedReader) Err() error {
+	return reader.err
+}
+
+func (reader *awsChunkedReader) nextChunk() error {
+
+	line, err := reader.reader.ReadString('\n')
+	if err != nil {
+		return &s3Error{Status: http.StatusBadRequest, Code: "IncompleteBody", Message: "unexpected end of chunked payload"}
+	}
+
+	sizeVal, params, _ := strings.Cut(strings.TrimSpace(line), ";")
+
+	size, err := strconv.ParseInt(sizeVal, 16, 64)
+	if err != nil || size < 0 || size > maxStreamingChunkSize {
+		return &s3Error{Status: http.StatusBadRequest, Code: "InvalidChunkSizeError", Message: "invalid chunk size"}
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(reader.reader, data); err != nil {
+		return &s3Error{Status: http.StatusBadRequest, Code: "IncompleteBody", Message: "unexpected end of chunked payload"}
+	}
+
+	if reader.request != nil {
+
+		signature, _ := strings.CutPrefix(params, "chunk-signature=")
+
+		stringToSign := strings.Join([]string{
+			sigV4Algorithm + "-PAYLOAD",
+			reader.request.date,
+			reader.request.scope,
+			reader.prevSig,
+			sha256Hex(nil),
+			sha256Hex(data),
+		}, "\n")
+
+		if !hmac.Equal([]byte(hex.EncodeToString(hmacSHA256(reader.request.signingKey, stringToSign))), []byte(signature)) {
+			return &s3Error{Status: http.StatusForbidden, Code: "SignatureDoesNotMatch", Message: "chunk signature does not match"}
+		}
+
+		reader.prevSig = signature
+	}
+
+	if size == 0 {
+		//	whatever is left are the trailing headers, which aren't of much use here
+		reader.done = true
+		return nil
+	}
+
+	if crlf, err := reader.reader.ReadString('\n'); err != nil || strings.TrimSpace(crlf) != "" {
+		return &s3Error{Status: http.StatusBadRequest, Code: "IncompleteBody", Message: "malformed chunked payload"}
+	}
+
+	reader.chunk.Reset(data)
+	return nil
+}
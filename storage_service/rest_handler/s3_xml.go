@@ -0,0 +1,231 @@
+package rest_handler
+
+import (
+	"encoding/xml"
+	"net/http"
+	"time"
+
+	s4 "github.com/maddsua/syncctl/storage_service"
+	"github.com/maddsua/syncctl/storage_service/audit"
+)
+
+const s3Xmlns = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// Timestamps in the listings have milliseconds in them, unlike the ones in the headers
+const s3TimeFormat = "2006-01-02T15:04:05.000Z"
+
+type s3Owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type s3Bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type s3ListBucketsResult struct {
+	XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Owner   s3Owner    `xml:"Owner"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// Serves both versions of the listing, the fields that don't belong to the requested one are left empty
+type s3ListBucketResult struct {
+	XMLName               xml.Name         `xml:"ListBucketResult"`
+	Xmlns                 string           `xml:"xmlns,attr"`
+	Name                  string           `xml:"Name"`
+	Prefix                string           `xml:"Prefix"`
+	Delimiter             string           `xml:"Delimiter,omitempty"`
+	EncodingType          string           `xml:"EncodingType,omitempty"`
+	MaxKeys               int              `xml:"MaxKeys"`
+	IsTruncated           bool             `xml:"IsTruncated"`
+	Marker                *string          `xml:"Marker"`
+	NextMarker            string           `xml:"NextMarker,omitempty"`
+	KeyCount              *int             `xml:"KeyCount"`
+	StartAfter            string           `xml:"StartAfter,omitempty"`
+	ContinuationToken     string           `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+	Contents              []s3Object       `xml:"Contents"`
+	CommonPrefixes        []s3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+type s3LocationConstraint struct {
+	XMLName xml.Name `xml:"LocationConstraint"`
+	Xmlns   string   `xml:"xmlns,attr"`
+}
+
+type s3CopyObjectResult struct {
+	XMLName      xml.Name `xml:"CopyObjectResult"`
+	Xmlns        string   `xml:"xmlns,attr"`
+	LastModified string   `xml:"LastModified"`
+	ETag         string   `xml:"ETag"`
+}
+
+type s3DeleteRequest struct {
+	Quiet   bool `xml:"Quiet"`
+	Objects []struct {
+		Key string `xml:"Key"`
+	} `xml:"Object"`
+}
+
+type s3DeletedObject struct {
+	Key string `xml:"Key"`
+}
+
+type s3DeleteError struct {
+	Key     string `xml:"Key"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+type s3DeleteResult struct {
+	XMLName xml.Name          `xml:"DeleteResult"`
+	Xmlns   string            `xml:"xmlns,attr"`
+	Deleted []s3DeletedObject `xml:"Deleted"`
+	Errors  []s3DeleteError   `xml:"Error"`
+}
+
+type s3InitiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+type s3CompleteMultipartUpload struct {
+	Parts []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type s3CompleteMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+type s3MultipartUpload struct {
+	Key       string `xml:"Key"`
+	UploadID  string `xml:"UploadId"`
+	Initiated string `xml:"Initiated"`
+}
+
+type s3ListMultipartUploadsResult struct {
+	XMLName     xml.Name            `xml:"ListMultipartUploadsResult"`
+	Xmlns       string              `xml:"xmlns,attr"`
+	Bucket      string              `xml:"Bucket"`
+	IsTruncated bool                `xml:"IsTruncated"`
+	Uploads     []s3MultipartUpload `xml:"Upload"`
+}
+
+type s3Part struct {
+	PartNumber   int    `xml:"PartNumber"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+}
+
+type s3ListPartsResult struct {
+	XMLName     xml.Name `xml:"ListPartsResult"`
+	Xmlns       string   `xml:"xmlns,attr"`
+	Bucket      string   `xml:"Bucket"`
+	Key         string   `xml:"Key"`
+	UploadID    string   `xml:"UploadId"`
+	IsTruncated bool     `xml:"IsTruncated"`
+	Parts       []s3Part `xml:"Part"`
+}
+
+func s3ETag(entry *s4.FileMetadata) string {
+	return `"` + entry.SHA256 + `"`
+}
+
+func s3Time(val time.Time) string {
+	return val.UTC().Format(s3TimeFormat)
+}
+
+type s3Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (err *s3Error) Error() string {
+	return err.Message
+}
+
+type s3ErrorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	Resource  string   `xml:"Resource"`
+	RequestID string   `xml:"RequestId"`
+}
+
+// Maps the storage errors onto the codes that s3 clients know how to deal with
+func s3ErrorOf(err error) *s3Error {
+
+	if err, ok := err.(*s3Error); ok {
+		return err
+	}
+
+	code := errorStatus(err)
+
+	switch code {
+	case http.StatusNotFound:
+		return &s3Error{Status: code, Code: "NoSuchKey", Message: err.Error()}
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return &s3Error{Status: http.StatusForbidden, Code: "AccessDenied", Message: err.Error()}
+	case http.StatusConflict:
+		return &s3Error{Status: code, Code: "OperationAborted", Message: err.Error()}
+	case http.StatusBadRequest:
+		return &s3Error{Status: code, Code: "InvalidArgument", Message: err.Error()}
+	case http.StatusRequestEntityTooLarge:
+		return &s3Error{Status: http.StatusBadRequest, Code: "EntityTooLarge", Message: err.Error()}
+	case http.StatusInsufficientStorage:
+		return &s3Error{Status: code, Code: "QuotaExceeded", Message: err.Error()}
+	default:
+		return &s3Error{Status: http.StatusInternalServerError, Code: "InternalError", Message: err.Error()}
+	}
+}
+
+func writeS3Error(wrt http.ResponseWriter, req *http.Request, err error) {
+
+	s3err := s3ErrorOf(err)
+
+	//	head responses can't have a body, so the status is all the client gets
+	if req.Method == http.MethodHead {
+		wrt.WriteHeader(s3err.Status)
+		return
+	}
+
+	resp := s3ErrorResponse{
+		Code:     s3err.Code,
+		Message:  s3err.Message,
+		Resource: req.URL.Path,
+	}
+
+	if actor := audit.ActorFrom(req.Context()); actor != nil {
+		resp.RequestID = actor.RequestID
+	}
+
+	writeXML(wrt, s3err.Status, resp)
+}
@@ -25,3 +25,57 @@ type NameError struct {
 func (err *NameError) Error() string {
 	return fmt.Sprintf("file name '%s' invalid", err.Name)
 }
+
+type UploadNotFoundError struct {
+	ID string
+}
+
+func (err *UploadNotFoundError) Error() string {
+	return fmt.Sprintf("upload session '%s' not found", err.ID)
+}
+
+type UploadConflictError struct {
+	ID     string
+	Offset int64
+	Busy   bool
+}
+
+func (err *UploadConflictError) Error() string {
+	if err.Busy {
+		return fmt.Sprintf("upload session '%s' is busy", err.ID)
+	}
+	return fmt.Sprintf("upload session '%s' is at offset %d", err.ID, err.Offset)
+}
+
+type QuotaError struct {
+	//	file count limit rather than the storage size one
+	IsFiles bool
+	Limit   int64
+	Used    int64
+	Size    int64
+}
+
+// The upload can't possibly fit, no matter how much space gets freed up
+func (err *QuotaError) TooLarge() bool {
+	return !err.IsFiles && err.Size > err.Limit
+}
+
+func (err *QuotaError) Error() string {
+	switch {
+	case err.IsFiles:
+		return fmt.Sprintf("file limit of %d reached", err.Limit)
+	case err.TooLarge():
+		return fmt.Sprintf("file size of %d bytes exceeds the storage quota of %d bytes", err.Size, err.Limit)
+	default:
+		return fmt.Sprintf("storage quota exceeded: %d of %d bytes used, %d more needed", err.Used, err.Limit, err.Size)
+	}
+}
+
+// Returned by the storage wrappers that pass calls through to a feature that hasn't been enabled
+type NotSupportedError struct {
+	Feature string
+}
+
+func (err *NotSupportedError) Error() string {
+	return fmt.Sprintf("%s is disabled", err.Feature)
+}
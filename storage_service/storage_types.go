@@ -22,10 +22,75 @@ type Storage interface {
 
 type StorageClient interface {
 	BaseStorageController
-	Download(ctx context.Context, name string) (*ReadableFile, error)
+	Download(ctx context.Context, name string, offset int64) (*ReadableFile, error)
 	Ping(ctx context.Context) error
 }
 
+// Implemented by storages that wrap other storages to add some extra behavior on top
+type StorageWrapper interface {
+	Unwrap() Storage
+}
+
+// Looks for a storage that implements T, going down the wrapping chain if needed
+func StorageAs[T any](storage Storage) (T, bool) {
+
+	for storage != nil {
+
+		if val, ok := storage.(T); ok {
+			return val, true
+		}
+
+		wrapper, ok := storage.(StorageWrapper)
+		if !ok {
+			break
+		}
+
+		storage = wrapper.Unwrap()
+	}
+
+	var none T
+	return none, false
+}
+
+// Implemented by the storage backends that can tell how much they're holding without listing everything
+type StatsController interface {
+	Stats(ctx context.Context) (*StorageStats, error)
+}
+
+type TrashController interface {
+	ListTrash(ctx context.Context, prefix string) ([]TrashEntry, error)
+	RestoreTrash(ctx context.Context, scope string, id string, overwrite bool) (*FileMetadata, error)
+	EmptyTrash(ctx context.Context, prefix string) ([]TrashEntry, error)
+	PurgeTrash(ctx context.Context, before time.Time) ([]TrashEntry, error)
+}
+
+type TrashClient interface {
+	ListTrash(ctx context.Context, prefix string) ([]TrashEntry, error)
+	RestoreTrash(ctx context.Context, id string, overwrite bool) (*FileMetadata, error)
+	EmptyTrash(ctx context.Context, prefix string) ([]TrashEntry, error)
+}
+
+type VersionController interface {
+	ListVersions(ctx context.Context, name string) ([]FileVersion, error)
+	GetVersion(ctx context.Context, name string, id string) (*ReadSeekableFile, error)
+	RestoreVersion(ctx context.Context, name string, id string) (*FileMetadata, error)
+	PurgeVersions(ctx context.Context, before time.Time) ([]FileVersion, error)
+}
+
+type VersionClient interface {
+	ListVersions(ctx context.Context, name string) ([]FileVersion, error)
+	DownloadVersion(ctx context.Context, name string, id string, offset int64) (*ReadableFile, error)
+	RestoreVersion(ctx context.Context, name string, id string) (*FileMetadata, error)
+}
+
+type ResumableUploadClient interface {
+	CreateUpload(ctx context.Context, entry *FileMetadata, overwrite bool) (*UploadSession, error)
+	StatUpload(ctx context.Context, id string) (*UploadSession, error)
+	WriteUpload(ctx context.Context, id string, offset int64, chunk []byte) (*UploadSession, error)
+	FinalizeUpload(ctx context.Context, id string, sha256 string) (*FileMetadata, error)
+	CancelUpload(ctx context.Context, id string) error
+}
+
 type ReadSeekableFile struct {
 	FileMetadata
 	io.ReadSeekCloser
@@ -48,3 +113,38 @@ type FileMetadata struct {
 	Modified time.Time `json:"mod"`
 	SHA256   string    `json:"sha256"`
 }
+
+type UploadSession struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	Offset    int64     `json:"offset"`
+	Modified  time.Time `json:"mod"`
+	Overwrite bool      `json:"overwrite"`
+	Expires   time.Time `json:"expires"`
+}
+
+func (session *UploadSession) SizeKnown() bool {
+	return session.Size >= 0
+}
+
+type TrashEntry struct {
+	FileMetadata
+	ID        string    `json:"id"`
+	Deleted   time.Time `json:"deleted"`
+	DeletedBy string    `json:"deleted_by,omitempty"`
+}
+
+type FileVersion struct {
+	FileMetadata
+	ID       string    `json:"id"`
+	Archived time.Time `json:"archived"`
+}
+
+type StorageStats struct {
+	//	stored objects, including the ones that hold trash and versions
+	Blobs int
+	Bytes int64
+	//	uploads that are being written right now
+	Uploads int
+}
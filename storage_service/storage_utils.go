@@ -0,0 +1,50 @@
+package storage_service
+
+import (
+	"context"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Checks if a path is the directory itself or anything inside of it
+func IsPathUnder(name, dir string) bool {
+	name, dir = path.Clean("/"+name), path.Clean("/"+dir)
+	return dir == "/" || name == dir || strings.HasPrefix(name, dir+"/")
+}
+
+// Same as a regular Find, but everything inside the hidden directory gets left out.
+// Since the hidden stuff can only show up when listing root recursively, that's the only case
+// where the whole listing has to be fetched so that paging can be applied after filtering
+func FindHidingDir(ctx context.Context, storage BaseStorageController, hiddenDir string, prefix string, filter *regexp.Regexp, recursive bool, offset int, limit int) ([]FileMetadata, error) {
+
+	if IsPathUnder(prefix, hiddenDir) {
+		return []FileMetadata{}, nil
+	}
+
+	if !recursive || path.Clean("/"+prefix) != "/" {
+		return storage.Find(ctx, prefix, filter, recursive, offset, limit)
+	}
+
+	entries, err := storage.Find(ctx, prefix, filter, recursive, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]FileMetadata, 0, len(entries))
+	for _, entry := range entries {
+		if !IsPathUnder(entry.Name, hiddenDir) {
+			result = append(result, entry)
+		}
+	}
+
+	if offset > 0 {
+		result = result[min(offset, len(result)):]
+	}
+
+	if limit > 0 && len(result) > limit {
+		result = result[:limit]
+	}
+
+	return result, nil
+}
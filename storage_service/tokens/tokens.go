@@ -0,0 +1,295 @@
+package tokens
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maddsua/syncctl/utils"
+)
+
+// Every token starts with it, which makes them easy to tell apart from passwords (and to grep for in leaked configs)
+const TokenPrefix = "s4t_"
+
+var ErrInvalidToken = errors.New("invalid token")
+var ErrTokenExpired = errors.New("token expired")
+
+// A single API key. The secret part of it is never stored, only its hash is
+type Token struct {
+	ID         string    `json:"id"`
+	Username   string    `json:"username"`
+	Name       string    `json:"name,omitempty"`
+	SecretHash string    `json:"secret_hash,omitempty"`
+	Created    time.Time `json:"created"`
+	Expires    time.Time `json:"expires,omitzero"`
+	PathPrefix string    `json:"path_prefix,omitempty"`
+	ReadOnly   bool      `json:"read_only,omitempty"`
+}
+
+func (token *Token) Expired(now time.Time) bool {
+	return !token.Expires.IsZero() && !now.Before(token.Expires)
+}
+
+// What the client gets when a token is issued, which is the only time it sees the full token value
+type IssuedToken struct {
+	Value string `json:"value"`
+	Token
+}
+
+type TokenOptions struct {
+	Name       string
+	Expires    time.Time
+	PathPrefix string
+	ReadOnly   bool
+}
+
+// Keeps issued tokens in a json file. The file is re-read whenever it changes on disk,
+// so that tokens issued or revoked from the command line apply to a running server right away
+type Store struct {
+	Location string
+	mtx      sync.Mutex
+	entries  map[string]Token
+	modified time.Time
+}
+
+func hashSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+// Splits a token into its id and secret parts
+func parseToken(value string) (string, string, bool) {
+
+	value, ok := strings.CutPrefix(value, TokenPrefix)
+	if !ok {
+		return "", "", false
+	}
+
+	id, secret, ok := strings.Cut(value, "_")
+	if !ok || id == "" || secret == "" {
+		return "", "", false
+	}
+
+	return id, secret, true
+}
+
+func (store *Store) load() error {
+
+	stat, err := os.Stat(store.Location)
+	if err != nil {
+		if os.IsNotExist(err) {
+			store.entries, store.modified = map[string]Token{}, time.Time{}
+			return nil
+		}
+		return err
+	}
+
+	if store.entries != nil && stat.ModTime().Equal(store.modified) {
+		return nil
+	}
+
+	data, err := os.ReadFile(store.Location)
+	if err != nil {
+		return err
+	}
+
+	var list []Token
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+
+	store.entries = map[string]Token{}
+	for _, entry := range list {
+		store.entries[entry.ID] = entry
+	}
+
+	store.modified = stat.ModTime()
+
+	return nil
+}
+
+func (store *Store) save() error {
+
+	list := make([]Token, 0, len(store.entries))
+	for _, entry := range store.entries {
+		list = append(list, entry)
+	}
+
+	slices.SortFunc(list, func(a, b Token) int {
+		return a.Created.Compare(b.Created)
+	})
+
+	if err := os.MkdirAll(path.Dir(store.Location), os.ModePerm); err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(path.Dir(store.Location), path.Base(store.Location)+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	janitor := utils.FileJanitor{Name: file.Name()}
+	defer janitor.Cleanup()
+	defer file.Close()
+
+	enc := json.NewEncoder(file)
+	enc.SetIndent("", "  ")
+
+	if err := enc.Encode(list); err != nil {
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(file.Name(), store.Location); err != nil {
+		return err
+	}
+
+	janitor.Release()
+
+	if stat, err := os.Stat(store.Location); err == nil {
+		store.modified = stat.ModTime()
+	}
+
+	return nil
+}
+
+// Creates a new token. The returned string is the only place where the secret ever shows up
+func (store *Store) Issue(username string, opts TokenOptions) (string, *Token, error) {
+
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+
+	if err := store.load(); err != nil {
+		return "", nil, err
+	}
+
+	idBytes := make([]byte, 6)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", nil, err
+	}
+
+	id := hex.EncodeToString(idBytes)
+	secret := rand.Text()
+
+	token := Token{
+		ID:         id,
+		Username:   username,
+		Name:       opts.Name,
+		SecretHash: hashSecret(secret),
+		Created:    time.Now(),
+		Expires:    opts.Expires,
+		ReadOnly:   opts.ReadOnly,
+	}
+
+	if opts.PathPrefix != "" {
+		if token.PathPrefix = path.Clean("/" + opts.PathPrefix); token.PathPrefix == "/" {
+			token.PathPrefix = ""
+		}
+	}
+
+	store.entries[id] = token
+
+	if err := store.save(); err != nil {
+		delete(store.entries, id)
+		return "", nil, err
+	}
+
+	token.SecretHash = ""
+
+	return TokenPrefix + id + "_" + secret, &token, nil
+}
+
+// Looks up a token by its full value, checking the secret and the expiry date
+func (store *Store) Verify(value string) (*Token, error) {
+
+	id, secret, ok := parseToken(value)
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+
+	token, has := store.entries[id]
+	if !has || subtle.ConstantTimeCompare([]byte(token.SecretHash), []byte(hashSecret(secret))) != 1 {
+		return nil, ErrInvalidToken
+	}
+
+	if token.Expired(time.Now()) {
+		return nil, ErrTokenExpired
+	}
+
+	token.SecretHash = ""
+
+	return &token, nil
+}
+
+// Lists tokens issued to a user. Empty username lists all of them
+func (store *Store) List(username string) ([]Token, error) {
+
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+
+	result := []Token{}
+
+	for _, entry := range store.entries {
+		if username == "" || entry.Username == username {
+			entry.SecretHash = ""
+			result = append(result, entry)
+		}
+	}
+
+	slices.SortFunc(result, func(a, b Token) int {
+		return a.Created.Compare(b.Created)
+	})
+
+	return result, nil
+}
+
+// Removes a token. Empty username allows revoking tokens of any user.
+// Returns nil when there's no such token
+func (store *Store) Revoke(username string, id string) (*Token, error) {
+
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+
+	token, has := store.entries[id]
+	if !has || (username != "" && token.Username != username) {
+		return nil, nil
+	}
+
+	delete(store.entries, id)
+
+	if err := store.save(); err != nil {
+		store.entries[id] = token
+		return nil, err
+	}
+
+	token.SecretHash = ""
+
+	return &token, nil
+}
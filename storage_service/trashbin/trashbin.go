@@ -0,0 +1,288 @@
+package trashbin
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	s4 "github.com/maddsua/syncctl/storage_service"
+	"github.com/maddsua/syncctl/storage_service/audit"
+)
+
+const DefaultRetention = 30 * 24 * time.Hour
+
+// Trashed files are kept in the same storage, just under a directory that nobody can see
+const trashDir = "/.trash"
+
+var trashIdExpr = regexp.MustCompile(`^\d+-[0-9a-f]{8}$`)
+
+// Every user has their own part of the trash, which is marked with this prefix so that it couldn't be mistaken for an id
+const trashUserPrefix = "@"
+
+// Turns deletes into moves to the trash directory, where files stay until the retention period runs out.
+// Each trashed file ends up at '/.trash/@<user>/<id>/<original path>', and the id also holds the deletion date.
+// Files deleted by the server itself, and not by any user, go to '/.trash/<id>/<original path>'
+type Storage struct {
+	s4.Storage
+	Retention time.Duration
+}
+
+func (storage *Storage) Unwrap() s4.Storage {
+	return storage.Storage
+}
+
+func cleanPath(name string) string {
+	return path.Clean("/" + name)
+}
+
+func isTrashPath(name string) bool {
+	return s4.IsPathUnder(name, trashDir)
+}
+
+func newTrashID(deleted time.Time) (string, error) {
+
+	buff := make([]byte, 4)
+	if _, err := rand.Read(buff); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%d-%s", deleted.UnixNano(), hex.EncodeToString(buff)), nil
+}
+
+// Whoever is deleting the files. Empty for the server commands, which don't have a user
+func trashOwner(ctx context.Context) string {
+	if actor := audit.ActorFrom(ctx); actor != nil {
+		return actor.User
+	}
+	return ""
+}
+
+// Users only get to see what they've deleted themselves, while the server commands get to see everything
+func ownsTrashEntry(ctx context.Context, entry *s4.TrashEntry) bool {
+	actor := audit.ActorFrom(ctx)
+	return actor == nil || actor.User == entry.DeletedBy
+}
+
+func parseTrashEntry(entry s4.FileMetadata) (*s4.TrashEntry, bool) {
+
+	relName, ok := strings.CutPrefix(entry.Name, trashDir+"/")
+	if !ok {
+		return nil, false
+	}
+
+	var owner string
+
+	if userDir, rest, ok := strings.Cut(relName, "/"); ok && strings.HasPrefix(userDir, trashUserPrefix) {
+
+		var err error
+		if owner, err = url.PathUnescape(strings.TrimPrefix(userDir, trashUserPrefix)); err != nil || owner == "" {
+			return nil, false
+		}
+
+		relName = rest
+	}
+
+	id, originalName, ok := strings.Cut(relName, "/")
+	if !ok || !trashIdExpr.MatchString(id) {
+		return nil, false
+	}
+
+	tsVal, _, _ := strings.Cut(id, "-")
+	ts, err := strconv.ParseInt(tsVal, 10, 64)
+	if err != nil {
+		return nil, false
+	}
+
+	entry.Name = "/" + originalName
+
+	return &s4.TrashEntry{
+		FileMetadata: entry,
+		ID:           id,
+		Deleted:      time.Unix(0, ts),
+		DeletedBy:    owner,
+	}, true
+}
+
+func trashPath(entry *s4.TrashEntry) string {
+
+	if entry.DeletedBy == "" {
+		return path.Join(trashDir, entry.ID, entry.Name)
+	}
+
+	return path.Join(trashDir, trashUserPrefix+url.PathEscape(entry.DeletedBy), entry.ID, entry.Name)
+}
+
+func (storage *Storage) Put(ctx context.Context, entry *s4.FileUpload, overwrite bool) (*s4.FileMetadata, error) {
+
+	if isTrashPath(entry.Name) {
+		return nil, &s4.NameError{Name: entry.Name}
+	}
+
+	return storage.Storage.Put(ctx, entry, overwrite)
+}
+
+func (storage *Storage) Get(ctx context.Context, name string) (*s4.ReadSeekableFile, error) {
+
+	if isTrashPath(name) {
+		return nil, &s4.FileNotFoundError{Path: name}
+	}
+
+	return storage.Storage.Get(ctx, name)
+}
+
+func (storage *Storage) Stat(ctx context.Context, name string) (*s4.FileMetadata, error) {
+
+	if isTrashPath(name) {
+		return nil, &s4.FileNotFoundError{Path: name}
+	}
+
+	return storage.Storage.Stat(ctx, name)
+}
+
+func (storage *Storage) Move(ctx context.Context, name string, newName string, overwrite bool) (*s4.FileMetadata, error) {
+
+	if isTrashPath(name) {
+		return nil, &s4.FileNotFoundError{Path: name}
+	} else if isTrashPath(newName) {
+		return nil, &s4.NameError{Name: newName}
+	}
+
+	return storage.Storage.Move(ctx, name, newName, overwrite)
+}
+
+func (storage *Storage) Delete(ctx context.Context, name string) (*s4.FileMetadata, error) {
+
+	if isTrashPath(name) {
+		return nil, &s4.FileNotFoundError{Path: name}
+	}
+
+	id, err := newTrashID(time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	entry := s4.TrashEntry{
+		FileMetadata: s4.FileMetadata{Name: cleanPath(name)},
+		ID:           id,
+		DeletedBy:    trashOwner(ctx),
+	}
+
+	result, err := storage.Storage.Move(ctx, name, trashPath(&entry), false)
+	if err != nil {
+		return nil, err
+	}
+
+	result.Name = cleanPath(name)
+
+	return result, nil
+}
+
+func (storage *Storage) Find(ctx context.Context, prefix string, filter *regexp.Regexp, recursive bool, offset int, limit int) ([]s4.FileMetadata, error) {
+	return s4.FindHidingDir(ctx, storage.Storage, trashDir, prefix, filter, recursive, offset, limit)
+}
+
+func (storage *Storage) listTrash(ctx context.Context, match func(entry *s4.TrashEntry) bool) ([]s4.TrashEntry, error) {
+
+	entries, err := storage.Storage.Find(ctx, trashDir, nil, true, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []s4.TrashEntry{}
+
+	for _, entry := range entries {
+		if trashed, ok := parseTrashEntry(entry); ok && match(trashed) {
+			result = append(result, *trashed)
+		}
+	}
+
+	return result, nil
+}
+
+// Lists trashed files which used to be located under the prefix, and which were deleted by the same user
+func (storage *Storage) ListTrash(ctx context.Context, prefix string) ([]s4.TrashEntry, error) {
+	return storage.listTrash(ctx, func(entry *s4.TrashEntry) bool {
+		return s4.IsPathUnder(entry.Name, prefix) && ownsTrashEntry(ctx, entry)
+	})
+}
+
+// Moves a trashed file back to where it was. Scope limits which entries can be restored,
+// so that nobody gets to pull out something that was deleted from outside of their root directory.
+// Users can only restore the files that they've deleted themselves
+func (storage *Storage) RestoreTrash(ctx context.Context, scope string, id string, overwrite bool) (*s4.FileMetadata, error) {
+
+	if !trashIdExpr.MatchString(id) {
+		return nil, &s4.FileNotFoundError{Path: id}
+	}
+
+	entries, err := storage.listTrash(ctx, func(entry *s4.TrashEntry) bool {
+		return entry.ID == id && s4.IsPathUnder(entry.Name, scope) && ownsTrashEntry(ctx, entry)
+	})
+	if err != nil {
+		return nil, err
+	} else if len(entries) == 0 {
+		return nil, &s4.FileNotFoundError{Path: id}
+	}
+
+	entry := entries[0]
+
+	return storage.Storage.Move(ctx, trashPath(&entry), entry.Name, overwrite)
+}
+
+// Permanently deletes trashed files which used to be located under the prefix, and which were deleted by the same user
+func (storage *Storage) EmptyTrash(ctx context.Context, prefix string) ([]s4.TrashEntry, error) {
+
+	entries, err := storage.ListTrash(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return storage.remove(ctx, entries)
+}
+
+// Permanently deletes trashed files that were deleted before a set date
+func (storage *Storage) PurgeTrash(ctx context.Context, before time.Time) ([]s4.TrashEntry, error) {
+
+	entries, err := storage.listTrash(ctx, func(entry *s4.TrashEntry) bool {
+		return entry.Deleted.Before(before)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return storage.remove(ctx, entries)
+}
+
+// Everything that's been sitting in the trash since before the returned time has outlived the retention period
+func (storage *Storage) Expiry() time.Time {
+
+	retention := storage.Retention
+	if retention <= 0 {
+		retention = DefaultRetention
+	}
+
+	return time.Now().Add(-retention)
+}
+
+func (storage *Storage) remove(ctx context.Context, entries []s4.TrashEntry) ([]s4.TrashEntry, error) {
+
+	removed := []s4.TrashEntry{}
+
+	for _, entry := range entries {
+
+		if _, err := storage.Storage.Delete(ctx, trashPath(&entry)); err != nil {
+			return removed, err
+		}
+
+		removed = append(removed, entry)
+	}
+
+	return removed, nil
+}
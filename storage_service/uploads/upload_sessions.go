@@ -0,0 +1,309 @@
+package uploads
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	s4 "github.com/maddsua/syncctl/storage_service"
+)
+
+const DefaultSessionLifetime = 24 * time.Hour
+
+const fileExtSession = ".json"
+const fileExtData = ".part"
+
+var sessionIdExpr = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// Keeps track of chunked uploads that haven't been finalized yet.
+// Chunks are appended to a plain data file, and the amount of data in it is what tells us
+// where to continue from, so that even a server restart doesn't lose anything that was already written
+type SessionStore struct {
+	Dir      string
+	Lifetime time.Duration
+	busy     sync.Map
+}
+
+type sessionState struct {
+	s4.UploadSession
+	Owner string `json:"owner"`
+}
+
+func (store *SessionStore) lifetime() time.Duration {
+	if store.Lifetime > 0 {
+		return store.Lifetime
+	}
+	return DefaultSessionLifetime
+}
+
+func (store *SessionStore) statePath(id string) string {
+	return path.Join(store.Dir, id+fileExtSession)
+}
+
+func (store *SessionStore) dataPath(id string) string {
+	return path.Join(store.Dir, id+fileExtData)
+}
+
+func (store *SessionStore) lock(id string) (func(), error) {
+
+	if _, locked := store.busy.LoadOrStore(id, struct{}{}); locked {
+		return nil, &s4.UploadConflictError{ID: id, Busy: true}
+	}
+
+	return func() { store.busy.Delete(id) }, nil
+}
+
+func (store *SessionStore) Create(owner string, meta *s4.FileMetadata, overwrite bool) (*s4.UploadSession, error) {
+
+	if err := os.MkdirAll(store.Dir, fs.ModePerm); err != nil {
+		return nil, err
+	}
+
+	//	a bit of housekeeping
+	store.Cleanup()
+
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, err
+	}
+
+	state := sessionState{
+		UploadSession: s4.UploadSession{
+			ID:        hex.EncodeToString(idBytes),
+			Name:      meta.Name,
+			Size:      meta.Size,
+			Modified:  meta.Modified,
+			Overwrite: overwrite,
+			Expires:   time.Now().Add(store.lifetime()),
+		},
+		Owner: owner,
+	}
+
+	if err := store.writeState(&state); err != nil {
+		return nil, err
+	}
+
+	file, err := os.Create(store.dataPath(state.ID))
+	if err != nil {
+		_ = os.Remove(store.statePath(state.ID))
+		return nil, err
+	}
+
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+
+	return &state.UploadSession, nil
+}
+
+func (store *SessionStore) Stat(owner, id string) (*s4.UploadSession, error) {
+
+	state, err := store.readState(owner, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &state.UploadSession, nil
+}
+
+func (store *SessionStore) Write(ctx context.Context, owner, id string, offset int64, reader io.Reader) (*s4.UploadSession, error) {
+
+	unlock, err := store.lock(id)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	state, err := store.readState(owner, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset != state.Offset {
+		return nil, &s4.UploadConflictError{ID: id, Offset: state.Offset}
+	}
+
+	file, err := os.OpenFile(store.dataPath(id), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if state.SizeKnown() {
+		reader = io.LimitReader(reader, state.Size-state.Offset)
+	}
+
+	written, err := io.Copy(file, &contextReader{ctx: ctx, Reader: reader})
+	state.Offset += written
+
+	if err != nil {
+		return &state.UploadSession, err
+	}
+
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+
+	//	every successful write pushes the expiration date further
+	state.Expires = time.Now().Add(store.lifetime())
+	if err := store.writeState(state); err != nil {
+		return nil, err
+	}
+
+	return &state.UploadSession, nil
+}
+
+// Hands the upload data over to the commit function, and removes the session
+// if the commit succeeds. If it doesn't, the session is kept around for another try
+func (store *SessionStore) Commit(owner, id string, commit func(session *s4.UploadSession, reader io.Reader) error) error {
+
+	unlock, err := store.lock(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	state, err := store.readState(owner, id)
+	if err != nil {
+		return err
+	}
+
+	if state.SizeKnown() && state.Offset != state.Size {
+		return &s4.UploadConflictError{ID: id, Offset: state.Offset}
+	}
+
+	file, err := os.Open(store.dataPath(id))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := commit(&state.UploadSession, io.LimitReader(file, state.Offset)); err != nil {
+		return err
+	}
+
+	_ = file.Close()
+
+	return store.remove(id)
+}
+
+func (store *SessionStore) Remove(owner, id string) error {
+
+	if _, err := store.readState(owner, id); err != nil {
+		return err
+	}
+
+	return store.remove(id)
+}
+
+func (store *SessionStore) remove(id string) error {
+	errData := os.Remove(store.dataPath(id))
+	errState := os.Remove(store.statePath(id))
+	return errors.Join(errData, errState)
+}
+
+// Removes all the sessions that have expired
+func (store *SessionStore) Cleanup() {
+
+	entries, err := os.ReadDir(store.Dir)
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+
+	for _, entry := range entries {
+
+		id, ok := strings.CutSuffix(entry.Name(), fileExtSession)
+		if !ok || !sessionIdExpr.MatchString(id) {
+			continue
+		}
+
+		state, err := store.loadState(id)
+		if err != nil || now.After(state.Expires) {
+			if _, busy := store.busy.Load(id); !busy {
+				_ = store.remove(id)
+			}
+		}
+	}
+}
+
+func (store *SessionStore) readState(owner, id string) (*sessionState, error) {
+
+	if !sessionIdExpr.MatchString(id) {
+		return nil, &s4.UploadNotFoundError{ID: id}
+	}
+
+	state, err := store.loadState(id)
+	if err != nil || state.Owner != owner || time.Now().After(state.Expires) {
+		return nil, &s4.UploadNotFoundError{ID: id}
+	}
+
+	stat, err := os.Stat(store.dataPath(id))
+	if err != nil {
+		return nil, &s4.UploadNotFoundError{ID: id}
+	}
+
+	//	the data file itself is the source of truth regarding how much was uploaded
+	state.Offset = stat.Size()
+
+	return state, nil
+}
+
+func (store *SessionStore) loadState(id string) (*sessionState, error) {
+
+	file, err := os.Open(store.statePath(id))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var state sessionState
+	if err := json.NewDecoder(file).Decode(&state); err != nil {
+		return nil, err
+	}
+
+	return &state, nil
+}
+
+func (store *SessionStore) writeState(state *sessionState) error {
+
+	file, err := os.CreateTemp(store.Dir, state.ID+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if err := json.NewEncoder(file).Encode(state); err != nil {
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), store.statePath(state.ID))
+}
+
+type contextReader struct {
+	ctx context.Context
+	io.Reader
+}
+
+func (reader *contextReader) Read(buff []byte) (int, error) {
+	if err := reader.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return reader.Reader.Read(buff)
+}
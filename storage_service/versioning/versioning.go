@@ -0,0 +1,417 @@
+package versioning
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log/slog"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	s4 "github.com/maddsua/syncctl/storage_service"
+)
+
+// Old versions live in the same storage, under a directory that's hidden from everyone
+const versionsDir = "/.versions"
+
+// New content is uploaded here first, so that the current version stays in place until the upload is done
+const stagingDir = versionsDir + "/.staging"
+
+// Version file names are prefixed so that they can't be confused with the directories
+// holding versions of nested files. The id itself is the date when the version got replaced
+var versionNameExpr = regexp.MustCompile(`^@(\d+)$`)
+var versionIdExpr = regexp.MustCompile(`^\d+$`)
+
+// Keeps previous versions of overwritten files around. Every time a file gets replaced
+// its old content is moved to '/.versions/<original path>/@<id>' instead of being lost,
+// and the oldest versions get dropped once they go past the count or age limits
+type Storage struct {
+	s4.Storage
+	MaxCount int
+	MaxAge   time.Duration
+	nameLock sync.Map
+}
+
+func (storage *Storage) Unwrap() s4.Storage {
+	return storage.Storage
+}
+
+func cleanPath(name string) string {
+	return path.Clean("/" + name)
+}
+
+func isVersionsPath(name string) bool {
+	return s4.IsPathUnder(name, versionsDir)
+}
+
+func versionPath(name string, id string) string {
+	return path.Join(versionsDir, cleanPath(name), "@"+id)
+}
+
+func parseVersionEntry(entry s4.FileMetadata) (*s4.FileVersion, bool) {
+
+	relName, ok := strings.CutPrefix(entry.Name, versionsDir+"/")
+	if !ok {
+		return nil, false
+	}
+
+	dir, base := path.Split(relName)
+
+	match := versionNameExpr.FindStringSubmatch(base)
+	if match == nil || dir == "" {
+		return nil, false
+	}
+
+	ts, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil {
+		return nil, false
+	}
+
+	entry.Name = cleanPath(dir)
+
+	return &s4.FileVersion{
+		FileMetadata: entry,
+		ID:           match[1],
+		Archived:     time.Unix(0, ts),
+	}, true
+}
+
+func (storage *Storage) stagingPath() string {
+	return path.Join(stagingDir, rand.Text())
+}
+
+// Prevents concurrent replacements of the same file, since those involve several steps each
+func (storage *Storage) lock(ctx context.Context, name string) (func(), error) {
+
+	if _, locked := storage.nameLock.LoadOrStore(name, ctx); locked {
+		return nil, &s4.FileConflictError{Path: name}
+	}
+
+	return func() { storage.nameLock.Delete(name) }, nil
+}
+
+func (storage *Storage) Put(ctx context.Context, entry *s4.FileUpload, overwrite bool) (*s4.FileMetadata, error) {
+
+	if isVersionsPath(entry.Name) {
+		return nil, &s4.NameError{Name: entry.Name}
+	}
+
+	if !overwrite {
+		return storage.Storage.Put(ctx, entry, overwrite)
+	}
+
+	name := cleanPath(entry.Name)
+
+	unlock, err := storage.lock(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	current, err := storage.Storage.Stat(ctx, name)
+	if err != nil {
+		if _, ok := err.(*s4.FileNotFoundError); ok {
+			return storage.Storage.Put(ctx, entry, overwrite)
+		}
+		return nil, err
+	}
+
+	staged := *entry
+	staged.Name = storage.stagingPath()
+
+	result, err := storage.Storage.Put(ctx, &staged, false)
+	if err != nil {
+		return nil, err
+	}
+
+	//	same content doesn't make for a new version, so just updating the metadata here
+	if result.SHA256 == current.SHA256 {
+		return storage.Storage.Move(ctx, staged.Name, name, true)
+	}
+
+	archived, err := storage.archive(ctx, name)
+	if err != nil {
+		_, _ = storage.Storage.Delete(ctx, staged.Name)
+		return nil, err
+	}
+
+	result, err = storage.Storage.Move(ctx, staged.Name, name, false)
+	if err != nil {
+		_, _ = storage.Storage.Move(ctx, versionPath(name, archived.ID), name, false)
+		_, _ = storage.Storage.Delete(ctx, staged.Name)
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (storage *Storage) Get(ctx context.Context, name string) (*s4.ReadSeekableFile, error) {
+
+	if isVersionsPath(name) {
+		return nil, &s4.FileNotFoundError{Path: name}
+	}
+
+	return storage.Storage.Get(ctx, name)
+}
+
+func (storage *Storage) Stat(ctx context.Context, name string) (*s4.FileMetadata, error) {
+
+	if isVersionsPath(name) {
+		return nil, &s4.FileNotFoundError{Path: name}
+	}
+
+	return storage.Storage.Stat(ctx, name)
+}
+
+func (storage *Storage) Move(ctx context.Context, name string, newName string, overwrite bool) (*s4.FileMetadata, error) {
+
+	if isVersionsPath(name) {
+		return nil, &s4.FileNotFoundError{Path: name}
+	} else if isVersionsPath(newName) {
+		return nil, &s4.NameError{Name: newName}
+	}
+
+	if !overwrite || cleanPath(name) == cleanPath(newName) {
+		return storage.Storage.Move(ctx, name, newName, overwrite)
+	}
+
+	newName = cleanPath(newName)
+
+	unlock, err := storage.lock(ctx, newName)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if _, err := storage.Storage.Stat(ctx, name); err != nil {
+		return nil, err
+	}
+
+	archived, err := storage.archive(ctx, newName)
+	if err != nil {
+		if _, ok := err.(*s4.FileNotFoundError); ok {
+			return storage.Storage.Move(ctx, name, newName, overwrite)
+		}
+		return nil, err
+	}
+
+	result, err := storage.Storage.Move(ctx, name, newName, false)
+	if err != nil {
+		_, _ = storage.Storage.Move(ctx, versionPath(newName, archived.ID), newName, false)
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (storage *Storage) Delete(ctx context.Context, name string) (*s4.FileMetadata, error) {
+
+	if isVersionsPath(name) {
+		return nil, &s4.FileNotFoundError{Path: name}
+	}
+
+	return storage.Storage.Delete(ctx, name)
+}
+
+func (storage *Storage) Find(ctx context.Context, prefix string, filter *regexp.Regexp, recursive bool, offset int, limit int) ([]s4.FileMetadata, error) {
+	return s4.FindHidingDir(ctx, storage.Storage, versionsDir, prefix, filter, recursive, offset, limit)
+}
+
+// Moves the current file into the versions directory and drops the versions that went over the limits
+func (storage *Storage) archive(ctx context.Context, name string) (*s4.FileVersion, error) {
+
+	id := strconv.FormatInt(time.Now().UnixNano(), 10)
+
+	result, err := storage.Storage.Move(ctx, name, versionPath(name, id), false)
+	if err != nil {
+		return nil, err
+	}
+
+	version, ok := parseVersionEntry(*result)
+	if !ok {
+		return nil, fmt.Errorf("unexpected version path: '%s'", result.Name)
+	}
+
+	storage.prune(ctx, name)
+
+	return version, nil
+}
+
+func (storage *Storage) prune(ctx context.Context, name string) {
+
+	versions, err := storage.ListVersions(ctx, name)
+	if err != nil {
+		slog.Warn("Versioning: List versions",
+			slog.String("name", name),
+			slog.String("err", err.Error()))
+		return
+	}
+
+	var expired []s4.FileVersion
+
+	for idx, version := range versions {
+		if (storage.MaxCount > 0 && idx >= storage.MaxCount) ||
+			(storage.MaxAge > 0 && time.Since(version.Archived) > storage.MaxAge) {
+			expired = append(expired, version)
+		}
+	}
+
+	if _, err := storage.remove(ctx, expired); err != nil {
+		slog.Warn("Versioning: Remove expired versions",
+			slog.String("name", name),
+			slog.String("err", err.Error()))
+	}
+}
+
+// Lists previous versions of a file, newest first
+func (storage *Storage) ListVersions(ctx context.Context, name string) ([]s4.FileVersion, error) {
+
+	if isVersionsPath(name) || cleanPath(name) == "/" {
+		return nil, &s4.NameError{Name: name}
+	}
+
+	entries, err := storage.Storage.Find(ctx, path.Join(versionsDir, cleanPath(name)), nil, false, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []s4.FileVersion{}
+
+	for _, entry := range entries {
+		if version, ok := parseVersionEntry(entry); ok {
+			result = append(result, *version)
+		}
+	}
+
+	slices.SortFunc(result, func(a, b s4.FileVersion) int {
+		return b.Archived.Compare(a.Archived)
+	})
+
+	return result, nil
+}
+
+// Lists previous versions of all the files under the prefix, in no particular order
+func (storage *Storage) ListVersionsUnder(ctx context.Context, prefix string) ([]s4.FileVersion, error) {
+
+	if isVersionsPath(prefix) {
+		return nil, &s4.NameError{Name: prefix}
+	}
+
+	entries, err := storage.Storage.Find(ctx, path.Join(versionsDir, cleanPath(prefix)), nil, true, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []s4.FileVersion{}
+
+	for _, entry := range entries {
+		if version, ok := parseVersionEntry(entry); ok {
+			result = append(result, *version)
+		}
+	}
+
+	return result, nil
+}
+
+func (storage *Storage) GetVersion(ctx context.Context, name string, id string) (*s4.ReadSeekableFile, error) {
+
+	if isVersionsPath(name) || !versionIdExpr.MatchString(id) {
+		return nil, &s4.FileNotFoundError{Path: name}
+	}
+
+	file, err := storage.Storage.Get(ctx, versionPath(name, id))
+	if err != nil {
+		if _, ok := err.(*s4.FileNotFoundError); ok {
+			return nil, &s4.FileNotFoundError{Path: name}
+		}
+		return nil, err
+	}
+
+	file.Name = cleanPath(name)
+
+	return file, nil
+}
+
+// Makes a previous version current again. Whatever was current before that becomes a version itself
+func (storage *Storage) RestoreVersion(ctx context.Context, name string, id string) (*s4.FileMetadata, error) {
+
+	if isVersionsPath(name) || !versionIdExpr.MatchString(id) {
+		return nil, &s4.FileNotFoundError{Path: name}
+	}
+
+	name = cleanPath(name)
+
+	unlock, err := storage.lock(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	//	taking the version out first, otherwise archiving the current file could prune it
+	staged, err := storage.Storage.Move(ctx, versionPath(name, id), storage.stagingPath(), false)
+	if err != nil {
+		if _, ok := err.(*s4.FileNotFoundError); ok {
+			return nil, &s4.FileNotFoundError{Path: name}
+		}
+		return nil, err
+	}
+
+	if _, err := storage.archive(ctx, name); err != nil {
+		if _, ok := err.(*s4.FileNotFoundError); !ok {
+			_, _ = storage.Storage.Move(ctx, staged.Name, versionPath(name, id), false)
+			return nil, err
+		}
+	}
+
+	return storage.Storage.Move(ctx, staged.Name, name, false)
+}
+
+// Permanently deletes all versions that were replaced before a set date
+func (storage *Storage) PurgeVersions(ctx context.Context, before time.Time) ([]s4.FileVersion, error) {
+
+	entries, err := storage.Storage.Find(ctx, versionsDir, nil, true, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var expired []s4.FileVersion
+
+	for _, entry := range entries {
+		if version, ok := parseVersionEntry(entry); ok && version.Archived.Before(before) {
+			expired = append(expired, *version)
+		}
+	}
+
+	return storage.remove(ctx, expired)
+}
+
+// Versions archived before the returned time are older than the max age. Zero when there's no age limit set
+func (storage *Storage) Expiry() time.Time {
+
+	if storage.MaxAge <= 0 {
+		return time.Time{}
+	}
+
+	return time.Now().Add(-storage.MaxAge)
+}
+
+func (storage *Storage) remove(ctx context.Context, versions []s4.FileVersion) ([]s4.FileVersion, error) {
+
+	removed := []s4.FileVersion{}
+
+	for _, version := range versions {
+
+		if _, err := storage.Storage.Delete(ctx, versionPath(version.Name, version.ID)); err != nil {
+			return removed, err
+		}
+
+		removed = append(removed, version)
+	}
+
+	return removed, nil
+}
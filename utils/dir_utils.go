@@ -11,18 +11,38 @@ import (
 )
 
 func ListRegilarFiles(name string) ([]string, error) {
+	entries, _, err := ListFilesIgnoring(name, nil)
+	return entries, err
+}
+
+// Walks a directory collecting regular files and skipping everything the ignore rules match.
+// Ignore files found along the way are added to a copy of the rules, which is returned
+// so that the exact same rules could be applied to the files on the other side
+func ListFilesIgnoring(name string, rules *IgnoreRules) ([]string, *IgnoreRules, error) {
+
+	rules = rules.Clone()
 
 	if stat, err := os.Stat(name); err != nil {
 		if err := os.MkdirAll(name, os.ModePerm); err != nil {
-			return nil, err
+			return nil, rules, err
 		}
-		return nil, nil
+		return nil, rules, nil
 	} else if !stat.IsDir() {
-		return nil, fmt.Errorf("not a directory")
+		return nil, rules, fmt.Errorf("not a directory")
 	}
 
+	result, err := listFilesIgnoring(name, "/", rules)
+	return result, rules, err
+}
+
+func listFilesIgnoring(name string, relName string, rules *IgnoreRules) ([]string, error) {
+
 	var result []string
 
+	if err := rules.ReadFile(path.Join(name, IgnoreFileName), relName); err != nil && !os.IsNotExist(err) {
+		return result, err
+	}
+
 	entries, err := os.ReadDir(name)
 	if err != nil {
 		return result, err
@@ -31,12 +51,17 @@ func ListRegilarFiles(name string) ([]string, error) {
 	for _, entry := range entries {
 
 		nextName := path.Join(name, entry.Name())
+		nextRelName := path.Join(relName, entry.Name())
 
 		if entry.Type().IsRegular() && NameListable(entry.Name()) {
-			result = append(result, nextName)
-		} else if entry.IsDir() {
 
-			next, err := ListRegilarFiles(nextName)
+			if !rules.match(nextRelName, false) {
+				result = append(result, nextName)
+			}
+
+		} else if entry.IsDir() && !rules.match(nextRelName, true) {
+
+			next, err := listFilesIgnoring(nextName, nextRelName, rules)
 			if len(next) > 0 {
 				result = append(result, next...)
 			}
@@ -52,6 +77,10 @@ func ListRegilarFiles(name string) ([]string, error) {
 
 func NameListable(name string) bool {
 
+	if strings.HasSuffix(name, FileExtPartialDownload) {
+		return false
+	}
+
 	switch runtime.GOOS {
 	case "android", "linux":
 		return !strings.HasPrefix(path.Base(name), ".trashed-")
@@ -5,8 +5,24 @@ import (
 	"encoding/hex"
 	"io"
 	"os"
+	"path"
 )
 
+const FileExtPartialDownload = ".s4part"
+
+// Returns a stable name for a partially downloaded file, so that an interrupted download
+// can be picked up on the next run. Content hash is a part of the name to make sure
+// that we never glue together two different versions of the same file
+func PartialDownloadName(name, sha256 string) string {
+
+	if len(sha256) > 16 {
+		sha256 = sha256[:16]
+	}
+
+	dir, base := path.Split(name)
+	return path.Join(dir, "."+base+"."+sha256+FileExtPartialDownload)
+}
+
 type FileJanitor struct {
 	Name string
 
@@ -0,0 +1,249 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const IgnoreFileName = ".syncignore"
+
+// Gitignore-style path filter. Rules from ignore files apply to the directory the file is in,
+// and the ones that come later win, which puts deeper ignore files above the ones higher up.
+// Overrides (set with Exclude/Include) always go on top of everything else
+type IgnoreRules struct {
+	patterns  []ignorePattern
+	overrides []ignorePattern
+}
+
+type ignorePattern struct {
+	base    string
+	expr    *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+func (pattern *ignorePattern) matches(name string, isDir bool) bool {
+
+	if pattern.dirOnly && !isDir {
+		return false
+	}
+
+	relName, ok := strings.CutPrefix(name, strings.TrimSuffix(pattern.base, "/")+"/")
+	if !ok {
+		return false
+	}
+
+	return pattern.expr.MatchString(relName)
+}
+
+// Parses a single line of an ignore file. Returns nil for blank lines and comments
+func parseIgnorePattern(base string, line string) (*ignorePattern, error) {
+
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+
+	pattern := ignorePattern{base: path.Clean("/" + base)}
+
+	if val, ok := strings.CutPrefix(line, "!"); ok {
+		pattern.negate = true
+		line = val
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+
+	if val, ok := strings.CutSuffix(line, "/"); ok {
+		pattern.dirOnly = true
+		line = val
+	}
+
+	//	just like git does it, patterns with a slash anywhere but at the end
+	//	are relative to the base directory, others match names at any level
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+
+	if line == "" {
+		return nil, nil
+	}
+
+	exprPrefix := "^(?:.*/)?"
+	if anchored {
+		exprPrefix = "^"
+	}
+
+	expr, err := regexp.Compile(exprPrefix + globToRegexp(line) + "$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern '%s': %v", line, err)
+	}
+
+	pattern.expr = expr
+
+	return &pattern, nil
+}
+
+func globToRegexp(glob string) string {
+
+	var expr strings.Builder
+
+	for idx := 0; idx < len(glob); idx++ {
+
+		switch char := glob[idx]; char {
+
+		case '*':
+
+			if strings.HasPrefix(glob[idx:], "**") && (idx == 0 || glob[idx-1] == '/') {
+
+				rest := glob[idx+2:]
+
+				if rest == "" {
+					expr.WriteString(".*")
+					idx++
+					continue
+				} else if strings.HasPrefix(rest, "/") {
+					expr.WriteString("(?:.*/)?")
+					idx += 2
+					continue
+				}
+			}
+
+			expr.WriteString("[^/]*")
+
+		case '?':
+			expr.WriteString("[^/]")
+
+		case '[':
+
+			end := strings.IndexByte(glob[idx+1:], ']')
+			if end < 0 {
+				expr.WriteString(`\[`)
+				continue
+			}
+
+			class := glob[idx+1 : idx+1+end]
+			if val, ok := strings.CutPrefix(class, "!"); ok {
+				class = "^" + val
+			}
+
+			expr.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			idx += end + 1
+
+		case '\\':
+
+			if idx+1 < len(glob) {
+				idx++
+				expr.WriteString(regexp.QuoteMeta(glob[idx : idx+1]))
+			}
+
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(char)))
+		}
+	}
+
+	return expr.String()
+}
+
+// Adds a pattern that applies to everything under the base directory
+func (rules *IgnoreRules) AddPattern(base string, line string) error {
+
+	pattern, err := parseIgnorePattern(base, line)
+	if err != nil || pattern == nil {
+		return err
+	}
+
+	rules.patterns = append(rules.patterns, *pattern)
+	return nil
+}
+
+// Reads an ignore file, applying its patterns to everything under the base directory
+func (rules *IgnoreRules) ReadFile(name string, base string) error {
+
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if err := rules.AddPattern(base, scanner.Text()); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+
+	return scanner.Err()
+}
+
+func (rules *IgnoreRules) addOverride(line string) error {
+
+	pattern, err := parseIgnorePattern("/", line)
+	if err != nil || pattern == nil {
+		return err
+	}
+
+	rules.overrides = append(rules.overrides, *pattern)
+	return nil
+}
+
+// Ignores paths matching a pattern, regardless of what the ignore files say
+func (rules *IgnoreRules) Exclude(pattern string) error {
+	return rules.addOverride(strings.TrimPrefix(pattern, "!"))
+}
+
+// Keeps paths matching a pattern, regardless of what the ignore files say.
+// A path still can't be included back if the directory it's in is excluded
+func (rules *IgnoreRules) Include(pattern string) error {
+	return rules.addOverride("!" + strings.TrimPrefix(pattern, "!"))
+}
+
+func (rules *IgnoreRules) Clone() *IgnoreRules {
+
+	if rules == nil {
+		return &IgnoreRules{}
+	}
+
+	return &IgnoreRules{
+		patterns:  append([]ignorePattern(nil), rules.patterns...),
+		overrides: append([]ignorePattern(nil), rules.overrides...),
+	}
+}
+
+func (rules *IgnoreRules) match(name string, isDir bool) bool {
+
+	var ignored bool
+
+	for _, list := range [][]ignorePattern{rules.patterns, rules.overrides} {
+		for _, pattern := range list {
+			if pattern.matches(name, isDir) {
+				ignored = !pattern.negate
+			}
+		}
+	}
+
+	return ignored
+}
+
+// Checks if a path relative to the root directory is ignored, including the case when it's inside of an ignored directory
+func (rules *IgnoreRules) Ignored(name string, isDir bool) bool {
+
+	if rules == nil || (len(rules.patterns) == 0 && len(rules.overrides) == 0) {
+		return false
+	}
+
+	name = path.Clean("/" + name)
+	if name == "/" {
+		return false
+	}
+
+	for dir := path.Dir(name); dir != "/"; dir = path.Dir(dir) {
+		if rules.match(dir, true) {
+			return true
+		}
+	}
+
+	return rules.match(name, isDir)
+}
@@ -0,0 +1,256 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestIgnoreRules(t *testing.T) {
+
+	type check struct {
+		name    string
+		isDir   bool
+		ignored bool
+	}
+
+	tests := []struct {
+		name     string
+		patterns map[string][]string
+		exclude  []string
+		include  []string
+		checks   []check
+	}{
+		{
+			name:     "unanchored names match at any level",
+			patterns: map[string][]string{"/": {"*.log"}},
+			checks: []check{
+				{name: "/a.log", ignored: true},
+				{name: "/deep/down/b.log", ignored: true},
+				{name: "/a.txt"},
+				{name: "/a.log.txt"},
+			},
+		},
+		{
+			name:     "anchored patterns only match relative to the base",
+			patterns: map[string][]string{"/": {"/build", "docs/*.md"}},
+			checks: []check{
+				{name: "/build", isDir: true, ignored: true},
+				{name: "/build/out.bin", ignored: true},
+				{name: "/src/build"},
+				{name: "/docs/readme.md", ignored: true},
+				{name: "/docs/api/readme.md"},
+				{name: "/src/docs/readme.md"},
+			},
+		},
+		{
+			name:     "directory only patterns",
+			patterns: map[string][]string{"/": {"cache/"}},
+			checks: []check{
+				{name: "/cache", isDir: true, ignored: true},
+				{name: "/cache"},
+				{name: "/a/cache/file", ignored: true},
+			},
+		},
+		{
+			name:     "double stars",
+			patterns: map[string][]string{"/": {"**/tmp", "logs/**", "a/**/z"}},
+			checks: []check{
+				{name: "/tmp", isDir: true, ignored: true},
+				{name: "/x/y/tmp", ignored: true},
+				{name: "/logs/2024/jan.txt", ignored: true},
+				{name: "/logs"},
+				{name: "/a/z", ignored: true},
+				{name: "/a/b/c/z", ignored: true},
+				{name: "/b/a/z"},
+			},
+		},
+		{
+			name:     "question marks and classes",
+			patterns: map[string][]string{"/": {"file?.txt", "[ab].bin", "[!0-9].dat"}},
+			checks: []check{
+				{name: "/file1.txt", ignored: true},
+				{name: "/file12.txt"},
+				{name: "/a.bin", ignored: true},
+				{name: "/c.bin"},
+				{name: "/x.dat", ignored: true},
+				{name: "/1.dat"},
+			},
+		},
+		{
+			name:     "negation and order",
+			patterns: map[string][]string{"/": {"*.log", "!keep.log"}},
+			checks: []check{
+				{name: "/a.log", ignored: true},
+				{name: "/keep.log"},
+				{name: "/sub/keep.log"},
+			},
+		},
+		{
+			name:     "files can't be included back from an ignored directory",
+			patterns: map[string][]string{"/": {"vendor/", "!vendor/keep.go"}},
+			checks: []check{
+				{name: "/vendor/keep.go", ignored: true},
+			},
+		},
+		{
+			name:     "comments, blanks and escapes",
+			patterns: map[string][]string{"/": {"# comment", "", "   ", `\#hash`, `\!bang`, "trailing   "}},
+			checks: []check{
+				{name: "/# comment"},
+				{name: "/#hash", ignored: true},
+				{name: "/!bang", ignored: true},
+				{name: "/trailing", ignored: true},
+			},
+		},
+		{
+			name:     "nested rules apply under their directory only",
+			patterns: map[string][]string{"/": {"*.tmp"}, "/sub": {"!*.tmp", "local"}},
+			checks: []check{
+				{name: "/a.tmp", ignored: true},
+				{name: "/sub/a.tmp"},
+				{name: "/sub/local", ignored: true},
+				{name: "/local"},
+			},
+		},
+		{
+			name:     "overrides go on top of the files",
+			patterns: map[string][]string{"/": {"*.log", "!important.txt"}},
+			exclude:  []string{"important.txt"},
+			include:  []string{"debug.log"},
+			checks: []check{
+				{name: "/important.txt", ignored: true},
+				{name: "/debug.log"},
+				{name: "/other.log", ignored: true},
+			},
+		},
+		{
+			name: "no rules",
+			checks: []check{
+				{name: "/anything"},
+				{name: "/"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			var rules IgnoreRules
+
+			//	deeper directories have to come later, as they would when walking the tree
+			bases := make([]string, 0, len(tt.patterns))
+			for base := range tt.patterns {
+				bases = append(bases, base)
+			}
+			slices.Sort(bases)
+
+			for _, base := range bases {
+				for _, line := range tt.patterns[base] {
+					if err := rules.AddPattern(base, line); err != nil {
+						t.Fatalf("AddPattern(%q, %q): %v", base, line, err)
+					}
+				}
+			}
+
+			for _, pattern := range tt.exclude {
+				if err := rules.Exclude(pattern); err != nil {
+					t.Fatalf("Exclude(%q): %v", pattern, err)
+				}
+			}
+
+			for _, pattern := range tt.include {
+				if err := rules.Include(pattern); err != nil {
+					t.Fatalf("Include(%q): %v", pattern, err)
+				}
+			}
+
+			for _, check := range tt.checks {
+				if got := rules.Ignored(check.name, check.isDir); got != check.ignored {
+					t.Errorf("Ignored(%q, %v) = %v, want %v", check.name, check.isDir, got, check.ignored)
+				}
+			}
+		})
+	}
+}
+
+func TestListFilesIgnoring(t *testing.T) {
+
+	root := t.TempDir()
+
+	files := map[string]string{
+		IgnoreFileName:                         "*.tmp\nbuild/\n",
+		"a.txt":                                "",
+		"a.tmp":                                "",
+		"build/out.bin":                        "",
+		"src/main.go":                          "",
+		"src/" + IgnoreFileName:                "!keep.tmp\n/gen\n",
+		"src/keep.tmp":                         "",
+		"src/other.tmp":                        "",
+		"src/gen/code.go":                      "",
+		"src/pkg/gen/code.go":                  "",
+		"dl/file.bin" + FileExtPartialDownload: "",
+	}
+
+	for name, content := range files {
+		fullName := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(fullName), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fullName, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var exclude IgnoreRules
+	if err := exclude.Exclude("*.go"); err != nil {
+		t.Fatal(err)
+	}
+	if err := exclude.Include("main.go"); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, rules, err := ListFilesIgnoring(root, &exclude)
+	if err != nil {
+		t.Fatalf("ListFilesIgnoring: %v", err)
+	}
+
+	var got []string
+	for _, entry := range entries {
+		got = append(got, strings.TrimPrefix(filepath.ToSlash(entry), filepath.ToSlash(root)))
+	}
+	slices.Sort(got)
+
+	want := []string{
+		"/" + IgnoreFileName,
+		"/a.txt",
+		"/src/" + IgnoreFileName,
+		"/src/keep.tmp",
+		"/src/main.go",
+	}
+
+	if !slices.Equal(got, want) {
+		t.Errorf("listed %v, want %v", got, want)
+	}
+
+	//	the returned rules have to judge the other side the same way
+	for name, ignored := range map[string]bool{
+		"/a.tmp":             true,
+		"/src/keep.tmp":      false,
+		"/src/gen/code.go":   true,
+		"/build/out.bin":     true,
+		"/src/pkg/gen/x.txt": false,
+		"/src/main.go":       false,
+	} {
+		if got := rules.Ignored(name, false); got != ignored {
+			t.Errorf("returned rules: Ignored(%q) = %v, want %v", name, got, ignored)
+		}
+	}
+
+	//	the rules that were passed in must stay as they were
+	if exclude.Ignored("/a.tmp", false) {
+		t.Errorf("rules from the ignore files leaked into the ones passed in")
+	}
+}